@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000,
+	24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// aacConfig is the content of a MPEG-4 AudioSpecificConfig.
+type aacConfig struct {
+	objectType int
+	sampleRate int
+	channels   int
+}
+
+func (c *aacConfig) decode(byts []byte) error {
+	if len(byts) < 2 {
+		return fmt.Errorf("invalid AudioSpecificConfig")
+	}
+
+	c.objectType = int(byts[0] >> 3)
+	if c.objectType == 31 {
+		return fmt.Errorf("unsupported AAC object type")
+	}
+
+	sampleRateIndex := int((byts[0]&0x07)<<1 | byts[1]>>7)
+	if sampleRateIndex >= len(aacSampleRates) {
+		return fmt.Errorf("unsupported AAC sample rate index: %d", sampleRateIndex)
+	}
+	c.sampleRate = aacSampleRates[sampleRateIndex]
+	c.channels = int(byts[1]>>3) & 0x0f
+
+	return nil
+}
+
+func (c *aacConfig) encode() []byte {
+	sampleRateIndex := 0
+	for i, v := range aacSampleRates {
+		if v == c.sampleRate {
+			sampleRateIndex = i
+			break
+		}
+	}
+
+	return []byte{
+		byte(c.objectType<<3) | byte(sampleRateIndex>>1),
+		byte(sampleRateIndex<<7) | byte(c.channels<<3),
+	}
+}
+
+// readAdts splits a buffer of ADTS frames into access units.
+func readAdts(buf []byte) (*aacConfig, [][]byte, error) {
+	var conf *aacConfig
+	var aus [][]byte
+
+	for len(buf) > 0 {
+		if len(buf) < 7 || buf[0] != 0xff || buf[1]&0xf0 != 0xf0 {
+			return nil, nil, fmt.Errorf("invalid ADTS frame")
+		}
+
+		sampleRateIndex := int(buf[2]>>2) & 0x0f
+		if sampleRateIndex >= len(aacSampleRates) {
+			return nil, nil, fmt.Errorf("unsupported AAC sample rate index: %d", sampleRateIndex)
+		}
+
+		if conf == nil {
+			conf = &aacConfig{
+				objectType: int(buf[2]>>6) + 1,
+				sampleRate: aacSampleRates[sampleRateIndex],
+				channels:   int(buf[2]&0x01)<<2 | int(buf[3]>>6),
+			}
+		}
+
+		headerLen := 7
+		if buf[1]&0x01 == 0 {
+			headerLen = 9 // CRC
+		}
+
+		frameLen := int(buf[3]&0x03)<<11 | int(buf[4])<<3 | int(buf[5]>>5)
+		if frameLen < headerLen || frameLen > len(buf) {
+			return nil, nil, fmt.Errorf("invalid ADTS frame length")
+		}
+
+		aus = append(aus, buf[headerLen:frameLen])
+		buf = buf[frameLen:]
+	}
+
+	return conf, aus, nil
+}
+
+// rtpAacPacketizer puts access units into RTP packets, as described in
+// RFC3640, with mode AAC-hbr.
+type rtpAacPacketizer struct {
+	payloadType uint8
+	ssrc        uint32
+	seq         uint16
+}
+
+// packetize returns the RTP packet of an access unit.
+func (e *rtpAacPacketizer) packetize(au []byte, ts uint32) []byte {
+	pkt := make([]byte, 12+4+len(au))
+	pkt[0] = 0x80
+	pkt[1] = 0x80 | e.payloadType
+	binary.BigEndian.PutUint16(pkt[2:], e.seq)
+	binary.BigEndian.PutUint32(pkt[4:], ts)
+	binary.BigEndian.PutUint32(pkt[8:], e.ssrc)
+	e.seq++
+
+	// AU-headers-length in bits, followed by AU-size and AU-index
+	binary.BigEndian.PutUint16(pkt[12:], 16)
+	binary.BigEndian.PutUint16(pkt[14:], uint16(len(au)<<3))
+	copy(pkt[16:], au)
+
+	return pkt
+}
+
+// rtpAacDepacketizer extracts access units from RTP packets, as described
+// in RFC3640. Access units fragmented into multiple packets are discarded.
+type rtpAacDepacketizer struct {
+	sizeLength       int
+	indexLength      int
+	indexDeltaLength int
+}
+
+// newRtpAacDepacketizer allocates a rtpAacDepacketizer with the parameters
+// of the fmtp attribute.
+func newRtpAacDepacketizer(fmtp map[string]string) (*rtpAacDepacketizer, error) {
+	d := &rtpAacDepacketizer{
+		sizeLength:       13,
+		indexLength:      3,
+		indexDeltaLength: 3,
+	}
+
+	for key, dest := range map[string]*int{
+		"sizelength":       &d.sizeLength,
+		"indexlength":      &d.indexLength,
+		"indexdeltalength": &d.indexDeltaLength,
+	} {
+		if v, ok := fmtp[key]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > 16 {
+				return nil, fmt.Errorf("invalid %s: %s", key, v)
+			}
+			*dest = n
+		}
+	}
+
+	if d.sizeLength == 0 {
+		return nil, fmt.Errorf("AAC without AU headers is not supported")
+	}
+	return d, nil
+}
+
+// decode returns the access units contained in a RTP packet, together with
+// the timestamp of the first one.
+func (d *rtpAacDepacketizer) decode(pkt []byte) ([][]byte, uint32, error) {
+	payload, ok := rtpPayload(pkt)
+	if !ok || len(payload) < 2 {
+		return nil, 0, fmt.Errorf("invalid RTP packet")
+	}
+	ts := binary.BigEndian.Uint32(pkt[4:])
+
+	headersLen := int(binary.BigEndian.Uint16(payload))
+	headersSize := (headersLen + 7) / 8
+	if len(payload) < 2+headersSize {
+		return nil, 0, fmt.Errorf("invalid AU headers")
+	}
+
+	r := &h264BitReader{buf: payload[2 : 2+headersSize]}
+	data := payload[2+headersSize:]
+
+	var sizes []int
+	for i := 0; r.pos+d.sizeLength <= headersLen; i++ {
+		size, _ := r.readBits(d.sizeLength)
+		if i == 0 {
+			r.readBits(d.indexLength)
+		} else {
+			r.readBits(d.indexDeltaLength)
+		}
+		sizes = append(sizes, int(size))
+	}
+
+	var aus [][]byte
+	for _, size := range sizes {
+		if size > len(data) {
+			return nil, 0, fmt.Errorf("fragmented AUs are not supported")
+		}
+		aus = append(aus, append([]byte(nil), data[:size]...))
+		data = data[size:]
+	}
+
+	return aus, ts, nil
+}
+
+// latmStreamMuxConfig decodes the StreamMuxConfig that is sent in the config
+// parameter of MP4A-LATM tracks (RFC6416), and returns its AudioSpecificConfig.
+// Only configurations with a single program and layer are supported.
+func latmStreamMuxConfig(byts []byte) (*aacConfig, error) {
+	r := &h264BitReader{buf: byts}
+
+	audioMuxVersion, err := r.readBits(1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid StreamMuxConfig")
+	}
+	if audioMuxVersion != 0 {
+		return nil, fmt.Errorf("unsupported LATM version")
+	}
+
+	// allStreamsSameTimeFraming, numSubFrames, numProgram, numLayer
+	r.readBits(1)
+	r.readBits(6)
+	numProgram, _ := r.readBits(4)
+	numLayer, err := r.readBits(3)
+	if err != nil || numProgram != 0 || numLayer != 0 {
+		return nil, fmt.Errorf("unsupported LATM configuration")
+	}
+
+	// the AudioSpecificConfig is not aligned to bytes
+	var asc []byte
+	for r.pos+8 <= len(byts)*8 {
+		b, _ := r.readBits(8)
+		asc = append(asc, byte(b))
+	}
+
+	conf := &aacConfig{}
+	err = conf.decode(asc)
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// rtpLatmDepacketizer extracts access units from RTP packets of MP4A-LATM
+// tracks, whose configuration is out of band (cpresent=0), as described in
+// RFC6416.
+type rtpLatmDepacketizer struct {
+	buf []byte
+	ts  uint32
+}
+
+// decode returns the access units of an AudioMuxElement, when its last packet
+// is received, together with the timestamp of the first one.
+func (d *rtpLatmDepacketizer) decode(pkt []byte) ([][]byte, uint32, error) {
+	payload, ok := rtpPayload(pkt)
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid RTP packet")
+	}
+	ts := binary.BigEndian.Uint32(pkt[4:])
+	marker := (pkt[1] & 0x80) != 0
+
+	// fragments belong to the same AudioMuxElement when they have the same
+	// timestamp
+	if len(d.buf) > 0 && ts != d.ts {
+		d.buf = nil
+	}
+	d.buf = append(d.buf, payload...)
+	d.ts = ts
+
+	if len(d.buf) > 1<<16 {
+		d.buf = nil
+		return nil, 0, fmt.Errorf("AudioMuxElement too big")
+	}
+
+	if !marker {
+		return nil, 0, nil
+	}
+
+	buf := d.buf
+	d.buf = nil
+
+	var aus [][]byte
+	for len(buf) > 0 {
+		// PayloadLengthInfo
+		size := 0
+		for {
+			if len(buf) == 0 {
+				return nil, 0, fmt.Errorf("invalid PayloadLengthInfo")
+			}
+			b := buf[0]
+			buf = buf[1:]
+			size += int(b)
+			if b != 255 {
+				break
+			}
+		}
+
+		if size > len(buf) {
+			return nil, 0, fmt.Errorf("invalid PayloadMux")
+		}
+		aus = append(aus, append([]byte(nil), buf[:size]...))
+		buf = buf[size:]
+	}
+
+	return aus, ts, nil
+}
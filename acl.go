@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// aclRuleConf allows a set of identities to read the streams whose name
+// matches one of the path globs.
+type aclRuleConf struct {
+	// user names, "group:<dn>" for LDAP groups, "scope:<scope>" for OAuth2
+	// scopes, or "*" for everybody, including anonymous clients
+	Users []string `yaml:"users"`
+	Paths []string `yaml:"paths"`
+}
+
+// authIdentity is the identity of an authenticated client.
+type authIdentity struct {
+	user    string
+	groups  []string
+	scopes  []string
+	backend authBackend
+}
+
+func validateAcl(rules []aclRuleConf) error {
+	for i, r := range rules {
+		if len(r.Users) == 0 || len(r.Paths) == 0 {
+			return fmt.Errorf("ACL rule %d must contain users and paths", i)
+		}
+
+		for _, p := range r.Paths {
+			_, err := path.Match(p, "")
+			if err != nil {
+				return fmt.Errorf("invalid ACL path '%s': %s", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r aclRuleConf) matchesIdentity(id authIdentity) bool {
+	for _, u := range r.Users {
+		switch {
+		case u == "*":
+			return true
+
+		case strings.HasPrefix(u, "group:"):
+			if ldapInGroups(id.groups, []string{strings.TrimPrefix(u, "group:")}) {
+				return true
+			}
+
+		case strings.HasPrefix(u, "scope:"):
+			if oauthHasScope(id.scopes, []string{strings.TrimPrefix(u, "scope:")}) {
+				return true
+			}
+
+		default:
+			if id.user != "" && u == id.user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r aclRuleConf) matchesPath(name string) bool {
+	for _, p := range r.Paths {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// aclAllows checks whether an identity can read a stream. When no rules are
+// defined, every identity can read every stream.
+func aclAllows(rules []aclRuleConf, id authIdentity, name string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	for _, r := range rules {
+		if r.matchesIdentity(id) && r.matchesPath(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	_ACME_DIRECTORY    = "https://acme-v02.api.letsencrypt.org/directory"
+	_ACME_RENEW_BEFORE = 30 * 24 * time.Hour
+)
+
+// acmeConf contains the options of the ACME client.
+type acmeConf struct {
+	Domains   []string
+	Email     string
+	Directory string
+	Dir       string
+	HttpPort  int
+}
+
+// acmeClient obtains and renews the certificates of the RTSPS listener with
+// autocert and the HTTP-01 challenge, that is served on a dedicated HTTP
+// listener.
+type acmeClient struct {
+	conf    acmeConf
+	manager *autocert.Manager
+	netl    net.Listener
+}
+
+func newAcmeClient(conf acmeConf, sockets *handoverSockets) (*acmeClient, error) {
+	netl, err := sockets.listenTcp(conf.HttpPort)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &acmeClient{
+		conf: conf,
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(conf.Dir),
+			HostPolicy:  autocert.HostWhitelist(conf.Domains...),
+			RenewBefore: _ACME_RENEW_BEFORE,
+			Email:       conf.Email,
+			Client:      &acme.Client{DirectoryURL: conf.Directory},
+		},
+		netl: netl,
+	}
+
+	a.log("challenge listener opened on :%d", conf.HttpPort)
+	return a, nil
+}
+
+func (a *acmeClient) log(format string, args ...interface{}) {
+	log.Printf("[ACME] "+format, args...)
+}
+
+// getCertificate returns the certificate of the first domain to clients that
+// don't send the server name.
+func (a *acmeClient) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		h := *hello
+		h.ServerName = a.conf.Domains[0]
+		hello = &h
+	}
+	return a.manager.GetCertificate(hello)
+}
+
+func (a *acmeClient) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: a.getCertificate,
+	}
+}
+
+func (a *acmeClient) run() {
+	go (&http.Server{Handler: a.manager.HTTPHandler(http.NotFoundHandler())}).Serve(a.netl)
+
+	// certificates are obtained at startup instead of during the first
+	// handshake, then they are renewed in background by autocert
+	for _, domain := range a.conf.Domains {
+		_, err := a.manager.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:       domain,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		})
+		if err != nil {
+			a.log("ERR: unable to obtain certificate for %s: %s", domain, err)
+			continue
+		}
+		a.log("certificate for %s available", domain)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+)
+
+// apiAuthConf contains the options that protect the HTTP API.
+type apiAuthConf struct {
+	Keys        []string
+	User        string
+	Pass        string
+	CorsOrigins []string
+}
+
+func (c apiAuthConf) enabled() bool {
+	return len(c.Keys) > 0 || c.User != ""
+}
+
+// setRequestAuth adds the credentials to a request sent to the API of
+// another instance.
+func (c apiAuthConf) setRequestAuth(req *http.Request) {
+	if len(c.Keys) > 0 {
+		req.Header.Set("X-Api-Key", c.Keys[0])
+	} else if c.User != "" {
+		req.SetBasicAuth(c.User, c.Pass)
+	}
+}
+
+// apiKey returns the API key of a request, that is sent in the X-Api-Key
+// header or as a bearer token.
+func apiKey(r *http.Request) (string, bool) {
+	if k := r.Header.Get("X-Api-Key"); k != "" {
+		return k, true
+	}
+	return parseBearerAuth(r.Header["Authorization"])
+}
+
+func apiSecureCompare(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// checkApiAuth checks the API key or the basic credentials of a request.
+func checkApiAuth(conf apiAuthConf, r *http.Request) bool {
+	if key, ok := apiKey(r); ok {
+		// all keys are compared, in order not to leak which one matched
+		valid := false
+		for _, k := range conf.Keys {
+			if apiSecureCompare(key, k) {
+				valid = true
+			}
+		}
+		return valid
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok && conf.User != "" {
+		return apiSecureCompare(user, conf.User) && apiSecureCompare(pass, conf.Pass)
+	}
+
+	return false
+}
+
+func (l *serverHttpListener) corsOriginAllowed(origin string) (bool, bool) {
+	for _, o := range l.p.conf.ApiAuth.CorsOrigins {
+		if o == origin {
+			return true, true
+		}
+		if o == "*" {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// cors adds CORS headers to responses to allowed origins, and answers to
+// preflight requests, that are never authenticated.
+func (l *serverHttpListener) cors(h http.Handler) http.Handler {
+	if len(l.p.conf.ApiAuth.CorsOrigins) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		allowed, explicit := l.corsOriginAllowed(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			// browsers can send stored credentials only to origins that
+			// are listed explicitly
+			if explicit {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Api-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate requires an API key or basic credentials, when configured.
+// Failures count towards bans, like the ones of RTSP clients. Health checks
+// are never authenticated, since probes do not send credentials.
+func (l *serverHttpListener) authenticate(h http.Handler) http.Handler {
+	if !l.p.conf.ApiAuth.enabled() {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/ready" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+		if l.p.bans.isBanned(ip) {
+			http.Error(w, "IP is banned", http.StatusForbidden)
+			l.p.audit.write(auditEvent{
+				Event:  _AUDIT_ACCESS_DENIED,
+				Ip:     ip,
+				Method: r.Method,
+				Path:   r.URL.RequestURI(),
+				Detail: "IP is banned",
+			})
+			return
+		}
+
+		if checkApiAuth(l.p.conf.ApiAuth, r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		_, hasKey := apiKey(r)
+		_, _, hasBasic := r.BasicAuth()
+
+		// requests without credentials are the first step of basic
+		// authentication in browsers and are not failures
+		if hasKey || hasBasic {
+			user, _, _ := r.BasicAuth()
+			l.log("ERR: authentication of %s failed", ip)
+			l.p.audit.write(auditEvent{
+				Event:  _AUDIT_AUTH_FAILURE,
+				User:   user,
+				Ip:     ip,
+				Method: r.Method,
+				Path:   r.URL.RequestURI(),
+				Detail: "API",
+			})
+
+			if l.p.bans.addFailure(ip) {
+				l.log("%s banned for %s", ip, l.p.conf.AuthBanDuration)
+				go l.p.saveState()
+				l.p.audit.write(auditEvent{
+					Event:  _AUDIT_BAN,
+					Ip:     ip,
+					Detail: "banned for " + l.p.conf.AuthBanDuration.String(),
+				})
+			}
+		}
+
+		if l.p.conf.ApiAuth.User != "" {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\""+l.p.conf.AuthRealm+"\"")
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	_AUDIT_AUTH_SUCCESS  = "auth_success"
+	_AUDIT_AUTH_FAILURE  = "auth_failure"
+	_AUDIT_BAN           = "ban"
+	_AUDIT_ACCESS_DENIED = "access_denied"
+	_AUDIT_API_CALL      = "api_call"
+)
+
+// auditEvent is a line of the audit log.
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	User   string    `json:"user,omitempty"`
+	Ip     string    `json:"ip,omitempty"`
+	Method string    `json:"method,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Status int       `json:"status,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// auditLog writes security events into a dedicated file, one JSON object per
+// line, such that they can be ingested by a SIEM. The file is opened in
+// append mode and is never truncated.
+type auditLog struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{
+		enc: json.NewEncoder(f),
+	}, nil
+}
+
+// write writes an event. It can be called on a nil log, in which case the
+// event is discarded.
+func (a *auditLog) write(e auditEvent) {
+	if a == nil {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.enc.Encode(e)
+}
+
+// auditPath returns the name of the stream requested with a path segment.
+// Encoded source URLs are logged without password.
+func (p *program) auditPath(segment string) string {
+	path, err := p.resolvePath(segment)
+	if err != nil {
+		return segment
+	}
+	return p.pathDisplayName(path)
+}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// handler writes an event for each API call that can change the state of
+// the server.
+func (a *auditLog) handler(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		aw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(aw, r)
+
+		user, _, _ := r.BasicAuth()
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		a.write(auditEvent{
+			Event:  _AUDIT_API_CALL,
+			User:   user,
+			Ip:     ip,
+			Method: r.Method,
+			Path:   r.URL.RequestURI(),
+			Status: aw.status,
+		})
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	_HTPASSWD_CHECK_INTERVAL = 1 * time.Second
+	_HTPASSWD_CACHE_TTL      = 1 * time.Minute
+)
+
+// htpasswdFile validates credentials of clients against a htpasswd file,
+// that is reloaded when it changes. Successful checks are cached, since
+// clients authenticate every request and bcrypt is slow on purpose.
+type htpasswdFile struct {
+	path      string
+	mutex     sync.Mutex
+	users     map[string]string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+	cache     map[[sha256.Size]byte]time.Time
+}
+
+func newHtpasswdFile(path string) (*htpasswdFile, error) {
+	h := &htpasswdFile{
+		path: path,
+	}
+
+	err := h.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *htpasswdFile) log(format string, args ...interface{}) {
+	log.Printf("[htpasswd] "+format, args...)
+}
+
+func (h *htpasswdFile) reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid htpasswd line %d", n)
+		}
+
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") &&
+			!strings.HasPrefix(hash, "$2y$") && !strings.HasPrefix(hash, "$apr1$") &&
+			!strings.HasPrefix(hash, "$1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("unsupported hash of user '%s' (bcrypt, apr1 and SHA1 are supported)", parts[0])
+		}
+
+		users[parts[0]] = hash
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+
+	h.users = users
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.cache = make(map[[sha256.Size]byte]time.Time)
+	return nil
+}
+
+// reloadIfChanged reloads the file when its modification time or its size
+// changed. It must be called with the mutex locked.
+func (h *htpasswdFile) reloadIfChanged() {
+	now := time.Now()
+	if now.Sub(h.lastCheck) < _HTPASSWD_CHECK_INTERVAL {
+		return
+	}
+	h.lastCheck = now
+
+	info, err := os.Stat(h.path)
+	if err != nil {
+		h.log("ERR: %s", err)
+		return
+	}
+
+	if info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return
+	}
+
+	// in case of errors, the previous users are kept
+	err = h.reload()
+	if err != nil {
+		h.log("ERR: %s", err)
+		return
+	}
+	h.log("reloaded")
+}
+
+// check checks the credentials of a user.
+func (h *htpasswdFile) check(user string, pass string) bool {
+	h.mutex.Lock()
+	h.reloadIfChanged()
+	hash, ok := h.users[user]
+	key := sha256.Sum256([]byte(user + "\x00" + pass + "\x00" + hash))
+	expires, cached := h.cache[key]
+	h.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	if cached && now.Before(expires) {
+		return true
+	}
+
+	var valid bool
+	var err error
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		valid = subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])),
+			[]byte(strings.TrimPrefix(hash, "{SHA}"))) == 1
+
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		valid, err = checkMd5Crypt(hash, pass)
+
+	default:
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+		valid = err == nil
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			err = nil
+		}
+	}
+	if err != nil {
+		h.log("ERR: user '%s': %s", user, err)
+		return false
+	}
+
+	if !valid {
+		return false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for k, e := range h.cache {
+		if now.After(e) {
+			delete(h.cache, k)
+		}
+	}
+	h.cache[key] = now.Add(_HTPASSWD_CACHE_TTL)
+
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHtpasswdCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the bcrypt hash is a vector of the OpenBSD implementation, the others
+	// have been generated with openssl passwd
+	path := filepath.Join(dir, "htpasswd")
+	err = ioutil.WriteFile(path, []byte("# users\n"+
+		"bcrypt:$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW\n"+
+		"bcrypt2y:$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW\n"+
+		"apr1:$apr1$r31...cW$mWakZIgIUy5PPqAbSWI420\n"+
+		"md5:$1$saltsalt$9xy1btjgzLYfb7hivXtC//\n"+
+		"sha1:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := newHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ca := range []struct {
+		user  string
+		pass  string
+		valid bool
+	}{
+		{"bcrypt", "U*U", true},
+		{"bcrypt", "U*V", false},
+		{"bcrypt2y", "U*U", true},
+		{"apr1", "myPassword", true},
+		{"apr1", "mypassword", false},
+		{"md5", "secret", true},
+		{"md5", "secreT", false},
+		{"sha1", "secret", true},
+		{"sha1", "", false},
+		{"missing", "secret", false},
+	} {
+		// checks are repeated, since successful ones are cached
+		for i := 0; i < 2; i++ {
+			if valid := h.check(ca.user, ca.pass); valid != ca.valid {
+				t.Errorf("user '%s', pass '%s': expected %v, got %v", ca.user, ca.pass, ca.valid, valid)
+			}
+		}
+	}
+}
+
+func TestHtpasswdUnsupportedHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	err = ioutil.WriteFile(path, []byte("user:plaintext\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newHtpasswdFile(path)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	_LDAP_TIMEOUT   = 5 * time.Second
+	_LDAP_CACHE_TTL = 1 * time.Minute
+)
+
+// ldapConf contains the options of the LDAP authentication backend.
+type ldapConf struct {
+	Url           string
+	BindDn        string // DN of users, %s is replaced with the username
+	BaseDn        string
+	UserAttribute string
+}
+
+type ldapCacheEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+// ldapAuthenticator validates credentials of clients by binding to a LDAP
+// server, and returns the groups of users, read from their memberOf
+// attribute. Results are cached, since clients authenticate every request.
+type ldapAuthenticator struct {
+	conf  ldapConf
+	mutex sync.Mutex
+	cache map[[sha256.Size]byte]ldapCacheEntry
+}
+
+func newLdapAuthenticator(conf ldapConf) (*ldapAuthenticator, error) {
+	ur, err := url.Parse(conf.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP url: %s", err)
+	}
+
+	switch ur.Scheme {
+	case "ldap", "ldaps":
+	default:
+		return nil, fmt.Errorf("unsupported LDAP url scheme: %s", ur.Scheme)
+	}
+
+	if strings.Count(conf.BindDn, "%s") != 1 {
+		return nil, fmt.Errorf("LDAP bind DN must contain %%s exactly once")
+	}
+
+	return &ldapAuthenticator{
+		conf:  conf,
+		cache: make(map[[sha256.Size]byte]ldapCacheEntry),
+	}, nil
+}
+
+// authenticate checks the credentials of a user and returns its groups.
+func (l *ldapAuthenticator) authenticate(user string, pass string) ([]string, error) {
+	// a bind without password is anonymous and always succeeds
+	if user == "" || pass == "" {
+		return nil, fmt.Errorf("empty credentials")
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + pass))
+	now := time.Now()
+
+	l.mutex.Lock()
+	e, ok := l.cache[key]
+	l.mutex.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.groups, nil
+	}
+
+	groups, err := l.query(user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for k, e := range l.cache {
+		if now.After(e.expires) {
+			delete(l.cache, k)
+		}
+	}
+	l.cache[key] = ldapCacheEntry{
+		groups:  groups,
+		expires: now.Add(_LDAP_CACHE_TTL),
+	}
+
+	return groups, nil
+}
+
+func (l *ldapAuthenticator) query(user string, pass string) (groups []string, err error) {
+	// the library doesn't check the structure of search entries and panics
+	// when they are malformed
+	defer func() {
+		if r := recover(); r != nil {
+			groups = nil
+			err = fmt.Errorf("invalid LDAP response: %v", r)
+		}
+	}()
+
+	conn, err := ldap.DialURL(l.conf.Url, ldap.DialWithDialer(&net.Dialer{Timeout: _LDAP_TIMEOUT}))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetTimeout(_LDAP_TIMEOUT)
+
+	// bind as the user
+	err = conn.Bind(fmt.Sprintf(l.conf.BindDn, ldapEscapeDn(user)), pass)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.conf.BaseDn != "" {
+		res, err := conn.Search(ldap.NewSearchRequest(
+			l.conf.BaseDn,
+			ldap.ScopeWholeSubtree,
+			ldap.NeverDerefAliases,
+			1,
+			int(_LDAP_TIMEOUT/time.Second),
+			false,
+			fmt.Sprintf("(%s=%s)", ldap.EscapeFilter(l.conf.UserAttribute), ldap.EscapeFilter(user)),
+			[]string{"memberOf"},
+			nil,
+		))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range res.Entries {
+			groups = append(groups, entry.GetEqualFoldAttributeValues("memberOf")...)
+		}
+	}
+
+	conn.Unbind()
+
+	return groups, nil
+}
+
+// ldapEscapeDn escapes a value inserted into a DN (RFC 4514).
+func ldapEscapeDn(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		ch := v[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", ch) >= 0,
+			(ch == ' ' || ch == '#') && i == 0,
+			ch == ' ' && i == len(v)-1:
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// ldapInGroups checks whether a user belongs to at least one of the given
+// groups. Group DNs are compared case-insensitively.
+func ldapInGroups(userGroups []string, groups []string) bool {
+	for _, ug := range userGroups {
+		for _, g := range groups {
+			if strings.EqualFold(strings.TrimSpace(ug), strings.TrimSpace(g)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLdapServer accepts a single password and returns fixed groups.
+type fakeLdapServer struct {
+	ln             net.Listener
+	dn             string
+	pass           string
+	groups         []string
+	malformedEntry bool
+}
+
+func newFakeLdapServer(t *testing.T, dn string, pass string, groups []string) *fakeLdapServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeLdapServer{
+		ln:     ln,
+		dn:     dn,
+		pass:   pass,
+		groups: groups,
+	}
+	go s.run()
+	return s
+}
+
+func (s *fakeLdapServer) close() {
+	s.ln.Close()
+}
+
+func (s *fakeLdapServer) url() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+func (s *fakeLdapServer) run() {
+	for {
+		nconn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(nconn)
+	}
+}
+
+func fakeLdapMessage(id int64, op *ber.Packet) []byte {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	msg.AppendChild(op)
+	return msg.Bytes()
+}
+
+func fakeLdapString(v string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "")
+}
+
+func fakeLdapResult(tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(fakeLdapString(""))
+	op.AppendChild(fakeLdapString(""))
+	return op
+}
+
+func (s *fakeLdapServer) handleConn(nconn net.Conn) {
+	defer nconn.Close()
+
+	for {
+		req, err := ber.ReadPacket(nconn)
+		if err != nil || len(req.Children) < 2 {
+			return
+		}
+
+		id, _ := req.Children[0].Value.(int64)
+		op := req.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if op.Children[1].Data.String() == s.dn && op.Children[2].Data.String() == s.pass {
+				code = ldap.LDAPResultSuccess
+			}
+			nconn.Write(fakeLdapMessage(id, fakeLdapResult(ldap.ApplicationBindResponse, code)))
+
+		case ldap.ApplicationSearchRequest:
+			vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, g := range s.groups {
+				vals.AppendChild(fakeLdapString(g))
+			}
+			attr := ber.NewSequence("")
+			attr.AppendChild(fakeLdapString("memberOf"))
+			attr.AppendChild(vals)
+			attrs := ber.NewSequence("")
+			attrs.AppendChild(attr)
+			entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+			if !s.malformedEntry {
+				entry.AppendChild(fakeLdapString(s.dn))
+				entry.AppendChild(attrs)
+			}
+			nconn.Write(fakeLdapMessage(id, entry))
+
+			nconn.Write(fakeLdapMessage(id, fakeLdapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+
+		default:
+			return
+		}
+	}
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	groups := []string{"cn=viewers,dc=example,dc=com"}
+	s := newFakeLdapServer(t, "uid=alice,ou=users,dc=example,dc=com", "secret", groups)
+	defer s.close()
+
+	l, err := newLdapAuthenticator(ldapConf{
+		Url:           s.url(),
+		BindDn:        "uid=%s,ou=users,dc=example,dc=com",
+		BaseDn:        "dc=example,dc=com",
+		UserAttribute: "uid",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userGroups, err := l.authenticate("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ldapInGroups(userGroups, []string{"CN=viewers,DC=example,DC=com"}) {
+		t.Errorf("unexpected groups: %v", userGroups)
+	}
+
+	_, err = l.authenticate("alice", "wrong")
+	if err == nil {
+		t.Error("expected an error with a wrong password")
+	}
+
+	_, err = l.authenticate("alice", "")
+	if err == nil {
+		t.Error("expected an error with an empty password")
+	}
+}
+
+// TestLdapMalformedResponse checks that truncated responses and responses
+// with invalid lengths are rejected.
+func TestLdapMalformedResponse(t *testing.T) {
+	for _, res := range [][]byte{
+		{0x30},
+		{0x30, 0x84, 0xff, 0xff, 0xff, 0xff},
+		{0x30, 0x0c, 0x02, 0x01, 0x01, 0x61, 0x07, 0x0a},
+		{0x30, 0x05, 0x02, 0x09, 0x01, 0x61, 0x00},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func(res []byte) {
+			nconn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer nconn.Close()
+			ber.ReadPacket(nconn)
+			nconn.Write(res)
+		}(res)
+
+		l, err := newLdapAuthenticator(ldapConf{
+			Url:    "ldap://" + ln.Addr().String(),
+			BindDn: "uid=%s,dc=example,dc=com",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = l.authenticate("alice", "secret")
+		if err == nil {
+			t.Errorf("response %x: expected an error", res)
+		}
+
+		ln.Close()
+	}
+}
+
+func TestLdapMalformedEntry(t *testing.T) {
+	s := newFakeLdapServer(t, "uid=alice,dc=example,dc=com", "secret", nil)
+	s.malformedEntry = true
+	defer s.close()
+
+	l, err := newLdapAuthenticator(ldapConf{
+		Url:           s.url(),
+		BindDn:        "uid=%s,dc=example,dc=com",
+		BaseDn:        "dc=example,dc=com",
+		UserAttribute: "uid",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = l.authenticate("alice", "secret")
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestLdapEscapeDn(t *testing.T) {
+	for _, ca := range []struct {
+		in  string
+		out string
+	}{
+		{"alice", "alice"},
+		{"a,b=c", "a\\,b\\=c"},
+		{" #x ", "\\ #x\\ "},
+		{"#x", "\\#x"},
+	} {
+		if out := ldapEscapeDn(ca.in); out != ca.out {
+			t.Errorf("'%s': expected '%s', got '%s'", ca.in, ca.out, out)
+		}
+	}
+}
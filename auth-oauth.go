@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_OAUTH_TIMEOUT            = 5 * time.Second
+	_OAUTH_CACHE_TTL          = 1 * time.Minute
+	_OAUTH_INACTIVE_CACHE_TTL = 10 * time.Second
+)
+
+// oauthConf contains the options of the OAuth2 introspection backend.
+type oauthConf struct {
+	IntrospectionUrl string
+	ClientId         string
+	ClientSecret     string
+}
+
+// oauthToken contains the result of the introspection of a token.
+type oauthToken struct {
+	active  bool
+	subject string
+	scopes  []string
+}
+
+type oauthCacheEntry struct {
+	token   oauthToken
+	expires time.Time
+}
+
+// oauthIntrospector validates bearer tokens of clients with an OAuth2 token
+// introspection endpoint (RFC 7662). Results are cached, since clients
+// authenticate every request.
+type oauthIntrospector struct {
+	conf   oauthConf
+	client *http.Client
+	mutex  sync.Mutex
+	cache  map[[sha256.Size]byte]oauthCacheEntry
+}
+
+func newOauthIntrospector(conf oauthConf) (*oauthIntrospector, error) {
+	ur, err := url.Parse(conf.IntrospectionUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OAuth introspection url: %s", err)
+	}
+
+	if ur.Scheme != "http" && ur.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported OAuth introspection url scheme: %s", ur.Scheme)
+	}
+
+	return &oauthIntrospector{
+		conf:   conf,
+		client: &http.Client{Timeout: _OAUTH_TIMEOUT},
+		cache:  make(map[[sha256.Size]byte]oauthCacheEntry),
+	}, nil
+}
+
+// parseBearerAuth returns the token contained in a Bearer Authorization
+// header.
+func parseBearerAuth(header []string) (string, bool) {
+	if len(header) != 1 || !strings.HasPrefix(header[0], "Bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(header[0], "Bearer "))
+	return token, token != ""
+}
+
+// introspect returns whether a token is active, its subject and its scopes.
+func (o *oauthIntrospector) introspect(token string) (oauthToken, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	o.mutex.Lock()
+	e, ok := o.cache[key]
+	o.mutex.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.conf.IntrospectionUrl,
+		strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return oauthToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.conf.ClientId != "" {
+		req.SetBasicAuth(url.QueryEscape(o.conf.ClientId), url.QueryEscape(o.conf.ClientSecret))
+	}
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return oauthToken{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return oauthToken{}, fmt.Errorf("introspection endpoint returned code %d", res.StatusCode)
+	}
+
+	var body struct {
+		Active   bool   `json:"active"`
+		Scope    string `json:"scope"`
+		Exp      int64  `json:"exp"`
+		Username string `json:"username"`
+		Sub      string `json:"sub"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return oauthToken{}, fmt.Errorf("invalid introspection response: %s", err)
+	}
+
+	// the username is preferred, since the subject is often an opaque id
+	subject := body.Username
+	if subject == "" {
+		subject = body.Sub
+	}
+
+	e = oauthCacheEntry{
+		token: oauthToken{
+			active:  body.Active,
+			subject: subject,
+			scopes:  strings.Fields(body.Scope),
+		},
+		expires: now.Add(_OAUTH_INACTIVE_CACHE_TTL),
+	}
+
+	if body.Active {
+		e.expires = now.Add(_OAUTH_CACHE_TTL)
+
+		// tokens are not cached beyond their expiration
+		if body.Exp != 0 {
+			exp := time.Unix(body.Exp, 0)
+			if !exp.After(now) {
+				e.token.active = false
+			} else if exp.Before(e.expires) {
+				e.expires = exp
+			}
+		}
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for k, e := range o.cache {
+		if now.After(e.expires) {
+			delete(o.cache, k)
+		}
+	}
+	o.cache[key] = e
+
+	return e.token, nil
+}
+
+// oauthHasScope checks whether a token has at least one of the given scopes.
+func oauthHasScope(tokenScopes []string, scopes []string) bool {
+	for _, ts := range tokenScopes {
+		for _, s := range scopes {
+			if ts == s {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const _AUTH_REALM = "rtsp-simple-proxy"
+
+// authBackend is the backend that accepted the credentials of a client.
+type authBackend int
+
+const (
+	_AUTH_BACKEND_STATIC authBackend = iota
+	_AUTH_BACKEND_HTPASSWD
+	_AUTH_BACKEND_LDAP
+	_AUTH_BACKEND_OAUTH
+)
+
+// authMethods contains the authentication methods offered to clients.
+type authMethods struct {
+	basic  bool
+	digest bool
+}
+
+func parseAuthMethods(methods []string) (authMethods, error) {
+	var ret authMethods
+	for _, m := range methods {
+		switch strings.TrimSpace(m) {
+		case "basic":
+			ret.basic = true
+		case "digest":
+			ret.digest = true
+		default:
+			return authMethods{}, fmt.Errorf("unsupported auth method: %s", m)
+		}
+	}
+
+	if !ret.basic && !ret.digest {
+		return authMethods{}, fmt.Errorf("no auth methods provided")
+	}
+	return ret, nil
+}
+
+// challenge returns the WWW-Authenticate headers that offer the methods to a
+// client. Digest comes first, since clients pick the first method they
+// support.
+func (am authMethods) challenge(realm string, nonce string) []string {
+	var ret []string
+	if am.digest {
+		ret = append(ret, "Digest realm=\""+realm+"\", nonce=\""+nonce+"\"")
+	}
+	if am.basic {
+		ret = append(ret, "Basic realm=\""+realm+"\"")
+	}
+	return ret
+}
+
+// check validates the Authorization header of a request with the offered
+// methods.
+func (am authMethods) check(header []string, method string, ur *url.URL, user string, pass string,
+	realm string, nonce string) bool {
+	if am.basic && checkBasicAuth(header, user, pass) {
+		return true
+	}
+	return am.digest && checkDigestAuth(header, method, ur, user, pass, realm, nonce)
+}
+
+// newAuthNonce returns a random nonce, used by a client for Digest
+// authentication.
+func newAuthNonce() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+func md5Hex(in string) string {
+	h := md5.Sum([]byte(in))
+	return hex.EncodeToString(h[:])
+}
+
+// parseDigestParams parses the comma-separated key="value" pairs of a Digest
+// Authorization header.
+func parseDigestParams(in string) map[string]string {
+	ret := make(map[string]string)
+	for len(in) > 0 {
+		in = strings.TrimLeft(in, " ,")
+
+		i := strings.IndexByte(in, '=')
+		if i < 0 {
+			break
+		}
+		key := strings.TrimSpace(in[:i])
+		in = in[i+1:]
+
+		var val string
+		if strings.HasPrefix(in, "\"") {
+			j := strings.IndexByte(in[1:], '"')
+			if j < 0 {
+				break
+			}
+			val = in[1 : j+1]
+			in = in[j+2:]
+		} else {
+			j := strings.IndexByte(in, ',')
+			if j < 0 {
+				j = len(in)
+			}
+			val = strings.TrimSpace(in[:j])
+			in = in[j:]
+		}
+
+		ret[key] = val
+	}
+	return ret
+}
+
+// authHeaderUser returns the username contained in an Authorization header,
+// if any.
+func authHeaderUser(header []string) string {
+	if user, _, ok := parseBasicAuth(header); ok {
+		return user
+	}
+
+	if len(header) == 1 && strings.HasPrefix(header[0], "Digest ") {
+		return parseDigestParams(strings.TrimPrefix(header[0], "Digest "))["username"]
+	}
+
+	return ""
+}
+
+// digestUriPath returns the path of a url without the track of SETUP
+// requests (trackID=id) and the trailing slash, such that the uri of a
+// Digest header matches all the requests to a stream.
+func digestUriPath(ur *url.URL) string {
+	path := ur.Path
+	if n := strings.LastIndex(path, "/"); n >= 0 && strings.HasPrefix(path[n+1:], "trackID=") {
+		path = path[:n]
+	}
+	return strings.TrimSuffix(path, "/")
+}
+
+// checkDigestAuth validates a Digest Authorization header (RFC 2069, as used
+// by RTSP clients) against the given credentials. The uri of the header must
+// be the one of the request, otherwise a response computed for a stream could
+// be replayed to read another one. The host and the query are ignored.
+func checkDigestAuth(header []string, method string, ur *url.URL, user string, pass string,
+	realm string, nonce string) bool {
+	if len(header) != 1 || !strings.HasPrefix(header[0], "Digest ") {
+		return false
+	}
+
+	params := parseDigestParams(strings.TrimPrefix(header[0], "Digest "))
+
+	if params["realm"] != realm || params["nonce"] != nonce {
+		return false
+	}
+
+	uri, err := url.Parse(params["uri"])
+	if err != nil || digestUriPath(uri) != digestUriPath(ur) {
+		return false
+	}
+
+	ha1 := md5Hex(user + ":" + realm + ":" + pass)
+	ha2 := md5Hex(method + ":" + params["uri"])
+	response := md5Hex(ha1 + ":" + nonce + ":" + ha2)
+
+	userOk := subtle.ConstantTimeCompare([]byte(params["username"]), []byte(user)) == 1
+	responseOk := subtle.ConstantTimeCompare([]byte(strings.ToLower(params["response"])), []byte(response)) == 1
+	return userOk && responseOk
+}
+
+// parseBasicAuth returns the credentials contained in a Basic Authorization
+// header.
+func parseBasicAuth(header []string) (string, string, bool) {
+	if len(header) != 1 || !strings.HasPrefix(header[0], "Basic ") {
+		return "", "", false
+	}
+
+	dec, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header[0], "Basic "))
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(dec), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// checkBasicAuth validates the Authorization header of a request against the
+// given credentials.
+func checkBasicAuth(header []string, user string, pass string) bool {
+	reqUser, reqPass, ok := parseBasicAuth(header)
+	if !ok {
+		return false
+	}
+
+	userOk := subtle.ConstantTimeCompare([]byte(reqUser), []byte(user)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(reqPass), []byte(pass)) == 1
+	return userOk && passOk
+}
+
+type authFailures struct {
+	count       int
+	last        time.Time
+	bannedUntil time.Time
+}
+
+// authBans tracks authentication failures and bans IPs that fail too often.
+type authBans struct {
+	attempts int
+	duration time.Duration
+	mutex    sync.Mutex
+	ips      map[string]*authFailures
+}
+
+func newAuthBans(attempts int, duration time.Duration) *authBans {
+	return &authBans{
+		attempts: attempts,
+		duration: duration,
+		ips:      make(map[string]*authFailures),
+	}
+}
+
+// addFailure records a failure and returns true if the IP has been banned.
+// Clients without IP, like the ones connected through Unix sockets, are
+// never banned, since they would share the same entry.
+func (b *authBans) addFailure(ip string) bool {
+	if b.attempts == 0 || ip == "" {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	f, ok := b.ips[ip]
+	if !ok || now.Sub(f.last) > b.duration {
+		f = &authFailures{}
+		b.ips[ip] = f
+	}
+
+	f.count++
+	f.last = now
+
+	if f.count >= b.attempts {
+		f.bannedUntil = now.Add(b.duration)
+		return true
+	}
+	return false
+}
+
+func (b *authBans) isBanned(ip string) bool {
+	if ip == "" {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	f, ok := b.ips[ip]
+	return ok && time.Now().Before(f.bannedUntil)
+}
+
+// list returns the banned IPs and the end of their bans.
+func (b *authBans) list() map[string]time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	ret := make(map[string]time.Time)
+	for ip, f := range b.ips {
+		if now.Before(f.bannedUntil) {
+			ret[ip] = f.bannedUntil
+		} else if now.Sub(f.last) > b.duration {
+			delete(b.ips, ip)
+		}
+	}
+	return ret
+}
+
+// restore bans an IP until the given time, unless it has already passed.
+func (b *authBans) restore(ip string, until time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	if !now.Before(until) {
+		return false
+	}
+
+	b.ips[ip] = &authFailures{
+		count:       b.attempts,
+		last:        now,
+		bannedUntil: until,
+	}
+	return true
+}
+
+// clear removes the ban of an IP, or of all IPs if ip is empty.
+func (b *authBans) clear(ip string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if ip == "" {
+		b.ips = make(map[string]*authFailures)
+		return
+	}
+	delete(b.ips, ip)
+}
+
+// streamAuthConf returns the realm, the methods, the LDAP groups and the
+// OAuth2 scopes that apply to a stream. The realm and the methods can be
+// overridden by static streams.
+func (p *program) streamAuthConf(name string) (string, authMethods, []string, []string) {
+	realm := p.conf.AuthRealm
+	methods := p.conf.AuthMethods
+	var groups []string
+	var scopes []string
+	if sc, ok := p.conf.Streams[name]; ok {
+		if sc.AuthRealm != "" {
+			realm = sc.AuthRealm
+		}
+		if len(sc.AuthMethods) > 0 {
+			methods, _ = parseAuthMethods(sc.AuthMethods)
+		}
+		groups = sc.AuthGroups
+		scopes = sc.AuthScopes
+	}
+	return realm, methods, groups, scopes
+}
+
+// authRequired tells whether clients must authenticate.
+func (p *program) authRequired() bool {
+	return p.conf.AuthUser != "" || p.ldap != nil || p.htpasswd != nil || p.oauth != nil
+}
+
+// checkCredentials checks the Authorization header of a request to a stream
+// with every configured backend, and returns the identity of the client.
+// Digest requires the nonce that was sent to the client and the url of the
+// request.
+func (p *program) checkCredentials(header []string, method string, ur *url.URL, name string, nonce string,
+	logf func(format string, args ...interface{})) (authIdentity, bool) {
+	realm, methods, groups, scopes := p.streamAuthConf(name)
+	if nonce == "" {
+		methods.digest = false
+	}
+
+	// streams restricted to groups or scopes can be read only by users that
+	// belong to them. The static user and the users of the htpasswd file
+	// have no groups nor scopes
+	restricted := len(groups) > 0 || len(scopes) > 0
+
+	if p.conf.AuthUser != "" && !restricted &&
+		methods.check(header, method, ur, p.conf.AuthUser, p.conf.AuthPass, realm, nonce) {
+		return authIdentity{user: p.conf.AuthUser, backend: _AUTH_BACKEND_STATIC}, true
+	}
+
+	// the htpasswd file and the directory require the password, that is
+	// provided by Basic only
+	if p.htpasswd != nil && methods.basic && !restricted {
+		if user, pass, ok := parseBasicAuth(header); ok && p.htpasswd.check(user, pass) {
+			return authIdentity{user: user, backend: _AUTH_BACKEND_HTPASSWD}, true
+		}
+	}
+
+	if p.ldap != nil && methods.basic {
+		if user, pass, ok := parseBasicAuth(header); ok {
+			userGroups, err := p.ldap.authenticate(user, pass)
+			if err != nil {
+				logf("ERR: LDAP: %s", err)
+			} else if !restricted || ldapInGroups(userGroups, groups) {
+				return authIdentity{user: user, groups: userGroups, backend: _AUTH_BACKEND_LDAP}, true
+			} else {
+				logf("ERR: user '%s' doesn't belong to the groups of the stream", user)
+			}
+		}
+	}
+
+	if p.oauth != nil {
+		if token, ok := parseBearerAuth(header); ok {
+			t, err := p.oauth.introspect(token)
+			if err != nil {
+				logf("ERR: OAuth: %s", err)
+			} else if !t.active {
+				logf("ERR: token is not active")
+			} else if !restricted || oauthHasScope(t.scopes, scopes) {
+				return authIdentity{user: t.subject, scopes: t.scopes, backend: _AUTH_BACKEND_OAUTH}, true
+			} else {
+				logf("ERR: token doesn't have the scopes of the stream")
+			}
+		}
+	}
+
+	return authIdentity{}, false
+}
+
+// authChallenge returns the WWW-Authenticate headers sent to clients that
+// didn't authenticate. Digest is offered only when a nonce is provided.
+func (p *program) authChallenge(name string, nonce string) []string {
+	realm, methods, _, _ := p.streamAuthConf(name)
+	if nonce == "" {
+		methods.digest = false
+	}
+
+	var ret []string
+	if p.conf.AuthUser != "" || p.htpasswd != nil || p.ldap != nil {
+		ret = methods.challenge(realm, nonce)
+	}
+	if p.oauth != nil {
+		ret = append(ret, "Bearer realm=\""+realm+"\"")
+	}
+	return ret
+}
+
+// credentialsRevoked tells whether credentials that have been accepted are
+// no longer valid, that is, the user has been removed from the htpasswd file
+// or the OAuth2 token is no longer active. Errors of LDAP can't be told apart
+// from the unavailability of the directory, therefore users of the directory
+// are never revoked.
+func (p *program) credentialsRevoked(header []string, id authIdentity) bool {
+	switch id.backend {
+	case _AUTH_BACKEND_HTPASSWD:
+		user, pass, ok := parseBasicAuth(header)
+		return ok && !p.htpasswd.check(user, pass)
+
+	case _AUTH_BACKEND_OAUTH:
+		token, ok := parseBearerAuth(header)
+		if !ok {
+			return false
+		}
+		t, err := p.oauth.introspect(token)
+		return err == nil && !t.active
+	}
+
+	return false
+}
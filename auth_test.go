@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+)
+
+func TestCheckCredentialsRestricted(t *testing.T) {
+	p := &program{
+		conf: conf{
+			AuthUser:    "user",
+			AuthPass:    "pass",
+			AuthMethods: authMethods{basic: true},
+			Streams: map[string]streamConf{
+				"open":   {},
+				"groups": {AuthGroups: []string{"cn=viewers,dc=example,dc=com"}},
+				"scopes": {AuthScopes: []string{"cameras:read"}},
+			},
+		},
+	}
+
+	header := []string{"Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))}
+	logf := func(format string, args ...interface{}) {}
+
+	for _, ca := range []struct {
+		name  string
+		valid bool
+	}{
+		{"open", true},
+		{"groups", false},
+		{"scopes", false},
+	} {
+		ur := &url.URL{Scheme: "rtsp", Host: "localhost:8554", Path: "/" + ca.name}
+		_, ok := p.checkCredentials(header, "DESCRIBE", ur, ca.name, "", logf)
+		if ok != ca.valid {
+			t.Errorf("%s: expected %v, got %v", ca.name, ca.valid, ok)
+		}
+	}
+}
+
+func TestCheckDigestAuthUri(t *testing.T) {
+	header := func(uri string) []string {
+		ha1 := md5Hex("user:realm:pass")
+		ha2 := md5Hex("SETUP:" + uri)
+		return []string{"Digest username=\"user\", realm=\"realm\", nonce=\"nonce\", " +
+			"uri=\"" + uri + "\", response=\"" + md5Hex(ha1+":nonce:"+ha2) + "\""}
+	}
+
+	ur, err := url.Parse("rtsp://localhost:8554/cam/trackID=1?token=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ca := range []struct {
+		uri   string
+		valid bool
+	}{
+		{"rtsp://localhost:8554/cam/trackID=1", true},
+		{"rtsp://localhost:8554/cam/", true},
+		{"rtsp://127.0.0.1:8554/cam?token=b", true},
+		{"/cam", true},
+		{"rtsp://localhost:8554/other/trackID=1", false},
+		{"rtsp://localhost:8554/cam/other", false},
+		{"", false},
+	} {
+		ok := checkDigestAuth(header(ca.uri), "SETUP", ur, "user", "pass", "realm", "nonce")
+		if ok != ca.valid {
+			t.Errorf("%s: expected %v, got %v", ca.uri, ca.valid, ok)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// bitrateWindows contains the average bitrates over the last 1, 10 and 60
+// seconds, in bits per second.
+type bitrateWindows struct {
+	Last1s  float64 `json:"last1s"`
+	Last10s float64 `json:"last10s"`
+	Last60s float64 `json:"last60s"`
+}
+
+// averageBitrate returns the average of the last n samples, or of all the
+// samples when they are less than n.
+func averageBitrate(samples []float64, n int) float64 {
+	if len(samples) > n {
+		samples = samples[len(samples)-n:]
+	}
+	if len(samples) == 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for _, v := range samples {
+		sum += v
+	}
+	return sum / float64(len(samples))
+}
+
+func newBitrateWindows(samples []float64) bitrateWindows {
+	return bitrateWindows{
+		Last1s:  averageBitrate(samples, 1),
+		Last10s: averageBitrate(samples, 10),
+		Last60s: averageBitrate(samples, 60),
+	}
+}
+
+func (w *bitrateWindows) add(o bitrateWindows) {
+	w.Last1s += o.Last1s
+	w.Last10s += o.Last10s
+	w.Last60s += o.Last60s
+}
+
+// rollingBitrate computes the bitrate of a flow over the last 60 seconds,
+// from a sample taken every second.
+type rollingBitrate struct {
+	mutex     sync.Mutex
+	bytes     uint64
+	lastBytes uint64
+	lastTime  time.Time
+	samples   []float64 // bits per second, most recent last
+}
+
+func newRollingBitrate() *rollingBitrate {
+	return &rollingBitrate{
+		lastTime: time.Now(),
+	}
+}
+
+func (r *rollingBitrate) add(n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.bytes += uint64(n)
+}
+
+// sample computes the bitrate since the previous sample.
+func (r *rollingBitrate) sample() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(r.lastTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	r.samples = append(r.samples, float64(r.bytes-r.lastBytes)*8/elapsed)
+	if len(r.samples) > _STATS_BITRATE_SAMPLES {
+		r.samples = r.samples[len(r.samples)-_STATS_BITRATE_SAMPLES:]
+	}
+
+	r.lastBytes = r.bytes
+	r.lastTime = now
+}
+
+func (r *rollingBitrate) windows() bitrateWindows {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return newBitrateWindows(r.samples)
+}
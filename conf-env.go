@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// prefix of the environment variables that define streams, in the format
+// STREAM_<NAME>_<OPTION>
+const _ENV_STREAM_PREFIX = "STREAM_"
+
+// envStreamOption returns the index of the field of streamConf whose
+// option, in upper case, ends the given string, and the name of the stream
+// that precedes it.
+func envStreamOption(rest string) (int, string, bool) {
+	t := reflect.TypeOf(streamConf{})
+
+	index := -1
+	var name string
+
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.ToUpper(strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0])
+		if key == "" || !strings.HasSuffix(rest, "_"+key) {
+			continue
+		}
+
+		// the longest option wins, since names can contain underscores
+		n := rest[:len(rest)-len(key)-1]
+		if n != "" && (index < 0 || len(n) < len(name)) {
+			index = i
+			name = n
+		}
+	}
+
+	return index, strings.ToLower(name), index >= 0
+}
+
+// mergeEnvStreams adds the streams defined with environment variables to
+// the ones of the configuration file. Options set with environment variables
+// override the ones of the file. Values are in YAML format, such that lists
+// and maps can be provided inline.
+func mergeEnvStreams(streams map[string]streamConf, environ []string) (map[string]streamConf, error) {
+	ret := make(map[string]streamConf)
+	for name, sc := range streams {
+		ret[name] = sc
+	}
+
+	for _, e := range environ {
+		if !strings.HasPrefix(e, _ENV_STREAM_PREFIX) {
+			continue
+		}
+
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		// variables that do not end with an option, like the ones of
+		// command-line flags, are not stream definitions
+		index, name, ok := envStreamOption(strings.TrimPrefix(parts[0], _ENV_STREAM_PREFIX))
+		if !ok {
+			continue
+		}
+
+		// names of variables are case-insensitive, therefore they
+		// override streams of the file whose names contain upper case
+		// letters
+		if _, ok := ret[name]; !ok {
+			for existing := range ret {
+				if strings.EqualFold(existing, name) {
+					name = existing
+					break
+				}
+			}
+		}
+
+		sc := ret[name]
+		v := reflect.ValueOf(&sc).Elem().Field(index)
+
+		ptr := reflect.New(v.Type())
+		err := yaml.Unmarshal([]byte(parts[1]), ptr.Interface())
+		if err != nil {
+			return nil, fmt.Errorf("invalid environment variable %s: %s", parts[0], err)
+		}
+		v.Set(ptr.Elem())
+
+		ret[name] = sc
+	}
+
+	return ret, nil
+}
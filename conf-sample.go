@@ -0,0 +1,219 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+)
+
+// maximum length of the comment lines of the sample configuration
+const _SAMPLE_CONF_LINE_LENGTH = 76
+
+// descriptions of the options of the configuration file, by path. The
+// sample configuration is generated from the configuration structs, such
+// that it contains all the options, including the ones without description.
+var sampleConfDocs = map[string]string{
+	"acl": "rules that restrict access to streams. When present, a client can read a stream " +
+		"only if a rule matches both its identity and the name of the stream",
+	"acl.users": "user names, LDAP groups (group:<dn>), OAuth2 scopes (scope:<scope>) or * for everybody",
+	"acl.paths": "names of streams, that can end with * to match prefixes",
+
+	"streams":                  "static streams, that are pulled at startup and opened by using their name as path",
+	"streams.*":                "name of the stream",
+	"streams.url":              "url of the source stream (rtsp:// or file://)",
+	"streams.useTcp":           "whether to receive this stream in udp or tcp",
+	"streams.push":             "fixed destinations to which tracks are sent, regardless of clients",
+	"streams.push.track":       "id of the track",
+	"streams.push.rtp":         "address to which RTP packets are sent",
+	"streams.push.rtcp":        "address to which RTCP packets are sent. If empty, they are not sent",
+	"streams.userAgent":        "User-Agent sent to the source, overrides --user-agent",
+	"streams.headers":          "additional headers sent to the source",
+	"streams.rangePassthrough": "forward the Range header of PLAY requests to the source (udp only), seeking the stream for all clients",
+	"streams.scalePassthrough": "forward the Scale and Speed headers of PLAY requests to the source (udp only)",
+	"streams.vod": "give each client a dedicated session with the source (udp only), in order to " +
+		"forward PAUSE, Range, Scale and Speed independently",
+	"streams.logFile": "file to which the log of this stream and of its clients is written, in addition " +
+		"to the main log; overrides --stream-log-dir",
+	"streams.debugRtsp":     "log RTSP requests and responses of this stream and of its clients",
+	"streams.sdp":           "SDP that describes the tracks of pcap captures and rtpdump files",
+	"streams.source":        "instead of url, generate the stream (testpattern)",
+	"streams.disabled":      "do not pull this stream; clients are refused",
+	"streams.maxBitrate":    "maximum bitrate of this stream, in bits per second; packets in excess are dropped. Overrides --stream-max-bitrate",
+	"streams.maxBufferSize": "maximum size of the buffer of this stream, in bytes; the oldest packets are discarded first. Overrides --stream-max-buffer-size",
+	"streams.dscp": "DSCP of the packets sent to clients of this stream (0-63), used by networks to " +
+		"prioritize traffic. Overrides --dscp",
+	"streams.authRealm":   "realm of the authentication of this stream. Overrides --auth-realm",
+	"streams.authMethods": "authentication methods offered to clients of this stream (basic, digest). Overrides --auth-methods",
+	"streams.authGroups": "LDAP groups whose members can read this stream; requires --auth-ldap-url. " +
+		"If empty, all users of the directory are allowed, otherwise the single user and the users of the " +
+		"htpasswd file are refused",
+	"streams.authScopes": "OAuth2 scopes that allow to read this stream; requires " +
+		"--auth-oauth-introspection-url. If empty, all active tokens are allowed, otherwise the single user " +
+		"and the users of the htpasswd file are refused",
+	"streams.multicast":           "options of pushes whose destination is a multicast group",
+	"streams.multicast.ttl":       "time to live of multicast packets. 0 means the system default",
+	"streams.multicast.interface": "name of the interface through which multicast packets are sent",
+	"streams.multicast.source": "address from which multicast packets are sent. When set, push destinations " +
+		"must be source-specific multicast groups (232.0.0.0/8 or ff3x::/32)",
+	"streams.hls":   "serve this stream with LL-HLS on --playback-port; requires H.264, AAC or Opus tracks",
+	"streams.dash":  "serve this stream with MPEG-DASH on --playback-port; requires H.264, AAC or Opus tracks",
+	"streams.mse":   "serve this stream with fMP4 over WebSocket on --playback-port, for browsers that play it with Media Source Extensions",
+	"streams.mjpeg": "serve the JPEG track of this stream with MJPEG on --playback-port",
+	"streams.latencyProfile": "buffering of this stream (lowest, balanced, resilient). Empty means " +
+		"that packets are forwarded as soon as they are received",
+	"streams.preload": "when --on-demand is set, pull this stream at startup and keep it running without clients",
+	"streams.schedule": "weekly time windows during which the stream is pulled, in the format \"Mon-Fri 18:00-08:00\" " +
+		"(local time; * means every day). Outside of them the stream is disabled. Empty means always",
+	"streams.congestionPolicy": "frames that are dropped first when the queue of a TCP client fills up. " +
+		"video-first drops audio and metadata, then non-reference video frames. Empty means no preference",
+	"streams.timeouts":             "timeouts of each phase of the session with the source. 0 means the global value",
+	"streams.timeouts.describe":    "timeout of the connection to the source and of its answer to DESCRIBE",
+	"streams.timeouts.setup":       "timeout of the answers of the source to SETUP and PLAY",
+	"streams.timeouts.firstPacket": "maximum time between the answer of the source to PLAY and its first packet",
+	"streams.timeouts.frameGap":    "maximum time between two packets of the source, after which it is considered dead",
+	"streams.tcpPacing": "send frames to TCP clients according to their RTP timestamps, instead of " +
+		"forwarding bursts of the source as they are",
+	"streams.replayOnConnect": "duration of buffered media sent at accelerated pace to new clients of this stream. 0 disables it",
+	"streams.h264PacketizationMode": "repacketize H.264 tracks to this packetization mode (0 or 1) before " +
+		"sending them to clients. Empty means that packets are forwarded as they are",
+	"streams.h264MaxPacketSize":              "maximum size of repacketized H.264 packets, including the RTP header. 0 means 1412",
+	"streams.sdpOverrides":                   "attributes that are added to the SDP sent to clients, or that replace the ones of the source",
+	"streams.sdpOverrides.bandwidth":         "bandwidth of the session (b=AS), in kbit/s. 0 means not set",
+	"streams.sdpOverrides.tracks":            "attributes of the tracks",
+	"streams.sdpOverrides.tracks.track":      "id of the track",
+	"streams.sdpOverrides.tracks.bandwidth":  "bandwidth of the track (b=AS), in kbit/s. 0 means the one of the source",
+	"streams.sdpOverrides.tracks.framerate":  "frame rate of the track (a=framerate). 0 means not set",
+	"streams.sdpOverrides.tracks.attributes": "other attributes, in the format key: value",
+	"streams.compose":                        "additional sources, whose tracks of the given media type replace the ones of the main source",
+	"streams.compose.url":                    "url of the additional source",
+	"streams.compose.useTcp":                 "whether to receive the additional source in udp or tcp",
+	"streams.compose.media":                  "media type of the tracks that are taken (audio, video or application)",
+	"streams.from":                           "instead of url, take the tracks of another static stream, without connecting to its source again",
+	"streams.fromTracks":                     "ids of the tracks of the other stream that are taken. Empty means all",
+	"streams.fromMedia":                      "media types (audio, video, application) of the tracks of the other stream that are taken. Empty means all",
+	"streams.queryPassthrough":               "query parameters of clients that are forwarded to the source. They replace the {name} placeholders of url, or are added to its query",
+	"streams.reconnectInterval":              "time between a failed attempt to read the source and the next one. 0 means 5s",
+	"streams.maxReconnectAttempts":           "consecutive failed reconnect attempts after which the stream stops retrying and becomes exhausted. 0 means infinite",
+	"streams.backoffFactor":                  "factor by which the reconnect interval is multiplied after each failed attempt, up to 5 minutes. 0 means 1",
+}
+
+// values of the sample configuration that differ from the zero value
+var sampleConfValues = map[string]string{
+	"streams.*":   "mypath",
+	"streams.url": "rtsp://localhost:8554/mystream",
+}
+
+type sampleConfWriter struct {
+	lines []string
+}
+
+// line writes a line. Lines of blocks that are commented out, starting
+// from the indentation commentAt, are prefixed with #, such that the sample
+// configuration is valid as it is. A negative commentAt means that the line
+// is not commented out.
+func (w *sampleConfWriter) line(indent int, commentAt int, text string) {
+	if commentAt < 0 {
+		w.lines = append(w.lines, strings.Repeat("  ", indent)+text)
+		return
+	}
+	w.lines = append(w.lines, strings.Repeat("  ", commentAt)+"# "+
+		strings.Repeat("  ", indent-commentAt)+text)
+}
+
+func (w *sampleConfWriter) comment(indent int, commentAt int, path string) {
+	doc, ok := sampleConfDocs[path]
+	if !ok {
+		return
+	}
+
+	width := _SAMPLE_CONF_LINE_LENGTH - 2*indent
+	if commentAt >= 0 {
+		width -= 2
+	}
+
+	cur := "#"
+	for _, word := range strings.Fields(doc) {
+		if len(cur)+1+len(word) > width && cur != "#" {
+			w.line(indent, commentAt, cur)
+			cur = "#"
+		}
+		cur += " " + word
+	}
+	w.line(indent, commentAt, cur)
+}
+
+func (w *sampleConfWriter) scalar(t reflect.Type, path string) string {
+	if v, ok := sampleConfValues[path]; ok {
+		return " " + v
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return " no"
+
+	case reflect.String:
+		return ""
+	}
+	return " 0"
+}
+
+// fields writes the fields of a struct, with their descriptions.
+func (w *sampleConfWriter) fields(t reflect.Type, prefix string, indent int, commentAt int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		path := prefix + key
+
+		w.comment(indent, commentAt, path)
+
+		switch f.Type.Kind() {
+		case reflect.Struct:
+			w.line(indent, commentAt, key+":")
+			w.fields(f.Type, path+".", indent+1, commentAt)
+
+		case reflect.Slice:
+			if f.Type.Elem().Kind() != reflect.Struct {
+				w.line(indent, commentAt, key+": []")
+				continue
+			}
+
+			// entries are written as a commented example, since empty
+			// entries are not valid
+			exampleAt := commentAt
+			if exampleAt < 0 {
+				w.line(indent, commentAt, key+": []")
+				exampleAt = indent
+			}
+			w.line(indent, exampleAt, key+":")
+			w.line(indent+1, exampleAt, "-")
+			w.fields(f.Type.Elem(), path+".", indent+2, exampleAt)
+
+		case reflect.Map:
+			if f.Type.Elem().Kind() != reflect.Struct {
+				w.line(indent, commentAt, key+": {}")
+				continue
+			}
+
+			w.line(indent, commentAt, key+":")
+			w.comment(indent+1, commentAt, path+".*")
+			w.line(indent+1, commentAt, sampleConfValues[path+".*"]+":")
+			w.fields(f.Type.Elem(), path+".", indent+2, commentAt)
+
+		default:
+			w.line(indent, commentAt, key+":"+w.scalar(f.Type, path))
+		}
+	}
+}
+
+// sampleConf returns a configuration file that contains all the options,
+// with their default values and their descriptions.
+func sampleConf() string {
+	w := &sampleConfWriter{}
+	w.line(0, -1, "# configuration file of rtsp-simple-proxy, generated by 'rtsp-simple-proxy init'.")
+	w.line(0, -1, "# Other options are set with command-line flags, see 'rtsp-simple-proxy --help'.")
+	w.line(0, -1, "")
+	w.fields(reflect.TypeOf(confSnapshot{}), "", 0, -1)
+	return strings.Join(w.lines, "\n") + "\n"
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// timeout of the request that reads the configuration of the running
+// instance
+const _DRY_RUN_TIMEOUT = 10 * time.Second
+
+// headers sent to sources whose values are not exposed by the API
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// confSnapshot is the part of the configuration that is exposed by the API
+// and compared by dry runs.
+type confSnapshot struct {
+	Acl     []aclRuleConf         `yaml:"acl"`
+	Streams map[string]streamConf `yaml:"streams"`
+}
+
+// snapshot returns the static streams and the ACL without credentials.
+func (c *conf) snapshot() (*confSnapshot, error) {
+	snap := &confSnapshot{
+		Acl:     c.Acl,
+		Streams: make(map[string]streamConf),
+	}
+
+	for name, sc := range c.Streams {
+		sc.Url = urlStringRedacted(sc.Url)
+
+		compose := make([]streamComposeConf, len(sc.Compose))
+		for i, cc := range sc.Compose {
+			cc.Url = urlStringRedacted(cc.Url)
+			compose[i] = cc
+		}
+		sc.Compose = compose
+
+		headers := make(map[string]string)
+		for k, v := range sc.Headers {
+			for _, rh := range redactedHeaders {
+				if strings.EqualFold(k, rh) {
+					v = "xxxxx"
+				}
+			}
+			headers[k] = v
+		}
+		sc.Headers = headers
+
+		snap.Streams[name] = sc
+	}
+
+	// empty and missing values are normalized by encoding and decoding
+	byts, err := yaml.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret confSnapshot
+	err = yaml.Unmarshal(byts, &ret)
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// validateStreams performs the checks that are otherwise performed when
+// streams are created.
+func (c *conf) validateStreams() error {
+	for name, sc := range c.Streams {
+		_, err := parseStreamConf(c, sc)
+		if err != nil {
+			return fmt.Errorf("stream '%s': %s", name, err)
+		}
+
+		if sc.From != "" && !sc.Disabled {
+			parent, ok := c.Streams[sc.From]
+			if !ok || parent.Vod || len(parent.QueryPassthrough) > 0 {
+				return fmt.Errorf("stream '%s': stream '%s' not found", name, sc.From)
+			}
+			if parent.From != "" {
+				return fmt.Errorf("stream '%s': stream '%s' is derived from another stream", name, sc.From)
+			}
+		}
+	}
+	return nil
+}
+
+// fetchRunningConf reads the configuration of the running instance through
+// its API.
+func fetchRunningConf(c *conf, apiUrl string) (*confSnapshot, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(apiUrl, "/")+"/v1/config", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ApiAuth.setRequestAuth(req)
+
+	res, err := (&http.Client{Timeout: _DRY_RUN_TIMEOUT}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	byts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var snap confSnapshot
+	err = yaml.Unmarshal(byts, &snap)
+	if err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func formatConfValue(v interface{}) string {
+	byts, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(byts)
+}
+
+// diffStreamConfs returns the options that differ between two
+// configurations of a stream.
+func diffStreamConfs(a streamConf, b streamConf) []string {
+	var ret []string
+
+	va := reflect.ValueOf(a)
+	vb := reflect.ValueOf(b)
+	t := va.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		fa := va.Field(i).Interface()
+		fb := vb.Field(i).Interface()
+		if reflect.DeepEqual(fa, fb) {
+			continue
+		}
+
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		ret = append(ret, fmt.Sprintf("%s: %s -> %s", key, formatConfValue(fa), formatConfValue(fb)))
+	}
+
+	return ret
+}
+
+// diffConfs returns the differences between the running configuration and
+// a new one, one per line.
+func diffConfs(running *confSnapshot, next *confSnapshot) []string {
+	var names []string
+	for name := range running.Streams {
+		names = append(names, name)
+	}
+	for name := range next.Streams {
+		if _, ok := running.Streams[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var ret []string
+
+	for _, name := range names {
+		a, inRunning := running.Streams[name]
+		b, inNext := next.Streams[name]
+
+		switch {
+		case !inRunning:
+			ret = append(ret, fmt.Sprintf("+ stream '%s'", name))
+
+		case !inNext:
+			ret = append(ret, fmt.Sprintf("- stream '%s'", name))
+
+		default:
+			changes := diffStreamConfs(a, b)
+			if len(changes) > 0 {
+				ret = append(ret, fmt.Sprintf("~ stream '%s'", name))
+				for _, c := range changes {
+					ret = append(ret, "    "+c)
+				}
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(running.Acl, next.Acl) {
+		ret = append(ret, "~ acl")
+	}
+
+	return ret
+}
+
+// dryRun validates the configuration and prints the differences with the
+// one of the running instance, without applying anything.
+func dryRun(c *conf, apiUrl string) error {
+	err := c.validateStreams()
+	if err != nil {
+		return err
+	}
+
+	if apiUrl == "" {
+		if c.ApiPort == 0 {
+			return fmt.Errorf("dry runs require the API port or the API url of the running instance")
+		}
+		apiUrl = fmt.Sprintf("http://localhost:%d", c.ApiPort)
+	}
+
+	running, err := fetchRunningConf(c, apiUrl)
+	if err != nil {
+		return fmt.Errorf("unable to read the configuration of the running instance: %s", err)
+	}
+
+	next, err := c.snapshot()
+	if err != nil {
+		return err
+	}
+
+	diff := diffConfs(running, next)
+	if len(diff) == 0 {
+		fmt.Println("configuration is valid, no changes")
+		return nil
+	}
+
+	fmt.Println("configuration is valid, changes:")
+	for _, l := range diff {
+		fmt.Println(l)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// policies that choose which frames are dropped when the queue of a client
+// fills up
+const (
+	_CONGESTION_POLICY_VIDEO_FIRST = "video-first"
+)
+
+// fill of the queue of a client, in fractions of its size, above which
+// audio and metadata, and then non-reference video frames, are dropped
+const (
+	_CONGESTION_DROP_NON_VIDEO_NUM     = 1
+	_CONGESTION_DROP_NON_VIDEO_DEN     = 2
+	_CONGESTION_DROP_NON_REFERENCE_NUM = 3
+	_CONGESTION_DROP_NON_REFERENCE_DEN = 4
+)
+
+func parseCongestionPolicy(v string) (string, error) {
+	switch v {
+	case "", _CONGESTION_POLICY_VIDEO_FIRST:
+		return v, nil
+	}
+	return "", fmt.Errorf("unsupported congestion policy: %s", v)
+}
+
+// congestionDrop tells whether a frame must be dropped in order to keep
+// space in the queue of a client for video. Audio and metadata are dropped
+// first, then non-reference video frames; when the queue is full, video is
+// skipped until the next key frame, since the following frames can't be
+// decoded without the dropped ones.
+func (o *streamOutputs) congestionDrop(sub streamSubscriber, id int, flow trackFlow, frame []byte) bool {
+	size := cap(sub.c.chanWrite)
+	if size == 0 {
+		return false
+	}
+	queued := len(sub.c.chanWrite)
+
+	// RTCP packets are small and keep tracks synchronized
+	if flow != _TRACK_FLOW_RTP {
+		return false
+	}
+
+	if !o.videoTracks[id] {
+		return queued*_CONGESTION_DROP_NON_VIDEO_DEN >= size*_CONGESTION_DROP_NON_VIDEO_NUM
+	}
+
+	if !o.h264Tracks[id] {
+		return false
+	}
+
+	if queued >= size {
+		if sub.dropFrames {
+			atomic.StoreInt32(&sub.c.keyFrameWait, 1)
+			return true
+		}
+		return false
+	}
+
+	return queued*_CONGESTION_DROP_NON_REFERENCE_DEN >= size*_CONGESTION_DROP_NON_REFERENCE_NUM &&
+		rtpH264IsNonReference(frame)
+}
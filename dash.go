@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+const (
+	_DASH_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+)
+
+// dashDuration formats a duration as a xs:duration.
+func dashDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// dashTrack returns a track by id. It must be called with the mutex locked.
+func (m *hlsMuxer) dashTrack(id int) (*hlsMuxerTrack, bool) {
+	for _, t := range m.tracks {
+		if t.id == id {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// dashManifest returns the MPD of a live MPEG-DASH presentation, in which each
+// track is served separately and lists the complete segments.
+func (m *hlsMuxer) dashManifest(now time.Time) ([]byte, error) {
+	// the manifest is published once it contains a complete segment
+	if !m.wait(func() bool { return len(m.segments) > 0 }, m.blockTimeout()) {
+		return nil, fmt.Errorf("the manifest is not ready yet")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var depth time.Duration
+	maxDuration := m.segmentDuration
+	for _, s := range m.segments {
+		depth += s.duration
+		if s.duration > maxDuration {
+			maxDuration = s.duration
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\""+
+		" type=\"dynamic\" availabilityStartTime=\"%s\" publishTime=\"%s\""+
+		" minimumUpdatePeriod=\"%s\" minBufferTime=\"%s\" timeShiftBufferDepth=\"%s\""+
+		" suggestedPresentationDelay=\"%s\" maxSegmentDuration=\"%s\">\n",
+		m.startTime.UTC().Format(_DASH_TIME_FORMAT), now.UTC().Format(_DASH_TIME_FORMAT),
+		dashDuration(m.segmentDuration), dashDuration(maxDuration), dashDuration(depth),
+		dashDuration(2*maxDuration), dashDuration(maxDuration))
+	buf.WriteString("  <Period id=\"0\" start=\"PT0S\">\n")
+
+	for _, t := range m.tracks {
+		var size int
+		var duration int64
+		var timeline bytes.Buffer
+
+		for _, s := range m.segments {
+			traf, ok := s.trafs[t.id]
+			if !ok {
+				continue
+			}
+
+			var d int64
+			for _, sample := range traf.samples {
+				d += int64(sample.duration)
+				size += len(sample.data)
+			}
+			duration += d
+
+			fmt.Fprintf(&timeline, "          <S t=\"%d\" d=\"%d\"/>\n", traf.baseMediaDecodeTime, d)
+		}
+
+		// tracks without samples can't be played yet
+		if duration == 0 {
+			continue
+		}
+		bandwidth := int64(size) * 8 * int64(t.timescale) / duration
+
+		if t.codec == _FILE_CODEC_H264 {
+			fmt.Fprintf(&buf, "    <AdaptationSet id=\"%d\" contentType=\"video\" mimeType=\"video/mp4\" codecs=\"%s\""+
+				" segmentAlignment=\"true\" startWithSAP=\"1\">\n", t.id, t.codecs())
+		} else {
+			fmt.Fprintf(&buf, "    <AdaptationSet id=\"%d\" contentType=\"audio\" mimeType=\"audio/mp4\" codecs=\"%s\">\n",
+				t.id, t.codecs())
+		}
+
+		fmt.Fprintf(&buf, "      <SegmentTemplate timescale=\"%d\" initialization=\"dash-$RepresentationID$-init.mp4\""+
+			" media=\"dash-$RepresentationID$-$Time$.m4s\">\n"+
+			"        <SegmentTimeline>\n", t.timescale)
+		buf.Write(timeline.Bytes())
+		buf.WriteString("        </SegmentTimeline>\n" +
+			"      </SegmentTemplate>\n")
+
+		if t.codec == _FILE_CODEC_H264 {
+			fmt.Fprintf(&buf, "      <Representation id=\"%d\" bandwidth=\"%d\" width=\"%d\" height=\"%d\"/>\n",
+				t.id, bandwidth, t.width, t.height)
+		} else {
+			sampleRate, channels := t.audioParams()
+			fmt.Fprintf(&buf, "      <Representation id=\"%d\" bandwidth=\"%d\" audioSamplingRate=\"%d\">\n"+
+				"        <AudioChannelConfiguration schemeIdUri=\"urn:mpeg:dash:23003:3:audio_channel_configuration:2011\" value=\"%d\"/>\n"+
+				"      </Representation>\n",
+				t.id, bandwidth, sampleRate, channels)
+		}
+
+		buf.WriteString("    </AdaptationSet>\n")
+	}
+
+	buf.WriteString("  </Period>\n")
+
+	// clients synchronize their clock with the one of the server, since
+	// segments are available according to the wall clock
+	fmt.Fprintf(&buf, "  <UTCTiming schemeIdUri=\"urn:mpeg:dash:utc:direct:2014\" value=\"%s\"/>\n"+
+		"</MPD>\n", now.UTC().Format(_DASH_TIME_FORMAT))
+
+	return buf.Bytes(), nil
+}
+
+// dashInitSegment returns the initialization segment of a track.
+func (m *hlsMuxer) dashInitSegment(trackId int) ([]byte, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.dashTrack(trackId)
+	if !ok || m.init == nil {
+		return nil, false
+	}
+	return fmp4InitSegment([]*fmp4Track{&t.fmp4Track}), true
+}
+
+// dashSegment returns the segment of a track that starts at the given decode
+// time.
+func (m *hlsMuxer) dashSegment(trackId int, start uint64) ([]byte, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, s := range m.segments {
+		traf, ok := s.trafs[trackId]
+		if ok && traf.baseMediaDecodeTime == start {
+			return fmp4Fragment(uint32(s.id+1), []*fmp4Traf{traf}), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+const (
+	_FAKESOURCE_AAC_SAMPLE_RATE = 48000
+	_FAKESOURCE_AAC_FRAME_SIZE  = 1024 // samples of each access unit
+)
+
+// AAC-LC access unit that contains silence, mono
+var fakeSourceSilence = []byte{0x00, 0xc8, 0x00, 0x80, 0x23, 0x80}
+
+type fakeSourceCodec int
+
+const (
+	_FAKESOURCE_CODEC_H264 fakeSourceCodec = iota
+	_FAKESOURCE_CODEC_AAC
+)
+
+func parseFakeSourceTracks(v string) ([]fakeSourceCodec, error) {
+	var ret []fakeSourceCodec
+
+	for _, name := range strings.Split(v, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "h264":
+			ret = append(ret, _FAKESOURCE_CODEC_H264)
+
+		case "aac":
+			ret = append(ret, _FAKESOURCE_CODEC_AAC)
+
+		default:
+			return nil, fmt.Errorf("unsupported fake source track: %s", name)
+		}
+	}
+
+	return ret, nil
+}
+
+// fakeSourceSdp returns the SDP of the tracks of a fake source.
+func fakeSourceSdp(codecs []fakeSourceCodec) []byte {
+	ret := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=Fake source\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"t=0 0\r\n"
+
+	for i, codec := range codecs {
+		payloadType := 96 + i
+
+		switch codec {
+		case _FAKESOURCE_CODEC_H264:
+			ret += fmt.Sprintf("m=video 0 RTP/AVP %d\r\n"+
+				"a=rtpmap:%d H264/90000\r\n"+
+				"a=fmtp:%d packetization-mode=1; profile-level-id=42C014; sprop-parameter-sets=%s,%s\r\n",
+				payloadType, payloadType, payloadType,
+				base64.StdEncoding.EncodeToString(testPatternSps()),
+				base64.StdEncoding.EncodeToString(testPatternPps()))
+
+		case _FAKESOURCE_CODEC_AAC:
+			conf := &aacConfig{
+				objectType: 2,
+				sampleRate: _FAKESOURCE_AAC_SAMPLE_RATE,
+				channels:   1,
+			}
+			ret += fmt.Sprintf("m=audio 0 RTP/AVP %d\r\n"+
+				"a=rtpmap:%d MPEG4-GENERIC/%d/1\r\n"+
+				"a=fmtp:%d profile-level-id=1; mode=AAC-hbr; sizelength=13; indexlength=3; indexdeltalength=3; config=%s\r\n",
+				payloadType, payloadType, _FAKESOURCE_AAC_SAMPLE_RATE,
+				payloadType, hex.EncodeToString(conf.encode()))
+		}
+
+		ret += "a=control:trackID=" + strconv.FormatInt(int64(i), 10) + "\r\n"
+	}
+
+	return []byte(ret)
+}
+
+// fakeSource is a RTSP server that serves a deterministic test stream on
+// any path, in order to test the proxy end to end without cameras. Each
+// session receives the same packets, starting from the same sequence numbers
+// and timestamps.
+type fakeSource struct {
+	codecs []fakeSourceCodec
+	sdp    []byte
+}
+
+func (fs *fakeSource) log(format string, args ...interface{}) {
+	log.Printf("[fakesource] "+format, args...)
+}
+
+func newFakeSource(tracks string) (*fakeSource, error) {
+	codecs, err := parseFakeSourceTracks(tracks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fakeSource{
+		codecs: codecs,
+		sdp:    fakeSourceSdp(codecs),
+	}, nil
+}
+
+// serve accepts sessions until the listener is closed.
+func (fs *fakeSource) serve(ln net.Listener) error {
+	for {
+		nconn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go newFakeSourceSession(fs, nconn).run()
+	}
+}
+
+// runFakeSource serves a fake source until an error occurs.
+func runFakeSource(port int, tracks string) error {
+	fs, err := newFakeSource(tracks)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	fs.log("listening on port %d, tracks: %s", port, tracks)
+
+	return fs.serve(ln)
+}
+
+type fakeSourceTrack struct {
+	rtpChannel  uint8
+	rtcpChannel uint8
+	rtpl        net.PacketConn
+	rtcpl       net.PacketConn
+	rtpAddr     *net.UDPAddr
+}
+
+type fakeSourceSession struct {
+	fs         *fakeSource
+	conn       *gortsplib.ConnServer
+	ip         net.IP
+	writeMutex sync.Mutex // guards writes to the connection
+	tracks     map[int]*fakeSourceTrack
+	udp        bool
+	playing    bool
+	done       chan struct{}
+}
+
+func newFakeSourceSession(fs *fakeSource, nconn net.Conn) *fakeSourceSession {
+	ipstr, _, _ := net.SplitHostPort(nconn.RemoteAddr().String())
+
+	return &fakeSourceSession{
+		fs:     fs,
+		conn:   gortsplib.NewConnServer(nconn, _READ_TIMEOUT, _WRITE_TIMEOUT),
+		ip:     net.ParseIP(ipstr),
+		tracks: make(map[int]*fakeSourceTrack),
+		done:   make(chan struct{}),
+	}
+}
+
+func (ss *fakeSourceSession) log(format string, args ...interface{}) {
+	ss.fs.log("[client %s] "+format, append([]interface{}{ss.ip}, args...)...)
+}
+
+func (ss *fakeSourceSession) run() {
+	defer func() {
+		close(ss.done)
+		ss.conn.NetConn().Close()
+		for _, t := range ss.tracks {
+			if t.rtpl != nil {
+				t.rtpl.Close()
+				t.rtcpl.Close()
+			}
+		}
+		ss.log("disconnected")
+	}()
+
+	ss.log("connected")
+
+	for {
+		req, err := ss.conn.ReadRequest()
+		if err != nil {
+			if err != io.EOF {
+				ss.log("ERR: %s", err)
+			}
+			return
+		}
+
+		if !ss.handleRequest(req) {
+			return
+		}
+	}
+}
+
+func (ss *fakeSourceSession) writeResponse(req *gortsplib.Request, code gortsplib.StatusCode, header gortsplib.Header, content []byte) error {
+	if header == nil {
+		header = gortsplib.Header{}
+	}
+	if cseq, ok := req.Header["CSeq"]; ok && len(cseq) == 1 {
+		header["CSeq"] = []string{cseq[0]}
+	}
+
+	ss.writeMutex.Lock()
+	defer ss.writeMutex.Unlock()
+
+	return ss.conn.WriteResponse(&gortsplib.Response{
+		StatusCode: code,
+		Header:     header,
+		Content:    content,
+	})
+}
+
+func (ss *fakeSourceSession) handleRequest(req *gortsplib.Request) bool {
+	ss.log(string(req.Method))
+
+	switch req.Method {
+	case gortsplib.OPTIONS:
+		ss.writeResponse(req, gortsplib.StatusOK, gortsplib.Header{
+			"Public": []string{strings.Join([]string{
+				string(gortsplib.OPTIONS),
+				string(gortsplib.DESCRIBE),
+				string(gortsplib.SETUP),
+				string(gortsplib.PLAY),
+				string(gortsplib.GET_PARAMETER),
+				string(gortsplib.SET_PARAMETER),
+				string(gortsplib.TEARDOWN),
+			}, ", ")},
+		}, nil)
+		return true
+
+	case gortsplib.GET_PARAMETER, gortsplib.SET_PARAMETER:
+		ss.writeResponse(req, gortsplib.StatusOK, nil, nil)
+		return true
+
+	case gortsplib.DESCRIBE:
+		ss.writeResponse(req, gortsplib.StatusOK, gortsplib.Header{
+			"Content-Base": []string{req.Url.String()},
+			"Content-Type": []string{"application/sdp"},
+		}, ss.fs.sdp)
+		return true
+
+	case gortsplib.SETUP:
+		header, err := ss.setup(req)
+		if err != nil {
+			ss.log("ERR: %s", err)
+			ss.writeResponse(req, gortsplib.StatusBadRequest, nil, nil)
+			return false
+		}
+		ss.writeResponse(req, gortsplib.StatusOK, header, nil)
+		return true
+
+	case gortsplib.PLAY:
+		if len(ss.tracks) == 0 || ss.playing {
+			ss.writeResponse(req, gortsplib.StatusBadRequest, nil, nil)
+			return false
+		}
+
+		ss.writeResponse(req, gortsplib.StatusOK, gortsplib.Header{
+			"Session": []string{"12345678"},
+		}, nil)
+
+		ss.playing = true
+		go ss.runGenerator()
+		return true
+
+	case gortsplib.TEARDOWN:
+		return false
+	}
+
+	ss.writeResponse(req, gortsplib.StatusNotImplemented, nil, nil)
+	return true
+}
+
+// setup sets up a track and returns the headers of the response.
+func (ss *fakeSourceSession) setup(req *gortsplib.Request) (gortsplib.Header, error) {
+	if ss.playing {
+		return nil, fmt.Errorf("tracks can't be setup while playing")
+	}
+
+	segment := req.Url.Path
+	if n := strings.LastIndex(segment, "/"); n >= 0 {
+		segment = segment[n+1:]
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(segment, "trackID="), 10, 31)
+	if err != nil || !strings.HasPrefix(segment, "trackID=") || int(id) >= len(ss.fs.codecs) {
+		return nil, fmt.Errorf("invalid track (%s)", segment)
+	}
+	if _, ok := ss.tracks[int(id)]; ok {
+		return nil, fmt.Errorf("track %d has already been setup", id)
+	}
+
+	transport, ok := req.Header["Transport"]
+	if !ok || len(transport) != 1 {
+		return nil, fmt.Errorf("transport header missing")
+	}
+	th := gortsplib.ReadHeaderTransport(strings.Split(transport[0], ",")[0])
+	udp := transportIsUdp(th)
+	if len(ss.tracks) > 0 && udp != ss.udp {
+		return nil, fmt.Errorf("tracks must be setup with the same protocol")
+	}
+
+	t := &fakeSourceTrack{}
+
+	if udp {
+		rtpPort, rtcpPort := th.GetPorts("client_port")
+		if rtpPort == 0 || rtcpPort == 0 {
+			return nil, fmt.Errorf("transport header does not have valid client ports (%s)", transport[0])
+		}
+
+		t.rtpl, err = net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, err
+		}
+		t.rtcpl, err = net.ListenPacket("udp", ":0")
+		if err != nil {
+			t.rtpl.Close()
+			return nil, err
+		}
+		t.rtpAddr = &net.UDPAddr{IP: ss.ip, Port: rtpPort}
+
+		ss.udp = true
+		ss.tracks[int(id)] = t
+
+		return gortsplib.Header{
+			"Transport": []string{strings.Join([]string{
+				"RTP/AVP/UDP",
+				"unicast",
+				fmt.Sprintf("client_port=%d-%d", rtpPort, rtcpPort),
+				fmt.Sprintf("server_port=%d-%d", t.rtpl.LocalAddr().(*net.UDPAddr).Port,
+					t.rtcpl.LocalAddr().(*net.UDPAddr).Port),
+			}, ";")},
+			"Session": []string{"12345678"},
+		}, nil
+	}
+
+	if _, ok := th["RTP/AVP/TCP"]; !ok {
+		return nil, fmt.Errorf("unsupported transport (%s)", transport[0])
+	}
+
+	t.rtpChannel = trackToInterleavedChannel(int(id), _TRACK_FLOW_RTP)
+	t.rtcpChannel = trackToInterleavedChannel(int(id), _TRACK_FLOW_RTCP)
+	rtpChannel, rtcpChannel, hasChannels, err := readInterleaved(th)
+	if err != nil {
+		return nil, err
+	}
+	if hasChannels {
+		t.rtpChannel, t.rtcpChannel = uint8(rtpChannel), uint8(rtcpChannel)
+	}
+
+	ss.tracks[int(id)] = t
+
+	return gortsplib.Header{
+		"Transport": []string{strings.Join([]string{
+			"RTP/AVP/TCP",
+			"unicast",
+			fmt.Sprintf("interleaved=%d-%d", t.rtpChannel, t.rtcpChannel),
+		}, ";")},
+		"Session": []string{"12345678"},
+	}, nil
+}
+
+func (ss *fakeSourceSession) writeRtp(t *fakeSourceTrack, pkt []byte) error {
+	if ss.udp {
+		_, err := t.rtpl.WriteTo(pkt, t.rtpAddr)
+		return err
+	}
+
+	ss.writeMutex.Lock()
+	defer ss.writeMutex.Unlock()
+
+	return ss.conn.WriteInterleavedFrame(&gortsplib.InterleavedFrame{
+		Channel: t.rtpChannel,
+		Content: pkt,
+	})
+}
+
+// runGenerator sends the tracks that have been setup: a H.264 test pattern,
+// whose clock shows the time elapsed since the beginning of the session, and
+// AAC silence.
+func (ss *fakeSourceSession) runGenerator() {
+	h264Packetizers := make(map[int]*rtpH264Packetizer)
+	aacPacketizers := make(map[int]*rtpAacPacketizer)
+	aacTimestamps := make(map[int]uint32)
+
+	for id := range ss.tracks {
+		payloadType := uint8(96 + id)
+		ssrc := uint32(0x10000000 + id)
+
+		switch ss.fs.codecs[id] {
+		case _FAKESOURCE_CODEC_H264:
+			h264Packetizers[id] = &rtpH264Packetizer{payloadType: payloadType, ssrc: ssrc}
+
+		case _FAKESOURCE_CODEC_AAC:
+			aacPacketizers[id] = &rtpAacPacketizer{payloadType: payloadType, ssrc: ssrc}
+		}
+	}
+
+	sps := testPatternSps()
+	pps := testPatternPps()
+
+	ticker := time.NewTicker(time.Second / _TESTPATTERN_FPS)
+	defer ticker.Stop()
+
+	for i := uint32(0); ; i++ {
+		for id, t := range ss.tracks {
+			var pkts [][]byte
+
+			switch ss.fs.codecs[id] {
+			case _FAKESOURCE_CODEC_H264:
+				var nalus [][]byte
+				if frameNum := i % _TESTPATTERN_FPS; frameNum == 0 {
+					elapsed := time.Unix(int64(i/_TESTPATTERN_FPS), 0).UTC()
+					nalus = [][]byte{sps, pps, testPatternIdr((i/_TESTPATTERN_FPS)%2, elapsed)}
+				} else {
+					nalus = [][]byte{testPatternP(frameNum)}
+				}
+				pkts = h264Packetizers[id].packetize(nalus, i*(90000/_TESTPATTERN_FPS))
+
+			case _FAKESOURCE_CODEC_AAC:
+				// send the access units whose samples precede the next video frame
+				due := (i + 1) * (_FAKESOURCE_AAC_SAMPLE_RATE / _TESTPATTERN_FPS)
+				for ts := aacTimestamps[id]; ts+_FAKESOURCE_AAC_FRAME_SIZE <= due; ts += _FAKESOURCE_AAC_FRAME_SIZE {
+					pkts = append(pkts, aacPacketizers[id].packetize(fakeSourceSilence, ts))
+					aacTimestamps[id] = ts + _FAKESOURCE_AAC_FRAME_SIZE
+				}
+			}
+
+			for _, pkt := range pkts {
+				err := ss.writeRtp(t, pkt)
+				if err != nil {
+					ss.log("ERR: %s", err)
+					ss.conn.NetConn().Close()
+					return
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ss.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+// freeTcpPort returns a port on which nothing is listening.
+func freeTcpPort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// TestFakeSourceProxied proxies a fake source and checks that a client
+// receives its RTP packets through the proxy.
+func TestFakeSourceProxied(t *testing.T) {
+	fs, err := newFakeSource("h264,aac")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsl.Close()
+	go fs.serve(fsl)
+
+	port := freeTcpPort(t)
+
+	p, err := newProgramFromConf(&conf{
+		Protocols:          []string{"tcp"},
+		RtspPorts:          []int{port},
+		StreamReadyTimeout: 10 * time.Second,
+		StreamTTL:          10 * time.Second,
+		SourceTimeouts: sourceTimeoutsConf{
+			Describe:    5 * time.Second,
+			Setup:       5 * time.Second,
+			FirstPacket: 5 * time.Second,
+			FrameGap:    5 * time.Second,
+		},
+		SourceUdpPorts: defaultSourceUdpPorts,
+		Streams: map[string]streamConf{
+			"fake": {
+				Url:    "rtsp://" + fsl.Addr().String() + "/",
+				UseTcp: true,
+			},
+		},
+	}, map[streamProtocol]struct{}{
+		_STREAM_PROTOCOL_TCP: {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.run()
+
+	nconn, err := dialRetry(fmt.Sprintf("127.0.0.1:%d", port), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nconn.Close()
+
+	conn := gortsplib.NewConnClient(nconn, 10*time.Second, 5*time.Second)
+
+	ur, err := url.Parse(fmt.Sprintf("rtsp://127.0.0.1:%d/fake", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := conn.WriteRequest(&gortsplib.Request{
+		Method: gortsplib.DESCRIBE,
+		Url:    ur,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != gortsplib.StatusOK {
+		t.Fatalf("DESCRIBE: unexpected status %d", res.StatusCode)
+	}
+
+	setupUr, err := url.Parse(ur.String() + "/trackID=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = conn.WriteRequest(&gortsplib.Request{
+		Method: gortsplib.SETUP,
+		Url:    setupUr,
+		Header: gortsplib.Header{
+			"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != gortsplib.StatusOK {
+		t.Fatalf("SETUP: unexpected status %d", res.StatusCode)
+	}
+
+	res, err = conn.WriteRequest(&gortsplib.Request{
+		Method: gortsplib.PLAY,
+		Url:    ur,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != gortsplib.StatusOK {
+		t.Fatalf("PLAY: unexpected status %d", res.StatusCode)
+	}
+
+	for {
+		frame, err := conn.ReadInterleavedFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Channel != 0 {
+			continue
+		}
+
+		if len(frame.Content) < 12 || frame.Content[0]>>6 != 2 {
+			t.Fatalf("invalid RTP packet: %x", frame.Content)
+		}
+		if pt := frame.Content[1] & 0x7F; pt != 96 {
+			t.Fatalf("unexpected payload type: %d", pt)
+		}
+		return
+	}
+}
+
+// dialRetry connects to an address, waiting until it is listening.
+func dialRetry(address string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		nconn, err := net.Dial("tcp", address)
+		if err == nil || time.Now().After(deadline) {
+			return nconn, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
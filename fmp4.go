@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	_FMP4_SAMPLE_FLAGS_SYNC     = 0x02000000 // sample_depends_on = 2
+	_FMP4_SAMPLE_FLAGS_NON_SYNC = 0x01010000 // sample_depends_on = 1, sample_is_non_sync_sample
+)
+
+// fmp4Track is a track of a fragmented MP4 file.
+type fmp4Track struct {
+	id        int
+	timescale uint32
+	codec     fileCodec
+
+	// H.264
+	sps    []byte
+	pps    []byte
+	width  int
+	height int
+
+	// AAC
+	aacConf *aacConfig
+
+	// Opus
+	channels int
+}
+
+func (t *fmp4Track) audio() bool {
+	return t.codec == _FILE_CODEC_AAC || t.codec == _FILE_CODEC_OPUS
+}
+
+// audioParams returns the sample rate and the channels of an audio track.
+func (t *fmp4Track) audioParams() (int, int) {
+	if t.codec == _FILE_CODEC_OPUS {
+		return _OPUS_CLOCK_RATE, t.channels
+	}
+	return t.aacConf.sampleRate, t.aacConf.channels
+}
+
+// fmp4Sample is a sample of a fragment.
+type fmp4Sample struct {
+	duration uint32
+	cto      int32 // composition time offset
+	sync     bool
+	data     []byte
+}
+
+// fmp4Traf contains the samples of a track in a fragment.
+type fmp4Traf struct {
+	trackId             int
+	baseMediaDecodeTime uint64
+	samples             []*fmp4Sample
+}
+
+// codecs returns the codec of a track in the format of RFC6381, that is used
+// by playlists and manifests.
+func (t *fmp4Track) codecs() string {
+	switch t.codec {
+	case _FILE_CODEC_AAC:
+		return fmt.Sprintf("mp4a.40.%d", t.aacConf.objectType)
+	case _FILE_CODEC_OPUS:
+		return "opus"
+	}
+	return fmt.Sprintf("avc1.%02x%02x%02x", t.sps[1], t.sps[2], t.sps[3])
+}
+
+// mp4Writer writes MP4 boxes.
+type mp4Writer struct {
+	buf []byte
+}
+
+func (w *mp4Writer) u8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *mp4Writer) u16(v uint16) {
+	w.buf = append(w.buf, byte(v>>8), byte(v))
+}
+
+func (w *mp4Writer) u32(v uint32) {
+	w.buf = append(w.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *mp4Writer) u64(v uint64) {
+	w.u32(uint32(v >> 32))
+	w.u32(uint32(v))
+}
+
+func (w *mp4Writer) bytes(v []byte) {
+	w.buf = append(w.buf, v...)
+}
+
+func (w *mp4Writer) zeros(n int) {
+	w.buf = append(w.buf, make([]byte, n)...)
+}
+
+// box writes a box, whose content is written by fn.
+func (w *mp4Writer) box(typ string, fn func()) {
+	start := len(w.buf)
+	w.u32(0)
+	w.bytes([]byte(typ))
+	fn()
+	binary.BigEndian.PutUint32(w.buf[start:], uint32(len(w.buf)-start))
+}
+
+// fullBox writes a box with a version and flags.
+func (w *mp4Writer) fullBox(typ string, version uint8, flags uint32, fn func()) {
+	w.box(typ, func() {
+		w.u32(uint32(version)<<24 | flags)
+		fn()
+	})
+}
+
+// descriptor writes a MPEG-4 descriptor, used by esds.
+func (w *mp4Writer) descriptor(tag uint8, fn func()) {
+	w.u8(tag)
+	start := len(w.buf)
+	w.zeros(4)
+	fn()
+
+	// the size is written in the 4-bytes form, that doesn't depend on the
+	// size itself
+	size := len(w.buf) - start - 4
+	w.buf[start] = 0x80 | byte(size>>21)&0x7f
+	w.buf[start+1] = 0x80 | byte(size>>14)&0x7f
+	w.buf[start+2] = 0x80 | byte(size>>7)&0x7f
+	w.buf[start+3] = byte(size) & 0x7f
+}
+
+func (w *mp4Writer) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
+
+func (w *mp4Writer) sampleEntry(t *fmp4Track) {
+	switch t.codec {
+	case _FILE_CODEC_H264:
+		w.box("avc1", func() {
+			w.zeros(6)
+			w.u16(1) // data_reference_index
+			w.zeros(16)
+			w.u16(uint16(t.width))
+			w.u16(uint16(t.height))
+			w.u32(0x00480000) // horizresolution
+			w.u32(0x00480000) // vertresolution
+			w.u32(0)
+			w.u16(1) // frame_count
+			w.zeros(32)
+			w.u16(0x0018) // depth
+			w.u16(0xffff) // pre_defined
+
+			w.box("avcC", func() {
+				w.u8(1) // configurationVersion
+				w.u8(t.sps[1])
+				w.u8(t.sps[2])
+				w.u8(t.sps[3])
+				w.u8(0xff) // lengthSizeMinusOne = 3
+				w.u8(0xe1) // numOfSequenceParameterSets = 1
+				w.u16(uint16(len(t.sps)))
+				w.bytes(t.sps)
+				w.u8(1) // numOfPictureParameterSets
+				w.u16(uint16(len(t.pps)))
+				w.bytes(t.pps)
+			})
+		})
+
+	case _FILE_CODEC_AAC:
+		w.box("mp4a", func() {
+			w.zeros(6)
+			w.u16(1) // data_reference_index
+			w.zeros(8)
+			w.u16(uint16(t.aacConf.channels))
+			w.u16(16) // samplesize
+			w.zeros(4)
+			w.u32(uint32(t.aacConf.sampleRate) << 16)
+
+			w.fullBox("esds", 0, 0, func() {
+				w.descriptor(0x03, func() { // ES_Descriptor
+					w.u16(uint16(t.id))
+					w.u8(0)
+
+					w.descriptor(0x04, func() { // DecoderConfigDescriptor
+						w.u8(0x40) // objectTypeIndication = MPEG-4 audio
+						w.u8(0x15) // streamType = audio
+						w.zeros(3) // bufferSizeDB
+						w.u32(0)   // maxBitrate
+						w.u32(0)   // avgBitrate
+
+						// DecoderSpecificInfo
+						w.descriptor(0x05, func() {
+							w.bytes(t.aacConf.encode())
+						})
+					})
+
+					w.descriptor(0x06, func() { // SLConfigDescriptor
+						w.u8(0x02)
+					})
+				})
+			})
+		})
+
+	case _FILE_CODEC_OPUS:
+		w.box("Opus", func() {
+			w.zeros(6)
+			w.u16(1) // data_reference_index
+			w.zeros(8)
+			w.u16(uint16(t.channels))
+			w.u16(16) // samplesize
+			w.zeros(4)
+			w.u32(_OPUS_CLOCK_RATE << 16)
+
+			w.box("dOps", func() {
+				w.u8(0) // Version
+				w.u8(uint8(t.channels))
+				w.u16(0) // PreSkip, that is not known
+				w.u32(_OPUS_CLOCK_RATE)
+				w.u16(0) // OutputGain
+				w.u8(0)  // ChannelMappingFamily
+			})
+		})
+	}
+}
+
+// fmp4InitSegment returns the initialization segment of a fragmented MP4
+// file, that contains the description of the tracks.
+func fmp4InitSegment(tracks []*fmp4Track) []byte {
+	w := &mp4Writer{}
+
+	w.box("ftyp", func() {
+		w.bytes([]byte("iso5"))
+		w.u32(512)
+		w.bytes([]byte("iso5iso6mp41"))
+	})
+
+	w.box("moov", func() {
+		w.fullBox("mvhd", 0, 0, func() {
+			w.u32(0)    // creation_time
+			w.u32(0)    // modification_time
+			w.u32(1000) // timescale
+			w.u32(0)    // duration
+			w.u32(0x00010000)
+			w.u16(0x0100)
+			w.zeros(10)
+			w.matrix()
+			w.zeros(24)
+			w.u32(uint32(len(tracks) + 1)) // next_track_ID
+		})
+
+		for _, t := range tracks {
+			t := t
+			w.box("trak", func() {
+				w.fullBox("tkhd", 0, 3, func() {
+					w.u32(0) // creation_time
+					w.u32(0) // modification_time
+					w.u32(uint32(t.id))
+					w.u32(0)
+					w.u32(0) // duration
+					w.zeros(8)
+					w.u16(0) // layer
+					w.u16(0) // alternate_group
+					if t.audio() {
+						w.u16(0x0100)
+					} else {
+						w.u16(0)
+					}
+					w.u16(0)
+					w.matrix()
+					w.u32(uint32(t.width) << 16)
+					w.u32(uint32(t.height) << 16)
+				})
+
+				w.box("mdia", func() {
+					w.fullBox("mdhd", 0, 0, func() {
+						w.u32(0) // creation_time
+						w.u32(0) // modification_time
+						w.u32(t.timescale)
+						w.u32(0)      // duration
+						w.u16(0x55c4) // language = und
+						w.u16(0)
+					})
+
+					w.fullBox("hdlr", 0, 0, func() {
+						w.u32(0)
+						if t.audio() {
+							w.bytes([]byte("soun"))
+						} else {
+							w.bytes([]byte("vide"))
+						}
+						w.zeros(12)
+						w.bytes([]byte("Handler\x00"))
+					})
+
+					w.box("minf", func() {
+						if t.audio() {
+							w.fullBox("smhd", 0, 0, func() {
+								w.zeros(4)
+							})
+						} else {
+							w.fullBox("vmhd", 0, 1, func() {
+								w.zeros(8)
+							})
+						}
+
+						w.box("dinf", func() {
+							w.fullBox("dref", 0, 0, func() {
+								w.u32(1)
+								w.fullBox("url ", 0, 1, func() {})
+							})
+						})
+
+						w.box("stbl", func() {
+							w.fullBox("stsd", 0, 0, func() {
+								w.u32(1)
+								w.sampleEntry(t)
+							})
+							w.fullBox("stts", 0, 0, func() { w.u32(0) })
+							w.fullBox("stsc", 0, 0, func() { w.u32(0) })
+							w.fullBox("stsz", 0, 0, func() { w.u32(0); w.u32(0) })
+							w.fullBox("stco", 0, 0, func() { w.u32(0) })
+						})
+					})
+				})
+			})
+		}
+
+		w.box("mvex", func() {
+			for _, t := range tracks {
+				w.fullBox("trex", 0, 0, func() {
+					w.u32(uint32(t.id))
+					w.u32(1) // default_sample_description_index
+					w.u32(0) // default_sample_duration
+					w.u32(0) // default_sample_size
+					w.u32(0) // default_sample_flags
+				})
+			}
+		})
+	})
+
+	return w.buf
+}
+
+// fmp4Fragment returns a fragment (moof and mdat) that contains the samples
+// of one or more tracks.
+func fmp4Fragment(sequenceNumber uint32, trafs []*fmp4Traf) []byte {
+	w := &mp4Writer{}
+
+	// positions of the data_offset fields, that are filled when the size
+	// of moof is known
+	var dataOffsetPos []int
+
+	w.box("moof", func() {
+		w.fullBox("mfhd", 0, 0, func() {
+			w.u32(sequenceNumber)
+		})
+
+		for _, traf := range trafs {
+			w.box("traf", func() {
+				w.fullBox("tfhd", 0, 0x020000, func() { // default-base-is-moof
+					w.u32(uint32(traf.trackId))
+				})
+
+				w.fullBox("tfdt", 1, 0, func() {
+					w.u64(traf.baseMediaDecodeTime)
+				})
+
+				// data-offset, sample-duration, sample-size, sample-flags,
+				// sample-composition-time-offset
+				w.fullBox("trun", 1, 0x000f01, func() {
+					w.u32(uint32(len(traf.samples)))
+					dataOffsetPos = append(dataOffsetPos, len(w.buf))
+					w.u32(0)
+
+					for _, s := range traf.samples {
+						w.u32(s.duration)
+						w.u32(uint32(len(s.data)))
+						if s.sync {
+							w.u32(_FMP4_SAMPLE_FLAGS_SYNC)
+						} else {
+							w.u32(_FMP4_SAMPLE_FLAGS_NON_SYNC)
+						}
+						w.u32(uint32(s.cto))
+					}
+				})
+			})
+		}
+	})
+
+	offset := len(w.buf) + 8
+	for i, traf := range trafs {
+		binary.BigEndian.PutUint32(w.buf[dataOffsetPos[i]:], uint32(offset))
+		for _, s := range traf.samples {
+			offset += len(s.data)
+		}
+	}
+
+	w.box("mdat", func() {
+		for _, traf := range trafs {
+			for _, s := range traf.samples {
+				w.bytes(s.data)
+			}
+		}
+	})
+
+	return w.buf
+}
@@ -0,0 +1,25 @@
+package main
+
+const _FRAME_SLAB_SIZE = 256 * 1024
+
+// frameSlab copies frames into large shared buffers, in order to avoid an
+// allocation for each frame received from the network. Buffers are never
+// reused, therefore frames can be retained as long as needed.
+type frameSlab struct {
+	buf []byte
+}
+
+func (s *frameSlab) copy(frame []byte) []byte {
+	if len(frame) > len(s.buf) {
+		size := _FRAME_SLAB_SIZE
+		if len(frame) > size {
+			size = len(frame)
+		}
+		s.buf = make([]byte, size)
+	}
+
+	ret := s.buf[:len(frame):len(frame)]
+	copy(ret, frame)
+	s.buf = s.buf[len(frame):]
+	return ret
+}
@@ -0,0 +1,845 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+const (
+	_H264_NALU_NON_IDR = 1
+	_H264_NALU_IDR     = 5
+	_H264_NALU_SPS     = 7
+	_H264_NALU_PPS     = 8
+	_H264_NALU_STAPA   = 24
+	_H264_NALU_FUA     = 28
+
+	// maximum size of the payload of the RTP packets that are generated
+	_RTP_MAX_PAYLOAD_SIZE = 1400
+
+	// limits of the size of repacketized packets
+	_H264_MIN_PACKET_SIZE = 128
+	_H264_MAX_PACKET_SIZE = 65000
+
+	// maximum size of a NAL unit or of an access unit, in order to limit the
+	// memory used by sources that never complete them
+	_H264_MAX_ACCESS_UNIT_SIZE = 8 * 1024 * 1024
+)
+
+// h264BitWriter writes the syntax elements of H.264 bitstreams.
+type h264BitWriter struct {
+	buf  []byte
+	nbit uint
+}
+
+func (w *h264BitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.nbit%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if (v>>uint(i))&1 != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> (w.nbit % 8)
+		}
+		w.nbit++
+	}
+}
+
+func (w *h264BitWriter) writeFlag(v bool) {
+	if v {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+// writeUe writes an unsigned Exp-Golomb code.
+func (w *h264BitWriter) writeUe(v uint32) {
+	x := uint64(v) + 1
+	n := bits.Len64(x)
+	w.writeBits(0, n-1)
+	w.writeBits(x, n)
+}
+
+// writeSe writes a signed Exp-Golomb code.
+func (w *h264BitWriter) writeSe(v int32) {
+	if v > 0 {
+		w.writeUe(uint32(v)*2 - 1)
+	} else {
+		w.writeUe(uint32(-v) * 2)
+	}
+}
+
+// align writes zero bits until the next byte boundary.
+func (w *h264BitWriter) align() {
+	w.nbit = uint(len(w.buf)) * 8
+}
+
+func (w *h264BitWriter) writeBytes(byts []byte) {
+	w.align()
+	w.buf = append(w.buf, byts...)
+	w.nbit = uint(len(w.buf)) * 8
+}
+
+// rbspTrailingBits terminates the RBSP and returns the escaped NAL unit.
+func (w *h264BitWriter) rbspTrailingBits() []byte {
+	w.writeBits(1, 1)
+	w.align()
+	return h264Escape(w.buf)
+}
+
+// h264Escape inserts emulation prevention bytes into a NAL unit.
+func h264Escape(nalu []byte) []byte {
+	ret := make([]byte, 0, len(nalu)+len(nalu)/64)
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b <= 3 {
+			ret = append(ret, 3)
+			zeros = 0
+		}
+		ret = append(ret, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return ret
+}
+
+// rtpH264Packetizer splits access units into RTP packets, as described in
+// RFC6184, with packetization mode 1.
+type rtpH264Packetizer struct {
+	payloadType uint8
+	ssrc        uint32
+	seq         uint16
+}
+
+func (e *rtpH264Packetizer) header(ts uint32, marker bool) []byte {
+	header := make([]byte, 12, 12+_RTP_MAX_PAYLOAD_SIZE)
+	header[0] = 0x80
+	header[1] = e.payloadType
+	if marker {
+		header[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(header[2:], e.seq)
+	binary.BigEndian.PutUint32(header[4:], ts)
+	binary.BigEndian.PutUint32(header[8:], e.ssrc)
+	e.seq++
+	return header
+}
+
+// packetize returns the RTP packets of an access unit.
+func (e *rtpH264Packetizer) packetize(nalus [][]byte, ts uint32) [][]byte {
+	var ret [][]byte
+
+	for i, nalu := range nalus {
+		last := i == len(nalus)-1
+
+		if len(nalu) <= _RTP_MAX_PAYLOAD_SIZE {
+			ret = append(ret, append(e.header(ts, last), nalu...))
+			continue
+		}
+
+		// fragmentation unit
+		indicator := (nalu[0] & 0xe0) | _H264_NALU_FUA
+		typ := nalu[0] & 0x1f
+		rest := nalu[1:]
+		first := true
+
+		for len(rest) > 0 {
+			n := len(rest)
+			if n > _RTP_MAX_PAYLOAD_SIZE-2 {
+				n = _RTP_MAX_PAYLOAD_SIZE - 2
+			}
+			end := n == len(rest)
+
+			fuHeader := typ
+			if first {
+				fuHeader |= 0x80
+			}
+			if end {
+				fuHeader |= 0x40
+			}
+
+			pkt := append(e.header(ts, last && end), indicator, fuHeader)
+			ret = append(ret, append(pkt, rest[:n]...))
+
+			rest = rest[n:]
+			first = false
+		}
+	}
+
+	return ret
+}
+
+// rtpHeaderSize returns the size of the header of a RTP packet, including
+// the CSRCs and the extension.
+func rtpHeaderSize(pkt []byte) (int, bool) {
+	if len(pkt) < 12 {
+		return 0, false
+	}
+
+	n := 12 + int(pkt[0]&0x0f)*4
+	if pkt[0]&0x10 != 0 {
+		if len(pkt) < n+4 {
+			return 0, false
+		}
+		n += 4 + int(binary.BigEndian.Uint16(pkt[n+2:]))*4
+	}
+	if len(pkt) < n {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// rtpPayload returns the payload of a RTP packet, without the padding.
+func rtpPayload(pkt []byte) ([]byte, bool) {
+	n, ok := rtpHeaderSize(pkt)
+	if !ok {
+		return nil, false
+	}
+
+	// the last byte of the padding contains its size
+	end := len(pkt)
+	if pkt[0]&0x20 != 0 {
+		if end == n {
+			return nil, false
+		}
+		padding := int(pkt[end-1])
+		if padding == 0 || padding > end-n {
+			return nil, false
+		}
+		end -= padding
+	}
+
+	return pkt[n:end], true
+}
+
+func h264IsKeyNalu(typ byte) bool {
+	return typ == _H264_NALU_IDR || typ == _H264_NALU_SPS || typ == _H264_NALU_PPS
+}
+
+// rtpH264IsNonReference tells whether a RTP packet contains a part of a NAL
+// unit that is not used to decode other frames, that is, whose nal_ref_idc is
+// zero. The header of aggregation and fragmentation units carries the highest
+// nal_ref_idc of their NAL units.
+func rtpH264IsNonReference(pkt []byte) bool {
+	payload, ok := rtpPayload(pkt)
+	if !ok || len(payload) < 1 {
+		return false
+	}
+	return payload[0]&0x60 == 0
+}
+
+// rtpH264IsKeyFrame tells whether a RTP packet contains a part of a key
+// frame or of its parameters.
+func rtpH264IsKeyFrame(pkt []byte) bool {
+	payload, ok := rtpPayload(pkt)
+	if !ok || len(payload) < 1 {
+		return false
+	}
+
+	switch typ := payload[0] & 0x1f; typ {
+	case _H264_NALU_STAPA:
+		for rest := payload[1:]; len(rest) >= 3; {
+			size := int(binary.BigEndian.Uint16(rest))
+			if h264IsKeyNalu(rest[2] & 0x1f) {
+				return true
+			}
+			if len(rest) < 2+size {
+				break
+			}
+			rest = rest[2+size:]
+		}
+		return false
+
+	case _H264_NALU_FUA:
+		return len(payload) >= 2 && h264IsKeyNalu(payload[1]&0x1f)
+
+	default:
+		return h264IsKeyNalu(typ)
+	}
+}
+
+// rtpH264IsKeyFrameStart tells whether a RTP packet starts a key frame or
+// its parameters.
+func rtpH264IsKeyFrameStart(pkt []byte) bool {
+	payload, ok := rtpPayload(pkt)
+	if !ok || len(payload) < 1 {
+		return false
+	}
+
+	switch typ := payload[0] & 0x1f; typ {
+	case _H264_NALU_STAPA:
+		return len(payload) >= 4 && h264IsKeyNalu(payload[3]&0x1f)
+
+	case _H264_NALU_FUA:
+		return len(payload) >= 2 && payload[1]&0x80 != 0 && h264IsKeyNalu(payload[1]&0x1f)
+
+	default:
+		return h264IsKeyNalu(typ)
+	}
+}
+
+// h264AccessUnit is an access unit reassembled from RTP packets.
+type h264AccessUnit struct {
+	ts    uint32
+	nalus [][]byte
+}
+
+// rtpH264Depacketizer reassembles access units from RTP packets, as
+// described in RFC6184. Single NAL units, STAP-A and FU-A are supported.
+// NAL units are copied, since packets can be reused by the caller.
+type rtpH264Depacketizer struct {
+	nalus     [][]byte
+	size      int
+	ts        uint32
+	fragments []byte
+	seq       uint16
+	seqValid  bool
+}
+
+// decode adds a RTP packet and returns the access units that are complete.
+// An access unit is complete when its last packet has the marker bit set or
+// when a packet with a different timestamp is received.
+func (d *rtpH264Depacketizer) decode(pkt []byte) []h264AccessUnit {
+	payload, ok := rtpPayload(pkt)
+	if !ok || len(payload) < 1 {
+		return nil
+	}
+
+	seq := binary.BigEndian.Uint16(pkt[2:])
+	lost := d.seqValid && seq != d.seq+1
+	d.seq = seq
+	d.seqValid = true
+
+	ts := binary.BigEndian.Uint32(pkt[4:])
+	marker := pkt[1]&0x80 != 0
+
+	var ret []h264AccessUnit
+	if ts != d.ts {
+		if len(d.nalus) > 0 {
+			ret = append(ret, h264AccessUnit{ts: d.ts, nalus: d.nalus})
+		}
+		d.nalus = nil
+		d.size = 0
+	}
+	d.ts = ts
+
+	switch typ := payload[0] & 0x1f; typ {
+	case _H264_NALU_STAPA:
+		for rest := payload[1:]; len(rest) >= 2; {
+			size := int(binary.BigEndian.Uint16(rest))
+			if size == 0 || len(rest) < 2+size {
+				break
+			}
+			d.addNalu(append([]byte(nil), rest[2:2+size]...))
+			rest = rest[2+size:]
+		}
+
+	case _H264_NALU_FUA:
+		if len(payload) < 2 {
+			break
+		}
+
+		start := payload[1]&0x80 != 0
+		end := payload[1]&0x40 != 0
+
+		if start {
+			d.fragments = append([]byte{(payload[0] & 0xe0) | (payload[1] & 0x1f)}, payload[2:]...)
+		} else if d.fragments != nil && !lost {
+			d.fragments = append(d.fragments, payload[2:]...)
+		} else {
+			// fragments of a NAL unit whose start was lost are discarded
+			d.fragments = nil
+			break
+		}
+
+		if len(d.fragments) > _H264_MAX_ACCESS_UNIT_SIZE {
+			d.fragments = nil
+			break
+		}
+
+		if end {
+			d.addNalu(d.fragments)
+			d.fragments = nil
+		}
+
+	default:
+		d.addNalu(append([]byte(nil), payload...))
+	}
+
+	if marker {
+		if len(d.nalus) > 0 {
+			ret = append(ret, h264AccessUnit{ts: d.ts, nalus: d.nalus})
+		}
+		d.nalus = nil
+		d.size = 0
+	}
+
+	return ret
+}
+
+// addNalu adds a NAL unit to the current access unit. Access units that are
+// too big are discarded until their end.
+func (d *rtpH264Depacketizer) addNalu(nalu []byte) {
+	d.size += len(nalu)
+	if d.size > _H264_MAX_ACCESS_UNIT_SIZE {
+		d.nalus = nil
+		return
+	}
+	d.nalus = append(d.nalus, nalu)
+}
+
+// h264BitReader reads the syntax elements of H.264 bitstreams.
+type h264BitReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *h264BitReader) readBits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.buf)*8 {
+			return 0, fmt.Errorf("not enough bits")
+		}
+		v = v<<1 | uint32(r.buf[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return v, nil
+}
+
+// readUe reads an unsigned Exp-Golomb code.
+func (r *h264BitReader) readUe() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, fmt.Errorf("invalid Exp-Golomb code")
+		}
+	}
+
+	v, err := r.readBits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<uint(zeros) - 1) + v, nil
+}
+
+func (r *h264BitReader) readSe() (int32, error) {
+	v, err := r.readUe()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int32((v + 1) / 2), nil
+	}
+	return -int32(v / 2), nil
+}
+
+// h264Unescape removes emulation prevention bytes from a NAL unit.
+func h264Unescape(nalu []byte) []byte {
+	ret := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		ret = append(ret, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return ret
+}
+
+// h264SpsResolution returns the width and the height of the pictures
+// described by a SPS.
+func h264SpsResolution(sps []byte) (int, int, error) {
+	if len(sps) < 4 {
+		return 0, 0, fmt.Errorf("invalid SPS")
+	}
+
+	r := &h264BitReader{buf: h264Unescape(sps)[4:]}
+	profileIdc := sps[1]
+
+	skipUe := func(n int) error {
+		for i := 0; i < n; i++ {
+			_, err := r.readUe()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	_, err := r.readUe() // seq_parameter_set_id
+	if err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormatIdc := uint32(1)
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc, err = r.readUe()
+		if err != nil {
+			return 0, 0, err
+		}
+		if chromaFormatIdc == 3 {
+			r.readBits(1) // separate_colour_plane_flag
+		}
+
+		err = skipUe(2) // bit_depth_luma_minus8, bit_depth_chroma_minus8
+		if err != nil {
+			return 0, 0, err
+		}
+		r.readBits(1) // qpprime_y_zero_transform_bypass_flag
+
+		scalingMatrixPresent, err := r.readBits(1)
+		if err != nil {
+			return 0, 0, err
+		}
+		if scalingMatrixPresent == 1 {
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.readBits(1)
+				if err != nil {
+					return 0, 0, err
+				}
+				if present == 0 {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, err := r.readSe()
+						if err != nil {
+							return 0, 0, err
+						}
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	err = skipUe(1) // log2_max_frame_num_minus4
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pocType, err := r.readUe()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		err = skipUe(1) // log2_max_pic_order_cnt_lsb_minus4
+		if err != nil {
+			return 0, 0, err
+		}
+
+	case 1:
+		r.readBits(1) // delta_pic_order_always_zero_flag
+		_, err = r.readSe()
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = r.readSe()
+		if err != nil {
+			return 0, 0, err
+		}
+		n, err := r.readUe()
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := uint32(0); i < n; i++ {
+			_, err = r.readSe()
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	err = skipUe(1) // max_num_ref_frames
+	if err != nil {
+		return 0, 0, err
+	}
+	r.readBits(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs, err := r.readUe()
+	if err != nil {
+		return 0, 0, err
+	}
+	heightMapUnits, err := r.readUe()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	frameMbsOnly, err := r.readBits(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		r.readBits(1) // mb_adaptive_frame_field_flag
+	}
+	r.readBits(1) // direct_8x8_inference_flag
+
+	width := int(widthMbs+1) * 16
+	height := int(2-frameMbsOnly) * int(heightMapUnits+1) * 16
+
+	cropping, err := r.readBits(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		var crop [4]uint32
+		for i := range crop {
+			crop[i], err = r.readUe()
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		cropUnitX, cropUnitY := 1, int(2-frameMbsOnly)
+		if chromaFormatIdc == 1 || chromaFormatIdc == 2 {
+			cropUnitX = 2
+		}
+		if chromaFormatIdc == 1 {
+			cropUnitY *= 2
+		}
+
+		width -= int(crop[0]+crop[1]) * cropUnitX
+		height -= int(crop[2]+crop[3]) * cropUnitY
+	}
+
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid SPS")
+	}
+	return width, height, nil
+}
+
+// rtpH264Repacketizer converts the RTP packets of a H.264 track to a given
+// packetization mode and maximum packet size, as described in RFC6184.
+// NAL units are never merged across packets, such that the timing of the
+// source is preserved. Sequence numbers are rewritten, but gaps are kept,
+// such that losses can still be detected by clients. In mode 0, NAL units
+// can't be fragmented, therefore they are sent whatever their size.
+type rtpH264Repacketizer struct {
+	mode          int
+	maxPacketSize int
+	fragments     []byte
+	seq           uint16
+	seqValid      bool
+	outSeq        uint16
+}
+
+func newRtpH264Repacketizer(mode int, maxPacketSize int) *rtpH264Repacketizer {
+	return &rtpH264Repacketizer{
+		mode:          mode,
+		maxPacketSize: maxPacketSize,
+	}
+}
+
+// repacketize adds a RTP packet and returns the packets that replace it.
+func (r *rtpH264Repacketizer) repacketize(pkt []byte) [][]byte {
+	payload, ok := rtpPayload(pkt)
+	if !ok || len(payload) < 1 {
+		return nil
+	}
+
+	// padding is removed
+	n, _ := rtpHeaderSize(pkt)
+	header := append([]byte(nil), pkt[:n]...)
+	header[0] &^= 0x20
+
+	// gaps are kept, while packets that arrive after the following ones
+	// are discarded, since their sequence numbers have already been used
+	seq := binary.BigEndian.Uint16(pkt[2:])
+	diff := int16(seq - r.seq)
+	if r.seqValid && diff <= 0 {
+		return nil
+	}
+	lost := r.seqValid && diff > 1
+	if lost {
+		r.outSeq += uint16(diff - 1)
+	}
+	r.seq = seq
+	r.seqValid = true
+
+	marker := pkt[1]&0x80 != 0
+
+	var nalus [][]byte
+
+	switch typ := payload[0] & 0x1f; typ {
+	case _H264_NALU_STAPA:
+		for rest := payload[1:]; len(rest) >= 2; {
+			size := int(binary.BigEndian.Uint16(rest))
+			if size == 0 || len(rest) < 2+size {
+				break
+			}
+			nalus = append(nalus, rest[2:2+size])
+			rest = rest[2+size:]
+		}
+
+	case _H264_NALU_FUA:
+		if len(payload) < 2 {
+			break
+		}
+
+		start := payload[1]&0x80 != 0
+		end := payload[1]&0x40 != 0
+
+		if start {
+			r.fragments = append([]byte{(payload[0] & 0xe0) | (payload[1] & 0x1f)}, payload[2:]...)
+		} else if r.fragments != nil && !lost {
+			r.fragments = append(r.fragments, payload[2:]...)
+		} else {
+			// fragments of a NAL unit whose start was lost are discarded
+			r.fragments = nil
+			break
+		}
+
+		if len(r.fragments) > _H264_MAX_ACCESS_UNIT_SIZE {
+			r.fragments = nil
+			break
+		}
+
+		if end {
+			nalus = append(nalus, r.fragments)
+			r.fragments = nil
+		}
+
+	default:
+		nalus = append(nalus, payload)
+	}
+
+	return r.packetize(header, nalus, marker)
+}
+
+func (r *rtpH264Repacketizer) packet(header []byte, payload ...[]byte) []byte {
+	pkt := append([]byte(nil), header...)
+	pkt[1] &^= 0x80
+	binary.BigEndian.PutUint16(pkt[2:], r.outSeq)
+	r.outSeq++
+	for _, p := range payload {
+		pkt = append(pkt, p...)
+	}
+	return pkt
+}
+
+// packetize splits or aggregates NAL units received in the same packet.
+func (r *rtpH264Repacketizer) packetize(header []byte, nalus [][]byte, marker bool) [][]byte {
+	var ret [][]byte
+	maxPayloadSize := r.maxPacketSize - len(header)
+
+	// NAL units that are waiting to be aggregated
+	var group [][]byte
+	groupSize := 1
+
+	flush := func() {
+		switch len(group) {
+		case 0:
+			return
+
+		case 1:
+			ret = append(ret, r.packet(header, group[0]))
+
+		default:
+			// the indicator carries the highest NRI and the F bit of any
+			// of the aggregated NAL units
+			indicator := byte(_H264_NALU_STAPA)
+			for _, nalu := range group {
+				if nalu[0]&0x60 > indicator&0x60 {
+					indicator = (indicator &^ 0x60) | (nalu[0] & 0x60)
+				}
+				indicator |= nalu[0] & 0x80
+			}
+
+			payload := [][]byte{{indicator}}
+			for _, nalu := range group {
+				payload = append(payload, []byte{byte(len(nalu) >> 8), byte(len(nalu))}, nalu)
+			}
+			ret = append(ret, r.packet(header, payload...))
+		}
+
+		group = nil
+		groupSize = 1
+	}
+
+	for _, nalu := range nalus {
+		if len(nalu) < 1 {
+			continue
+		}
+
+		if r.mode == 0 {
+			ret = append(ret, r.packet(header, nalu))
+			continue
+		}
+
+		if len(nalu) > maxPayloadSize {
+			flush()
+
+			// fragmentation unit
+			indicator := (nalu[0] & 0xe0) | _H264_NALU_FUA
+			typ := nalu[0] & 0x1f
+			rest := nalu[1:]
+			first := true
+
+			for len(rest) > 0 {
+				n := len(rest)
+				if n > maxPayloadSize-2 {
+					n = maxPayloadSize - 2
+				}
+
+				fuHeader := typ
+				if first {
+					fuHeader |= 0x80
+				}
+				if n == len(rest) {
+					fuHeader |= 0x40
+				}
+
+				ret = append(ret, r.packet(header, []byte{indicator, fuHeader}, rest[:n]))
+				rest = rest[n:]
+				first = false
+			}
+			continue
+		}
+
+		if groupSize+2+len(nalu) > maxPayloadSize {
+			flush()
+		}
+		group = append(group, nalu)
+		groupSize += 2 + len(nalu)
+	}
+	flush()
+
+	if marker && len(ret) > 0 {
+		ret[len(ret)-1][1] |= 0x80
+	}
+
+	return ret
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// h264TestPacket returns a RTP packet with the given payload, followed by
+// the given amount of padding.
+func h264TestPacket(seq uint16, ts uint32, marker bool, payload []byte, padding int) []byte {
+	pkt := make([]byte, 12, 12+len(payload)+padding)
+	pkt[0] = 0x80
+	if padding > 0 {
+		pkt[0] |= 0x20
+	}
+	pkt[1] = 96
+	if marker {
+		pkt[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(pkt[2:], seq)
+	binary.BigEndian.PutUint32(pkt[4:], ts)
+	pkt = append(pkt, payload...)
+	if padding > 0 {
+		pkt = append(pkt, make([]byte, padding-1)...)
+		pkt = append(pkt, byte(padding))
+	}
+	return pkt
+}
+
+func TestRtpPayloadPadding(t *testing.T) {
+	payload, ok := rtpPayload(h264TestPacket(0, 0, false, []byte{1, 2, 3}, 4))
+	if !ok || !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Errorf("unexpected payload: %v %x", ok, payload)
+	}
+
+	pkt := h264TestPacket(0, 0, false, []byte{1, 2, 3}, 4)
+	pkt[len(pkt)-1] = 8
+	if _, ok := rtpPayload(pkt); ok {
+		t.Errorf("padding bigger than the payload accepted")
+	}
+
+	pkt[len(pkt)-1] = 0
+	if _, ok := rtpPayload(pkt); ok {
+		t.Errorf("empty padding accepted")
+	}
+}
+
+func TestRtpH264DepacketizerPadding(t *testing.T) {
+	d := &rtpH264Depacketizer{}
+	aus := d.decode(h264TestPacket(0, 0, true, []byte{_H264_NALU_IDR, 1, 2}, 3))
+	if len(aus) != 1 || len(aus[0].nalus) != 1 || !bytes.Equal(aus[0].nalus[0], []byte{_H264_NALU_IDR, 1, 2}) {
+		t.Errorf("unexpected access units: %v", aus)
+	}
+}
+
+func TestRtpH264DepacketizerTooBig(t *testing.T) {
+	d := &rtpH264Depacketizer{}
+	chunk := make([]byte, 60000)
+	seq := uint16(0)
+
+	// a NAL unit that never ends
+	fu := append([]byte{_H264_NALU_FUA, 0x80 | _H264_NALU_IDR}, chunk...)
+	for i := 0; i <= _H264_MAX_ACCESS_UNIT_SIZE/len(chunk); i++ {
+		d.decode(h264TestPacket(seq, 0, false, fu, 0))
+		fu[1] = _H264_NALU_IDR
+		seq++
+	}
+	if d.fragments != nil {
+		t.Errorf("fragments not discarded (%d bytes)", len(d.fragments))
+	}
+
+	// an access unit that never ends
+	nalu := append([]byte{_H264_NALU_NON_IDR}, chunk...)
+	for i := 0; i <= _H264_MAX_ACCESS_UNIT_SIZE/len(chunk); i++ {
+		d.decode(h264TestPacket(seq, 0, false, nalu, 0))
+		seq++
+	}
+	if d.nalus != nil {
+		t.Errorf("access unit not discarded (%d NAL units)", len(d.nalus))
+	}
+
+	// the rest of the access unit is discarded, the following one is not
+	aus := d.decode(h264TestPacket(seq, 0, true, nalu, 0))
+	if len(aus) != 0 {
+		t.Errorf("end of a discarded access unit returned")
+	}
+	aus = d.decode(h264TestPacket(seq+1, 3000, true, []byte{_H264_NALU_IDR, 1}, 0))
+	if len(aus) != 1 || aus[0].ts != 3000 {
+		t.Errorf("unexpected access units: %v", aus)
+	}
+}
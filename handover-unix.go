@@ -0,0 +1,124 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// time within which the new instance must be ready
+const _HANDOVER_READY_TIMEOUT = 30 * time.Second
+
+// runHandover starts a new instance of the program, with the same
+// arguments, when SIGUSR2 is received. The new instance inherits the
+// listening sockets, while this one keeps serving its clients and exits
+// when they are gone.
+func (p *program) runHandover() {
+	chanSignal := make(chan os.Signal, 1)
+	signal.Notify(chanSignal, syscall.SIGUSR2)
+
+	for range chanSignal {
+		// the new instance reads the state file when it starts, therefore
+		// this one stops writing it before, such that the file is not
+		// overwritten with an outdated state
+		p.mutex.Lock()
+		p.handedOver = true
+		p.mutex.Unlock()
+
+		err := p.handover()
+		if err != nil {
+			p.logHandover("ERR: %s", err)
+
+			p.mutex.Lock()
+			p.handedOver = false
+			p.mutex.Unlock()
+
+			// store changes made during the attempt
+			p.saveState()
+			continue
+		}
+
+		signal.Stop(chanSignal)
+		go p.exitWhenIdle()
+		return
+	}
+}
+
+func (p *program) handover() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	readyr, readyw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyr.Close()
+
+	// descriptors 0, 1 and 2 are stdin, stdout and stderr
+	files, entries, err := p.sockets.files(3)
+	if err != nil {
+		readyw.Close()
+		return err
+	}
+	entries = append(entries, _HANDOVER_READY_KEY+"="+strconv.FormatInt(int64(3+len(files)), 10))
+	files = append(files, readyw)
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, _HANDOVER_ENV+"=") {
+			env = append(env, e)
+		}
+	}
+	env = append(env, _HANDOVER_ENV+"="+strings.Join(entries, ","))
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	err = cmd.Start()
+	for _, f := range files {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	p.logHandover("new instance started with pid %d, waiting until it is ready", cmd.Process.Pid)
+
+	// the pipe is closed without data when the new instance exits
+	readyr.SetReadDeadline(time.Now().Add(_HANDOVER_READY_TIMEOUT))
+	buf := make([]byte, 1)
+	n, _ := readyr.Read(buf)
+	if n != 1 {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("the new instance didn't become ready")
+	}
+
+	// release the resources of the new instance when it exits
+	go cmd.Wait()
+
+	p.logHandover("new instance is ready, stopping accepting connections")
+	p.sockets.closeListeners()
+
+	// new sessions of existing connections are refused as well
+	p.mutex.Lock()
+	p.draining = true
+	p.listening = false
+	p.mutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+// runHandover does nothing, since sockets can't be passed to new processes
+// on Windows.
+func (p *program) runHandover() {
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// environment variable through which a previous instance passes its
+// listening sockets, in the format key=fd,key=fd
+const _HANDOVER_ENV = "RTSP_SIMPLE_PROXY_HANDOVER"
+
+// key of the pipe through which the new instance tells the previous one
+// that it is ready
+const _HANDOVER_READY_KEY = "ready"
+
+// handoverSocket is a listening socket that can be passed to a new
+// instance.
+type handoverSocket struct {
+	key  string
+	file func() (*os.File, error)
+
+	// closes the socket when the instance stops accepting connections.
+	// UDP sockets are not closed, since they are shared with the new
+	// instance until the previous one exits.
+	close func()
+}
+
+// handoverSockets contains the sockets inherited from a previous instance
+// and the sockets that are passed to the next one, during zero-downtime
+// upgrades.
+type handoverSockets struct {
+	mutex     sync.Mutex
+	inherited map[string]*os.File
+	own       []handoverSocket
+}
+
+func newHandoverSockets() (*handoverSockets, error) {
+	h := &handoverSockets{
+		inherited: make(map[string]*os.File),
+	}
+
+	env := os.Getenv(_HANDOVER_ENV)
+	if env == "" {
+		return h, nil
+	}
+	os.Unsetenv(_HANDOVER_ENV)
+
+	for _, entry := range strings.Split(env, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid handover entry: %s", entry)
+		}
+
+		fd, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid handover entry: %s", entry)
+		}
+
+		h.inherited[parts[0]] = os.NewFile(uintptr(fd), parts[0])
+	}
+
+	log.Printf("[handover] received sockets from the previous instance")
+	return h, nil
+}
+
+// take returns the inherited socket with the given key, if any.
+func (h *handoverSockets) take(key string) (*os.File, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	f, ok := h.inherited[key]
+	if ok {
+		delete(h.inherited, key)
+	}
+	return f, ok
+}
+
+func (h *handoverSockets) add(s handoverSocket) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.own = append(h.own, s)
+}
+
+// listenTcp returns a TCP listener on the given port, inherited or new.
+func (h *handoverSockets) listenTcp(port int) (*net.TCPListener, error) {
+	key := "tcp:" + strconv.FormatInt(int64(port), 10)
+
+	var netl *net.TCPListener
+	if f, ok := h.take(key); ok {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var isTcp bool
+		netl, isTcp = l.(*net.TCPListener)
+		if !isTcp {
+			l.Close()
+			return nil, fmt.Errorf("inherited socket %s is not a TCP listener", key)
+		}
+
+	} else {
+		var err error
+		netl, err = net.ListenTCP("tcp", &net.TCPAddr{
+			Port: port,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.add(handoverSocket{
+		key:   key,
+		file:  netl.File,
+		close: func() { netl.Close() },
+	})
+	return netl, nil
+}
+
+// listenUdp returns a UDP socket on the given port, inherited or new.
+func (h *handoverSockets) listenUdp(port int) (*net.UDPConn, error) {
+	key := "udp:" + strconv.FormatInt(int64(port), 10)
+
+	var nconn *net.UDPConn
+	if f, ok := h.take(key); ok {
+		c, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var isUdp bool
+		nconn, isUdp = c.(*net.UDPConn)
+		if !isUdp {
+			c.Close()
+			return nil, fmt.Errorf("inherited socket %s is not a UDP socket", key)
+		}
+
+	} else {
+		var err error
+		nconn, err = net.ListenUDP("udp", &net.UDPAddr{
+			Port: port,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.add(handoverSocket{
+		key:   key,
+		file:  nconn.File,
+		close: func() {},
+	})
+	return nconn, nil
+}
+
+// listenUnix returns a Unix listener on the given path, inherited or new.
+func (h *handoverSockets) listenUnix(path string) (*net.UnixListener, error) {
+	key := "unix:" + path
+
+	var netl *net.UnixListener
+	if f, ok := h.take(key); ok {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var isUnix bool
+		netl, isUnix = l.(*net.UnixListener)
+		if !isUnix {
+			l.Close()
+			return nil, fmt.Errorf("inherited socket %s is not a Unix listener", key)
+		}
+
+	} else {
+		// remove the socket left by a previous instance
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+
+		var err error
+		netl, err = net.ListenUnix("unix", &net.UnixAddr{
+			Name: path,
+			Net:  "unix",
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.add(handoverSocket{
+		key:  key,
+		file: netl.File,
+		close: func() {
+			// the socket file is used by the new instance
+			netl.SetUnlinkOnClose(false)
+			netl.Close()
+		},
+	})
+	return netl, nil
+}
+
+// notifyReady tells the previous instance, if any, that this instance is
+// accepting connections.
+func (h *handoverSockets) notifyReady() {
+	f, ok := h.take(_HANDOVER_READY_KEY)
+	if !ok {
+		return
+	}
+
+	f.Write([]byte{1})
+	f.Close()
+
+	// sockets that are not used anymore, for instance because the
+	// configuration has changed
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for key, f := range h.inherited {
+		f.Close()
+		delete(h.inherited, key)
+	}
+}
+
+// files returns duplicates of the sockets, and the value of the
+// environment variable that describes them to the new instance, whose
+// first descriptor is firstFd.
+func (h *handoverSockets) files(firstFd int) ([]*os.File, []string, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var files []*os.File
+	var entries []string
+
+	for _, s := range h.own {
+		f, err := s.file()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("unable to duplicate socket %s: %s", s.key, err)
+		}
+
+		entries = append(entries, s.key+"="+strconv.FormatInt(int64(firstFd+len(files)), 10))
+		files = append(files, f)
+	}
+
+	return files, entries, nil
+}
+
+// closeListeners stops accepting connections, that are accepted by the new
+// instance.
+func (h *handoverSockets) closeListeners() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, s := range h.own {
+		s.close()
+	}
+}
+
+func (p *program) logHandover(format string, args ...interface{}) {
+	log.Printf("[handover] "+format, args...)
+}
+
+// exitWhenIdle exits when the clients of an instance that has been replaced
+// are gone, or when the handover timeout expires.
+func (p *program) exitWhenIdle() {
+	start := time.Now()
+
+	t := time.NewTicker(1 * time.Second)
+	defer t.Stop()
+
+	for range t.C {
+		p.mutex.RLock()
+		n := len(p.clients)
+		p.mutex.RUnlock()
+
+		if n == 0 {
+			p.logHandover("no more clients, exiting")
+			os.Exit(0)
+		}
+
+		if p.conf.HandoverTimeout > 0 && time.Since(start) >= p.conf.HandoverTimeout {
+			p.logHandover("handover timeout expired, exiting with %d clients", n)
+			os.Exit(0)
+		}
+	}
+}
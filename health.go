@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// criteria that can be required by the readiness endpoint
+const (
+	_READY_LISTENERS    = "listeners"
+	_READY_NOT_DRAINING = "not-draining"
+	_READY_ANY_STREAM   = "any-stream"
+	_READY_ALL_STREAMS  = "all-streams"
+)
+
+func parseReadyCriteria(vals []string) ([]string, error) {
+	var ret []string
+	for _, v := range vals {
+		v = strings.TrimSpace(v)
+		switch v {
+		case "":
+			continue
+
+		case _READY_LISTENERS, _READY_NOT_DRAINING, _READY_ANY_STREAM, _READY_ALL_STREAMS:
+			ret = append(ret, v)
+
+		default:
+			return nil, fmt.Errorf("unsupported ready criterion: %s", v)
+		}
+	}
+	return ret, nil
+}
+
+// readyCheck is the result of a readiness criterion.
+type readyCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// staticStreamsReady returns the number of static streams that are ready
+// and the number of static streams that are expected to run. It must be
+// called with the mutex locked.
+func (p *program) staticStreamsReady() (int, int) {
+	ready := 0
+	total := 0
+
+	for name, sc := range p.conf.Streams {
+		if sc.Vod || len(sc.QueryPassthrough) > 0 || sc.Disabled {
+			continue
+		}
+		if _, ok := p.onDemand[name]; ok {
+			continue
+		}
+		total++
+
+		if s, ok := p.streams[name]; ok && s.state == _STREAM_STATE_READY {
+			ready++
+		}
+	}
+
+	return ready, total
+}
+
+// readyChecks evaluates the readiness criteria. It must be called with the
+// mutex locked.
+func (p *program) readyChecks() []readyCheck {
+	checks := []readyCheck{}
+
+	for _, name := range p.conf.ReadyCriteria {
+		c := readyCheck{Name: name}
+
+		switch name {
+		case _READY_LISTENERS:
+			c.Ok = p.listening
+			if c.Ok {
+				c.Detail = "listeners are accepting connections"
+			} else {
+				c.Detail = "listeners are not accepting connections"
+			}
+
+		case _READY_NOT_DRAINING:
+			c.Ok = !p.draining
+			if c.Ok {
+				c.Detail = "drain mode is disabled"
+			} else {
+				c.Detail = "drain mode is enabled"
+			}
+
+		case _READY_ANY_STREAM:
+			ready, total := p.staticStreamsReady()
+			c.Ok = ready > 0
+			c.Detail = fmt.Sprintf("%d of %d static streams are ready", ready, total)
+
+		case _READY_ALL_STREAMS:
+			ready, total := p.staticStreamsReady()
+			c.Ok = ready == total
+			c.Detail = fmt.Sprintf("%d of %d static streams are ready", ready, total)
+		}
+
+		checks = append(checks, c)
+	}
+
+	return checks
+}
+
+// handleHealthz tells whether the process is responsive, regardless of
+// streams, such that liveness probes do not restart it during outages of
+// sources. The mutex is acquired in order to detect deadlocks.
+func (l *serverHttpListener) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	l.p.mutex.RLock()
+	l.p.mutex.RUnlock()
+
+	l.writeJson(w, struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+// handleReady tells whether the instance should receive clients, according
+// to the criteria set with --ready-criteria.
+func (l *serverHttpListener) handleReady(w http.ResponseWriter, r *http.Request) {
+	l.p.mutex.RLock()
+	checks := l.p.readyChecks()
+	l.p.mutex.RUnlock()
+
+	ready := true
+	for _, c := range checks {
+		if !c.Ok {
+			ready = false
+		}
+	}
+
+	if !ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	l.writeJson(w, struct {
+		Ready    bool         `json:"ready"`
+		Criteria []readyCheck `json:"criteria"`
+	}{ready, checks})
+}
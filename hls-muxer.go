@@ -0,0 +1,722 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gortc.io/sdp"
+)
+
+const (
+	// number of complete segments listed in the playlist
+	_HLS_SEGMENT_COUNT = 7
+
+	// number of complete segments whose parts are listed in the playlist
+	_HLS_PART_SEGMENT_COUNT = 2
+
+	// maximum number of samples of a track waiting to be written, in case
+	// the track that drives segmentation stops
+	_HLS_MAX_PENDING_SAMPLES = 1000
+
+	_AAC_SAMPLES_PER_AU = 1024
+)
+
+// hlsTsToDuration converts a timestamp into a duration, without overflows.
+func hlsTsToDuration(v int64, timescale uint32) time.Duration {
+	ts := int64(timescale)
+	return time.Duration(v/ts)*time.Second + time.Duration(v%ts)*time.Second/time.Duration(ts)
+}
+
+// hlsDurationToTs converts a duration into a timestamp, without overflows.
+func hlsDurationToTs(d time.Duration, timescale uint32) int64 {
+	ts := int64(timescale)
+	return int64(d/time.Second)*ts + int64(d%time.Second)*ts/int64(time.Second)
+}
+
+// hlsPart is a partial segment, that contains a single fragment.
+type hlsPart struct {
+	id          int
+	duration    time.Duration
+	independent bool
+	content     []byte
+}
+
+// hlsSegment is a segment, made of the parts that have been generated while
+// it was the current segment.
+type hlsSegment struct {
+	id        int
+	startTime time.Time
+	duration  time.Duration
+	parts     []*hlsPart
+
+	// samples of each track, by track id, used by DASH, that serves tracks
+	// separately
+	trafs map[int]*fmp4Traf
+}
+
+func (s *hlsSegment) content() []byte {
+	var buf bytes.Buffer
+	for _, p := range s.parts {
+		buf.Write(p.content)
+	}
+	return buf.Bytes()
+}
+
+type hlsSample struct {
+	dts  int64
+	pts  int64
+	sync bool
+	data []byte
+}
+
+// rtpAudioDepacketizer extracts the access units of an audio track from RTP
+// packets.
+type rtpAudioDepacketizer interface {
+	decode(pkt []byte) ([][]byte, uint32, error)
+}
+
+type hlsMuxerTrack struct {
+	fmp4Track
+	h264         *rtpH264Depacketizer
+	depacketizer rtpAudioDepacketizer
+
+	started      bool
+	lastTs       uint32
+	pts          int64 // presentation time of the last sample
+	dts          int64 // decode time of the last sample
+	lastDuration int64
+	pending      []*hlsSample
+}
+
+// defaultDuration returns the duration of a sample whose successor hasn't
+// been received yet.
+func (t *hlsMuxerTrack) defaultDuration(s *hlsSample) int64 {
+	switch t.codec {
+	case _FILE_CODEC_AAC:
+		return _AAC_SAMPLES_PER_AU
+	case _FILE_CODEC_OPUS:
+		return int64(opusPacketDuration(s.data))
+	}
+	if t.lastDuration > 0 {
+		return t.lastDuration
+	}
+	return int64(t.timescale) / 25
+}
+
+// hlsMuxer converts the RTP packets of a stream into a Low-Latency HLS
+// playlist, made of fMP4 segments divided into parts. Segments start with a
+// key frame of the first video track, or of the first audio track in case
+// there's no video. The same segments are served with MPEG-DASH.
+type hlsMuxer struct {
+	segmentDuration time.Duration
+	partDuration    time.Duration
+
+	mutex        sync.Mutex
+	tracks       []*hlsMuxerTrack
+	tracksBySdp  map[int]*hlsMuxerTrack
+	primary      *hlsMuxerTrack
+	init         []byte
+	startTime    time.Time
+	segments     []*hlsSegment
+	current      *hlsSegment
+	parts        map[int]*hlsPart
+	nextPartId   int
+	fragmentSeq  uint32
+	segmentStart int64 // decode time of the primary track
+	partStart    int64 // decode time of the primary track
+
+	// closed and replaced each time a part is generated
+	changed chan struct{}
+}
+
+// newHlsMuxer allocates a hlsMuxer for the H.264, AAC and Opus tracks of a
+// SDP. Other tracks, like G.711 and G.722 ones, that can't be put into fMP4
+// segments played by browsers, are ignored.
+func newHlsMuxer(msg *sdp.Message, segmentDuration time.Duration, partDuration time.Duration) (*hlsMuxer, error) {
+	m := &hlsMuxer{
+		segmentDuration: segmentDuration,
+		partDuration:    partDuration,
+		tracksBySdp:     make(map[int]*hlsMuxerTrack),
+		parts:           make(map[int]*hlsPart),
+		fragmentSeq:     1,
+		changed:         make(chan struct{}),
+	}
+
+	for i, media := range msg.Medias {
+		fmtp := mediaFmtp(media)
+
+		t := &hlsMuxerTrack{
+			fmp4Track: fmp4Track{
+				id:        len(m.tracks) + 1,
+				timescale: uint32(mediaClockRate(media)),
+			},
+		}
+		if t.timescale == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(mediaEncoding(media)) {
+		case "H264":
+			t.codec = _FILE_CODEC_H264
+			t.h264 = &rtpH264Depacketizer{}
+
+			// parameters are also read from the stream, in case they are
+			// not in the SDP
+			if v, ok := fmtp["sprop-parameter-sets"]; ok {
+				for _, ps := range strings.Split(v, ",") {
+					nalu, err := base64.StdEncoding.DecodeString(ps)
+					if err == nil && len(nalu) > 0 {
+						t.setParameter(nalu)
+					}
+				}
+			}
+
+		case "MPEG4-GENERIC":
+			config, err := hex.DecodeString(fmtp["config"])
+			if err != nil {
+				return nil, fmt.Errorf("track %d: invalid AAC config", i)
+			}
+
+			t.aacConf = &aacConfig{}
+			err = t.aacConf.decode(config)
+			if err != nil {
+				return nil, fmt.Errorf("track %d: %s", i, err)
+			}
+
+			t.codec = _FILE_CODEC_AAC
+			t.depacketizer, err = newRtpAacDepacketizer(fmtp)
+			if err != nil {
+				return nil, fmt.Errorf("track %d: %s", i, err)
+			}
+
+		case "MP4A-LATM":
+			if v, ok := fmtp["cpresent"]; ok && v != "0" {
+				return nil, fmt.Errorf("track %d: in-band LATM configuration is not supported", i)
+			}
+
+			config, err := hex.DecodeString(fmtp["config"])
+			if err != nil {
+				return nil, fmt.Errorf("track %d: invalid LATM config", i)
+			}
+
+			t.aacConf, err = latmStreamMuxConfig(config)
+			if err != nil {
+				return nil, fmt.Errorf("track %d: %s", i, err)
+			}
+
+			t.codec = _FILE_CODEC_AAC
+			t.depacketizer = &rtpLatmDepacketizer{}
+
+		case "OPUS":
+			t.codec = _FILE_CODEC_OPUS
+			t.channels = 1
+			if fmtp["sprop-stereo"] == "1" {
+				t.channels = 2
+			}
+			t.depacketizer = &rtpOpusDepacketizer{}
+
+		default:
+			continue
+		}
+
+		m.tracks = append(m.tracks, t)
+		m.tracksBySdp[i] = t
+
+		if m.primary == nil || (m.primary.codec != _FILE_CODEC_H264 && t.codec == _FILE_CODEC_H264) {
+			m.primary = t
+		}
+	}
+
+	if len(m.tracks) == 0 {
+		return nil, fmt.Errorf("the stream doesn't contain any H.264, AAC or Opus track")
+	}
+
+	return m, nil
+}
+
+// setParameter stores a SPS or a PPS.
+func (t *hlsMuxerTrack) setParameter(nalu []byte) {
+	switch nalu[0] & 0x1f {
+	case _H264_NALU_SPS:
+		if t.sps != nil {
+			return
+		}
+
+		width, height, err := h264SpsResolution(nalu)
+		if err != nil {
+			return
+		}
+		t.sps = append([]byte(nil), nalu...)
+		t.width = width
+		t.height = height
+
+	case _H264_NALU_PPS:
+		if t.pps == nil {
+			t.pps = append([]byte(nil), nalu...)
+		}
+	}
+}
+
+// tryInit generates the initialization segment, once the parameters of all
+// tracks are known. It must be called with the mutex locked.
+func (m *hlsMuxer) tryInit() bool {
+	if m.init != nil {
+		return true
+	}
+
+	var tracks []*fmp4Track
+	for _, t := range m.tracks {
+		if t.codec == _FILE_CODEC_H264 && (t.sps == nil || t.pps == nil) {
+			return false
+		}
+		tracks = append(tracks, &t.fmp4Track)
+	}
+
+	m.init = fmp4InitSegment(tracks)
+	return true
+}
+
+// writeRtp adds a RTP packet of a track.
+func (m *hlsMuxer) writeRtp(sdpId int, pkt []byte, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.tracksBySdp[sdpId]
+	if !ok {
+		return
+	}
+
+	switch t.codec {
+	case _FILE_CODEC_H264:
+		for _, au := range t.h264.decode(pkt) {
+			m.writeH264(t, au, now)
+		}
+
+	case _FILE_CODEC_AAC, _FILE_CODEC_OPUS:
+		aus, ts, err := t.depacketizer.decode(pkt)
+		if err != nil {
+			return
+		}
+		for i, au := range aus {
+			m.writeSample(t, ts+uint32(i*_AAC_SAMPLES_PER_AU), au, true, now)
+		}
+	}
+}
+
+func (m *hlsMuxer) writeH264(t *hlsMuxerTrack, au h264AccessUnit, now time.Time) {
+	var data []byte
+	key := false
+
+	for _, nalu := range au.nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & 0x1f {
+		case _H264_NALU_SPS, _H264_NALU_PPS:
+			t.setParameter(nalu)
+
+		case _H264_NALU_IDR:
+			key = true
+
+		case 9: // access unit delimiter
+			continue
+		}
+
+		data = append(data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		data = append(data, nalu...)
+	}
+
+	if data != nil {
+		m.writeSample(t, au.ts, data, key, now)
+	}
+}
+
+// writeSample adds a sample to a track. Parts and segments are generated
+// when a sample of the primary track is received.
+func (m *hlsMuxer) writeSample(t *hlsMuxerTrack, ts uint32, data []byte, key bool, now time.Time) {
+	if !m.tryInit() {
+		return
+	}
+
+	// tracks are aligned with the time at which their first sample has been
+	// received
+	if !t.started {
+		if m.startTime.IsZero() {
+			m.startTime = now
+		}
+		t.started = true
+		t.lastTs = ts
+		t.pts = hlsDurationToTs(now.Sub(m.startTime), t.timescale)
+		t.dts = t.pts - 1
+
+	} else {
+		t.pts += int64(int32(ts - t.lastTs))
+		t.lastTs = ts
+	}
+
+	// RTP timestamps are presentation timestamps. Decode timestamps must
+	// increase, therefore frames in the past are shifted forward
+	dts := t.pts
+	if dts <= t.dts {
+		dts = t.dts + 1
+	}
+
+	sample := &hlsSample{
+		dts:  dts,
+		pts:  t.pts,
+		sync: key,
+		data: data,
+	}
+
+	if t == m.primary {
+		if m.current == nil {
+			// the first segment starts with a key frame
+			if !key {
+				return
+			}
+
+			m.current = &hlsSegment{
+				startTime: m.startTime.Add(hlsTsToDuration(dts, t.timescale)),
+				trafs:     make(map[int]*fmp4Traf),
+			}
+			m.segmentStart = dts
+			m.partStart = dts
+
+		} else {
+			partElapsed := dts - m.partStart
+			partTarget := hlsDurationToTs(m.partDuration, t.timescale)
+
+			switch {
+			case key && dts-m.segmentStart >= hlsDurationToTs(m.segmentDuration, t.timescale):
+				m.flushPart(dts, true)
+
+			// parts can't be longer than the target, therefore they are
+			// closed when the next sample would exceed it
+			case partElapsed >= partTarget || partElapsed+(dts-t.dts) > partTarget:
+				m.flushPart(dts, false)
+			}
+		}
+
+	} else if m.current == nil {
+		return
+	}
+
+	if len(t.pending) > 0 {
+		t.lastDuration = dts - t.dts
+	}
+	t.dts = dts
+
+	if len(t.pending) >= _HLS_MAX_PENDING_SAMPLES {
+		t.pending = t.pending[1:]
+	}
+	t.pending = append(t.pending, sample)
+}
+
+// flushPart writes the pending samples into a part, that ends at the given
+// decode time of the primary track. It must be called with the mutex locked.
+func (m *hlsMuxer) flushPart(end int64, closeSegment bool) {
+	var trafs []*fmp4Traf
+	independent := false
+
+	for _, t := range m.tracks {
+		var samples []*hlsSample
+		if t == m.primary {
+			samples = t.pending
+			t.pending = nil
+			independent = len(samples) > 0 && samples[0].sync
+
+		} else {
+			limit := end * int64(t.timescale) / int64(m.primary.timescale)
+			n := 0
+			for n < len(t.pending) && t.pending[n].dts < limit {
+				n++
+			}
+			samples = t.pending[:n]
+			t.pending = t.pending[n:]
+		}
+
+		if len(samples) == 0 {
+			continue
+		}
+
+		traf := &fmp4Traf{
+			trackId:             t.id,
+			baseMediaDecodeTime: uint64(samples[0].dts),
+		}
+
+		for i, s := range samples {
+			var duration int64
+			switch {
+			case i+1 < len(samples):
+				duration = samples[i+1].dts - s.dts
+			case t == m.primary:
+				duration = end - s.dts
+			case len(t.pending) > 0:
+				duration = t.pending[0].dts - s.dts
+			default:
+				duration = t.defaultDuration(s)
+			}
+
+			traf.samples = append(traf.samples, &fmp4Sample{
+				duration: uint32(duration),
+				cto:      int32(s.pts - s.dts),
+				sync:     s.sync,
+				data:     s.data,
+			})
+		}
+
+		trafs = append(trafs, traf)
+
+		if st, ok := m.current.trafs[t.id]; ok {
+			st.samples = append(st.samples, traf.samples...)
+		} else {
+			m.current.trafs[t.id] = &fmp4Traf{
+				trackId:             traf.trackId,
+				baseMediaDecodeTime: traf.baseMediaDecodeTime,
+				samples:             append([]*fmp4Sample(nil), traf.samples...),
+			}
+		}
+	}
+
+	part := &hlsPart{
+		id:          m.nextPartId,
+		duration:    hlsTsToDuration(end-m.partStart, m.primary.timescale),
+		independent: independent,
+		content:     fmp4Fragment(m.fragmentSeq, trafs),
+	}
+	m.nextPartId++
+	m.fragmentSeq++
+
+	m.current.parts = append(m.current.parts, part)
+	m.current.duration += part.duration
+	m.parts[part.id] = part
+	m.partStart = end
+
+	if closeSegment {
+		m.segments = append(m.segments, m.current)
+		if len(m.segments) > _HLS_SEGMENT_COUNT {
+			for _, p := range m.segments[0].parts {
+				delete(m.parts, p.id)
+			}
+			m.segments = m.segments[1:]
+		}
+
+		m.current = &hlsSegment{
+			id:        m.current.id + 1,
+			startTime: m.startTime.Add(hlsTsToDuration(end, m.primary.timescale)),
+			trafs:     make(map[int]*fmp4Traf),
+		}
+		m.segmentStart = end
+	}
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// targetDuration returns the target duration of the playlist, that must be
+// greater or equal than the duration of every segment. It must be called
+// with the mutex locked.
+func (m *hlsMuxer) targetDuration() int {
+	max := m.segmentDuration
+	for _, s := range m.segments {
+		if s.duration > max {
+			max = s.duration
+		}
+	}
+	return int(math.Ceil(max.Seconds()))
+}
+
+// blockTimeout returns the maximum duration of blocking requests.
+func (m *hlsMuxer) blockTimeout() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return 3 * time.Duration(m.targetDuration()) * time.Second
+}
+
+// wait waits until a condition is true, or until the timeout expires. The
+// condition is evaluated with the mutex locked.
+func (m *hlsMuxer) wait(cond func() bool, timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		m.mutex.Lock()
+		ok := cond()
+		changed := m.changed
+		m.mutex.Unlock()
+
+		if ok {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-t.C:
+			return false
+		}
+	}
+}
+
+// hasPart tells whether a part of a segment has been generated, or whether
+// the segment is complete. It must be called with the mutex locked.
+func (m *hlsMuxer) hasPart(msn int, part int) bool {
+	if m.current == nil {
+		return false
+	}
+	if m.current.id > msn {
+		return true
+	}
+	return m.current.id == msn && part >= 0 && len(m.current.parts) > part
+}
+
+// playlist returns the media playlist. When msn is not negative, it blocks
+// until the segment msn, or its part with index part, is available, as
+// requested by LL-HLS blocking playlist reloads.
+func (m *hlsMuxer) playlist(msn int, part int) ([]byte, error) {
+	timeout := m.blockTimeout()
+
+	// the playlist is published once it contains a complete segment
+	if !m.wait(func() bool { return len(m.segments) > 0 }, timeout) {
+		return nil, fmt.Errorf("the playlist is not ready yet")
+	}
+
+	if msn >= 0 {
+		m.mutex.Lock()
+		tooFar := msn > m.current.id+2
+		m.mutex.Unlock()
+		if tooFar {
+			return nil, fmt.Errorf("the requested segment is too far in the future")
+		}
+
+		// on timeout, the current playlist is returned
+		m.wait(func() bool { return m.hasPart(msn, part) }, timeout)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	partDuration := m.partDuration.Seconds()
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n" +
+		"#EXT-X-VERSION:9\n" +
+		"#EXT-X-TARGETDURATION:" + strconv.Itoa(m.targetDuration()) + "\n" +
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=" +
+		strconv.FormatFloat(partDuration*3, 'f', 5, 64) + "\n" +
+		"#EXT-X-PART-INF:PART-TARGET=" + strconv.FormatFloat(partDuration, 'f', 5, 64) + "\n" +
+		"#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(m.segments[0].id) + "\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\"\n")
+
+	writeParts := func(s *hlsSegment) {
+		for _, p := range s.parts {
+			buf.WriteString("#EXT-X-PART:DURATION=" + strconv.FormatFloat(p.duration.Seconds(), 'f', 5, 64) +
+				",URI=\"part" + strconv.Itoa(p.id) + ".mp4\"")
+			if p.independent {
+				buf.WriteString(",INDEPENDENT=YES")
+			}
+			buf.WriteString("\n")
+		}
+	}
+
+	for i, s := range m.segments {
+		buf.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + s.startTime.UTC().Format("2006-01-02T15:04:05.000Z07:00") + "\n")
+		if i >= len(m.segments)-_HLS_PART_SEGMENT_COUNT {
+			writeParts(s)
+		}
+		buf.WriteString("#EXTINF:" + strconv.FormatFloat(s.duration.Seconds(), 'f', 5, 64) + ",\n" +
+			"seg" + strconv.Itoa(s.id) + ".mp4\n")
+	}
+
+	if len(m.current.parts) > 0 {
+		buf.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + m.current.startTime.UTC().Format("2006-01-02T15:04:05.000Z07:00") + "\n")
+		writeParts(m.current)
+	}
+
+	buf.WriteString("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part" + strconv.Itoa(m.nextPartId) + ".mp4\"\n")
+
+	return buf.Bytes(), nil
+}
+
+// livePart returns the id of the first part of the current segment, from
+// which a client can start decoding the stream with the lowest latency. It
+// blocks until the first segment starts.
+func (m *hlsMuxer) livePart() (int, bool) {
+	ok := m.wait(func() bool { return m.current != nil }, m.blockTimeout())
+	if !ok {
+		return 0, false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// when the segment doesn't have any part yet, its first part is the next
+	// one
+	if len(m.current.parts) == 0 {
+		return m.nextPartId, true
+	}
+	return m.current.parts[0].id, true
+}
+
+// mimeType returns the MIME type of segments, including codecs, as required
+// by Media Source Extensions. It must be called after the initialization
+// segment has been generated.
+func (m *hlsMuxer) mimeType() string {
+	typ := "audio/mp4"
+	var codecs []string
+	for _, t := range m.tracks {
+		if !t.audio() {
+			typ = "video/mp4"
+		}
+		codecs = append(codecs, t.codecs())
+	}
+	return typ + "; codecs=\"" + strings.Join(codecs, ",") + "\""
+}
+
+// initSegment returns the initialization segment.
+func (m *hlsMuxer) initSegment() ([]byte, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.init, m.init != nil
+}
+
+// segment returns the content of a complete segment.
+func (m *hlsMuxer) segment(id int) ([]byte, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, s := range m.segments {
+		if s.id == id {
+			return s.content(), true
+		}
+	}
+	return nil, false
+}
+
+// part returns the content of a part. The next part, that is advertised
+// with a preload hint, is returned as soon as it is generated.
+func (m *hlsMuxer) part(id int) ([]byte, bool) {
+	m.mutex.Lock()
+	next := m.nextPartId
+	m.mutex.Unlock()
+
+	if id == next {
+		m.wait(func() bool { return m.nextPartId > id }, m.blockTimeout())
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	p, ok := m.parts[id]
+	if !ok {
+		return nil, false
+	}
+	return p.content, true
+}
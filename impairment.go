@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parsePercentage parses a percentage, like "2%" or "2", into a fraction.
+func parsePercentage(v string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "%"), 64)
+	if err != nil || f < 0 || f > 100 {
+		return 0, fmt.Errorf("invalid percentage: %s", v)
+	}
+	return f / 100, nil
+}
+
+// networkImpairment simulates a lossy network with jitter between the proxy
+// and its clients, in order to test players without a WAN emulator. It
+// must not be used in production.
+type networkImpairment struct {
+	p      *program
+	loss   float64 // fraction of dropped frames
+	jitter time.Duration
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func newNetworkImpairment(p *program) *networkImpairment {
+	ni := &networkImpairment{
+		p:      p,
+		loss:   p.conf.SimulateLoss,
+		jitter: p.conf.SimulateJitter,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	ni.log("WARNING: simulating a loss of %.2f%% and a jitter of %s towards clients",
+		ni.loss*100, ni.jitter)
+
+	return ni
+}
+
+func (ni *networkImpairment) log(format string, args ...interface{}) {
+	log.Printf("[impairment] "+format, args...)
+}
+
+// apply tells whether a frame is lost, and otherwise how much it is delayed.
+func (ni *networkImpairment) apply() (bool, time.Duration) {
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+
+	if ni.loss > 0 && ni.rand.Float64() < ni.loss {
+		return true, 0
+	}
+	if ni.jitter > 0 {
+		return false, time.Duration(ni.rand.Int63n(int64(ni.jitter) + 1))
+	}
+	return false, 0
+}
+
+// writeClientFrame sends a frame to a client through the simulated network.
+// Delayed frames can overtake the following ones, like on a real network.
+func (ni *networkImpairment) writeClientFrame(sub streamSubscriber, id int, flow trackFlow, frame []byte) {
+	lost, delay := ni.apply()
+	if lost {
+		return
+	}
+
+	if delay == 0 {
+		ni.p.sendClientFrame(sub, id, flow, frame)
+		return
+	}
+
+	// frames can be reused by the caller once forwarded
+	frame = append([]byte(nil), frame...)
+	time.AfterFunc(delay, func() {
+		ni.p.sendClientFrame(sub, id, flow, frame)
+	})
+}
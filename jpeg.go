@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	_JPEG_MARKER_SOI = 0xd8
+	_JPEG_MARKER_EOI = 0xd9
+	_JPEG_MARKER_SOF = 0xc0
+	_JPEG_MARKER_DHT = 0xc4
+	_JPEG_MARKER_DQT = 0xdb
+	_JPEG_MARKER_DRI = 0xdd
+	_JPEG_MARKER_SOS = 0xda
+
+	// maximum size of a frame, in order to limit the memory used by sources
+	// that never complete frames
+	_JPEG_MAX_FRAME_SIZE = 8 * 1024 * 1024
+)
+
+// quantization tables and huffman tables of RFC2435, Appendix A and B
+var jpegLumaQuantizer = [64]byte{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+var jpegChromaQuantizer = [64]byte{
+	17, 18, 24, 47, 99, 99, 99, 99,
+	18, 21, 26, 66, 99, 99, 99, 99,
+	24, 26, 56, 99, 99, 99, 99, 99,
+	47, 66, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+}
+
+var jpegLumDcCodelens = []byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}
+
+var jpegLumDcSymbols = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+
+var jpegLumAcCodelens = []byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d}
+
+var jpegLumAcSymbols = []byte{
+	0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+	0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+	0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+	0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+	0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+	0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+	0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+	0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+	0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+	0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+	0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+	0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+	0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+	0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+	0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+	0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+	0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+	0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+	0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+	0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+	0xf9, 0xfa,
+}
+
+var jpegChmDcCodelens = []byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0}
+
+var jpegChmDcSymbols = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+
+var jpegChmAcCodelens = []byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77}
+
+var jpegChmAcSymbols = []byte{
+	0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+	0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+	0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+	0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+	0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+	0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+	0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+	0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+	0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+	0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+	0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+	0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+	0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+	0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+	0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+	0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+	0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+	0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+	0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+	0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+	0xf9, 0xfa,
+}
+
+// jpegQuantizationTables returns the tables that correspond to a Q factor
+// between 1 and 99, as described in RFC2435.
+func jpegQuantizationTables(q int) []byte {
+	if q < 1 {
+		q = 1
+	} else if q > 99 {
+		q = 99
+	}
+
+	factor := 200 - q*2
+	if q < 50 {
+		factor = 5000 / q
+	}
+
+	ret := make([]byte, 128)
+	for i := 0; i < 64; i++ {
+		for j, tbl := range [][64]byte{jpegLumaQuantizer, jpegChromaQuantizer} {
+			v := (int(tbl[i])*factor + 50) / 100
+			if v < 1 {
+				v = 1
+			} else if v > 255 {
+				v = 255
+			}
+			ret[j*64+i] = byte(v)
+		}
+	}
+	return ret
+}
+
+// jpegHeaders returns the headers of a frame whose entropy-coded data has
+// been received via RTP, as described in RFC2435.
+func jpegHeaders(typ byte, width int, height int, qtables []byte, restartInterval uint16) []byte {
+	var buf []byte
+
+	marker := func(m byte, content []byte) {
+		buf = append(buf, 0xff, m, byte((len(content)+2)>>8), byte(len(content)+2))
+		buf = append(buf, content...)
+	}
+
+	buf = append(buf, 0xff, _JPEG_MARKER_SOI)
+
+	// 8-bit tables, 0 for luma and 1 for chroma
+	var dqt []byte
+	for i := 0; i*64+64 <= len(qtables) && i < 2; i++ {
+		dqt = append(dqt, byte(i))
+		dqt = append(dqt, qtables[i*64:i*64+64]...)
+	}
+	marker(_JPEG_MARKER_DQT, dqt)
+
+	if restartInterval != 0 {
+		marker(_JPEG_MARKER_DRI, []byte{byte(restartInterval >> 8), byte(restartInterval)})
+	}
+
+	// type 0 is YUV 4:2:2, type 1 is YUV 4:2:0
+	lumaSampling := byte(0x21)
+	if typ&0x3f == 1 {
+		lumaSampling = 0x22
+	}
+
+	// chroma uses the luma table when a single table is present
+	chromaTable := byte(1)
+	if len(qtables) < 128 {
+		chromaTable = 0
+	}
+
+	marker(_JPEG_MARKER_SOF, []byte{
+		8, // precision
+		byte(height >> 8), byte(height),
+		byte(width >> 8), byte(width),
+		3, // components
+		0, lumaSampling, 0,
+		1, 0x11, chromaTable,
+		2, 0x11, chromaTable,
+	})
+
+	for _, t := range []struct {
+		class    byte
+		codelens []byte
+		symbols  []byte
+	}{
+		{0x00, jpegLumDcCodelens, jpegLumDcSymbols},
+		{0x10, jpegLumAcCodelens, jpegLumAcSymbols},
+		{0x01, jpegChmDcCodelens, jpegChmDcSymbols},
+		{0x11, jpegChmAcCodelens, jpegChmAcSymbols},
+	} {
+		dht := append([]byte{t.class}, t.codelens...)
+		marker(_JPEG_MARKER_DHT, append(dht, t.symbols...))
+	}
+
+	marker(_JPEG_MARKER_SOS, []byte{
+		3,       // components
+		0, 0x00, // luma uses tables 0
+		1, 0x11, // chroma uses tables 1
+		2, 0x11,
+		0, 63, 0, // spectral selection and successive approximation
+	})
+
+	return buf
+}
+
+// rtpJpegDepacketizer reassembles JPEG frames from RTP packets, as described
+// in RFC2435.
+type rtpJpegDepacketizer struct {
+	// tables of Q factors between 128 and 255, that are sent in band only in
+	// the first packet of a frame and may be omitted afterwards
+	qtables map[byte][]byte
+
+	header   []byte
+	data     []byte
+	ts       uint32
+	offset   uint32
+	seq      uint16
+	seqValid bool
+}
+
+// decode adds a RTP packet and returns a frame when it is complete.
+func (d *rtpJpegDepacketizer) decode(pkt []byte) ([]byte, error) {
+	payload, ok := rtpPayload(pkt)
+	if !ok || len(payload) < 8 {
+		return nil, fmt.Errorf("invalid RTP packet")
+	}
+
+	seq := binary.BigEndian.Uint16(pkt[2:])
+	ts := binary.BigEndian.Uint32(pkt[4:])
+	marker := (pkt[1] & 0x80) != 0
+
+	// frames with missing packets are discarded
+	lost := d.seqValid && seq != d.seq+1
+	d.seq = seq
+	d.seqValid = true
+
+	offset := uint32(payload[1])<<16 | uint32(payload[2])<<8 | uint32(payload[3])
+	typ := payload[4]
+	q := payload[5]
+	width := int(payload[6]) * 8
+	height := int(payload[7]) * 8
+	payload = payload[8:]
+
+	if typ&0x3f > 1 {
+		return nil, fmt.Errorf("unsupported JPEG type %d", typ)
+	}
+
+	var restartInterval uint16
+	if typ >= 64 {
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("invalid restart marker header")
+		}
+		restartInterval = binary.BigEndian.Uint16(payload)
+		payload = payload[4:]
+	}
+
+	if offset == 0 {
+		d.header = nil
+		d.data = nil
+
+		var qtables []byte
+		if q >= 128 {
+			if len(payload) >= 4 && payload[0] == 0 {
+				length := int(binary.BigEndian.Uint16(payload[2:]))
+				if len(payload) < 4+length {
+					return nil, fmt.Errorf("invalid quantization table header")
+				}
+
+				// a table for luma and optionally a table for chroma
+				if length != 0 && length != 64 && length != 128 {
+					return nil, fmt.Errorf("invalid quantization table length %d", length)
+				}
+
+				// tables with 16-bit precision are not supported
+				if length > 0 {
+					if payload[1] != 0 {
+						return nil, fmt.Errorf("unsupported quantization table precision")
+					}
+					if d.qtables == nil {
+						d.qtables = make(map[byte][]byte)
+					}
+					d.qtables[q] = append([]byte(nil), payload[4:4+length]...)
+				}
+				payload = payload[4+length:]
+			}
+
+			qtables = d.qtables[q]
+			if qtables == nil {
+				return nil, fmt.Errorf("quantization tables of Q %d not received", q)
+			}
+
+		} else {
+			qtables = jpegQuantizationTables(int(q))
+		}
+
+		d.header = jpegHeaders(typ, width, height, qtables, restartInterval)
+		d.ts = ts
+
+	} else if d.header == nil || lost || ts != d.ts || offset != d.offset {
+		// the beginning of the frame or a packet is missing
+		d.header = nil
+		d.data = nil
+		return nil, nil
+	}
+
+	d.data = append(d.data, payload...)
+	d.offset = offset + uint32(len(payload))
+
+	if len(d.data) > _JPEG_MAX_FRAME_SIZE {
+		d.header = nil
+		d.data = nil
+		return nil, fmt.Errorf("frame too big")
+	}
+
+	if !marker {
+		return nil, nil
+	}
+
+	frame := make([]byte, 0, len(d.header)+len(d.data)+2)
+	frame = append(frame, d.header...)
+	frame = append(frame, d.data...)
+	frame = append(frame, 0xff, _JPEG_MARKER_EOI)
+
+	d.header = nil
+	d.data = nil
+	return frame, nil
+}
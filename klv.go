@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	// KLV uses the clock of video, to which it is aligned (RFC6597)
+	_KLV_CLOCK_RATE = 90000
+
+	_TS_DESCRIPTOR_REGISTRATION = 0x05
+	_TS_DESCRIPTOR_METADATA     = 0x26
+)
+
+// tsIsKlv tells whether the descriptors of an elementary stream identify a
+// KLV stream, by the KLVA registration or metadata format identifier
+// (MISB ST 1402).
+func tsIsKlv(descriptors []byte) bool {
+	for len(descriptors) >= 2 {
+		tag := descriptors[0]
+		l := int(descriptors[1])
+		if 2+l > len(descriptors) {
+			return false
+		}
+		data := descriptors[2 : 2+l]
+
+		switch tag {
+		case _TS_DESCRIPTOR_REGISTRATION:
+			if bytes.HasPrefix(data, []byte("KLVA")) {
+				return true
+			}
+
+		case _TS_DESCRIPTOR_METADATA:
+			if bytes.Contains(data, []byte("KLVA")) {
+				return true
+			}
+		}
+
+		descriptors = descriptors[2+l:]
+	}
+	return false
+}
+
+// tsKlvUnwrapCells returns the KLV data contained into the metadata access
+// unit cells of synchronous metadata streams (ISO 13818-1, 2.12.4).
+func tsKlvUnwrapCells(payload []byte) []byte {
+	var ret []byte
+	for len(payload) >= 5 {
+		l := int(binary.BigEndian.Uint16(payload[3:]))
+		if 5+l > len(payload) {
+			break
+		}
+		ret = append(ret, payload[5:5+l]...)
+		payload = payload[5+l:]
+	}
+	return ret
+}
+
+// rtpKlvPacketizer puts KLV units into RTP packets, as described in RFC6597.
+// Units bigger than the maximum payload size are split into multiple
+// packets, and the marker is set on the last packet of each unit.
+type rtpKlvPacketizer struct {
+	payloadType uint8
+	ssrc        uint32
+	seq         uint16
+}
+
+// packetize returns the RTP packets of a KLV unit.
+func (e *rtpKlvPacketizer) packetize(unit []byte, ts uint32) [][]byte {
+	var ret [][]byte
+
+	for len(unit) > 0 {
+		n := len(unit)
+		if n > _RTP_MAX_PAYLOAD_SIZE {
+			n = _RTP_MAX_PAYLOAD_SIZE
+		}
+
+		pkt := make([]byte, 12+n)
+		pkt[0] = 0x80
+		pkt[1] = e.payloadType
+		if n == len(unit) {
+			pkt[1] |= 0x80
+		}
+		binary.BigEndian.PutUint16(pkt[2:], e.seq)
+		binary.BigEndian.PutUint32(pkt[4:], ts)
+		binary.BigEndian.PutUint32(pkt[8:], e.ssrc)
+		e.seq++
+		copy(pkt[12:], unit[:n])
+
+		ret = append(ret, pkt)
+		unit = unit[n:]
+	}
+
+	return ret
+}
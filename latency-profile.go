@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// profiles that trade latency for resilience to network issues
+const (
+	_LATENCY_PROFILE_LOWEST    = "lowest"
+	_LATENCY_PROFILE_BALANCED  = "balanced"
+	_LATENCY_PROFILE_RESILIENT = "resilient"
+)
+
+// latencyProfile is a set of buffering parameters that are tuned together.
+type latencyProfile struct {
+	// number of RTP packets of UDP sources that are held in order to fix
+	// their order. It must be a power of two; 0 disables reordering
+	reorderDepth int
+
+	// maximum time during which packets that follow a missing one are
+	// held, such that they are not held while the source is idle
+	reorderHold time.Duration
+
+	// number of frames that are queued for each TCP client. 0 means that
+	// the source waits for each client
+	clientQueue int
+
+	// frames are dropped, instead of waiting, when the queue of a client
+	// is full
+	dropOnFullQueue bool
+
+	// clients receive video starting from a key frame
+	waitKeyFrame bool
+}
+
+// when a profile is not set, buffering is the one of previous versions
+var latencyProfiles = map[string]latencyProfile{
+	"": {},
+	_LATENCY_PROFILE_LOWEST: {
+		clientQueue:     32,
+		dropOnFullQueue: true,
+	},
+	_LATENCY_PROFILE_BALANCED: {
+		reorderDepth: 16,
+		reorderHold:  50 * time.Millisecond,
+		clientQueue:  256,
+		waitKeyFrame: true,
+	},
+	_LATENCY_PROFILE_RESILIENT: {
+		reorderDepth: 128,
+		reorderHold:  200 * time.Millisecond,
+		clientQueue:  4096,
+		waitKeyFrame: true,
+	},
+}
+
+func parseLatencyProfile(v string) (latencyProfile, error) {
+	lp, ok := latencyProfiles[v]
+	if !ok {
+		return latencyProfile{}, fmt.Errorf("unsupported latency profile: %s", v)
+	}
+	return lp, nil
+}
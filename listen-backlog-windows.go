@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func setListenBacklog(netl *net.TCPListener, backlog int) error {
+	return fmt.Errorf("the listen backlog can't be changed on Windows")
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setListenBacklog changes the maximum number of pending connections of a
+// listener, by calling listen() again on its socket.
+func setListenBacklog(netl *net.TCPListener, backlog int) error {
+	rc, err := netl.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	err = rc.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
@@ -29,8 +32,15 @@ const (
 )
 
 type track struct {
-	rtpPort  int
-	rtcpPort int
+	rtpPort     int
+	rtcpPort    int
+	rtpChannel  uint8
+	rtcpChannel uint8
+
+	// addresses of UDP tracks are allocated once, since they're used for
+	// each frame
+	rtpAddr  *net.UDPAddr
+	rtcpAddr *net.UDPAddr
 }
 
 type streamProtocol int
@@ -47,18 +57,145 @@ func (s streamProtocol) String() string {
 	return "tcp"
 }
 
+type streamPushConf struct {
+	Track int    `yaml:"track"`
+	Rtp   string `yaml:"rtp"`
+	Rtcp  string `yaml:"rtcp"`
+}
+
 type streamConf struct {
-	Url    string `yaml:"url"`
-	UseTcp bool   `yaml:"useTcp"`
+	Url              string              `yaml:"url"`
+	UseTcp           bool                `yaml:"useTcp"`
+	Push             []streamPushConf    `yaml:"push"`
+	UserAgent        string              `yaml:"userAgent"`
+	Headers          map[string]string   `yaml:"headers"`
+	RangePassthrough bool                `yaml:"rangePassthrough"`
+	ScalePassthrough bool                `yaml:"scalePassthrough"`
+	Vod              bool                `yaml:"vod"`
+	LogFile          string              `yaml:"logFile"`
+	DebugRtsp        bool                `yaml:"debugRtsp"`
+	Sdp              string              `yaml:"sdp"`
+	Source           string              `yaml:"source"`
+	Disabled         bool                `yaml:"disabled"`
+	MaxBitrate       uint64              `yaml:"maxBitrate"`
+	MaxBufferSize    int                 `yaml:"maxBufferSize"`
+	Dscp             int                 `yaml:"dscp"`
+	AuthRealm        string              `yaml:"authRealm"`
+	AuthMethods      []string            `yaml:"authMethods"`
+	AuthGroups       []string            `yaml:"authGroups"`
+	AuthScopes       []string            `yaml:"authScopes"`
+	Multicast        streamMulticastConf `yaml:"multicast"`
+	Hls              bool                `yaml:"hls"`
+	Dash             bool                `yaml:"dash"`
+	Mse              bool                `yaml:"mse"`
+	Mjpeg            bool                `yaml:"mjpeg"`
+	LatencyProfile   string              `yaml:"latencyProfile"`
+	Preload          bool                `yaml:"preload"`
+	Schedule         []string            `yaml:"schedule"`
+	TcpPacing        bool                `yaml:"tcpPacing"`
+	ReplayOnConnect  time.Duration       `yaml:"replayOnConnect"`
+	CongestionPolicy string              `yaml:"congestionPolicy"`
+	Timeouts         sourceTimeoutsConf  `yaml:"timeouts"`
+
+	H264PacketizationMode string              `yaml:"h264PacketizationMode"`
+	H264MaxPacketSize     int                 `yaml:"h264MaxPacketSize"`
+	SdpOverrides          streamSdpConf       `yaml:"sdpOverrides"`
+	Compose               []streamComposeConf `yaml:"compose"`
+	From                  string              `yaml:"from"`
+	FromTracks            []int               `yaml:"fromTracks"`
+	FromMedia             []string            `yaml:"fromMedia"`
+	QueryPassthrough      []string            `yaml:"queryPassthrough"`
+	ReconnectInterval     time.Duration       `yaml:"reconnectInterval"`
+	MaxReconnectAttempts  int                 `yaml:"maxReconnectAttempts"`
+	BackoffFactor         float64             `yaml:"backoffFactor"`
+}
+
+// playback tells whether the stream is served by the playback listener.
+func (sc streamConf) playback() bool {
+	return sc.Hls || sc.Dash || sc.Mse || sc.Mjpeg
+}
+
+func (sc streamConf) h264PacketizationMode() int {
+	if sc.H264PacketizationMode == "0" {
+		return 0
+	}
+	return 1
+}
+
+// h264MaxPacketSize returns the maximum size of repacketized H264 packets.
+func (sc streamConf) h264MaxPacketSize() int {
+	if sc.H264MaxPacketSize == 0 {
+		return 12 + _RTP_MAX_PAYLOAD_SIZE
+	}
+	return sc.H264MaxPacketSize
 }
 
 type conf struct {
-	Protocols          []string
-	RtspPort           int
-	RtpPort            int
-	RtcpPort           int
-	StreamReadyTimeout time.Duration
-	StreamTTL          time.Duration
+	Protocols           []string
+	RtspPorts           []int
+	RtspUnixSocket      string
+	RtspsPort           int
+	TlsCert             string
+	TlsKey              string
+	Acme                acmeConf
+	ProxyProtocol       bool
+	RtpPort             int
+	RtcpPort            int
+	ApiPort             int
+	ApiAuth             apiAuthConf
+	PlaybackPort        int
+	RtspWebsocket       bool
+	DebugPort           int
+	HlsSegmentDuration  time.Duration
+	HlsPartDuration     time.Duration
+	ExternalIp          net.IP
+	UserAgent           string
+	StreamReadyTimeout  time.Duration
+	StreamTTL           time.Duration
+	OnDemand            bool
+	DvrDuration         time.Duration
+	SdpCacheTTL         time.Duration
+	DrainStatus         int
+	AuthUser            string
+	AuthPass            string
+	AuthRealm           string
+	AuthMethods         authMethods
+	AuthLdap            ldapConf
+	AuthHtpasswd        string
+	AuthOauth           oauthConf
+	AuditLog            string
+	AuthBanAttempts     int
+	AuthBanDuration     time.Duration
+	StatsdAddress       string
+	StatsdPrefix        string
+	StatsdTags          string
+	InfluxUrl           string
+	InfluxToken         string
+	InfluxMeasurement   string
+	InfluxInterval      time.Duration
+	MetricsMaxLabels    int
+	MetricsOverflow     string
+	StreamLogDir        string
+	DebugRtsp           bool
+	CaptureDir          string
+	StateFile           string
+	HandoverTimeout     time.Duration
+	DumpDir             string
+	ReadyCriteria       []string
+	StreamMaxBitrate    uint64
+	StreamMaxBufferSize int
+	MemoryLimit         uint64
+	UdpOffload          bool
+	ClientSocket        socketConf
+	SourceSocket        socketConf
+	SourceTimeouts      sourceTimeoutsConf
+	SourceUdpPorts      udpPortRange
+	ListenBacklog       int
+	RequestLimits       requestLimitsConf
+	SimulateLoss        float64
+	SimulateJitter      time.Duration
+	Acl                 []aclRuleConf         `yaml:"acl"`
+	Streams             map[string]streamConf `yaml:"streams"`
 }
 
 func loadConf(confPath string) (*conf, error) {
@@ -89,14 +226,40 @@ func loadConf(confPath string) (*conf, error) {
 }
 
 type program struct {
-	conf      conf
-	protocols map[streamProtocol]struct{}
-	mutex     sync.RWMutex
-	rtspl     *serverTcpListener
-	rtpl      *serverUdpListener
-	rtcpl     *serverUdpListener
-	clients   map[*serverClient]struct{}
-	streams   map[string]*stream
+	conf           conf
+	protocols      map[streamProtocol]struct{}
+	mutex          sync.RWMutex
+	rtspls         []*serverTcpListener
+	rtspsl         *serverTcpListener
+	certs          *certStore
+	acme           *acmeClient
+	unixl          *serverUnixListener
+	rtpl           *serverUdpListener
+	rtcpl          *serverUdpListener
+	httpl          *serverHttpListener
+	playbackl      *serverPlaybackListener
+	debugl         *serverDebugListener
+	statsd         *statsdReporter
+	influx         *influxReporter
+	memguard       *memoryGuard
+	impairment     *networkImpairment
+	clients        map[*serverClient]struct{}
+	streams        map[string]*stream
+	retiredStreams map[*stream]struct{}
+	sdpCache       map[string]*sdpCacheEntry
+	draining       bool
+	listening      bool
+	remaps         map[string]string
+	onDemand       map[string]struct{} // static streams that are pulled on demand
+	state          *stateFile
+	handedOver     bool  // the state file belongs to a new instance
+	memoryPressure int32 // accessed atomically
+	bans           *authBans
+	ldap           *ldapAuthenticator
+	htpasswd       *htpasswdFile
+	oauth          *oauthIntrospector
+	audit          *auditLog
+	sockets        *handoverSockets
 }
 
 func newProgram() (*program, error) {
@@ -105,30 +268,540 @@ func newProgram() (*program, error) {
 
 	protocolsStr := kingpin.Flag("protocols", "supported protocols").
 		Default("tcp,udp").Envar("PROTOCOLS").String()
-	rtspPort := kingpin.Flag("rtsp-port", "port of RTSP TCP listener").
-		Default("8554").Envar("RTSP_PORT").Int()
+	rtspPortsStr := kingpin.Flag("rtsp-port", "ports of RTSP TCP listeners, comma-separated").
+		Default("8554").Envar("RTSP_PORT").String()
+	rtspUnixSocket := kingpin.Flag("rtsp-unix-socket", "path of a Unix socket on which RTSP is served, with interleaved media only").
+		Default("").Envar("RTSP_UNIX_SOCKET").String()
+	rtspsPort := kingpin.Flag("rtsps-port", "port of the RTSPS (RTSP over TLS) listener, 0 to disable").
+		Default("0").Envar("RTSPS_PORT").Int()
+	tlsCert := kingpin.Flag("tls-cert", "path of the certificate of the RTSPS listener, in PEM format, reloaded when it changes or on SIGHUP").
+		Default("").Envar("TLS_CERT").String()
+	tlsKey := kingpin.Flag("tls-key", "path of the private key of the RTSPS listener, in PEM format").
+		Default("").Envar("TLS_KEY").String()
+	acmeDomains := kingpin.Flag("acme-domains", "domains, comma-separated, for which the certificate of the RTSPS listener is obtained and renewed via ACME (HTTP-01), empty to disable").
+		Default("").Envar("ACME_DOMAINS").String()
+	acmeEmail := kingpin.Flag("acme-email", "contact email of the ACME account").
+		Default("").Envar("ACME_EMAIL").String()
+	acmeDirectory := kingpin.Flag("acme-directory", "url of the directory of the ACME server").
+		Default(_ACME_DIRECTORY).Envar("ACME_DIRECTORY").String()
+	acmeDir := kingpin.Flag("acme-dir", "directory in which the ACME account key and the certificates are stored").
+		Default("acme").Envar("ACME_DIR").String()
+	acmeHttpPort := kingpin.Flag("acme-http-port", "port of the listener of HTTP-01 challenges, that must be reachable on port 80 of the domains").
+		Default("80").Envar("ACME_HTTP_PORT").Int()
+	proxyProtocol := kingpin.Flag("proxy-protocol", "expect a PROXY protocol v1 or v2 header on RTSP TCP connections").
+		Default("false").Envar("PROXY_PROTOCOL").Bool()
 	rtpPort := kingpin.Flag("rtp-port", "port of RTP UDP listener").
 		Default("8050").Envar("RTP_PORT").Int()
 	rtcpPort := kingpin.Flag("rtcp-port", "port of RTCP UDP listener").
 		Default("8051").Envar("RTP_PORT").Int()
+	externalIp := kingpin.Flag("external-ip", "IP advertised to clients when the proxy is behind a NAT or a load balancer").
+		Default("").Envar("EXTERNAL_IP").String()
+	userAgent := kingpin.Flag("user-agent", "User-Agent sent to sources").
+		Default("").Envar("USER_AGENT").String()
+	apiPort := kingpin.Flag("api-port", "port of the HTTP API listener, 0 to disable").
+		Default("0").Envar("API_PORT").Int()
+	apiKeys := kingpin.Flag("api-keys", "keys accepted by the HTTP API, comma-separated, sent in the X-Api-Key header or as bearer tokens").
+		Default("").Envar("API_KEYS").String()
+	apiUser := kingpin.Flag("api-user", "username required by the HTTP API with basic authentication").
+		Default("").Envar("API_USER").String()
+	apiPass := kingpin.Flag("api-pass", "password required by the HTTP API with basic authentication").
+		Default("").Envar("API_PASS").String()
+	apiCorsOrigins := kingpin.Flag("api-cors-origins", "origins allowed to call the HTTP API from browsers, comma-separated, * for all").
+		Default("").Envar("API_CORS_ORIGINS").String()
+	playbackPort := kingpin.Flag("playback-port", "port of the HTTP listener that serves streams to players (LL-HLS, MPEG-DASH, fMP4 over WebSocket, MJPEG), 0 to disable").
+		Default("0").Envar("PLAYBACK_PORT").Int()
+	rtspWebsocket := kingpin.Flag("rtsp-websocket", "accept RTSP sessions tunneled through a WebSocket on the /rtsp endpoint of the playback listener, with interleaved frames").
+		Default("false").Envar("RTSP_WEBSOCKET").Bool()
+	debugPort := kingpin.Flag("debug-port", "port of the HTTP listener that publishes counters through expvar on /debug/vars, without authentication, 0 to disable").
+		Default("0").Envar("DEBUG_PORT").Int()
+	hlsSegmentDuration := kingpin.Flag("hls-segment-duration", "minimum duration of HLS segments, that are cut on key frames").
+		Default("1s").Envar("HLS_SEGMENT_DURATION").Duration()
+	hlsPartDuration := kingpin.Flag("hls-part-duration", "target duration of HLS partial segments").
+		Default("200ms").Envar("HLS_PART_DURATION").Duration()
 	streamReadyTimeout := kingpin.Flag("stream-ready-timeout",
 		"timeout to stream become ready in seconds").Default("10s").Duration()
+	sourceDescribeTimeout := kingpin.Flag("source-describe-timeout", "timeout of the connection to sources and of their answer to DESCRIBE").
+		Default("5s").Envar("SOURCE_DESCRIBE_TIMEOUT").Duration()
+	sourceSetupTimeout := kingpin.Flag("source-setup-timeout", "timeout of the answers of sources to SETUP and PLAY").
+		Default("5s").Envar("SOURCE_SETUP_TIMEOUT").Duration()
+	sourceFirstPacketTimeout := kingpin.Flag("source-first-packet-timeout", "maximum time between the answer of sources to PLAY and their first packet").
+		Default("5s").Envar("SOURCE_FIRST_PACKET_TIMEOUT").Duration()
+	sourceFrameGapTimeout := kingpin.Flag("source-frame-gap-timeout", "maximum time between two packets of sources, after which they are considered dead").
+		Default("5s").Envar("SOURCE_FRAME_GAP_TIMEOUT").Duration()
+	sourceUdpPorts := kingpin.Flag("source-udp-ports", "range of local ports on which RTP and RTCP packets of sources are received with UDP, in the format min-max").
+		Default("10000-65535").Envar("SOURCE_UDP_PORTS").String()
 	streamTTL := kingpin.Flag("stream-ttl", "stream without clients time to life in seconds").
 		Default("10s").Duration()
+	onDemand := kingpin.Flag("on-demand", "pull static streams when clients request them, and stop them after --stream-ttl without clients, except the ones with preload").
+		Envar("ON_DEMAND").Bool()
+	dvrDuration := kingpin.Flag("dvr-duration", "duration of the in-memory time-shift buffer of each stream, 0 to disable").
+		Default("0s").Duration()
+	sdpCacheTTL := kingpin.Flag("sdp-cache-ttl", "time to live of cached source SDPs, 0 to disable").
+		Default("0s").Duration()
+
+	drainStatus := kingpin.Flag("drain-status", "status code returned to new clients in drain mode").
+		Default("503").Envar("DRAIN_STATUS").Int()
+	authUser := kingpin.Flag("auth-user", "username required to clients").
+		Default("").Envar("AUTH_USER").String()
+	authPass := kingpin.Flag("auth-pass", "password required to clients").
+		Default("").Envar("AUTH_PASS").String()
+	authRealm := kingpin.Flag("auth-realm", "realm of the authentication").
+		Default(_AUTH_REALM).Envar("AUTH_REALM").String()
+	authMethodsStr := kingpin.Flag("auth-methods", "authentication methods offered to clients, separated by a comma (basic, digest)").
+		Default("basic").Envar("AUTH_METHODS").String()
+	authHtpasswd := kingpin.Flag("auth-htpasswd", "path of a htpasswd file (bcrypt, apr1 or SHA1) that contains the credentials of clients, reloaded when it changes").
+		Default("").Envar("AUTH_HTPASSWD").String()
+	authOauthIntrospectionUrl := kingpin.Flag("auth-oauth-introspection-url", "url of an OAuth2 token introspection endpoint that validates the bearer tokens of clients, empty to disable").
+		Default("").Envar("AUTH_OAUTH_INTROSPECTION_URL").String()
+	authOauthClientId := kingpin.Flag("auth-oauth-client-id", "client id used to authenticate to the introspection endpoint").
+		Default("").Envar("AUTH_OAUTH_CLIENT_ID").String()
+	authOauthClientSecret := kingpin.Flag("auth-oauth-client-secret", "client secret used to authenticate to the introspection endpoint").
+		Default("").Envar("AUTH_OAUTH_CLIENT_SECRET").String()
+	authLdapUrl := kingpin.Flag("auth-ldap-url", "url of a LDAP server that validates the credentials of clients (ldap://host:port or ldaps://host:port), empty to disable").
+		Default("").Envar("AUTH_LDAP_URL").String()
+	authLdapBindDn := kingpin.Flag("auth-ldap-bind-dn", "DN used to bind as a client, %s is replaced with the username").
+		Default("uid=%s,dc=example,dc=com").Envar("AUTH_LDAP_BIND_DN").String()
+	authLdapBaseDn := kingpin.Flag("auth-ldap-base-dn", "DN under which users are searched to read their groups (memberOf), empty to skip the search").
+		Default("").Envar("AUTH_LDAP_BASE_DN").String()
+	authLdapUserAttribute := kingpin.Flag("auth-ldap-user-attribute", "attribute that contains the username of users (uid, sAMAccountName)").
+		Default("uid").Envar("AUTH_LDAP_USER_ATTRIBUTE").String()
+	auditLogPath := kingpin.Flag("audit-log", "path of a file to which authentications, denials and API calls are appended as JSON lines, empty to disable").
+		Default("").Envar("AUDIT_LOG").String()
+	authBanAttempts := kingpin.Flag("auth-ban-attempts", "number of failed authentications after which an IP is banned, 0 to disable").
+		Default("5").Envar("AUTH_BAN_ATTEMPTS").Int()
+	authBanDuration := kingpin.Flag("auth-ban-duration", "duration of bans").
+		Default("10m").Envar("AUTH_BAN_DURATION").Duration()
+	statsdAddress := kingpin.Flag("statsd-address", "address of a StatsD server to which metrics are sent, empty to disable").
+		Default("").Envar("STATSD_ADDRESS").String()
+	statsdPrefix := kingpin.Flag("statsd-prefix", "prefix of StatsD metrics").
+		Default("rtsp_simple_proxy.").Envar("STATSD_PREFIX").String()
+	statsdTags := kingpin.Flag("statsd-tags", "tags added to StatsD metrics, in the key:value,key:value format").
+		Default("").Envar("STATSD_TAGS").String()
+	influxUrl := kingpin.Flag("influx-url", "InfluxDB write URL, for instance http://localhost:8086/write?db=mydb, empty to disable").
+		Default("").Envar("INFLUX_URL").String()
+	influxToken := kingpin.Flag("influx-token", "InfluxDB authentication token").
+		Default("").Envar("INFLUX_TOKEN").String()
+	influxMeasurement := kingpin.Flag("influx-measurement", "InfluxDB measurement").
+		Default("rtsp_simple_proxy").Envar("INFLUX_MEASUREMENT").String()
+	influxInterval := kingpin.Flag("influx-interval", "interval between writes to InfluxDB").
+		Default("10s").Envar("INFLUX_INTERVAL").Duration()
+	metricsMaxLabels := kingpin.Flag("metrics-max-labels", "maximum number of values of the path, codec and source_host labels of Prometheus metrics. 0 means unlimited").
+		Default("0").Envar("METRICS_MAX_LABELS").Int()
+	metricsOverflow := kingpin.Flag("metrics-overflow", "what to do with labels that exceed --metrics-max-labels: aggregate (values of the streams with less clients are replaced with 'other') or drop (the label is removed)").
+		Default("aggregate").Envar("METRICS_OVERFLOW").String()
+	streamLogDir := kingpin.Flag("stream-log-dir", "directory in which the log of each stream is written to a dedicated file, in addition to the main log").
+		Default("").Envar("STREAM_LOG_DIR").String()
+	debugRtsp := kingpin.Flag("debug-rtsp", "log RTSP requests and responses exchanged with clients and sources, without credentials").
+		Default("false").Envar("DEBUG_RTSP").Bool()
+	readyCriteria := kingpin.Flag("ready-criteria", "criteria required by the /ready endpoint of the API, comma-separated (listeners, not-draining, any-stream, all-streams)").
+		Default("listeners,not-draining").Envar("READY_CRITERIA").String()
+	handoverTimeout := kingpin.Flag("handover-timeout", "after a zero-downtime upgrade triggered by SIGUSR2, maximum time during which the previous instance keeps serving its clients. 0 means until they disconnect").
+		Default("0s").Envar("HANDOVER_TIMEOUT").Duration()
+	dumpDir := kingpin.Flag("dump-dir", "directory in which a JSON snapshot of streams, clients, queues and goroutines is written when SIGUSR1 is received. If empty, it is written to stderr").
+		Default("").Envar("DUMP_DIR").String()
+	stateFile := kingpin.Flag("state-file", "path of a file in which drain mode, bans and remapped sources are stored, such that they are restored after a restart. If empty, they are lost").
+		Default("").Envar("STATE_FILE").String()
+	captureDir := kingpin.Flag("capture-dir", "directory in which pcap captures requested through the API are written. If empty, captures are disabled").
+		Default("").Envar("CAPTURE_DIR").String()
+	streamMaxBitrate := kingpin.Flag("stream-max-bitrate", "maximum bitrate of each stream, in bits per second; packets in excess are dropped. 0 means unlimited").
+		Default("0").Envar("STREAM_MAX_BITRATE").Uint64()
+	streamMaxBufferSize := kingpin.Flag("stream-max-buffer-size", "maximum size of the buffer of each stream, in bytes. 0 means unlimited").
+		Default("0").Envar("STREAM_MAX_BUFFER_SIZE").Int()
+	memoryLimit := kingpin.Flag("memory-limit", "memory that can be used by the process, in bytes; when it is approached, load is shed. 0 means unlimited").
+		Default("0").Envar("MEMORY_LIMIT").Uint64()
+	udpOffload := kingpin.Flag("udp-offload", "merge UDP packets sent to the same client (GSO) or received from the same source (GRO), in order to reduce CPU usage. Linux only").
+		Default("false").Envar("UDP_OFFLOAD").Bool()
+	clientTcpNoDelay := kingpin.Flag("client-tcp-nodelay", "disable Nagle's algorithm on TCP connections with clients").
+		Default("true").Envar("CLIENT_TCP_NODELAY").Bool()
+	clientSendBuffer := kingpin.Flag("client-send-buffer", "size of the send buffer of sockets towards clients, in bytes. 0 means the system default").
+		Default("0").Envar("CLIENT_SEND_BUFFER").Int()
+	clientReceiveBuffer := kingpin.Flag("client-receive-buffer", "size of the receive buffer of sockets towards clients, in bytes. 0 means the system default").
+		Default("0").Envar("CLIENT_RECEIVE_BUFFER").Int()
+	clientKeepAlive := kingpin.Flag("client-keepalive", "interval of TCP keepalives sent to clients. 0 means the default, a negative value disables keepalives").
+		Default("0s").Envar("CLIENT_KEEPALIVE").Duration()
+	sourceTcpNoDelay := kingpin.Flag("source-tcp-nodelay", "disable Nagle's algorithm on TCP connections with sources").
+		Default("true").Envar("SOURCE_TCP_NODELAY").Bool()
+	sourceSendBuffer := kingpin.Flag("source-send-buffer", "size of the send buffer of sockets towards sources, in bytes. 0 means the system default").
+		Default("0").Envar("SOURCE_SEND_BUFFER").Int()
+	sourceReceiveBuffer := kingpin.Flag("source-receive-buffer", "size of the receive buffer of sockets towards sources, in bytes. 0 means the system default").
+		Default("0").Envar("SOURCE_RECEIVE_BUFFER").Int()
+	sourceKeepAlive := kingpin.Flag("source-keepalive", "interval of TCP keepalives sent to sources. 0 means the default, a negative value disables keepalives").
+		Default("0s").Envar("SOURCE_KEEPALIVE").Duration()
+	dscp := kingpin.Flag("dscp", "DSCP of the packets sent to clients (0-63), used by networks to prioritize traffic. 0 means the system default").
+		Default("0").Envar("DSCP").Int()
+	listenBacklog := kingpin.Flag("listen-backlog", "maximum number of pending connections of RTSP TCP listeners. 0 means the system default").
+		Default("0").Envar("LISTEN_BACKLOG").Int()
+	maxRequestLine := kingpin.Flag("max-request-line", "maximum length of the request line of requests of clients, in bytes. 0 means unlimited").
+		Default("4096").Envar("MAX_REQUEST_LINE").Int()
+	maxHeaders := kingpin.Flag("max-headers", "maximum number of headers of requests of clients. 0 means unlimited").
+		Default("64").Envar("MAX_HEADERS").Int()
+	maxHeaderSize := kingpin.Flag("max-header-size", "maximum length of each header of requests of clients, in bytes. 0 means unlimited").
+		Default("8192").Envar("MAX_HEADER_SIZE").Int()
+	maxInterleavedSize := kingpin.Flag("max-interleaved-size", "maximum size of interleaved frames sent by clients, in bytes. 0 means unlimited").
+		Default("8192").Envar("MAX_INTERLEAVED_SIZE").Int()
+	strictCseq := kingpin.Flag("strict-cseq", "disconnect clients whose requests have a CSeq that doesn't increase").
+		Default("true").Envar("STRICT_CSEQ").Bool()
+	simulateLoss := kingpin.Flag("simulate-loss", "percentage of frames sent to clients that are dropped, in order to test players. Not for production use").
+		Default("0%").Envar("SIMULATE_LOSS").String()
+	simulateJitter := kingpin.Flag("simulate-jitter", "maximum random delay of frames sent to clients, in order to test players. Not for production use").
+		Default("0s").Envar("SIMULATE_JITTER").Duration()
+	confPath := kingpin.Flag("conf", "path of a config file defining static streams. Use 'stdin' to read config from stdin").
+		Default("").Envar("CONF").String()
+	dryRunFlag := kingpin.Flag("dry-run", "validate the configuration, print the differences with the static streams of the running instance, read through its API, and exit").
+		Default("false").Bool()
+	dryRunApiUrl := kingpin.Flag("dry-run-api-url", "url of the API of the running instance compared by --dry-run. If empty, http://localhost:<api-port> is used").
+		Default("").Envar("DRY_RUN_API_URL").String()
+
+	kingpin.Command("run", "run the proxy").Default()
+	initCmd := kingpin.Command("init", "print a sample configuration file, that contains all the options with their description")
+	fakesourceCmd := kingpin.Command("fakesource", "serve a deterministic test stream on any path, in order to test the proxy end to end")
+	fakesourcePort := fakesourceCmd.Flag("port", "port of the RTSP TCP listener").
+		Default("9554").Int()
+	fakesourceTracks := fakesourceCmd.Flag("tracks", "tracks of the stream, comma-separated (h264, aac)").
+		Default("h264,aac").String()
+	probeCmd := kingpin.Command("probe", "read a RTSP source once, print its tracks, the transport that works, the time to the first packet and the bitrate, and exit")
+	probeUrl := probeCmd.Arg("url", "url of the source").Required().String()
+	probeTimeout := probeCmd.Flag("timeout", "timeout of each phase of the session").
+		Default("10s").Duration()
+	probeDuration := probeCmd.Flag("duration", "duration of the measurement of the bitrate").
+		Default("5s").Duration()
+	statusCmd := kingpin.Command("status", "print the state of the streams of a running instance, read through its API, and exit")
+	statusApiUrl := statusCmd.Flag("api", "url of the API of the running instance. If empty, http://localhost:<api-port> is used").
+		Default("").Envar("STATUS_API_URL").String()
+
+	switch kingpin.Parse() {
+	case initCmd.FullCommand():
+		fmt.Print(sampleConf())
+		os.Exit(0)
+
+	case fakesourceCmd.FullCommand():
+		err := runFakeSource(*fakesourcePort, *fakesourceTracks)
+		if err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+
+	case probeCmd.FullCommand():
+		err := runProbe(*probeUrl, *probeTimeout, *probeDuration)
+		if err != nil {
+			return nil, err
+		}
+		os.Exit(0)
 
-	kingpin.Parse()
+	case statusCmd.FullCommand():
+		apiUrl := *statusApiUrl
+		if apiUrl == "" {
+			if *apiPort == 0 {
+				return nil, fmt.Errorf("the status command requires the API port or the API url of the running instance")
+			}
+			apiUrl = fmt.Sprintf("http://localhost:%d", *apiPort)
+		}
+
+		auth := apiAuthConf{
+			User: *apiUser,
+			Pass: *apiPass,
+		}
+		for _, k := range strings.Split(*apiKeys, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				auth.Keys = append(auth.Keys, k)
+			}
+		}
+
+		err := runStatus(apiUrl, auth)
+		if err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
 
 	conf := &conf{
-		Protocols:          strings.Split(*protocolsStr, ","),
-		RtspPort:           *rtspPort,
-		RtpPort:            *rtpPort,
-		RtcpPort:           *rtcpPort,
+		Protocols:      strings.Split(*protocolsStr, ","),
+		RtspUnixSocket: *rtspUnixSocket,
+		RtspsPort:      *rtspsPort,
+		TlsCert:        *tlsCert,
+		TlsKey:         *tlsKey,
+		Acme: acmeConf{
+			Email:     *acmeEmail,
+			Directory: *acmeDirectory,
+			Dir:       *acmeDir,
+			HttpPort:  *acmeHttpPort,
+		},
+		ProxyProtocol: *proxyProtocol,
+		RtpPort:       *rtpPort,
+		RtcpPort:      *rtcpPort,
+		ApiPort:       *apiPort,
+		ApiAuth: apiAuthConf{
+			User: *apiUser,
+			Pass: *apiPass,
+		},
+		PlaybackPort:       *playbackPort,
+		RtspWebsocket:      *rtspWebsocket,
+		DebugPort:          *debugPort,
+		HlsSegmentDuration: *hlsSegmentDuration,
+		HlsPartDuration:    *hlsPartDuration,
+		UserAgent:          *userAgent,
 		StreamReadyTimeout: *streamReadyTimeout,
 		StreamTTL:          *streamTTL,
+		OnDemand:           *onDemand,
+		DvrDuration:        *dvrDuration,
+		SdpCacheTTL:        *sdpCacheTTL,
+		DrainStatus:        *drainStatus,
+		AuthUser:           *authUser,
+		AuthPass:           *authPass,
+		AuthRealm:          *authRealm,
+		AuthHtpasswd:       *authHtpasswd,
+		AuditLog:           *auditLogPath,
+		AuthOauth: oauthConf{
+			IntrospectionUrl: *authOauthIntrospectionUrl,
+			ClientId:         *authOauthClientId,
+			ClientSecret:     *authOauthClientSecret,
+		},
+		AuthLdap: ldapConf{
+			Url:           *authLdapUrl,
+			BindDn:        *authLdapBindDn,
+			BaseDn:        *authLdapBaseDn,
+			UserAttribute: *authLdapUserAttribute,
+		},
+		AuthBanAttempts:     *authBanAttempts,
+		AuthBanDuration:     *authBanDuration,
+		StatsdAddress:       *statsdAddress,
+		StatsdPrefix:        *statsdPrefix,
+		StatsdTags:          *statsdTags,
+		InfluxUrl:           *influxUrl,
+		InfluxToken:         *influxToken,
+		InfluxMeasurement:   *influxMeasurement,
+		InfluxInterval:      *influxInterval,
+		MetricsMaxLabels:    *metricsMaxLabels,
+		MetricsOverflow:     *metricsOverflow,
+		StreamLogDir:        *streamLogDir,
+		DebugRtsp:           *debugRtsp,
+		CaptureDir:          *captureDir,
+		StateFile:           *stateFile,
+		HandoverTimeout:     *handoverTimeout,
+		DumpDir:             *dumpDir,
+		StreamMaxBitrate:    *streamMaxBitrate,
+		StreamMaxBufferSize: *streamMaxBufferSize,
+		MemoryLimit:         *memoryLimit,
+		UdpOffload:          *udpOffload,
+		ClientSocket: socketConf{
+			NoDelay:       *clientTcpNoDelay,
+			SendBuffer:    *clientSendBuffer,
+			ReceiveBuffer: *clientReceiveBuffer,
+			KeepAlive:     *clientKeepAlive,
+			Dscp:          *dscp,
+		},
+		SourceSocket: socketConf{
+			NoDelay:       *sourceTcpNoDelay,
+			SendBuffer:    *sourceSendBuffer,
+			ReceiveBuffer: *sourceReceiveBuffer,
+			KeepAlive:     *sourceKeepAlive,
+		},
+		SourceTimeouts: sourceTimeoutsConf{
+			Describe:    *sourceDescribeTimeout,
+			Setup:       *sourceSetupTimeout,
+			FirstPacket: *sourceFirstPacketTimeout,
+			FrameGap:    *sourceFrameGapTimeout,
+		},
+		ListenBacklog: *listenBacklog,
+		RequestLimits: requestLimitsConf{
+			RequestLine:     *maxRequestLine,
+			Headers:         *maxHeaders,
+			HeaderSize:      *maxHeaderSize,
+			InterleavedSize: *maxInterleavedSize,
+			Cseq:            *strictCseq,
+		},
+	}
+
+	if *externalIp != "" {
+		conf.ExternalIp = net.ParseIP(*externalIp)
+		if conf.ExternalIp == nil {
+			return nil, fmt.Errorf("invalid external ip: %s", *externalIp)
+		}
+	}
+
+	if conf.ClientSocket.Dscp < 0 || conf.ClientSocket.Dscp > 63 {
+		return nil, fmt.Errorf("invalid DSCP: %d", conf.ClientSocket.Dscp)
+	}
+
+	if conf.DrainStatus < 400 || conf.DrainStatus > 599 {
+		return nil, fmt.Errorf("invalid drain status: %d", conf.DrainStatus)
+	}
+
+	if (conf.AuthUser == "") != (conf.AuthPass == "") {
+		return nil, fmt.Errorf("auth user and pass must be provided together")
+	}
+
+	authMethods, err := parseAuthMethods(strings.Split(*authMethodsStr, ","))
+	if err != nil {
+		return nil, err
+	}
+	conf.AuthMethods = authMethods
+
+	conf.SimulateLoss, err = parsePercentage(*simulateLoss)
+	if err != nil {
+		return nil, err
+	}
+	conf.SimulateJitter = *simulateJitter
+
+	conf.SourceUdpPorts, err = parseUdpPortRange(*sourceUdpPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	if (conf.AuthLdap.Url != "" || conf.AuthHtpasswd != "") && !conf.AuthMethods.basic {
+		return nil, fmt.Errorf("LDAP and htpasswd authentication require the basic auth method")
+	}
+
+	if (conf.ApiAuth.User == "") != (conf.ApiAuth.Pass == "") {
+		return nil, fmt.Errorf("API user and pass must be provided together")
+	}
+
+	for _, k := range strings.Split(*apiKeys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			conf.ApiAuth.Keys = append(conf.ApiAuth.Keys, k)
+		}
+	}
+
+	for _, o := range strings.Split(*apiCorsOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			conf.ApiAuth.CorsOrigins = append(conf.ApiAuth.CorsOrigins, o)
+		}
+	}
+
+	conf.ReadyCriteria, err = parseReadyCriteria(strings.Split(*readyCriteria, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.AuthBanAttempts < 0 {
+		return nil, fmt.Errorf("auth ban attempts must be positive")
+	}
+
+	if conf.AuthBanDuration < time.Second {
+		return nil, fmt.Errorf("too small auth ban duration")
+	}
+
+	if conf.InfluxUrl != "" && conf.InfluxInterval < time.Second {
+		return nil, fmt.Errorf("too small influx interval")
 	}
 
-	if conf.RtspPort == 0 {
-		return nil, fmt.Errorf("rtsp port not provided")
+	if conf.MetricsMaxLabels < 0 {
+		return nil, fmt.Errorf("metrics max labels must be positive")
+	}
+
+	switch conf.MetricsOverflow {
+	case _LABEL_OVERFLOW_AGGREGATE, _LABEL_OVERFLOW_DROP:
+	default:
+		return nil, fmt.Errorf("unsupported metrics overflow: %s", conf.MetricsOverflow)
+	}
+
+	if *confPath != "" {
+		fileConf, err := loadConf(*confPath)
+		if err != nil {
+			return nil, err
+		}
+		conf.Streams = fileConf.Streams
+		conf.Acl = fileConf.Acl
+	}
+
+	conf.Streams, err = mergeEnvStreams(conf.Streams, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateAcl(conf.Acl)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, sc := range conf.Streams {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid stream name: '%s'", name)
+		}
+		if sc.Url == "" && sc.Source == "" && sc.From == "" {
+			return nil, fmt.Errorf("stream '%s': url not provided", name)
+		}
+		if sc.Vod && sc.UseTcp {
+			return nil, fmt.Errorf("stream '%s': vod streams must be received via udp", name)
+		}
+		if sc.Preload && (sc.Vod || len(sc.QueryPassthrough) > 0) {
+			return nil, fmt.Errorf("stream '%s': vod streams and streams with query passthrough can't be preloaded", name)
+		}
+		if len(sc.Schedule) > 0 && (sc.Vod || len(sc.QueryPassthrough) > 0 || sc.From != "") {
+			return nil, fmt.Errorf("stream '%s': vod, derived streams and streams with query passthrough can't be scheduled", name)
+		}
+		if sc.playback() && sc.Vod {
+			return nil, fmt.Errorf("stream '%s': HLS, DASH, MSE and MJPEG can't be enabled on vod streams", name)
+		}
+		if sc.playback() && conf.PlaybackPort == 0 {
+			return nil, fmt.Errorf("stream '%s': HLS, DASH, MSE and MJPEG require the playback port", name)
+		}
+		if len(sc.QueryPassthrough) > 0 {
+			if sc.playback() || sc.From != "" || sc.Source != "" {
+				return nil, fmt.Errorf("stream '%s': query passthrough can't be used with playback, derived streams or sources", name)
+			}
+			err := sc.validatePassthrough()
+			if err != nil {
+				return nil, fmt.Errorf("stream '%s': %s", name, err)
+			}
+		}
+	}
+
+	for _, portStr := range strings.Split(*rtspPortsStr, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(portStr))
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid rtsp port: %s", portStr)
+		}
+		conf.RtspPorts = append(conf.RtspPorts, port)
+	}
+
+	if conf.RtspsPort < 0 || conf.RtspsPort > 65535 {
+		return nil, fmt.Errorf("invalid rtsps port: %d", conf.RtspsPort)
+	}
+
+	if conf.PlaybackPort < 0 || conf.PlaybackPort > 65535 {
+		return nil, fmt.Errorf("invalid playback port: %d", conf.PlaybackPort)
+	}
+
+	if conf.RtspWebsocket && conf.PlaybackPort == 0 {
+		return nil, fmt.Errorf("RTSP over WebSocket requires the playback port")
+	}
+
+	if conf.DebugPort < 0 || conf.DebugPort > 65535 {
+		return nil, fmt.Errorf("invalid debug port: %d", conf.DebugPort)
+	}
+
+	if conf.HlsPartDuration < 10*time.Millisecond {
+		return nil, fmt.Errorf("too small HLS part duration")
+	}
+
+	if conf.HlsSegmentDuration < conf.HlsPartDuration {
+		return nil, fmt.Errorf("HLS segment duration must be greater than the part duration")
+	}
+
+	if *acmeDomains != "" {
+		for _, d := range strings.Split(*acmeDomains, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				return nil, fmt.Errorf("invalid ACME domains: %s", *acmeDomains)
+			}
+			conf.Acme.Domains = append(conf.Acme.Domains, d)
+		}
+
+		if conf.RtspsPort == 0 {
+			return nil, fmt.Errorf("ACME requires the rtsps port")
+		}
+
+		if conf.TlsCert != "" || conf.TlsKey != "" {
+			return nil, fmt.Errorf("TLS cert and key can't be provided together with ACME domains")
+		}
+
+		if conf.Acme.HttpPort <= 0 || conf.Acme.HttpPort > 65535 {
+			return nil, fmt.Errorf("invalid ACME http port: %d", conf.Acme.HttpPort)
+		}
+
+	} else if conf.RtspsPort != 0 && (conf.TlsCert == "" || conf.TlsKey == "") {
+		return nil, fmt.Errorf("the rtsps port requires a TLS cert and key, or ACME domains")
 	}
 
 	if conf.RtpPort == 0 {
@@ -151,10 +824,23 @@ func newProgram() (*program, error) {
 		return nil, fmt.Errorf("too small stream ready timeout")
 	}
 
+	if conf.SourceTimeouts.Describe <= 0 || conf.SourceTimeouts.Setup <= 0 ||
+		conf.SourceTimeouts.FirstPacket <= 0 || conf.SourceTimeouts.FrameGap <= 0 {
+		return nil, fmt.Errorf("source timeouts must be positive")
+	}
+
 	if conf.StreamTTL < time.Second {
 		return nil, fmt.Errorf("too small stream TTL")
 	}
 
+	if conf.DvrDuration < 0 {
+		return nil, fmt.Errorf("dvr duration must be positive")
+	}
+
+	if conf.SdpCacheTTL < 0 {
+		return nil, fmt.Errorf("sdp cache TTL must be positive")
+	}
+
 	protocols := make(map[streamProtocol]struct{})
 	for _, proto := range conf.Protocols {
 		switch proto {
@@ -172,28 +858,199 @@ func newProgram() (*program, error) {
 		return nil, fmt.Errorf("no protocols provided")
 	}
 
+	if *dryRunFlag {
+		err := dryRun(conf, *dryRunApiUrl)
+		if err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
+
 	log.Printf("rtsp-simple-proxy %s", Version)
 
+	return newProgramFromConf(conf, protocols)
+}
+
+// newProgramFromConf allocates a program with a configuration that has
+// already been validated. The UDP listeners are not created when the RTP
+// port is not provided, that is allowed only when clients can't use UDP.
+func newProgramFromConf(conf *conf, protocols map[streamProtocol]struct{}) (*program, error) {
+	var err error
+
 	p := &program{
 		conf:      *conf,
 		protocols: protocols,
 		clients:   make(map[*serverClient]struct{}),
 		streams:   make(map[string]*stream),
+
+		retiredStreams: make(map[*stream]struct{}),
+		remaps:         make(map[string]string),
+		sdpCache:       make(map[string]*sdpCacheEntry),
+		bans:           newAuthBans(conf.AuthBanAttempts, conf.AuthBanDuration),
 	}
 
-	var err error
+	if conf.AuthLdap.Url != "" {
+		p.ldap, err = newLdapAuthenticator(conf.AuthLdap)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	p.rtpl, err = newServerUdpListener(p, p.conf.RtpPort, _TRACK_FLOW_RTP)
-	if err != nil {
-		return nil, err
+	if conf.AuthHtpasswd != "" {
+		p.htpasswd, err = newHtpasswdFile(conf.AuthHtpasswd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.AuthOauth.IntrospectionUrl != "" {
+		p.oauth, err = newOauthIntrospector(conf.AuthOauth)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	p.rtcpl, err = newServerUdpListener(p, p.conf.RtcpPort, _TRACK_FLOW_RTCP)
+	if conf.AuditLog != "" {
+		p.audit, err = newAuditLog(conf.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.sockets, err = newHandoverSockets()
 	if err != nil {
 		return nil, err
 	}
 
-	p.rtspl, err = newServerTcpListener(p)
+	if conf.StateFile != "" {
+		p.state = newStateFile(conf.StateFile)
+		err = p.restoreState()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read state file: %s", err)
+		}
+	}
+
+	if p.conf.RtpPort != 0 {
+		p.rtpl, err = newServerUdpListener(p, p.conf.RtpPort, _TRACK_FLOW_RTP)
+		if err != nil {
+			return nil, err
+		}
+
+		p.rtcpl, err = newServerUdpListener(p, p.conf.RtcpPort, _TRACK_FLOW_RTCP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, port := range p.conf.RtspPorts {
+		rtspl, err := newServerTcpListener(p, port, nil)
+		if err != nil {
+			return nil, err
+		}
+		p.rtspls = append(p.rtspls, rtspl)
+	}
+
+	if p.conf.RtspsPort != 0 {
+		var tlsConfig *tls.Config
+		if len(p.conf.Acme.Domains) > 0 {
+			p.acme, err = newAcmeClient(p.conf.Acme, p.sockets)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig = p.acme.tlsConfig()
+
+		} else {
+			p.certs, err = newCertStore(p.conf.TlsCert, p.conf.TlsKey)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig = p.certs.tlsConfig()
+		}
+
+		p.rtspsl, err = newServerTcpListener(p, p.conf.RtspsPort, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.conf.RtspUnixSocket != "" {
+		p.unixl, err = newServerUnixListener(p, p.conf.RtspUnixSocket)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.conf.StatsdAddress != "" {
+		p.statsd, err = newStatsdReporter(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.conf.InfluxUrl != "" {
+		p.influx = newInfluxReporter(p)
+	}
+
+	if p.conf.MemoryLimit != 0 {
+		p.memguard = newMemoryGuard(p)
+	}
+
+	if p.conf.SimulateLoss > 0 || p.conf.SimulateJitter > 0 {
+		p.impairment = newNetworkImpairment(p)
+	}
+
+	if p.conf.ApiPort != 0 {
+		p.httpl, err = newServerHttpListener(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.conf.PlaybackPort != 0 {
+		p.playbackl, err = newServerPlaybackListener(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.conf.DebugPort != 0 {
+		p.debugl, err = newServerDebugListener(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.onDemand = onDemandStreams(&p.conf)
+
+	// static streams are always running, except VOD ones, that are created
+	// for each client, the ones with query passthrough, that are created
+	// for each combination of parameters, and the ones pulled on demand
+	for name, sc := range p.conf.Streams {
+		if sc.Vod || len(sc.QueryPassthrough) > 0 {
+			continue
+		}
+
+		if _, ok := p.onDemand[name]; ok {
+			continue
+		}
+
+		if u, ok := p.remaps[name]; ok {
+			sc.Url = u
+		}
+
+		// streams outside of their schedule are disabled
+		if !sc.scheduleActive(time.Now()) {
+			sc.Disabled = true
+		}
+
+		s, err := newStream(p, name, sc)
+		if err != nil {
+			return nil, fmt.Errorf("stream '%s': %s", name, err)
+		}
+		p.streams[name] = s
+	}
+
+	err = p.linkDerivedStreams()
 	if err != nil {
 		return nil, err
 	}
@@ -213,18 +1070,44 @@ func newProgram() (*program, error) {
 				}
 
 				for path, lastTime := range streamsClientLastTime {
+					_, static := p.conf.Streams[path]
+					_, onDemand := p.onDemand[path]
+					if static && !onDemand {
+						continue
+					}
+
 					if time.Now().Sub(lastTime) >= conf.StreamTTL {
 						s, exists := p.streams[path]
 						if !exists {
+							delete(streamsClientLastTime, path)
 							continue
 						}
-						s.log("have no clients, stopping")
-						close(s.stop)
+						s.log("have no clients, stopping, reason: %s", _TEARDOWN_TTL_EXPIRED)
+						s.stopWithReason(_TEARDOWN_TTL_EXPIRED)
 						delete(p.streams, path)
 						delete(streamsClientLastTime, path)
 					}
 				}
 
+				for _, s := range p.streams {
+					s.stats.sample()
+				}
+				for c := range p.clients {
+					c.sent.sample()
+				}
+
+				p.applySchedules(time.Now())
+
+				for s := range p.retiredStreams {
+					s.stopIfUnused()
+				}
+
+				for path, e := range p.sdpCache {
+					if time.Since(e.time) >= conf.SdpCacheTTL {
+						delete(p.sdpCache, path)
+					}
+				}
+
 				p.mutex.Unlock()
 			}
 		}
@@ -234,42 +1117,168 @@ func newProgram() (*program, error) {
 }
 
 func (p *program) run() {
-	go p.rtpl.run()
-	go p.rtcpl.run()
-	go p.rtspl.run()
+	if p.rtpl != nil {
+		go p.rtpl.run()
+		go p.rtcpl.run()
+	}
+	for _, rtspl := range p.rtspls {
+		go rtspl.run()
+	}
+	if p.certs != nil {
+		go p.certs.run()
+	}
+	if p.rtspsl != nil {
+		go p.rtspsl.run()
+	}
+	if p.acme != nil {
+		go p.acme.run()
+	}
+	if p.unixl != nil {
+		go p.unixl.run()
+	}
+	if p.httpl != nil {
+		go p.httpl.run()
+	}
+	if p.playbackl != nil {
+		go p.playbackl.run()
+	}
+	if p.debugl != nil {
+		go p.debugl.run()
+	}
+	if p.statsd != nil {
+		go p.statsd.run()
+	}
+	if p.influx != nil {
+		go p.influx.run()
+	}
+	if p.memguard != nil {
+		go p.memguard.run()
+	}
+	if p.htpasswd != nil || p.oauth != nil {
+		go p.runAuthRevalidation()
+	}
+
+	p.mutex.Lock()
+	p.listening = true
+	p.mutex.Unlock()
+
+	p.sockets.notifyReady()
+	go p.runHandover()
+	go p.runStateDump()
 
 	infty := make(chan struct{})
 	<-infty
 }
 
-func (p *program) forwardTrack(path string, id int, flow trackFlow, frame []byte) {
-	for c := range p.clients {
-		if c.path == path && c.state == _CLIENT_STATE_PLAY {
-			if c.streamProtocol == _STREAM_PROTOCOL_UDP {
-				if flow == _TRACK_FLOW_RTP {
-					p.rtpl.chanWrite <- &udpWrite{
-						addr: &net.UDPAddr{
-							IP:   c.ip,
-							Port: c.streamTracks[id].rtpPort,
-						},
-						buf: frame,
-					}
-				} else {
-					p.rtcpl.chanWrite <- &udpWrite{
-						addr: &net.UDPAddr{
-							IP:   c.ip,
-							Port: c.streamTracks[id].rtcpPort,
-						},
-						buf: frame,
-					}
-				}
+// waitStreamReady waits until the stream on the given path is ready or the
+// ready timeout expires. It must be called with the mutex unlocked.
+func (p *program) waitStreamReady(path string) (*stream, error) {
+	p.mutex.RLock()
+	str, ok := p.streams[path]
+	var chanReady chan struct{}
+	var state streamState
+	if ok {
+		chanReady = str.chanReady
+		state = str.state
+	}
+	p.mutex.RUnlock()
 
-			} else {
-				c.chanWrite <- &gortsplib.InterleavedFrame{
-					Channel: trackToInterleavedChannel(id, flow),
-					Content: frame,
-				}
+	if !ok {
+		return nil, fmt.Errorf("there is no stream on path '%s'", p.pathDisplayName(path))
+	}
+
+	switch state {
+	case _STREAM_STATE_DISABLED:
+		return nil, fmt.Errorf("stream '%s' is disabled", p.pathDisplayName(path))
+
+	case _STREAM_STATE_EXHAUSTED:
+		return nil, fmt.Errorf("stream '%s' has exhausted its reconnect attempts", p.pathDisplayName(path))
+	}
+
+	t := time.NewTimer(p.conf.StreamReadyTimeout)
+	defer t.Stop()
+
+	select {
+	case <-chanReady:
+		return str, nil
+	case <-t.C:
+		return nil, fmt.Errorf("stream '%s' is not ready yet", p.pathDisplayName(path))
+	}
+}
+
+// getMemoryPressure returns the current memory pressure. It can be called
+// without locking the mutex.
+func (p *program) getMemoryPressure() memoryPressure {
+	return memoryPressure(atomic.LoadInt32(&p.memoryPressure))
+}
+
+// resolvePath returns the stream path associated with the first segment of a
+// path requested by a client, that is either the name of a static stream or
+// an encoded source URL.
+func (p *program) resolvePath(segment string) (string, error) {
+	if _, ok := p.conf.Streams[segment]; ok {
+		return segment, nil
+	}
+	return pathDecode(segment)
+}
+
+// writeClientFrame sends a frame to a client, through the simulated network
+// when impairments are enabled.
+func (p *program) writeClientFrame(sub streamSubscriber, id int, flow trackFlow, frame []byte) {
+	if p.impairment != nil {
+		p.impairment.writeClientFrame(sub, id, flow, frame)
+		return
+	}
+
+	p.sendClientFrame(sub, id, flow, frame)
+}
+
+func (p *program) sendClientFrame(sub streamSubscriber, id int, flow trackFlow, frame []byte) {
+	t, ok := sub.tracks[id]
+	if !ok {
+		return
+	}
+
+	if sub.protocol == _STREAM_PROTOCOL_UDP {
+		sub.c.sent.add(len(frame))
+
+		if flow == _TRACK_FLOW_RTP {
+			p.rtpl.chanWrite <- udpWrite{
+				addr: t.rtpAddr,
+				buf:  frame,
+				dscp: sub.dscp,
+			}
+		} else {
+			p.rtcpl.chanWrite <- udpWrite{
+				addr: t.rtcpAddr,
+				buf:  frame,
+				dscp: sub.dscp,
+			}
+		}
+
+	} else {
+		channel := t.rtpChannel
+		if flow == _TRACK_FLOW_RTCP {
+			channel = t.rtcpChannel
+		}
+
+		f := gortsplib.InterleavedFrame{
+			Channel: channel,
+			Content: frame,
+		}
+
+		if sub.dropFrames {
+			select {
+			case sub.c.chanWrite <- f:
+			default:
 			}
+			return
+		}
+
+		// the client can be closed while frames are being forwarded
+		select {
+		case sub.c.chanWrite <- f:
+		case <-sub.c.done:
 		}
 	}
 }
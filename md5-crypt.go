@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// md5Crypt computes the MD5-based crypt of a password, with either the $1$
+// or the $apr1$ magic.
+func md5Crypt(pass []byte, magic string, salt []byte) string {
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	alt := md5.Sum(append(append(append([]byte{}, pass...), salt...), pass...))
+
+	ctx := append(append(append([]byte{}, pass...), magic...), salt...)
+	for pl := len(pass); pl > 0; pl -= 16 {
+		n := pl
+		if n > 16 {
+			n = 16
+		}
+		ctx = append(ctx, alt[:n]...)
+	}
+	for i := len(pass); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx = append(ctx, 0)
+		} else {
+			ctx = append(ctx, pass[0])
+		}
+	}
+	final := md5.Sum(ctx)
+
+	for i := 0; i < 1000; i++ {
+		ctx = ctx[:0]
+		if i&1 != 0 {
+			ctx = append(ctx, pass...)
+		} else {
+			ctx = append(ctx, final[:]...)
+		}
+		if i%3 != 0 {
+			ctx = append(ctx, salt...)
+		}
+		if i%7 != 0 {
+			ctx = append(ctx, pass...)
+		}
+		if i&1 != 0 {
+			ctx = append(ctx, final[:]...)
+		} else {
+			ctx = append(ctx, pass...)
+		}
+		final = md5.Sum(ctx)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic)
+	b.Write(salt)
+	b.WriteByte('$')
+
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+
+	return b.String()
+}
+
+// checkMd5Crypt checks a password against a MD5-based crypt ($1$ or $apr1$).
+func checkMd5Crypt(hash string, pass string) (bool, error) {
+	magic := "$apr1$"
+	if strings.HasPrefix(hash, "$1$") {
+		magic = "$1$"
+	}
+
+	rest := strings.TrimPrefix(hash, magic)
+	i := strings.IndexByte(rest, '$')
+	if i < 0 {
+		return false, fmt.Errorf("invalid MD5 crypt hash")
+	}
+
+	salt := rest[:i]
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	computed := md5Crypt([]byte(pass), magic, []byte(salt))
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+}
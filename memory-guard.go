@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+const _MEMORY_GUARD_INTERVAL = 1 * time.Second
+
+type memoryPressure int
+
+const (
+	_MEMORY_PRESSURE_NONE memoryPressure = iota
+	_MEMORY_PRESSURE_REJECT
+	_MEMORY_PRESSURE_DROP
+	_MEMORY_PRESSURE_DISCONNECT
+)
+
+func (m memoryPressure) String() string {
+	switch m {
+	case _MEMORY_PRESSURE_NONE:
+		return "none"
+	case _MEMORY_PRESSURE_REJECT:
+		return "rejecting new clients"
+	case _MEMORY_PRESSURE_DROP:
+		return "dropping non-key frames"
+	}
+	return "disconnecting slow clients"
+}
+
+// memoryGuard periodically compares the memory used by the process with the
+// configured limit and sheds load in steps: at 80% of the limit new clients
+// are rejected, at 90% video frames that are not key frames are dropped, at
+// 100% the slowest client is disconnected.
+type memoryGuard struct {
+	p     *program
+	limit uint64
+}
+
+func newMemoryGuard(p *program) *memoryGuard {
+	return &memoryGuard{
+		p:     p,
+		limit: p.conf.MemoryLimit,
+	}
+}
+
+func (g *memoryGuard) log(format string, args ...interface{}) {
+	log.Printf("[memory guard] "+format, args...)
+}
+
+// usage returns an estimate of the resident memory of the process.
+func (g *memoryGuard) usage() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys - ms.HeapReleased
+}
+
+func (g *memoryGuard) run() {
+	t := time.NewTicker(_MEMORY_GUARD_INTERVAL)
+	defer t.Stop()
+
+	for range t.C {
+		used := g.usage()
+
+		pressure := _MEMORY_PRESSURE_NONE
+		switch {
+		case used >= g.limit:
+			pressure = _MEMORY_PRESSURE_DISCONNECT
+		case used >= g.limit/10*9:
+			pressure = _MEMORY_PRESSURE_DROP
+		case used >= g.limit/10*8:
+			pressure = _MEMORY_PRESSURE_REJECT
+		}
+
+		g.p.mutex.Lock()
+
+		if pressure != g.p.getMemoryPressure() {
+			g.log("%d of %d bytes used, pressure: %s", used, g.limit, pressure)
+			atomic.StoreInt32(&g.p.memoryPressure, int32(pressure))
+		}
+
+		if pressure == _MEMORY_PRESSURE_DISCONNECT {
+			if c := g.p.slowestClient(); c != nil {
+				c.log("ERR: memory limit reached, disconnecting")
+				c.close(_TEARDOWN_MEMORY_LIMIT)
+			}
+		}
+
+		g.p.mutex.Unlock()
+
+		// give memory of disconnected clients back to the OS as soon as possible
+		if pressure == _MEMORY_PRESSURE_DISCONNECT {
+			debug.FreeOSMemory()
+		}
+	}
+}
+
+// slowestClient returns the playing client whose writes take the longest.
+// It must be called with the mutex locked.
+func (p *program) slowestClient() *serverClient {
+	var ret *serverClient
+	var retDuration int64
+	for c := range p.clients {
+		if c.state != _CLIENT_STATE_PLAY {
+			continue
+		}
+		d := atomic.LoadInt64(&c.writeDuration)
+		if ret == nil || d > retDuration {
+			ret = c
+			retDuration = d
+		}
+	}
+	return ret
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var influxEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+
+// influxReporter periodically writes metrics to InfluxDB in the line protocol.
+// Metrics with the same tags are written as fields of the same point.
+type influxReporter struct {
+	p          *program
+	url        string
+	token      string
+	httpClient *http.Client
+}
+
+func newInfluxReporter(p *program) *influxReporter {
+	r := &influxReporter{
+		p:     p,
+		url:   p.conf.InfluxUrl,
+		token: p.conf.InfluxToken,
+		httpClient: &http.Client{
+			Timeout: _WRITE_TIMEOUT,
+		},
+	}
+
+	r.log("writing to %s every %s", urlStringRedacted(r.url), p.conf.InfluxInterval)
+	return r
+}
+
+func (r *influxReporter) log(format string, args ...interface{}) {
+	log.Printf("[InfluxDB] "+format, args...)
+}
+
+func (r *influxReporter) run() {
+	t := time.NewTicker(r.p.conf.InfluxInterval)
+	defer t.Stop()
+
+	for range t.C {
+		err := r.write(r.p.collectMetrics(), time.Now())
+		if err != nil {
+			r.log("ERR: %s", err)
+		}
+	}
+}
+
+func (r *influxReporter) encode(metrics []metric, now time.Time) []byte {
+	type point struct {
+		tags   string
+		fields []string
+	}
+
+	points := make(map[string]*point)
+	var order []string
+
+	for _, m := range metrics {
+		var keys []string
+		for k := range m.tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var tags string
+		for _, k := range keys {
+			tags += "," + influxEscaper.Replace(k) + "=" + influxEscaper.Replace(m.tags[k])
+		}
+
+		pt, ok := points[tags]
+		if !ok {
+			pt = &point{tags: tags}
+			points[tags] = pt
+			order = append(order, tags)
+		}
+
+		field := influxEscaper.Replace(m.name) + "="
+		if m.kind == _METRIC_KIND_COUNTER {
+			field += strconv.FormatUint(uint64(m.value), 10) + "i"
+		} else {
+			field += strconv.FormatFloat(m.value, 'f', -1, 64)
+		}
+		pt.fields = append(pt.fields, field)
+	}
+
+	var buf bytes.Buffer
+	for _, tags := range order {
+		pt := points[tags]
+		fmt.Fprintf(&buf, "%s%s %s %d\n", influxEscaper.Replace(r.p.conf.InfluxMeasurement),
+			pt.tags, strings.Join(pt.fields, ","), now.UnixNano())
+	}
+	return buf.Bytes()
+}
+
+func (r *influxReporter) write(metrics []metric, now time.Time) error {
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(r.encode(metrics, now)))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Token "+r.token)
+	}
+
+	res, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("write returned code %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const _PROMETHEUS_PREFIX = "rtsp_simple_proxy_"
+
+// value of labels that replaces the values in excess
+const _PROMETHEUS_OTHER = "other"
+
+// actions taken when a label has too many values
+const (
+	_LABEL_OVERFLOW_AGGREGATE = "aggregate"
+	_LABEL_OVERFLOW_DROP      = "drop"
+)
+
+// labels of stream metrics whose cardinality is limited
+var prometheusLimitedLabels = []string{"path", "codec", "source_host"}
+
+// metrics that can't be summed when series are merged
+var prometheusUnmergeable = map[string]struct{}{
+	"stream_state": {},
+}
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// limitCardinality limits the number of values of each limited label to
+// maxValues. The values of the streams with the most clients are kept; the
+// others are replaced with "other" when action is aggregate, while the label
+// is removed from all series when action is drop. Series that become equal
+// are merged by summing their values.
+func limitCardinality(metrics []metric, maxValues int, action string) []metric {
+	if maxValues <= 0 {
+		return metrics
+	}
+
+	changed := false
+
+	for _, label := range prometheusLimitedLabels {
+		weights := make(map[string]float64)
+		for _, m := range metrics {
+			if v, ok := m.tags[label]; ok {
+				w := weights[v]
+				if m.name == "stream_clients" {
+					w += m.value
+				}
+				weights[v] = w
+			}
+		}
+
+		if len(weights) <= maxValues {
+			continue
+		}
+		changed = true
+
+		values := make([]string, 0, len(weights))
+		for v := range weights {
+			values = append(values, v)
+		}
+		sort.Slice(values, func(i, j int) bool {
+			if weights[values[i]] != weights[values[j]] {
+				return weights[values[i]] > weights[values[j]]
+			}
+			return values[i] < values[j]
+		})
+
+		kept := make(map[string]struct{})
+		for _, v := range values[:maxValues] {
+			kept[v] = struct{}{}
+		}
+
+		for i, m := range metrics {
+			v, ok := m.tags[label]
+			if !ok {
+				continue
+			}
+			if _, ok := kept[v]; ok && action != _LABEL_OVERFLOW_DROP {
+				continue
+			}
+
+			// tags are shared by the metrics of a stream
+			tags := make(map[string]string)
+			for k, v := range m.tags {
+				tags[k] = v
+			}
+			if action == _LABEL_OVERFLOW_DROP {
+				delete(tags, label)
+			} else {
+				tags[label] = _PROMETHEUS_OTHER
+			}
+			metrics[i].tags = tags
+		}
+	}
+
+	if !changed {
+		return metrics
+	}
+
+	var ret []metric
+	index := make(map[string]int)
+	merged := make(map[int]struct{})
+
+	for _, m := range metrics {
+		key := m.key()
+		if i, ok := index[key]; ok {
+			ret[i].value += m.value
+			merged[i] = struct{}{}
+			continue
+		}
+		index[key] = len(ret)
+		ret = append(ret, m)
+	}
+
+	filtered := ret[:0]
+	for i, m := range ret {
+		if _, ok := merged[i]; ok {
+			if _, ok := prometheusUnmergeable[m.name]; ok {
+				continue
+			}
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
+// encodePrometheus encodes metrics in the Prometheus text format.
+func encodePrometheus(metrics []metric) []byte {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].name != metrics[j].name {
+			return metrics[i].name < metrics[j].name
+		}
+		return metrics[i].key() < metrics[j].key()
+	})
+
+	var buf bytes.Buffer
+	prev := ""
+
+	for _, m := range metrics {
+		name := _PROMETHEUS_PREFIX + m.name
+
+		if m.name != prev {
+			typ := "gauge"
+			if m.kind == _METRIC_KIND_COUNTER {
+				typ = "counter"
+			}
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", name, typ)
+			prev = m.name
+		}
+
+		var keys []string
+		for k := range m.tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var labels []string
+		for _, k := range keys {
+			labels = append(labels, k+"=\""+prometheusEscaper.Replace(m.tags[k])+"\"")
+		}
+
+		buf.WriteString(name)
+		if len(labels) > 0 {
+			buf.WriteString("{" + strings.Join(labels, ",") + "}")
+		}
+		buf.WriteString(" " + strconv.FormatFloat(m.value, 'f', -1, 64) + "\n")
+	}
+
+	return buf.Bytes()
+}
+
+// handleMetrics returns the metrics in the Prometheus text format.
+func (l *serverHttpListener) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	metrics := limitCardinality(l.p.collectMetrics(),
+		l.p.conf.MetricsMaxLabels, l.p.conf.MetricsOverflow)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(encodePrometheus(metrics))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const _STATSD_INTERVAL = 10 * time.Second
+
+// statsdReporter periodically pushes metrics to a StatsD server, with tags in
+// the DogStatsD format.
+type statsdReporter struct {
+	p        *program
+	nconn    net.Conn
+	prefix   string
+	tags     []string
+	counters map[string]float64
+}
+
+func newStatsdReporter(p *program) (*statsdReporter, error) {
+	nconn, err := net.Dial("udp", p.conf.StatsdAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, t := range strings.Split(p.conf.StatsdTags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+
+	r := &statsdReporter{
+		p:        p,
+		nconn:    nconn,
+		prefix:   p.conf.StatsdPrefix,
+		tags:     tags,
+		counters: make(map[string]float64),
+	}
+
+	r.log("sending to %s", p.conf.StatsdAddress)
+	return r, nil
+}
+
+func (r *statsdReporter) log(format string, args ...interface{}) {
+	log.Printf("[StatsD] "+format, args...)
+}
+
+func (r *statsdReporter) run() {
+	t := time.NewTicker(_STATSD_INTERVAL)
+	defer t.Stop()
+
+	for range t.C {
+		r.send(r.p.collectMetrics())
+	}
+}
+
+func (r *statsdReporter) send(metrics []metric) {
+	var buf []byte
+
+	// counters of removed streams are forgotten
+	counters := make(map[string]float64)
+	defer func() { r.counters = counters }()
+
+	for _, m := range metrics {
+		value := m.value
+		typ := "g"
+
+		// counters are sent as increments
+		if m.kind == _METRIC_KIND_COUNTER {
+			key := m.key()
+			value = m.value - r.counters[key]
+			counters[key] = m.value
+			if value < 0 {
+				value = m.value
+			}
+			typ = "c"
+		}
+
+		tags := append([]string(nil), r.tags...)
+		for k, v := range m.tags {
+			tags = append(tags, k+":"+strings.NewReplacer(",", "_", "|", "_", "#", "_").Replace(v))
+		}
+		sort.Strings(tags)
+
+		line := fmt.Sprintf("%s%s:%g|%s", r.prefix, m.name, value, typ)
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+
+		// keep datagrams below the MTU
+		if len(buf) > 0 && len(buf)+1+len(line) > 1400 {
+			r.nconn.Write(buf)
+			buf = nil
+		}
+		if len(buf) > 0 {
+			buf = append(buf, '\n')
+		}
+		buf = append(buf, line...)
+	}
+
+	if len(buf) > 0 {
+		r.nconn.Write(buf)
+	}
+}
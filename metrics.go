@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+type metricKind int
+
+const (
+	_METRIC_KIND_GAUGE metricKind = iota
+	_METRIC_KIND_COUNTER
+)
+
+type metric struct {
+	name  string
+	kind  metricKind
+	value float64
+	tags  map[string]string
+}
+
+// key returns an identifier of the metric that includes its tags.
+func (m metric) key() string {
+	var keys []string
+	for k := range m.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret := m.name
+	for _, k := range keys {
+		ret += "," + k + "=" + m.tags[k]
+	}
+	return ret
+}
+
+// collectMetrics returns a snapshot of the metrics of the program.
+func (p *program) collectMetrics() []metric {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	clientsByPath := make(map[string]int)
+	sentByPath := make(map[string]bitrateWindows)
+	for c := range p.clients {
+		clientsByPath[c.path]++
+		sent := sentByPath[c.path]
+		sent.add(c.sent.windows())
+		sentByPath[c.path] = sent
+	}
+
+	ret := []metric{
+		{name: "clients", kind: _METRIC_KIND_GAUGE, value: float64(len(p.clients))},
+		{name: "streams", kind: _METRIC_KIND_GAUGE, value: float64(len(p.streams))},
+		{name: "memory_pressure", kind: _METRIC_KIND_GAUGE, value: float64(p.getMemoryPressure())},
+	}
+
+	for path, s := range p.streams {
+		tags := map[string]string{"path": s.displayName()}
+
+		// empty tags are not accepted by InfluxDB
+		if v := s.codecs(); v != "" {
+			tags["codec"] = v
+		}
+		if v := s.ur.Hostname(); v != "" {
+			tags["source_host"] = v
+		}
+
+		ready := 0.0
+		if s.state == _STREAM_STATE_READY {
+			ready = 1
+		}
+
+		ret = append(ret,
+			metric{name: "stream_ready", kind: _METRIC_KIND_GAUGE, value: ready, tags: tags},
+			metric{name: "stream_state", kind: _METRIC_KIND_GAUGE, value: float64(s.state), tags: tags},
+			metric{name: "stream_clients", kind: _METRIC_KIND_GAUGE, value: float64(clientsByPath[path]), tags: tags},
+			metric{name: "stream_bytes_received", kind: _METRIC_KIND_COUNTER, value: float64(s.stats.totalBytes()), tags: tags},
+			metric{name: "stream_bitrate", kind: _METRIC_KIND_GAUGE, value: s.stats.bitrate(), tags: tags},
+		)
+
+		received := s.stats.bitrateWindows()
+		sent := sentByPath[path]
+		ret = append(ret,
+			metric{name: "stream_bitrate_1s", kind: _METRIC_KIND_GAUGE, value: received.Last1s, tags: tags},
+			metric{name: "stream_bitrate_10s", kind: _METRIC_KIND_GAUGE, value: received.Last10s, tags: tags},
+			metric{name: "stream_bitrate_60s", kind: _METRIC_KIND_GAUGE, value: received.Last60s, tags: tags},
+			metric{name: "stream_clients_bitrate_1s", kind: _METRIC_KIND_GAUGE, value: sent.Last1s, tags: tags},
+			metric{name: "stream_clients_bitrate_10s", kind: _METRIC_KIND_GAUGE, value: sent.Last10s, tags: tags},
+			metric{name: "stream_clients_bitrate_60s", kind: _METRIC_KIND_GAUGE, value: sent.Last60s, tags: tags},
+		)
+
+		if s.dvr != nil {
+			ret = append(ret, metric{name: "stream_buffered_bytes", kind: _METRIC_KIND_GAUGE, value: float64(s.dvr.size()), tags: tags})
+		}
+
+		if s.quota != nil {
+			droppedBytes, droppedPackets := s.quota.dropped()
+			ret = append(ret,
+				metric{name: "stream_quota_dropped_bytes", kind: _METRIC_KIND_COUNTER, value: float64(droppedBytes), tags: tags},
+				metric{name: "stream_quota_dropped_packets", kind: _METRIC_KIND_COUNTER, value: float64(droppedPackets), tags: tags},
+			)
+		}
+	}
+
+	return ret
+}
+
+// codecs returns the encodings of the tracks of a stream, sorted and
+// separated by a comma. It must be called with the program mutex locked.
+func (s *stream) codecs() string {
+	if s.clientSdpParsed == nil {
+		return ""
+	}
+
+	seen := make(map[string]struct{})
+	var ret []string
+	for _, m := range s.clientSdpParsed.Medias {
+		enc := mediaEncoding(m)
+		if _, ok := seen[enc]; ok || enc == "" {
+			continue
+		}
+		seen[enc] = struct{}{}
+		ret = append(ret, enc)
+	}
+
+	sort.Strings(ret)
+	return strings.Join(ret, ",")
+}
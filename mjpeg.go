@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gortc.io/sdp"
+)
+
+const (
+	_MJPEG_BOUNDARY = "frame"
+
+	// clients are disconnected when no frames are received for this duration
+	_MJPEG_FRAME_TIMEOUT = 10 * time.Second
+)
+
+// mjpegBroadcaster reassembles the frames of the first JPEG track of a stream
+// and hands the last one to the clients of the MJPEG endpoint.
+type mjpegBroadcaster struct {
+	trackId int
+
+	mutex        sync.Mutex
+	depacketizer *rtpJpegDepacketizer
+	frame        []byte
+	frameId      int
+
+	// closed and replaced each time a frame is received
+	changed chan struct{}
+}
+
+func newMjpegBroadcaster(msg *sdp.Message) (*mjpegBroadcaster, error) {
+	for i, m := range msg.Medias {
+		if strings.ToUpper(mediaEncoding(m)) == "JPEG" {
+			return &mjpegBroadcaster{
+				trackId:      i,
+				depacketizer: &rtpJpegDepacketizer{},
+				frameId:      -1,
+				changed:      make(chan struct{}),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("the stream doesn't contain any JPEG track")
+}
+
+// writeRtp adds a RTP packet of a track.
+func (b *mjpegBroadcaster) writeRtp(trackId int, pkt []byte) {
+	if trackId != b.trackId {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	frame, err := b.depacketizer.decode(pkt)
+	if err != nil || frame == nil {
+		return
+	}
+
+	b.frame = frame
+	b.frameId++
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// next returns the first frame that follows the one with the given id. It
+// blocks until the frame is available or the timeout expires.
+func (b *mjpegBroadcaster) next(id int, timeout time.Duration) ([]byte, int, bool) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		b.mutex.Lock()
+		frame, frameId, changed := b.frame, b.frameId, b.changed
+		b.mutex.Unlock()
+
+		if frameId > id {
+			return frame, frameId, true
+		}
+
+		select {
+		case <-changed:
+		case <-t.C:
+			return nil, 0, false
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func setMulticastTtl(nconn *net.UDPConn, ttl int) error {
+	return fmt.Errorf("the multicast TTL can't be set on Windows")
+}
+
+func setMulticastInterface(nconn *net.UDPConn, ifi *net.Interface) error {
+	return fmt.Errorf("the multicast interface can't be set on Windows")
+}
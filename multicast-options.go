@@ -0,0 +1,75 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setMulticastTtl sets the TTL of the multicast packets sent by a socket. As
+// with the DSCP, both the IPv4 and the IPv6 options are set, and one of them
+// fails when the socket is not dual-stack.
+func setMulticastTtl(nconn *net.UDPConn, ttl int) error {
+	rc, err := nconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var v4Err, v6Err error
+	err = rc.Control(func(fd uintptr) {
+		v4Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+		v6Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+	})
+	if err != nil {
+		return err
+	}
+
+	if v4Err != nil && v6Err != nil {
+		return v4Err
+	}
+	return nil
+}
+
+// setMulticastInterface sets the interface through which a socket sends
+// multicast packets.
+func setMulticastInterface(nconn *net.UDPConn, ifi *net.Interface) error {
+	// the IPv4 option requires an address of the interface
+	var ip4 [4]byte
+	hasIp4 := false
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipn, ok := addr.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			copy(ip4[:], ipn.IP.To4())
+			hasIp4 = true
+			break
+		}
+	}
+
+	rc, err := nconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	v4Err := fmt.Errorf("interface %s has no IPv4 address", ifi.Name)
+	var v6Err error
+	err = rc.Control(func(fd uintptr) {
+		if hasIp4 {
+			v4Err = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, ip4)
+		}
+		v6Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+	})
+	if err != nil {
+		return err
+	}
+
+	if v4Err != nil && v6Err != nil {
+		return v4Err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// Opus always uses a 48kHz clock in RTP and in MP4 (RFC7587)
+	_OPUS_CLOCK_RATE = 48000
+)
+
+// opusPacketDuration returns the duration of an Opus packet, in samples at
+// 48kHz, as described in RFC6716, section 3.1.
+func opusPacketDuration(pkt []byte) int {
+	if len(pkt) == 0 {
+		return 0
+	}
+
+	// frame duration, in tenths of millisecond
+	config := pkt[0] >> 3
+	var frame int
+	switch {
+	case config < 12: // SILK
+		frame = []int{100, 200, 400, 600}[config%4]
+	case config < 16: // hybrid
+		frame = []int{100, 200}[config%2]
+	default: // CELT
+		frame = []int{25, 50, 100, 200}[config%4]
+	}
+
+	frames := 1
+	switch pkt[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(pkt) < 2 {
+			return 0
+		}
+		frames = int(pkt[1] & 0x3f)
+	}
+
+	return frame * frames * _OPUS_CLOCK_RATE / 10000
+}
+
+// rtpOpusPacketizer puts Opus packets into RTP packets, as described in
+// RFC7587.
+type rtpOpusPacketizer struct {
+	payloadType uint8
+	ssrc        uint32
+	seq         uint16
+}
+
+// packetize returns the RTP packet of an Opus packet.
+func (e *rtpOpusPacketizer) packetize(au []byte, ts uint32) []byte {
+	pkt := make([]byte, 12+len(au))
+	pkt[0] = 0x80
+	pkt[1] = 0x80 | e.payloadType
+	binary.BigEndian.PutUint16(pkt[2:], e.seq)
+	binary.BigEndian.PutUint32(pkt[4:], ts)
+	binary.BigEndian.PutUint32(pkt[8:], e.ssrc)
+	e.seq++
+	copy(pkt[12:], au)
+	return pkt
+}
+
+// rtpOpusDepacketizer extracts Opus packets from RTP packets, that contain
+// exactly one of them.
+type rtpOpusDepacketizer struct{}
+
+// decode returns the Opus packet contained in a RTP packet, together with
+// its timestamp.
+func (d *rtpOpusDepacketizer) decode(pkt []byte) ([][]byte, uint32, error) {
+	payload, ok := rtpPayload(pkt)
+	if !ok || len(payload) == 0 {
+		return nil, 0, fmt.Errorf("invalid RTP packet")
+	}
+	ts := binary.BigEndian.Uint32(pkt[4:])
+	return [][]byte{append([]byte(nil), payload...)}, ts, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gortc.io/sdp"
+)
+
+// interval between the checks of the state of a probed stream
+const _PROBE_POLL_INTERVAL = 10 * time.Millisecond
+
+// probeResult contains the outcome of a probe performed with a protocol.
+type probeResult struct {
+	proto             streamProtocol
+	tracks            []string
+	timeToReady       time.Duration
+	timeToFirstPacket time.Duration
+	bitrate           float64
+}
+
+// mediaResolution returns the resolution of a video track, read from the
+// sprop-parameter-sets of H264 tracks or from the framesize attribute.
+func mediaResolution(m sdp.Media) (int, int, bool) {
+	if sprop, ok := mediaFmtp(m)["sprop-parameter-sets"]; ok {
+		for _, part := range strings.Split(sprop, ",") {
+			nalu, err := base64.StdEncoding.DecodeString(strings.TrimSpace(part))
+			if err != nil || len(nalu) == 0 || nalu[0]&0x1F != _H264_NALU_SPS {
+				continue
+			}
+			width, height, err := h264SpsResolution(nalu)
+			if err == nil {
+				return width, height, true
+			}
+		}
+	}
+
+	// framesize is in the format "payloadType width-height"
+	framesize := m.Attributes.Value("framesize")
+	if n := strings.Index(framesize, " "); n >= 0 {
+		parts := strings.SplitN(framesize[n+1:], "-", 2)
+		if len(parts) == 2 {
+			width, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+			height, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err1 == nil && err2 == nil {
+				return width, height, true
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// probeWithProtocol reads a source with the given protocol, by using the
+// same code of proxied streams, and measures it.
+func probeWithProtocol(p *program, url string, proto streamProtocol, timeout time.Duration,
+	duration time.Duration) (*probeResult, error) {
+	sc := streamConf{
+		Url:    url,
+		UseTcp: proto == _STREAM_PROTOCOL_TCP,
+	}
+
+	start := time.Now()
+	s, err := newStream(p, "probe", sc)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		s.stopWithReason(_TEARDOWN_CLIENT_TEARDOWN)
+	}()
+
+	res := &probeResult{proto: proto}
+	var readyTime time.Time
+	var firstPacketTime time.Time
+	var firstPacketBytes uint64
+	deadline := start.Add(timeout)
+
+	for {
+		time.Sleep(_PROBE_POLL_INTERVAL)
+		now := time.Now()
+
+		p.mutex.RLock()
+		state := s.state
+		sdpParsed := s.clientSdpParsed
+		p.mutex.RUnlock()
+
+		if readyTime.IsZero() {
+			switch state {
+			case _STREAM_STATE_READY:
+				readyTime = now
+				res.timeToReady = now.Sub(start)
+				for i, m := range sdpParsed.Medias {
+					desc := fmt.Sprintf("%d: %s", i, mediaDescription(m))
+					if width, height, ok := mediaResolution(m); ok {
+						desc += fmt.Sprintf(" %dx%d", width, height)
+					}
+					res.tracks = append(res.tracks, desc)
+				}
+
+			// the first attempt failed
+			case _STREAM_STATE_RECONNECTING, _STREAM_STATE_FAILED, _STREAM_STATE_EXHAUSTED:
+				if msg, _ := s.stats.lastErr(); msg != "" {
+					return nil, fmt.Errorf("%s", msg)
+				}
+				return nil, fmt.Errorf("unable to read the stream")
+
+			default:
+				if now.After(deadline) {
+					return nil, fmt.Errorf("the stream is not ready after %s", timeout)
+				}
+			}
+			continue
+		}
+
+		if firstPacketTime.IsZero() {
+			if n := s.stats.totalBytes(); n > 0 {
+				firstPacketTime = now
+				firstPacketBytes = n
+				res.timeToFirstPacket = now.Sub(readyTime)
+				continue
+			}
+
+			if now.Sub(readyTime) > timeout {
+				return nil, fmt.Errorf("no packets received after %s", timeout)
+			}
+			continue
+		}
+
+		if elapsed := now.Sub(firstPacketTime); elapsed >= duration {
+			bytes := s.stats.totalBytes() - firstPacketBytes
+			res.bitrate = float64(bytes*8) / elapsed.Seconds()
+			return res, nil
+		}
+	}
+}
+
+// runProbe reads a source once, prints a report about it and returns. UDP is
+// tried first, then TCP.
+func runProbe(url string, timeout time.Duration, duration time.Duration) error {
+	// the program has no listeners, since the probe has no clients
+	p, err := newProgramFromConf(&conf{
+		SourceSocket: socketConf{
+			NoDelay: true,
+		},
+		SourceTimeouts: sourceTimeoutsConf{
+			Describe:    timeout,
+			Setup:       timeout,
+			FirstPacket: timeout,
+			FrameGap:    timeout,
+		},
+		SourceUdpPorts: defaultSourceUdpPorts,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+
+	for _, proto := range []streamProtocol{_STREAM_PROTOCOL_UDP, _STREAM_PROTOCOL_TCP} {
+		res, err := probeWithProtocol(p, url, proto, timeout, duration)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", proto, err))
+			continue
+		}
+
+		fmt.Printf("url: %s\n", urlStringRedacted(url))
+		fmt.Printf("transport: %s\n", res.proto)
+		fmt.Printf("tracks:\n")
+		for _, t := range res.tracks {
+			fmt.Printf("  %s\n", t)
+		}
+		fmt.Printf("time to ready: %s\n", res.timeToReady.Round(time.Millisecond))
+		fmt.Printf("time to first packet: %s\n", res.timeToFirstPacket.Round(time.Millisecond))
+		fmt.Printf("bitrate: %s\n", formatBitrate(res.bitrate))
+		return nil
+	}
+
+	return fmt.Errorf("probe failed: %s", strings.Join(errs, ", "))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolConn is a connection whose remote address has been provided by
+// a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	br         *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyProtocol reads a PROXY protocol v1 or v2 header from a connection
+// and returns a connection with the remote address of the original client.
+func readProxyProtocol(nconn net.Conn) (net.Conn, error) {
+	nconn.SetReadDeadline(time.Now().Add(_READ_TIMEOUT))
+	defer nconn.SetReadDeadline(time.Time{})
+
+	c := &proxyProtocolConn{
+		Conn:       nconn,
+		br:         bufio.NewReaderSize(nconn, 256),
+		remoteAddr: nconn.RemoteAddr(),
+	}
+
+	sig, err := c.br.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+	if bytes.Equal(sig, proxyProtocolV2Signature) {
+		addr, err = readProxyProtocolV2(c.br)
+	} else {
+		addr, err = readProxyProtocolV1(c.br)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+	return c, nil
+}
+
+func readProxyProtocolV1(br *bufio.Reader) (net.Addr, error) {
+	// the header is at most 107 bytes long
+	var line []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("PROXY header too long")
+		}
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid PROXY header")
+		}
+
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid PROXY source address (%s)", fields[2])
+		}
+
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY source port (%s)", fields[4])
+		}
+
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported PROXY protocol (%s)", fields[1])
+}
+
+func readProxyProtocolV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version (%d)", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command: connection established by the proxy itself
+	if header[12]&0x0F == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("invalid PROXY header")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("invalid PROXY header")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+
+	// unspecified or unix family: keep the address of the connection
+	return nil, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// passthroughValues returns the query parameters of a client that are
+// forwarded to the source.
+func (sc streamConf) passthroughValues(query url.Values) url.Values {
+	ret := url.Values{}
+	for _, key := range sc.QueryPassthrough {
+		v := query.Get(key)
+
+		// clients append the control path of tracks to the query
+		if n := strings.Index(v, "/"); n >= 0 {
+			v = v[:n]
+		}
+
+		if v != "" {
+			ret.Set(key, v)
+		}
+	}
+	return ret
+}
+
+// passthroughUrl returns the URL of the source of a stream, in which the
+// {name} placeholders are replaced with the query parameters of the client.
+// Parameters without placeholder are added to the query of the URL.
+func (sc streamConf) passthroughUrl(values url.Values) (string, error) {
+	rawUrl := sc.Url
+	var extra []string
+
+	for _, key := range sc.QueryPassthrough {
+		v := values.Get(key)
+		placeholder := "{" + key + "}"
+
+		if strings.Contains(rawUrl, placeholder) {
+			if v == "" {
+				return "", fmt.Errorf("query parameter '%s' not provided", key)
+			}
+			rawUrl = strings.Replace(rawUrl, placeholder, url.QueryEscape(v), -1)
+
+		} else if v != "" {
+			extra = append(extra, url.QueryEscape(key)+"="+url.QueryEscape(v))
+		}
+	}
+
+	if len(extra) == 0 {
+		return rawUrl, nil
+	}
+
+	ur, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	if ur.RawQuery != "" {
+		ur.RawQuery += "&"
+	}
+	ur.RawQuery += strings.Join(extra, "&")
+	return ur.String(), nil
+}
+
+// validatePassthrough checks that the URL of a stream with query
+// passthrough is valid once its placeholders are replaced.
+func (sc streamConf) validatePassthrough() error {
+	values := url.Values{}
+	for _, key := range sc.QueryPassthrough {
+		if key == "" {
+			return fmt.Errorf("invalid query passthrough parameter")
+		}
+		values.Set(key, "0")
+	}
+
+	rawUrl, err := sc.passthroughUrl(values)
+	if err != nil {
+		return err
+	}
+
+	ur, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("invalid url: %s", err)
+	}
+	if ur.Scheme != "rtsp" {
+		return fmt.Errorf("query passthrough requires a rtsp url")
+	}
+
+	return nil
+}
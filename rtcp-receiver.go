@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// interval between RTCP receiver reports sent to sources
+const _RTCP_RECEIVER_REPORT_INTERVAL = 5 * time.Second
+
+// time after which sender reports are synthesized, when the source does not
+// send them
+const _RTCP_SENDER_REPORT_TIMEOUT = 3 * _RTCP_RECEIVER_REPORT_INTERVAL
+
+// CNAME sent to sources in receiver reports
+const _RTCP_CNAME = "rtsp-simple-proxy"
+
+const (
+	_RTCP_TYPE_SR   = 200
+	_RTCP_TYPE_RR   = 201
+	_RTCP_TYPE_SDES = 202
+)
+
+// origins of the mapping between RTP timestamps and wall-clock time
+const (
+	_CLOCK_SOURCE_SENDER_REPORT = "sender-report"
+	_CLOCK_SOURCE_SYNTHESIZED   = "synthesized"
+)
+
+// trackClock is the mapping between the RTP timestamps of a track and
+// wall-clock time, taken from the last sender report.
+type trackClock struct {
+	Track        int       `json:"track"`
+	Ssrc         uint32    `json:"ssrc"`
+	ClockRate    int       `json:"clockRate"`
+	RtpTimestamp uint32    `json:"rtpTimestamp"`
+	Time         time.Time `json:"time"`
+	Source       string    `json:"source"`
+}
+
+// rtcpReceiver keeps the state of a track received from a source, in order
+// to send RTCP receiver reports. Some sources do not send sender reports,
+// or stop sending them, until they receive reports, and reports open the
+// path of sender reports through NATs and firewalls. The state is also used
+// to synthesize sender reports when the source does not send any.
+type rtcpReceiver struct {
+	mutex       sync.Mutex
+	clockRate   int
+	localSsrc   uint32
+	sourceSsrc  uint32
+	received    bool
+	maxSeq      uint16
+	cycles      uint32
+	lastSrNtp   uint32
+	lastSrTime  time.Time
+	firstTime   time.Time
+	packets     uint32
+	octets      uint32
+	lastRtpTs   uint32
+	lastRtpTime time.Time
+	clockTs     uint32
+	clockTime   time.Time
+	clockSource string
+}
+
+func newRtcpReceiver(clockRate int) *rtcpReceiver {
+	return &rtcpReceiver{
+		clockRate: clockRate,
+		localSsrc: rand.Uint32(),
+	}
+}
+
+// rtpPayloadSize returns the size of the payload of a RTP packet.
+func rtpPayloadSize(pkt []byte) int {
+	size := 12 + 4*int(pkt[0]&0x0F)
+	if pkt[0]&0x10 != 0 && len(pkt) >= size+4 {
+		size += 4 + 4*int(binary.BigEndian.Uint16(pkt[size+2:]))
+	}
+	if pkt[0]&0x20 != 0 {
+		size += int(pkt[len(pkt)-1])
+	}
+	if size > len(pkt) {
+		return 0
+	}
+	return len(pkt) - size
+}
+
+// processRtp updates the state with a RTP packet.
+func (r *rtcpReceiver) processRtp(pkt []byte) {
+	if len(pkt) < 12 {
+		return
+	}
+
+	ssrc := binary.BigEndian.Uint32(pkt[8:])
+	seq := binary.BigEndian.Uint16(pkt[2:])
+	ts := binary.BigEndian.Uint32(pkt[4:])
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.received || ssrc != r.sourceSsrc {
+		r.received = true
+		r.sourceSsrc = ssrc
+		r.maxSeq = seq
+		r.cycles = 0
+		r.firstTime = now
+		r.packets = 1
+		r.octets = uint32(rtpPayloadSize(pkt))
+		r.lastRtpTs = ts
+		r.lastRtpTime = now
+		return
+	}
+
+	r.packets++
+	r.octets += uint32(rtpPayloadSize(pkt))
+
+	// the timestamp is associated with the time of arrival only when it
+	// increases, since frames can be sent out of order
+	if d := int32(ts - r.lastRtpTs); d > 0 {
+		r.lastRtpTs = ts
+		r.lastRtpTime = now
+	}
+
+	// packets that are late or duplicated do not move the highest sequence
+	// number
+	diff := seq - r.maxSeq
+	if diff != 0 && diff < 0x8000 {
+		if seq < r.maxSeq {
+			r.cycles += 1 << 16
+		}
+		r.maxSeq = seq
+	}
+}
+
+// processRtcp updates the state with a compound RTCP packet, whose sender
+// report, if any, is referenced by the next receiver report.
+func (r *rtcpReceiver) processRtcp(pkt []byte, now time.Time) {
+	for len(pkt) >= 4 {
+		size := (int(binary.BigEndian.Uint16(pkt[2:])) + 1) * 4
+		if size > len(pkt) {
+			return
+		}
+
+		if pkt[1] == _RTCP_TYPE_SR && size >= 28 {
+			r.mutex.Lock()
+			// middle 32 bits of the NTP timestamp
+			r.lastSrNtp = binary.BigEndian.Uint32(pkt[10:])
+			r.lastSrTime = now
+			r.clockTs = binary.BigEndian.Uint32(pkt[16:])
+			r.clockTime = ntpTime(binary.BigEndian.Uint64(pkt[8:]))
+			r.clockSource = _CLOCK_SOURCE_SENDER_REPORT
+			r.mutex.Unlock()
+		}
+
+		pkt = pkt[size:]
+	}
+}
+
+// report returns a compound packet that contains a receiver report and the
+// CNAME, as required by RFC3550.
+func (r *rtcpReceiver) report(now time.Time) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rc := 0
+	if r.received {
+		rc = 1
+	}
+
+	buf := make([]byte, 8+24*rc)
+	buf[0] = 0x80 | byte(rc)
+	buf[1] = _RTCP_TYPE_RR
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)/4-1))
+	binary.BigEndian.PutUint32(buf[4:], r.localSsrc)
+
+	if r.received {
+		block := buf[8:]
+		binary.BigEndian.PutUint32(block[0:], r.sourceSsrc)
+
+		// losses are not tracked, since packets are forwarded as they are
+		binary.BigEndian.PutUint32(block[8:], r.cycles|uint32(r.maxSeq))
+
+		if !r.lastSrTime.IsZero() {
+			binary.BigEndian.PutUint32(block[16:], r.lastSrNtp)
+			// delay since the last sender report, in units of 1/65536 seconds
+			binary.BigEndian.PutUint32(block[20:], uint32(now.Sub(r.lastSrTime)*65536/time.Second))
+		}
+	}
+
+	// SDES with a single chunk, padded to a multiple of 4 bytes with the
+	// end item
+	chunkSize := 4 + 2 + len(_RTCP_CNAME) + 1
+	chunkSize += (4 - chunkSize%4) % 4
+
+	sdes := make([]byte, 4+chunkSize)
+	sdes[0] = 0x81
+	sdes[1] = _RTCP_TYPE_SDES
+	binary.BigEndian.PutUint16(sdes[2:], uint16(len(sdes)/4-1))
+	binary.BigEndian.PutUint32(sdes[4:], r.localSsrc)
+	sdes[8] = 1 // CNAME
+	sdes[9] = byte(len(_RTCP_CNAME))
+	copy(sdes[10:], _RTCP_CNAME)
+
+	return append(buf, sdes...)
+}
+
+// senderReport returns a sender report on behalf of the source, that maps
+// the RTP timestamps of the source to the time of the proxy, or nil when the
+// source sends sender reports or did not send any packet yet.
+func (r *rtcpReceiver) senderReport(now time.Time) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.received || r.clockRate <= 0 ||
+		now.Sub(r.firstTime) < _RTCP_SENDER_REPORT_TIMEOUT ||
+		(!r.lastSrTime.IsZero() && now.Sub(r.lastSrTime) < _RTCP_SENDER_REPORT_TIMEOUT) {
+		return nil
+	}
+
+	// the timestamp is extrapolated from the last one
+	elapsed := now.Sub(r.lastRtpTime)
+	ts := r.lastRtpTs + uint32(int64(elapsed)*int64(r.clockRate)/int64(time.Second))
+
+	buf := make([]byte, 28)
+	buf[0] = 0x80
+	buf[1] = _RTCP_TYPE_SR
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)/4-1))
+	binary.BigEndian.PutUint32(buf[4:], r.sourceSsrc)
+	secs := uint64(now.Unix()) + _NTP_EPOCH_OFFSET
+	frac := uint64(now.Nanosecond()) << 32 / 1000000000
+	binary.BigEndian.PutUint64(buf[8:], secs<<32|frac)
+	binary.BigEndian.PutUint32(buf[16:], ts)
+	binary.BigEndian.PutUint32(buf[20:], r.packets)
+	binary.BigEndian.PutUint32(buf[24:], r.octets)
+
+	r.clockTs = ts
+	r.clockTime = now
+	r.clockSource = _CLOCK_SOURCE_SYNTHESIZED
+	return buf
+}
+
+// clock returns the mapping between RTP timestamps and wall-clock time, if
+// a sender report has been received or synthesized.
+func (r *rtcpReceiver) clock() (trackClock, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.clockSource == "" {
+		return trackClock{}, false
+	}
+
+	return trackClock{
+		Ssrc:         r.sourceSsrc,
+		ClockRate:    r.clockRate,
+		RtpTimestamp: r.clockTs,
+		Time:         r.clockTime.UTC(),
+		Source:       r.clockSource,
+	}, true
+}
+
+// ntpTime converts a NTP timestamp into a time.
+func ntpTime(v uint64) time.Time {
+	secs := int64(v>>32) - _NTP_EPOCH_OFFSET
+	nsecs := int64((v & 0xFFFFFFFF) * 1000000000 >> 32)
+	return time.Unix(secs, nsecs)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// rtpReorderBuffer releases the RTP packets of a track in the order of their
+// sequence numbers. Packets that follow a missing one are held until it
+// arrives, until the buffer is full or until they have been held for the
+// hold time; packets that arrive after the ones that follow them have been
+// released are released immediately.
+type rtpReorderBuffer struct {
+	slots       [][]byte
+	times       []time.Time
+	hold        time.Duration
+	held        int
+	expected    uint16
+	initialized bool
+}
+
+// newRtpReorderBuffer allocates a buffer. depth must be a power of two, such
+// that slots are not shared when sequence numbers wrap around.
+func newRtpReorderBuffer(depth int, hold time.Duration) *rtpReorderBuffer {
+	return &rtpReorderBuffer{
+		slots: make([][]byte, depth),
+		times: make([]time.Time, depth),
+		hold:  hold,
+	}
+}
+
+// push adds a packet received at the given time and returns the packets
+// that can be released.
+func (b *rtpReorderBuffer) push(pkt []byte, now time.Time) [][]byte {
+	if len(pkt) < 12 {
+		return [][]byte{pkt}
+	}
+
+	seq := binary.BigEndian.Uint16(pkt[2:])
+
+	if !b.initialized {
+		b.initialized = true
+		b.expected = seq
+	}
+
+	diff := int16(seq - b.expected)
+	if diff < 0 {
+		return [][]byte{pkt}
+	}
+
+	// the gap is too large to be filled: held packets are released and the
+	// missing ones are skipped
+	if int(diff) >= len(b.slots) {
+		ret := b.flush()
+		b.expected = seq + 1
+		return append(ret, pkt)
+	}
+
+	i := int(seq) % len(b.slots)
+	if b.slots[i] == nil {
+		b.held++
+	}
+	b.slots[i] = pkt
+	b.times[i] = now
+
+	return b.expire(b.release(nil), now)
+}
+
+// release appends the packets that follow the last released one, without
+// gaps.
+func (b *rtpReorderBuffer) release(ret [][]byte) [][]byte {
+	for b.held > 0 {
+		i := int(b.expected) % len(b.slots)
+		if b.slots[i] == nil {
+			break
+		}
+		ret = append(ret, b.slots[i])
+		b.slots[i] = nil
+		b.held--
+		b.expected++
+	}
+	return ret
+}
+
+// expire appends the packets that have been held for the hold time, and the
+// ones that follow them. The missing packets that precede them are skipped.
+func (b *rtpReorderBuffer) expire(ret [][]byte, now time.Time) [][]byte {
+	if b.hold <= 0 {
+		return ret
+	}
+
+	for b.held > 0 {
+		n := b.firstHeld()
+		i := (int(b.expected) + n) % len(b.slots)
+		if now.Sub(b.times[i]) < b.hold {
+			break
+		}
+		b.expected += uint16(n)
+		ret = b.release(ret)
+	}
+	return ret
+}
+
+// firstHeld returns the distance between the next expected packet and the
+// first held one. It must be called when packets are held.
+func (b *rtpReorderBuffer) firstHeld() int {
+	n := 0
+	for b.slots[(int(b.expected)+n)%len(b.slots)] == nil {
+		n++
+	}
+	return n
+}
+
+// deadline returns the time at which the first held packet expires, if any.
+func (b *rtpReorderBuffer) deadline() (time.Time, bool) {
+	if b.hold <= 0 || b.held == 0 {
+		return time.Time{}, false
+	}
+	i := (int(b.expected) + b.firstHeld()) % len(b.slots)
+	return b.times[i].Add(b.hold), true
+}
+
+// flush returns all the held packets, in order.
+func (b *rtpReorderBuffer) flush() [][]byte {
+	var ret [][]byte
+	for n := 0; b.held > 0 && n < len(b.slots); n++ {
+		i := (int(b.expected) + n) % len(b.slots)
+		if b.slots[i] != nil {
+			ret = append(ret, b.slots[i])
+			b.slots[i] = nil
+			b.held--
+		}
+	}
+	return ret
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aler9/gortsplib"
+)
+
+// headers whose values are not dumped
+var dumpRedactedHeaders = map[string]struct{}{
+	"Authorization":       {},
+	"Proxy-Authorization": {},
+}
+
+func dumpHeader(header gortsplib.Header) string {
+	var keys []string
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ret string
+	for _, k := range keys {
+		for _, v := range header[k] {
+			if _, ok := dumpRedactedHeaders[k]; ok {
+				v = "<redacted>"
+			}
+			ret += "\n  " + k + ": " + v
+		}
+	}
+	return ret
+}
+
+func dumpContent(content []byte) string {
+	if len(content) == 0 {
+		return ""
+	}
+	return "\n\n  " + strings.Replace(strings.TrimRight(string(content), "\r\n"), "\n", "\n  ", -1)
+}
+
+// dumpUrl returns a request URL without credentials. Dynamic streams are
+// requested with the encoded URL of their source, that is redacted too.
+func dumpUrl(ur *url.URL) string {
+	segment := requestPathSegment(ur)
+	decoded, err := pathDecode(segment)
+	if err != nil {
+		return urlRedacted(ur)
+	}
+
+	sourceUr, err := url.Parse(decoded)
+	if err != nil || sourceUr.User == nil {
+		return urlRedacted(ur)
+	}
+
+	u := *ur
+	u.Path = strings.Replace(u.Path, segment,
+		base64.StdEncoding.EncodeToString([]byte(urlRedacted(sourceUr))), 1)
+	u.RawPath = ""
+	return urlRedacted(&u)
+}
+
+// dumpRequest returns a representation of a request, without credentials.
+func dumpRequest(req *gortsplib.Request) string {
+	u := ""
+	if req.Url != nil {
+		u = dumpUrl(req.Url)
+	}
+	return fmt.Sprintf("%s %s%s%s", req.Method, u, dumpHeader(req.Header), dumpContent(req.Content))
+}
+
+// dumpResponse returns a representation of a response, without credentials.
+func dumpResponse(res *gortsplib.Response) string {
+	return fmt.Sprintf("%d %s%s%s", res.StatusCode, res.Status, dumpHeader(res.Header), dumpContent(res.Content))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maximum size of the body of a request. Clients send bodies only with
+// SET_PARAMETER and GET_PARAMETER, that are small
+const _RTSP_MAX_BODY_SIZE = 64 * 1024
+
+// bytes of each header line that are kept in order to read Content-Length
+const _RTSP_LIMITS_LINE_PREFIX = 64
+
+// requestLimitsConf contains the limits of what clients can send. 0 means
+// unlimited.
+type requestLimitsConf struct {
+	RequestLine     int  // length of the request line, in bytes
+	Headers         int  // number of headers of each request
+	HeaderSize      int  // length of each header line, in bytes
+	InterleavedSize int  // size of interleaved frames, in bytes
+	Cseq            bool // whether the CSeq of requests must increase
+}
+
+// rtspLimitError is returned when a client exceeds a limit.
+type rtspLimitError struct {
+	msg string
+}
+
+func (e rtspLimitError) Error() string {
+	return e.msg
+}
+
+type rtspLimitState int
+
+const (
+	_RTSP_LIMIT_STATE_START rtspLimitState = iota
+	_RTSP_LIMIT_STATE_REQUEST_LINE
+	_RTSP_LIMIT_STATE_HEADER
+	_RTSP_LIMIT_STATE_FRAME_HEADER
+	_RTSP_LIMIT_STATE_BODY
+)
+
+// rtspLimitConn follows the framing of the RTSP requests and interleaved
+// frames read from a connection, and fails reads as soon as a limit is
+// exceeded, before the content is buffered by the parser.
+type rtspLimitConn struct {
+	net.Conn
+	limits requestLimitsConf
+
+	state         rtspLimitState
+	lineLen       int
+	line          []byte // beginning of the current header line
+	headers       int
+	contentLength int
+	frameHeader   []byte
+	remaining     int // bytes of the current body or frame
+}
+
+func newRtspLimitConn(nconn net.Conn, limits requestLimitsConf) *rtspLimitConn {
+	return &rtspLimitConn{
+		Conn:   nconn,
+		limits: limits,
+	}
+}
+
+func (l *rtspLimitConn) Read(b []byte) (int, error) {
+	n, err := l.Conn.Read(b)
+	if n > 0 {
+		if lerr := l.scan(b[:n]); lerr != nil {
+			return 0, lerr
+		}
+	}
+	return n, err
+}
+
+func (l *rtspLimitConn) scan(buf []byte) error {
+	for len(buf) > 0 {
+		switch l.state {
+		case _RTSP_LIMIT_STATE_START:
+			if buf[0] == '$' {
+				l.state = _RTSP_LIMIT_STATE_FRAME_HEADER
+				l.frameHeader = l.frameHeader[:0]
+				buf = buf[1:]
+				continue
+			}
+
+			// empty lines between messages are ignored
+			if buf[0] == '\r' || buf[0] == '\n' {
+				buf = buf[1:]
+				continue
+			}
+
+			l.state = _RTSP_LIMIT_STATE_REQUEST_LINE
+			l.lineLen = 0
+			l.headers = 0
+			l.contentLength = 0
+
+		case _RTSP_LIMIT_STATE_REQUEST_LINE, _RTSP_LIMIT_STATE_HEADER:
+			n := len(buf)
+			end := false
+			for i, c := range buf {
+				if c == '\n' {
+					n = i + 1
+					end = true
+					break
+				}
+			}
+
+			l.lineLen += n
+			if l.state == _RTSP_LIMIT_STATE_REQUEST_LINE {
+				if l.limits.RequestLine > 0 && l.lineLen > l.limits.RequestLine {
+					return rtspLimitError{fmt.Sprintf("request line exceeds %d bytes", l.limits.RequestLine)}
+				}
+			} else {
+				if l.limits.HeaderSize > 0 && l.lineLen > l.limits.HeaderSize {
+					return rtspLimitError{fmt.Sprintf("header exceeds %d bytes", l.limits.HeaderSize)}
+				}
+				if free := _RTSP_LIMITS_LINE_PREFIX - len(l.line); free > 0 {
+					if free > n {
+						free = n
+					}
+					l.line = append(l.line, buf[:free]...)
+				}
+			}
+			buf = buf[n:]
+
+			if !end {
+				continue
+			}
+
+			if l.state == _RTSP_LIMIT_STATE_REQUEST_LINE {
+				l.state = _RTSP_LIMIT_STATE_HEADER
+				l.lineLen = 0
+				l.line = l.line[:0]
+				continue
+			}
+
+			err := l.endHeader()
+			if err != nil {
+				return err
+			}
+
+		case _RTSP_LIMIT_STATE_FRAME_HEADER:
+			l.frameHeader = append(l.frameHeader, buf[0])
+			buf = buf[1:]
+
+			// channel and size
+			if len(l.frameHeader) < 3 {
+				continue
+			}
+
+			size := int(l.frameHeader[1])<<8 | int(l.frameHeader[2])
+			if l.limits.InterleavedSize > 0 && size > l.limits.InterleavedSize {
+				return rtspLimitError{fmt.Sprintf("interleaved frame exceeds %d bytes", l.limits.InterleavedSize)}
+			}
+			l.startBody(size)
+
+		case _RTSP_LIMIT_STATE_BODY:
+			n := l.remaining
+			if n > len(buf) {
+				n = len(buf)
+			}
+			buf = buf[n:]
+			l.remaining -= n
+			if l.remaining == 0 {
+				l.state = _RTSP_LIMIT_STATE_START
+			}
+		}
+	}
+
+	return nil
+}
+
+// endHeader is called at the end of each header line.
+func (l *rtspLimitConn) endHeader() error {
+	line := strings.TrimRight(string(l.line), "\r\n")
+	l.lineLen = 0
+	l.line = l.line[:0]
+
+	// end of headers
+	if line == "" {
+		l.startBody(l.contentLength)
+		return nil
+	}
+
+	l.headers++
+	if l.limits.Headers > 0 && l.headers > l.limits.Headers {
+		return rtspLimitError{fmt.Sprintf("request has more than %d headers", l.limits.Headers)}
+	}
+
+	if parts := strings.SplitN(line, ":", 2); len(parts) == 2 &&
+		strings.EqualFold(strings.TrimSpace(parts[0]), "Content-Length") {
+		v, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 31)
+		if err != nil || v > _RTSP_MAX_BODY_SIZE {
+			return rtspLimitError{fmt.Sprintf("invalid content length: %s", strings.TrimSpace(parts[1]))}
+		}
+		l.contentLength = int(v)
+	}
+
+	return nil
+}
+
+func (l *rtspLimitConn) startBody(size int) {
+	if size == 0 {
+		l.state = _RTSP_LIMIT_STATE_START
+		return
+	}
+	l.state = _RTSP_LIMIT_STATE_BODY
+	l.remaining = size
+}
+
+// checkCseq checks that the CSeq of a request is greater than the one of the
+// previous request.
+func (c *serverClient) checkCseq(cseq string) error {
+	v, err := strconv.ParseUint(strings.TrimSpace(cseq), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid cseq: %s", cseq)
+	}
+
+	if c.hasCseq && v <= c.lastCseq {
+		return fmt.Errorf("cseq %d does not follow %d", v, c.lastCseq)
+	}
+	c.hasCseq = true
+	c.lastCseq = v
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"gortc.io/sdp"
+)
+
+// streamSdpTrackConf contains the attributes that are added to a track of
+// the SDP sent to clients.
+type streamSdpTrackConf struct {
+	Track      int               `yaml:"track"`
+	Bandwidth  int               `yaml:"bandwidth"`
+	Framerate  float64           `yaml:"framerate"`
+	Attributes map[string]string `yaml:"attributes"`
+}
+
+// streamSdpConf contains the attributes that are added to the SDP sent to
+// clients, or that replace the ones of the source. Some video management
+// systems use them for admission control and to pace the display.
+type streamSdpConf struct {
+	Bandwidth int                  `yaml:"bandwidth"`
+	Tracks    []streamSdpTrackConf `yaml:"tracks"`
+}
+
+func (sc streamSdpConf) validate() error {
+	if sc.Bandwidth < 0 {
+		return fmt.Errorf("invalid SDP bandwidth: %d", sc.Bandwidth)
+	}
+
+	tracks := make(map[int]struct{})
+	for _, tc := range sc.Tracks {
+		if tc.Track < 0 {
+			return fmt.Errorf("invalid SDP track: %d", tc.Track)
+		}
+		if _, ok := tracks[tc.Track]; ok {
+			return fmt.Errorf("SDP track %d is defined twice", tc.Track)
+		}
+		tracks[tc.Track] = struct{}{}
+
+		if tc.Bandwidth < 0 {
+			return fmt.Errorf("invalid SDP bandwidth of track %d: %d", tc.Track, tc.Bandwidth)
+		}
+		if tc.Framerate < 0 {
+			return fmt.Errorf("invalid SDP framerate of track %d: %v", tc.Track, tc.Framerate)
+		}
+
+		for key := range tc.Attributes {
+			// the control attribute is generated by the server
+			if key == "" || key == "control" {
+				return fmt.Errorf("invalid SDP attribute of track %d: '%s'", tc.Track, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (sc streamSdpConf) track(i int) (streamSdpTrackConf, bool) {
+	for _, tc := range sc.Tracks {
+		if tc.Track == i {
+			return tc, true
+		}
+	}
+	return streamSdpTrackConf{}, false
+}
+
+// overrideBandwidth returns a copy of bandwidths in which the application
+// specific bandwidth is replaced, if it is set.
+func overrideBandwidth(in sdp.Bandwidths, as int) sdp.Bandwidths {
+	if as == 0 {
+		return in
+	}
+
+	out := make(sdp.Bandwidths)
+	for k, v := range in {
+		out[k] = v
+	}
+	out[sdp.BandwidthApplicationSpecific] = as
+	return out
+}
+
+// setAttribute replaces the attributes with the given key, keeping the
+// position of the first one, or adds one.
+func setAttribute(attributes []sdp.Attribute, key string, value string) []sdp.Attribute {
+	var out []sdp.Attribute
+	found := false
+	for _, attr := range attributes {
+		if attr.Key != key {
+			out = append(out, attr)
+		} else if !found {
+			out = append(out, sdp.Attribute{Key: key, Value: value})
+			found = true
+		}
+	}
+	if !found {
+		out = append(out, sdp.Attribute{Key: key, Value: value})
+	}
+	return out
+}
+
+// apply adds the configured attributes to the medias of a SDP.
+func (sc streamSdpConf) apply(msg *sdp.Message) {
+	msg.Bandwidths = overrideBandwidth(msg.Bandwidths, sc.Bandwidth)
+
+	for i := range msg.Medias {
+		tc, ok := sc.track(i)
+		if !ok {
+			continue
+		}
+		m := &msg.Medias[i]
+
+		m.Bandwidths = overrideBandwidth(m.Bandwidths, tc.Bandwidth)
+
+		if tc.Framerate > 0 {
+			m.Attributes = setAttribute(m.Attributes, "framerate",
+				strconv.FormatFloat(tc.Framerate, 'f', -1, 64))
+		}
+
+		// attributes are sorted, such that the SDP doesn't change between
+		// sessions
+		var keys []string
+		for key := range tc.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			m.Attributes = setAttribute(m.Attributes, key, tc.Attributes[key])
+		}
+	}
+}
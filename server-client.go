@@ -1,23 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/aler9/gortsplib"
 )
 
-func interleavedChannelToTrack(channel uint8) (int, trackFlow) {
-	if (channel % 2) == 0 {
-		return int(channel / 2), _TRACK_FLOW_RTP
-	}
-	return int((channel - 1) / 2), _TRACK_FLOW_RTCP
-}
+// speed factor of the replay of buffered media to new clients
+const _REPLAY_SPEED = 4
+
+const (
+	// size of the buffer in which interleaved frames are coalesced
+	_TCP_WRITE_BUFFER_SIZE = 64 * 1024
+
+	// maximum time that a coalesced frame waits before being written
+	_TCP_FLUSH_INTERVAL = 5 * time.Millisecond
+)
 
 func trackToInterleavedChannel(id int, flow trackFlow) uint8 {
 	if flow == _TRACK_FLOW_RTP {
@@ -26,6 +37,109 @@ func trackToInterleavedChannel(id int, flow trackFlow) uint8 {
 	return uint8((id * 2) + 1)
 }
 
+// pathDecode decodes a path requested by a client into the URL of the source.
+func pathDecode(path string) (string, error) {
+	pathBytes, err := base64.StdEncoding.DecodeString(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to to base64 decode RTSP URL: %w", err)
+	}
+	return string(pathBytes), nil
+}
+
+// setupTrackError is an error of the track requested by a SETUP request,
+// that is answered with its status code without closing the connection.
+type setupTrackError struct {
+	code gortsplib.StatusCode
+	msg  string
+}
+
+func (e setupTrackError) Error() string {
+	return e.msg
+}
+
+// setupTrackId returns the id of the track requested by a SETUP request, that
+// is contained in the last segment of the path (trackID=id) or is the first
+// track that is not setup yet. Tracks that are not in the SDP of the stream
+// and tracks that are already setup are refused.
+func (c *serverClient) setupTrackId(ur *url.URL, count int) (int, error) {
+	segment := ur.Path
+	if n := strings.LastIndex(segment, "/"); n >= 0 {
+		segment = segment[n+1:]
+	}
+
+	if strings.HasPrefix(segment, "trackID=") {
+		id, err := strconv.ParseUint(strings.TrimPrefix(segment, "trackID="), 10, 31)
+		if err != nil || int(id) >= count {
+			return 0, setupTrackError{gortsplib.StatusNotFound,
+				fmt.Sprintf("invalid track (%s), the stream has %d tracks", segment, count)}
+		}
+
+		if _, ok := c.streamTracks[int(id)]; ok {
+			return 0, setupTrackError{gortsplib.StatusMethodNotValidInThisState,
+				fmt.Sprintf("track %d has already been setup", id)}
+		}
+		return int(id), nil
+	}
+
+	for id := 0; id < count; id++ {
+		if _, ok := c.streamTracks[id]; !ok {
+			return id, nil
+		}
+	}
+	return 0, setupTrackError{gortsplib.StatusMethodNotValidInThisState,
+		"all the tracks have already been setup"}
+}
+
+// writeSetupError answers a SETUP request that failed, and tells whether
+// the connection can be kept open.
+func (c *serverClient) writeSetupError(req *gortsplib.Request, err error) bool {
+	var terr setupTrackError
+	if errors.As(err, &terr) {
+		c.writeResError(req, terr.code, err)
+		return true
+	}
+
+	c.writeResError(req, gortsplib.StatusBadRequest, err)
+	return false
+}
+
+// readInterleaved returns the interleaved channels requested in a transport
+// header, in the form interleaved=rtp-rtcp or interleaved=rtp.
+func readInterleaved(th gortsplib.HeaderTransport) (int, int, bool, error) {
+	for k := range th {
+		if !strings.HasPrefix(k, "interleaved=") {
+			continue
+		}
+
+		v := strings.TrimPrefix(k, "interleaved=")
+		parts := strings.Split(v, "-")
+		if len(parts) > 2 {
+			return 0, 0, false, fmt.Errorf("invalid interleaved channels (%s)", v)
+		}
+
+		rtp, err := strconv.ParseUint(parts[0], 10, 8)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("invalid interleaved channels (%s)", v)
+		}
+
+		rtcp := rtp + 1
+		if len(parts) == 2 {
+			rtcp, err = strconv.ParseUint(parts[1], 10, 8)
+			if err != nil {
+				return 0, 0, false, fmt.Errorf("invalid interleaved channels (%s)", v)
+			}
+		}
+
+		if rtcp > 255 || rtcp == rtp {
+			return 0, 0, false, fmt.Errorf("invalid interleaved channels (%s)", v)
+		}
+
+		return int(rtp), int(rtcp), true, nil
+	}
+
+	return 0, 0, false, nil
+}
+
 type clientState int
 
 const (
@@ -34,6 +148,16 @@ const (
 	_CLIENT_STATE_PLAY
 )
 
+func (s clientState) String() string {
+	switch s {
+	case _CLIENT_STATE_PRE_PLAY:
+		return "pre-play"
+	case _CLIENT_STATE_PLAY:
+		return "play"
+	}
+	return "starting"
+}
+
 type serverClient struct {
 	p              *program
 	conn           *gortsplib.ConnServer
@@ -41,16 +165,45 @@ type serverClient struct {
 	ip             net.IP
 	path           string
 	streamProtocol streamProtocol
-	streamTracks   []*track
-	chanWrite      chan *gortsplib.InterleavedFrame
+	streamTracks   map[int]*track
+	dscp           uint8 // DSCP of the stream, 0 means the DSCP of the socket
+	chanWrite      chan gortsplib.InterleavedFrame
+	done           chan struct{}
+	stream         *stream // stream whose frames are received live, if any
+	timeShiftStop  chan struct{}
+	streamLogger   *log.Logger
+	debugRtsp      bool
+	authNonce      string
+	identity       authIdentity // identity of the last authenticated request
+	authenticated  bool
+	writeDuration  int64 // average duration of writes to the connection, in nanoseconds
+	latency        latencyProfile
+	keyFrameWait   int32     // whether live video is skipped until a key frame
+	pacer          *tcpPacer // paces frames of TCP clients, if enabled
+	userAgent      string
+	authHeader     []string       // credentials of the last authenticated request
+	exitReason     teardownReason // reason of the end of the session, set by its routine
+	teardown       teardownReason // reason of the end of the session
+	sent           *rollingBitrate
+	videoFirst     bool // whether video is kept over audio when the queue fills up
+	lastCseq       uint64
+	hasCseq        bool
+
+	// whether the connection is tunneled through a WebSocket, that allows
+	// only interleaved frames
+	tunneled bool
 }
 
 func newServerClient(p *program, nconn net.Conn) *serverClient {
 	c := &serverClient{
-		p:         p,
-		conn:      gortsplib.NewConnServer(nconn, _READ_TIMEOUT, _WRITE_TIMEOUT),
-		state:     _CLIENT_STATE_STARTING,
-		chanWrite: make(chan *gortsplib.InterleavedFrame),
+		p:            p,
+		conn:         gortsplib.NewConnServer(newRtspLimitConn(nconn, p.conf.RequestLimits), _READ_TIMEOUT, _WRITE_TIMEOUT),
+		state:        _CLIENT_STATE_STARTING,
+		streamTracks: make(map[int]*track),
+		chanWrite:    make(chan gortsplib.InterleavedFrame),
+		done:         make(chan struct{}),
+		authNonce:    newAuthNonce(),
+		sent:         newRollingBitrate(),
 	}
 
 	c.p.mutex.Lock()
@@ -60,31 +213,77 @@ func newServerClient(p *program, nconn net.Conn) *serverClient {
 	return c
 }
 
-func (c *serverClient) close() error {
+// close closes the client. It must be called with the program mutex locked.
+func (c *serverClient) close(reason teardownReason) error {
 	// already deleted
 	if _, ok := c.p.clients[c]; !ok {
 		return nil
 	}
 
+	c.teardown = reason
+
+	// sessions of playing clients are counted by the stream
+	if c.state == _CLIENT_STATE_PLAY {
+		str := c.stream
+		if str == nil {
+			str = c.p.streams[c.path]
+		}
+		if str != nil {
+			str.stats.addClientTeardown(reason)
+			if reason.initiatedByProxy() {
+				str.log("client %s disconnected, reason: %s", c.ipString(), reason)
+			}
+		}
+	}
+
 	delete(c.p.clients, c)
+	c.unsubscribe()
 	c.conn.NetConn().Close()
-	close(c.chanWrite)
+	close(c.done)
+	c.stopTimeShift()
+
+	// dedicated streams are stopped together with their client
+	if str, ok := c.p.streams[c.path]; ok && str.conf.Vod {
+		str.log("client disconnected, stopping, reason: %s", reason)
+		str.stopWithReason(reason)
+		delete(c.p.streams, c.path)
+	}
 
 	return nil
 }
 
+// setExitReason sets the reason of the end of the session, when the routine
+// of the client exits.
+func (c *serverClient) setExitReason(reason teardownReason) {
+	if c.exitReason == "" {
+		c.exitReason = reason
+	}
+}
+
 func (c *serverClient) log(format string, args ...interface{}) {
 	// keep remote address outside format, since it can contain %
-	log.Println("[RTSP client " + c.conn.NetConn().RemoteAddr().String() + "] " +
-		fmt.Sprintf(format, args...))
+	line := "[RTSP client " + c.conn.NetConn().RemoteAddr().String() + "] " +
+		fmt.Sprintf(format, args...)
+	log.Println(line)
+	if c.streamLogger != nil {
+		c.streamLogger.Println(line)
+	}
 }
 
 func (c *serverClient) run() {
-	defer c.log("disconnected")
 	defer func() {
 		c.p.mutex.Lock()
 		defer c.p.mutex.Unlock()
-		c.close()
+
+		// sessions that end without a known reason have been refused
+		reason := c.exitReason
+		if reason == "" {
+			reason = _TEARDOWN_REQUEST_REJECTED
+		}
+		c.close(reason)
+
+		// the reason of the first close is kept
+		c.log("disconnected, reason: %s", c.teardown)
 	}()
 
 	ipstr, _, _ := net.SplitHostPort(c.conn.NetConn().RemoteAddr().String())
@@ -98,16 +297,172 @@ func (c *serverClient) run() {
 			if err != io.EOF {
 				c.log("ERR: %s", err)
 			}
+			c.setExitReason(connErrorReason(err, _TEARDOWN_READ_TIMEOUT))
 			return
 		}
 
 		ok := c.handleRequest(req)
 		if !ok {
+			if req.Method == gortsplib.TEARDOWN {
+				c.setExitReason(_TEARDOWN_CLIENT_TEARDOWN)
+			}
 			return
 		}
 	}
 }
 
+// publicMethods returns the methods advertised in responses to OPTIONS, that
+// must be the ones handled by handleRequest, since some clients don't use
+// methods that are not advertised.
+func publicMethods() []string {
+	return []string{
+		string(gortsplib.OPTIONS),
+		string(gortsplib.DESCRIBE),
+		string(gortsplib.SETUP),
+		string(gortsplib.PLAY),
+		string(gortsplib.PAUSE),
+		string(gortsplib.GET_PARAMETER),
+		string(gortsplib.TEARDOWN),
+	}
+}
+
+// supportedFeatures returns the option tags (RFC7826) that are implemented
+// for a stream, that are advertised in responses to OPTIONS and accepted in
+// the Require and Proxy-Require headers. The proxy is the server of its
+// clients, therefore the two headers are handled in the same way.
+func supportedFeatures(sc streamConf) []string {
+	ret := []string{
+		"play.basic",
+	}
+
+	// Scale and Speed are implemented by forwarding them to the source
+	if sc.ScalePassthrough || sc.Vod {
+		ret = append(ret, "play.scale", "play.speed")
+	}
+
+	return ret
+}
+
+// requestFeatures returns the option tags that are implemented for the
+// stream of a request.
+func (c *serverClient) requestFeatures(req *gortsplib.Request) []string {
+	var sc streamConf
+	if name, err := c.p.resolvePath(requestPathSegment(req.Url)); err == nil {
+		sc = c.p.conf.Streams[name]
+	}
+	return supportedFeatures(sc)
+}
+
+// unsupportedFeatures returns the option tags of the Require and
+// Proxy-Require headers of a request that are not implemented.
+func unsupportedFeatures(req *gortsplib.Request, features []string) []string {
+	supported := make(map[string]struct{})
+	for _, f := range features {
+		supported[f] = struct{}{}
+	}
+
+	var ret []string
+	seen := make(map[string]struct{})
+
+	for _, key := range []string{"Require", "Proxy-Require"} {
+		for _, v := range req.Header[key] {
+			for _, tag := range strings.Split(v, ",") {
+				tag = strings.TrimSpace(tag)
+				if tag == "" {
+					continue
+				}
+				if _, ok := supported[strings.ToLower(tag)]; ok {
+					continue
+				}
+				if _, ok := seen[tag]; ok {
+					continue
+				}
+				seen[tag] = struct{}{}
+				ret = append(ret, tag)
+			}
+		}
+	}
+
+	return ret
+}
+
+// requestPathSegment returns the first segment of the path of a request, that
+// identifies the stream.
+func requestPathSegment(ur *url.URL) string {
+	path := ur.Path
+
+	if len(path) > 0 && path[0] == '/' {
+		path = path[1:]
+	}
+
+	if n := strings.Index(path, "/"); n >= 0 {
+		path = path[:n]
+	}
+	return path
+}
+
+func transportIsUdp(th gortsplib.HeaderTransport) bool {
+	_, ok := th["RTP/AVP"]
+	if ok {
+		return true
+	}
+	_, ok = th["RTP/AVP/UDP"]
+	return ok
+}
+
+// selectTransport returns the first transport offered by a client that can be
+// satisfied, since clients can offer several transports separated by commas.
+// When none can be satisfied, the returned error explains why the last one
+// was refused.
+func (c *serverClient) selectTransport(raw string) (gortsplib.HeaderTransport, error) {
+	var err error
+
+	for _, alt := range strings.Split(raw, ",") {
+		th := gortsplib.ReadHeaderTransport(strings.TrimSpace(alt))
+		err = func() error {
+			if _, ok := th["unicast"]; !ok {
+				return fmt.Errorf("transport header does not contain unicast (%s)", alt)
+			}
+
+			var proto streamProtocol
+			if transportIsUdp(th) {
+				proto = _STREAM_PROTOCOL_UDP
+			} else if _, ok := th["RTP/AVP/TCP"]; ok {
+				proto = _STREAM_PROTOCOL_TCP
+			} else {
+				return fmt.Errorf("transport header does not contain a valid protocol (RTP/AVP, RTP/AVP/UDP or RTP/AVP/TCP) (%s)", alt)
+			}
+
+			if _, ok := c.p.protocols[proto]; !ok {
+				return fmt.Errorf("%s streaming is disabled", strings.ToUpper(proto.String()))
+			}
+
+			if len(c.streamTracks) > 0 && c.streamProtocol != proto {
+				return fmt.Errorf("client want to send tracks with different protocols")
+			}
+
+			if proto == _STREAM_PROTOCOL_UDP {
+				// clients connected through a Unix socket have no IP
+				if c.ip == nil || c.tunneled {
+					return fmt.Errorf("UDP streaming is not available on this connection")
+				}
+
+				rtpPort, rtcpPort := th.GetPorts("client_port")
+				if rtpPort == 0 || rtcpPort == 0 {
+					return fmt.Errorf("transport header does not have valid client ports (%s)", alt)
+				}
+			}
+
+			return nil
+		}()
+		if err == nil {
+			return th, nil
+		}
+	}
+
+	return nil, err
+}
+
 func (c *serverClient) writeResError(req *gortsplib.Request, code gortsplib.StatusCode, err error) {
 	c.log("ERR: %s", err)
 
@@ -116,77 +471,286 @@ func (c *serverClient) writeResError(req *gortsplib.Request, code gortsplib.Stat
 		header["CSeq"] = []string{cseq[0]}
 	}
 
-	c.conn.WriteResponse(&gortsplib.Response{
+	c.writeResponse(&gortsplib.Response{
 		StatusCode: code,
 		Header:     header,
 	})
 }
 
+// authenticate checks the credentials of a request. When they are not valid,
+// it writes the response and returns false.
+func (c *serverClient) authenticate(req *gortsplib.Request, cseq string) bool {
+	if !c.p.authRequired() || req.Method == gortsplib.OPTIONS {
+		return true
+	}
+
+	name := requestPathSegment(req.Url)
+
+	header, ok := req.Header["Authorization"]
+	if ok {
+		if id, valid := c.p.checkCredentials(header, string(req.Method), req.Url, name, c.authNonce, c.log); valid {
+			c.setIdentity(req, id)
+			return true
+		}
+
+		// requests without credentials are the first step of the
+		// authentication and are not failures
+		c.log("ERR: authentication failed")
+		c.p.audit.write(auditEvent{
+			Event:  _AUDIT_AUTH_FAILURE,
+			User:   authHeaderUser(header),
+			Ip:     c.ipString(),
+			Method: string(req.Method),
+			Path:   c.p.auditPath(name),
+		})
+
+		if c.p.bans.addFailure(c.ipString()) {
+			c.log("banned for %s", c.p.conf.AuthBanDuration)
+			go c.p.saveState()
+			c.p.audit.write(auditEvent{
+				Event:  _AUDIT_BAN,
+				Ip:     c.ipString(),
+				Detail: fmt.Sprintf("banned for %s", c.p.conf.AuthBanDuration),
+			})
+		}
+	}
+
+	c.writeResponse(&gortsplib.Response{
+		StatusCode: gortsplib.StatusUnauthorized,
+		Header: gortsplib.Header{
+			"CSeq":             []string{cseq},
+			"WWW-Authenticate": c.p.authChallenge(name, c.authNonce),
+		},
+	})
+	return false
+}
+
+// setIdentity records the identity of an authenticated request. Successes
+// are audited once per identity, since clients authenticate every request.
+func (c *serverClient) setIdentity(req *gortsplib.Request, id authIdentity) {
+	if !c.authenticated || c.identity.user != id.user {
+		c.p.audit.write(auditEvent{
+			Event:  _AUDIT_AUTH_SUCCESS,
+			User:   id.user,
+			Ip:     c.ipString(),
+			Method: string(req.Method),
+			Path:   c.p.auditPath(requestPathSegment(req.Url)),
+		})
+	}
+
+	c.p.mutex.Lock()
+	c.identity = id
+	c.authHeader = req.Header["Authorization"]
+	c.p.mutex.Unlock()
+
+	c.authenticated = true
+}
+
+// ipString returns the IP of the client, or an empty string for clients
+// connected through a Unix socket.
+func (c *serverClient) ipString() string {
+	if c.ip == nil {
+		return ""
+	}
+	return c.ip.String()
+}
+
+func (c *serverClient) writeResponse(res *gortsplib.Response) error {
+	if c.p.conf.DebugRtsp || c.debugRtsp {
+		c.log("response: %s", dumpResponse(res))
+	}
+	return c.conn.WriteResponse(res)
+}
+
 func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 	c.log(string(req.Method))
 
+	if c.p.conf.DebugRtsp || c.debugRtsp {
+		c.log("request: %s", dumpRequest(req))
+	}
+
 	cseq, ok := req.Header["CSeq"]
 	if !ok || len(cseq) != 1 {
 		c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("cseq missing"))
 		return false
 	}
 
-	path := req.Url.Path
+	if c.p.conf.RequestLimits.Cseq {
+		err := c.checkCseq(cseq[0])
+		if err != nil {
+			c.writeResError(req, gortsplib.StatusBadRequest, err)
+			c.setExitReason(_TEARDOWN_PROTOCOL_VIOLATION)
+			return false
+		}
+	}
+
+	if ua, ok := req.Header["User-Agent"]; ok && len(ua) == 1 {
+		c.userAgent = ua[0]
+	}
 
-	if len(path) > 0 && path[0] == '/' {
-		path = path[1:]
+	// strict clients abort the session when required features are ignored
+	if unsupported := unsupportedFeatures(req, c.requestFeatures(req)); len(unsupported) > 0 {
+		c.log("ERR: unsupported features: %s", strings.Join(unsupported, ", "))
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOptionNotSupported,
+			Header: gortsplib.Header{
+				"CSeq":        []string{cseq[0]},
+				"Unsupported": []string{strings.Join(unsupported, ", ")},
+			},
+		})
+		return true
 	}
 
-	if len(path) > 0 {
-		if n := strings.Index(path, "/"); n >= 0 {
-			path = path[:n]
+	if c.p.bans.isBanned(c.ipString()) {
+		c.writeResError(req, gortsplib.StatusForbidden, fmt.Errorf("IP is banned"))
+		c.p.audit.write(auditEvent{
+			Event:  _AUDIT_ACCESS_DENIED,
+			Ip:     c.ipString(),
+			Method: string(req.Method),
+			Path:   c.p.auditPath(requestPathSegment(req.Url)),
+			Detail: "IP is banned",
+		})
+		return false
+	}
+
+	if !c.authenticate(req, cseq[0]) {
+		return true
+	}
+
+	// in drain mode, existing sessions continue but new ones are refused
+	if req.Method == gortsplib.DESCRIBE || (req.Method == gortsplib.SETUP && c.state == _CLIENT_STATE_STARTING) {
+		c.p.mutex.RLock()
+		draining := c.p.draining
+		pressure := c.p.getMemoryPressure()
+		c.p.mutex.RUnlock()
+
+		if draining {
+			c.writeResError(req, gortsplib.StatusCode(c.p.conf.DrainStatus), fmt.Errorf("server is draining"))
+			return false
 		}
 
-		var err error
+		if pressure >= _MEMORY_PRESSURE_REJECT {
+			c.writeResError(req, gortsplib.StatusServiceUnavailable, fmt.Errorf("memory limit reached"))
+			return false
+		}
+	}
+
+	path := requestPathSegment(req.Url)
 
-		pathBytes, err := base64.StdEncoding.DecodeString(path)
+	if len(path) > 0 {
+		name, err := c.p.resolvePath(path)
 		if err != nil {
-			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("failed to to base64 decode RTSP URL: %w", err))
+			c.writeResError(req, gortsplib.StatusBadRequest, err)
+			return false
+		}
+
+		if (req.Method == gortsplib.DESCRIBE || req.Method == gortsplib.SETUP) &&
+			!aclAllows(c.p.conf.Acl, c.identity, name) {
+			c.writeResError(req, gortsplib.StatusForbidden, fmt.Errorf("access to '%s' is denied", c.p.pathDisplayName(name)))
+			c.p.audit.write(auditEvent{
+				Event:  _AUDIT_ACCESS_DENIED,
+				User:   c.identity.user,
+				Ip:     c.ipString(),
+				Method: string(req.Method),
+				Path:   c.p.auditPath(path),
+				Detail: "denied by ACL",
+			})
 			return false
 		}
 
-		useTCP := true
-		proto := req.Url.Query().Get("proto")
+		sc, ok := c.p.conf.Streams[name]
+		if !ok {
+			useTCP := true
+			proto := req.Url.Query().Get("proto")
+
+			// strip any subpath
+			if n := strings.Index(proto, "/"); n >= 0 {
+				proto = proto[:n]
+			}
+
+			switch proto {
+			case "tcp", "":
+			case "udp":
+				useTCP = false
+			default:
+				c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("invalid proto query param: %s", proto))
+				return false
+			}
+
+			// local files can be read only by static streams
+			if !strings.HasPrefix(name, "rtsp://") {
+				c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("unsupported URL: %s", urlStringRedacted(name)))
+				return false
+			}
 
-		// strip any subpath
-		if n := strings.Index(proto, "/"); n >= 0 {
-			proto = proto[:n]
+			sc = streamConf{
+				Url:    name,
+				UseTcp: useTCP,
+			}
 		}
 
-		path = string(pathBytes)
+		path = name
+		c.debugRtsp = sc.DebugRtsp
 
-		switch proto {
-		case "tcp", "":
-		case "udp":
-			useTCP = false
-		default:
-			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("invalid proto query param: %s", proto))
-			return false
+		// streams with query passthrough have a source for each combination
+		// of parameters. Requests without parameters, like SETUP requests
+		// of some clients, belong to the stream chosen before.
+		reused := false
+		if ok && len(sc.QueryPassthrough) > 0 {
+			values := sc.passthroughValues(req.Url.Query())
+
+			if len(values) == 0 && strings.HasPrefix(c.path, name+"?") {
+				path = c.path
+				reused = true
+			} else {
+				sc.Url, err = sc.passthroughUrl(values)
+				if err != nil {
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+				path = name + "?" + values.Encode()
+			}
 		}
 
-		c.p.mutex.RLock()
-		_, exists := c.p.streams[path]
-		c.p.mutex.RUnlock()
+		// in VOD mode, each client has a dedicated stream
+		if sc.Vod && !reused {
+			path = fmt.Sprintf("%s#%p", path, c)
+		}
 
-		if !exists {
-			str, err := newStream(c.p, path, streamConf{
-				Url:    path,
-				UseTcp: useTCP,
-			})
+		// check and create under the same lock, so that concurrent clients
+		// share a single stream
+		err = func() error {
+			c.p.mutex.Lock()
+			defer c.p.mutex.Unlock()
+
+			if _, exists := c.p.streams[path]; exists || reused {
+				return nil
+			}
+
+			// streams pulled on demand keep the source set through the API
+			// and follow their schedule
+			if _, ok := c.p.onDemand[path]; ok {
+				if u, ok := c.p.remaps[path]; ok {
+					sc.Url = u
+				}
+				if !sc.scheduleActive(time.Now()) {
+					sc.Disabled = true
+				}
+			}
+
+			str, err := newStream(c.p, path, sc)
 			if err != nil {
-				c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf(
-					"failed to create stream with given RTSP URL: %s, %w",
-					path, err))
-				return false
+				return err
 			}
-			c.p.mutex.Lock()
+
 			c.p.streams[path] = str
-			c.p.mutex.Unlock()
+			return nil
+		}()
+		if err != nil {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf(
+				"failed to create stream with given RTSP URL: %s, %w",
+				path, err))
+			return false
 		}
 	}
 
@@ -195,17 +759,24 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 		// do not check state, since OPTIONS can be requested
 		// in any state
 
-		c.conn.WriteResponse(&gortsplib.Response{
+		c.writeResponse(&gortsplib.Response{
 			StatusCode: gortsplib.StatusOK,
 			Header: gortsplib.Header{
-				"CSeq": []string{cseq[0]},
-				"Public": []string{strings.Join([]string{
-					string(gortsplib.DESCRIBE),
-					string(gortsplib.SETUP),
-					string(gortsplib.PLAY),
-					string(gortsplib.PAUSE),
-					string(gortsplib.TEARDOWN),
-				}, ", ")},
+				"CSeq":      []string{cseq[0]},
+				"Public":    []string{strings.Join(publicMethods(), ", ")},
+				"Supported": []string{strings.Join(c.requestFeatures(req), ", ")},
+			},
+		})
+		return true
+
+	case gortsplib.GET_PARAMETER:
+		// used by clients as keepalive; parameters are not supported,
+		// therefore the body is always empty
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq":         []string{cseq[0]},
+				"Content-Type": []string{"text/parameters"},
 			},
 		})
 		return true
@@ -217,23 +788,33 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 		}
 
 		sdp, err := func() ([]byte, error) {
-			c.p.mutex.RLock()
-			defer c.p.mutex.RUnlock()
+			// answer with the cached SDP while the stream is being established
+			cached := func() []byte {
+				c.p.mutex.RLock()
+				defer c.p.mutex.RUnlock()
 
-			str, ok := c.p.streams[path]
-			if !ok {
-				return nil, fmt.Errorf("there is no stream on path '%s'", path)
+				if str, ok := c.p.streams[path]; ok && str.state == _STREAM_STATE_READY {
+					return nil
+				}
+				if e, ok := c.p.sdpCache[path]; ok {
+					return e.text
+				}
+				return nil
+			}()
+			if cached != nil {
+				return cached, nil
 			}
 
-			st := time.Now()
-			for str.state != _STREAM_STATE_READY {
-				if time.Now().Sub(st) > c.p.conf.StreamReadyTimeout {
-					return nil, fmt.Errorf("stream '%s' is not ready yet", path)
-				}
+			str, err := c.p.waitStreamReady(path)
+			if err != nil {
+				return nil, err
+			}
 
-				c.p.mutex.RUnlock()
-				time.Sleep(time.Second)
-				c.p.mutex.RLock()
+			c.p.mutex.RLock()
+			defer c.p.mutex.RUnlock()
+
+			if str.state != _STREAM_STATE_READY {
+				return nil, fmt.Errorf("stream '%s' is not ready yet", c.p.pathDisplayName(path))
 			}
 
 			return str.serverSdpText, nil
@@ -243,7 +824,7 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return false
 		}
 
-		c.conn.WriteResponse(&gortsplib.Response{
+		c.writeResponse(&gortsplib.Response{
 			StatusCode: gortsplib.StatusOK,
 			Header: gortsplib.Header{
 				"CSeq":         []string{cseq[0]},
@@ -261,149 +842,174 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return false
 		}
 
-		th := gortsplib.ReadHeaderTransport(tsRaw[0])
-
-		if _, ok := th["unicast"]; !ok {
-			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not contain unicast"))
-			return false
-		}
-
 		switch c.state {
 		// play
 		case _CLIENT_STATE_STARTING, _CLIENT_STATE_PRE_PLAY:
-			// play via UDP
-			if func() bool {
-				_, ok := th["RTP/AVP"]
-				if ok {
-					return true
-				}
-				_, ok = th["RTP/AVP/UDP"]
-				if ok {
-					return true
-				}
-				return false
-			}() {
-				if _, ok := c.p.protocols[_STREAM_PROTOCOL_UDP]; !ok {
-					c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("UDP streaming is disabled"))
-					return false
-				}
+			th, err := c.selectTransport(tsRaw[0])
+			if err != nil {
+				// the session is kept, such that the client can retry with
+				// another transport
+				c.writeResError(req, gortsplib.StatusUnsupportedTransport, err)
+				return true
+			}
 
+			// play via UDP
+			if transportIsUdp(th) {
 				rtpPort, rtcpPort := th.GetPorts("client_port")
-				if rtpPort == 0 || rtcpPort == 0 {
-					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not have valid client ports (%s)", tsRaw[0]))
-					return false
-				}
 
 				if c.path != "" && path != c.path {
 					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
 					return false
 				}
 
-				err := func() error {
+				str, err := c.p.waitStreamReady(path)
+				if err != nil {
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+
+				err = func() error {
 					c.p.mutex.Lock()
 					defer c.p.mutex.Unlock()
 
-					str, ok := c.p.streams[path]
-					if !ok {
-						return fmt.Errorf("there is no stream on path '%s'", path)
-					}
-
-					st := time.Now()
-					for str.state != _STREAM_STATE_READY {
-						if time.Now().Sub(st) > c.p.conf.StreamReadyTimeout {
-							return fmt.Errorf("stream '%s' is not ready yet", path)
-						}
-
-						c.p.mutex.Unlock()
-						time.Sleep(time.Second)
-						c.p.mutex.Lock()
+					if str.state != _STREAM_STATE_READY {
+						return fmt.Errorf("stream '%s' is not ready yet", c.p.pathDisplayName(path))
 					}
 
 					if len(c.streamTracks) > 0 && c.streamProtocol != _STREAM_PROTOCOL_UDP {
 						return fmt.Errorf("client want to send tracks with different protocols")
 					}
 
-					if len(c.streamTracks) >= len(str.serverSdpParsed.Medias) {
-						return fmt.Errorf("all the tracks have already been setup")
+					id, err := c.setupTrackId(req.Url, len(str.serverSdpParsed.Medias))
+					if err != nil {
+						return err
 					}
 
 					c.path = path
+					c.streamLogger = str.logger
 					c.streamProtocol = _STREAM_PROTOCOL_UDP
-					c.streamTracks = append(c.streamTracks, &track{
+					c.setTrack(id, &track{
 						rtpPort:  rtpPort,
 						rtcpPort: rtcpPort,
+						rtpAddr:  &net.UDPAddr{IP: c.ip, Port: rtpPort},
+						rtcpAddr: &net.UDPAddr{IP: c.ip, Port: rtcpPort},
 					})
 
 					c.state = _CLIENT_STATE_PRE_PLAY
 					return nil
 				}()
 				if err != nil {
-					c.writeResError(req, gortsplib.StatusBadRequest, err)
-					return false
+					return c.writeSetupError(req, err)
 				}
 
-				c.conn.WriteResponse(&gortsplib.Response{
+				transport := []string{
+					"RTP/AVP/UDP",
+					"unicast",
+					fmt.Sprintf("client_port=%d-%d", rtpPort, rtcpPort),
+					fmt.Sprintf("server_port=%d-%d", c.p.conf.RtpPort, c.p.conf.RtcpPort),
+				}
+				if c.p.conf.ExternalIp != nil {
+					transport = append(transport, "source="+c.p.conf.ExternalIp.String())
+				}
+
+				c.writeResponse(&gortsplib.Response{
 					StatusCode: gortsplib.StatusOK,
 					Header: gortsplib.Header{
-						"CSeq": []string{cseq[0]},
-						"Transport": []string{strings.Join([]string{
-							"RTP/AVP/UDP",
-							"unicast",
-							fmt.Sprintf("client_port=%d-%d", rtpPort, rtcpPort),
-							fmt.Sprintf("server_port=%d-%d", c.p.conf.RtpPort, c.p.conf.RtcpPort),
-						}, ";")},
-						"Session": []string{"12345678"},
+						"CSeq":      []string{cseq[0]},
+						"Transport": []string{strings.Join(transport, ";")},
+						"Session":   []string{"12345678"},
 					},
 				})
+
+				c.p.rtpl.punchHole(&net.UDPAddr{IP: c.ip, Port: rtpPort})
+				c.p.rtcpl.punchHole(&net.UDPAddr{IP: c.ip, Port: rtcpPort})
 				return true
 
 				// play via TCP
-			} else if _, ok := th["RTP/AVP/TCP"]; ok {
-				if _, ok := c.p.protocols[_STREAM_PROTOCOL_TCP]; !ok {
-					c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("TCP streaming is disabled"))
+			} else {
+				if c.path != "" && path != c.path {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
 					return false
 				}
 
-				if c.path != "" && path != c.path {
-					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
+				reqRtpChannel, reqRtcpChannel, hasChannels, err := readInterleaved(th)
+				if err != nil {
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
 					return false
 				}
 
-				err := func() error {
+				str, err := c.p.waitStreamReady(path)
+				if err != nil {
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+
+				var setupTrack *track
+				err = func() error {
 					c.p.mutex.Lock()
 					defer c.p.mutex.Unlock()
 
-					str, ok := c.p.streams[path]
-					if !ok {
-						return fmt.Errorf("there is no stream on path '%s'", path)
+					if str.state != _STREAM_STATE_READY {
+						return fmt.Errorf("stream '%s' is not ready yet", c.p.pathDisplayName(path))
 					}
 
 					if len(c.streamTracks) > 0 && c.streamProtocol != _STREAM_PROTOCOL_TCP {
 						return fmt.Errorf("client want to send tracks with different protocols")
 					}
 
-					if len(c.streamTracks) >= len(str.serverSdpParsed.Medias) {
-						return fmt.Errorf("all the tracks have already been setup")
+					id, err := c.setupTrackId(req.Url, len(str.serverSdpParsed.Medias))
+					if err != nil {
+						return err
+					}
+
+					inUse := func(rtpChannel uint8, rtcpChannel uint8) bool {
+						for _, t := range c.streamTracks {
+							if t.rtpChannel == rtpChannel || t.rtpChannel == rtcpChannel ||
+								t.rtcpChannel == rtpChannel || t.rtcpChannel == rtcpChannel {
+								return true
+							}
+						}
+						return false
+					}
+
+					// use the channels requested by the client, if any;
+					// otherwise, the channels of the track id, or the first
+					// free ones when they have been requested for another
+					// track
+					rtpChannel := trackToInterleavedChannel(id, _TRACK_FLOW_RTP)
+					rtcpChannel := trackToInterleavedChannel(id, _TRACK_FLOW_RTCP)
+					if hasChannels {
+						rtpChannel, rtcpChannel = uint8(reqRtpChannel), uint8(reqRtcpChannel)
+					} else {
+						for ch := 0; inUse(rtpChannel, rtcpChannel) && ch < 255; ch += 2 {
+							rtpChannel, rtcpChannel = uint8(ch), uint8(ch+1)
+						}
+					}
+
+					if inUse(rtpChannel, rtcpChannel) {
+						return fmt.Errorf("interleaved channels %d-%d are already in use", rtpChannel, rtcpChannel)
 					}
 
 					c.path = path
+					c.streamLogger = str.logger
 					c.streamProtocol = _STREAM_PROTOCOL_TCP
-					c.streamTracks = append(c.streamTracks, &track{
-						rtpPort:  0,
-						rtcpPort: 0,
+					c.setTrack(id, &track{
+						rtpChannel:  rtpChannel,
+						rtcpChannel: rtcpChannel,
 					})
+					setupTrack = c.streamTracks[id]
 
 					c.state = _CLIENT_STATE_PRE_PLAY
 					return nil
 				}()
 				if err != nil {
-					c.writeResError(req, gortsplib.StatusBadRequest, err)
-					return false
+					return c.writeSetupError(req, err)
 				}
 
-				interleaved := fmt.Sprintf("%d-%d", ((len(c.streamTracks) - 1) * 2), ((len(c.streamTracks)-1)*2)+1)
+				t := setupTrack
+				interleaved := fmt.Sprintf("%d-%d", t.rtpChannel, t.rtcpChannel)
 
-				c.conn.WriteResponse(&gortsplib.Response{
+				c.writeResponse(&gortsplib.Response{
 					StatusCode: gortsplib.StatusOK,
 					Header: gortsplib.Header{
 						"CSeq": []string{cseq[0]},
@@ -416,10 +1022,6 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 					},
 				})
 				return true
-
-			} else {
-				c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not contain a valid protocol (RTP/AVP, RTP/AVP/UDP or RTP/AVP/TCP) (%s)", tsRaw[0]))
-				return false
 			}
 
 		default:
@@ -438,19 +1040,45 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return false
 		}
 
+		var str *stream
+		var dvr *streamDvr
+		var rangeStart time.Time
+		var clockRates map[uint8]int
+
 		err := func() error {
 			c.p.mutex.Lock()
 			defer c.p.mutex.Unlock()
 
-			str, ok := c.p.streams[c.path]
+			var ok bool
+			str, ok = c.p.streams[c.path]
 			if !ok {
-				return fmt.Errorf("no one is streaming on path '%s'", c.path)
+				return fmt.Errorf("no one is streaming on path '%s'", c.p.pathDisplayName(c.path))
+			}
+
+			if len(c.streamTracks) == 0 {
+				return fmt.Errorf("no tracks have been setup")
 			}
 
-			if len(c.streamTracks) != len(str.serverSdpParsed.Medias) {
-				return fmt.Errorf("not all tracks have been setup")
+			// the stream may have been restarted with less tracks
+			if str.serverSdpParsed != nil {
+				for id := range c.streamTracks {
+					if id >= len(str.serverSdpParsed.Medias) {
+						return fmt.Errorf("track %d is not in the stream anymore", id)
+					}
+				}
 			}
 
+			if str.conf.TcpPacing && c.streamProtocol == _STREAM_PROTOCOL_TCP &&
+				str.clientSdpParsed != nil {
+				clockRates = make(map[uint8]int)
+				for id, t := range c.streamTracks {
+					if id < len(str.clientSdpParsed.Medias) {
+						clockRates[t.rtpChannel] = mediaClockRate(str.clientSdpParsed.Medias[id])
+					}
+				}
+			}
+
+			dvr = str.dvr
 			return nil
 		}()
 		if err != nil {
@@ -458,36 +1086,155 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return false
 		}
 
+		header := gortsplib.Header{
+			"CSeq":    []string{cseq[0]},
+			"Session": []string{"12345678"},
+		}
+
+		// headers that are forwarded to the source
+		var passthrough []string
+		if str.conf.RangePassthrough || str.conf.Vod {
+			passthrough = append(passthrough, "Range")
+		}
+		if str.conf.ScalePassthrough || str.conf.Vod {
+			passthrough = append(passthrough, "Scale", "Speed")
+		}
+
+		forwardHeader := gortsplib.Header{}
+		for _, k := range passthrough {
+			if v, ok := req.Header[k]; ok {
+				forwardHeader[k] = v
+			}
+		}
+
+		rangeRaw, hasRange := req.Header["Range"]
+
+		// in VOD mode, PLAY is always forwarded, in order to resume after PAUSE
+		if len(forwardHeader) > 0 || str.conf.Vod {
+			res, err := str.request(&gortsplib.Request{
+				Method: gortsplib.PLAY,
+				Url: &url.URL{
+					Scheme:   "rtsp",
+					Host:     str.ur.Host,
+					Path:     str.ur.Path,
+					RawQuery: str.ur.RawQuery,
+				},
+				Header: forwardHeader,
+			})
+			if err != nil {
+				c.writeResError(req, gortsplib.StatusBadRequest, err)
+				return false
+			}
+
+			if res.StatusCode != gortsplib.StatusOK {
+				c.writeResError(req, res.StatusCode, fmt.Errorf("source returned code %d", res.StatusCode))
+				return false
+			}
+
+			for _, k := range passthrough {
+				if v, ok := res.Header[k]; ok {
+					header[k] = v
+				}
+			}
+
+		} else if hasRange && len(rangeRaw) == 1 && c.p.conf.DvrDuration > 0 {
+			rangeStart, err = dvr.parseRangeStart(rangeRaw[0])
+			if err != nil {
+				c.writeResError(req, gortsplib.StatusInvalidRange, err)
+				return false
+			}
+
+			if !rangeStart.IsZero() && rangeStart.Before(time.Now().Add(-c.p.conf.DvrDuration)) {
+				c.writeResError(req, gortsplib.StatusInvalidRange, fmt.Errorf("requested range is outside the time-shift buffer"))
+				return false
+			}
+		}
+
+		if !rangeStart.IsZero() {
+			header["Range"] = []string{"clock=" + rangeStart.UTC().Format("20060102T150405.000Z") + "-"}
+		}
+
+		// the DSCP of the stream overrides the global one
+		if str.conf.Dscp != 0 {
+			c.dscp = uint8(str.conf.Dscp)
+
+			if c.streamProtocol == _STREAM_PROTOCOL_TCP {
+				// the socket is behind the parsing limits
+				nconn := c.conn.NetConn()
+				if lc, ok := nconn.(*rtspLimitConn); ok {
+					nconn = lc.Conn
+				}
+
+				if sc, ok := nconn.(syscall.Conn); ok {
+					err := setDscp(sc, str.conf.Dscp)
+					if err != nil {
+						c.log("ERR: unable to set DSCP: %s", err)
+					}
+				}
+			}
+		}
+
+		// the queue is replaced before the client receives frames
+		c.latency = str.latency
+		c.videoFirst = str.conf.CongestionPolicy == _CONGESTION_POLICY_VIDEO_FIRST
+		queue := c.latency.clientQueue
+
+		// time-shifted playback and replay are not paced, since they are
+		// sent at their own pace
+		if clockRates != nil && rangeStart.IsZero() && str.conf.ReplayOnConnect == 0 {
+			c.pacer = newTcpPacer(clockRates)
+
+			// frames wait in the queue while they are paced
+			if queue == 0 {
+				queue = _TCP_PACING_QUEUE
+			}
+		}
+
+		if c.streamProtocol == _STREAM_PROTOCOL_TCP && queue > 0 {
+			// the queue is read by state dumps with the mutex locked
+			c.p.mutex.Lock()
+			c.chanWrite = make(chan gortsplib.InterleavedFrame, queue)
+			c.p.mutex.Unlock()
+		}
+
 		// first write response, then set state
 		// otherwise, in case of TCP connections, RTP packets could be written
 		// before the response
-		c.conn.WriteResponse(&gortsplib.Response{
+		c.writeResponse(&gortsplib.Response{
 			StatusCode: gortsplib.StatusOK,
-			Header: gortsplib.Header{
-				"CSeq":    []string{cseq[0]},
-				"Session": []string{"12345678"},
-			},
+			Header:     header,
 		})
 
-		c.log("is receiving on path '%s', %d %s via %s", c.path, len(c.streamTracks), func() string {
+		c.log("is receiving on path '%s', %d %s via %s", c.p.pathDisplayName(c.path), len(c.streamTracks), func() string {
 			if len(c.streamTracks) == 1 {
 				return "track"
 			}
 			return "tracks"
 		}(), c.streamProtocol)
 
+		str.stats.addSession(c.userAgent, c.streamProtocol.String())
+
 		c.p.mutex.Lock()
 		c.state = _CLIENT_STATE_PLAY
+		if !rangeStart.IsZero() {
+			c.timeShiftStop = make(chan struct{})
+			go c.runTimeShift(dvr, dvr.seek(rangeStart), time.Since(rangeStart), c.timeShiftStop)
+
+		} else if str.conf.ReplayOnConnect > 0 {
+			c.timeShiftStop = make(chan struct{})
+			go c.runReplay(str, dvr.seek(time.Now().Add(-str.conf.ReplayOnConnect)), c.timeShiftStop)
+
+		} else {
+			if c.latency.waitKeyFrame {
+				atomic.StoreInt32(&c.keyFrameWait, 1)
+			}
+			c.subscribe(str)
+		}
 		c.p.mutex.Unlock()
 
 		// when protocol is TCP, the RTSP connection becomes a RTP connection
 		if c.streamProtocol == _STREAM_PROTOCOL_TCP {
-			// write RTP frames sequentially
-			go func() {
-				for frame := range c.chanWrite {
-					c.conn.WriteInterleavedFrame(frame)
-				}
-			}()
+			go c.runTcpWriter()
 
 			// receive RTP feedback, do not parse it, wait until connection closes
 			buf := make([]byte, 2048)
@@ -497,6 +1244,7 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 					if err != io.EOF {
 						c.log("ERR: %s", err)
 					}
+					c.setExitReason(connErrorReason(err, _TEARDOWN_READ_TIMEOUT))
 					return false
 				}
 			}
@@ -515,13 +1263,40 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 			return false
 		}
 
+		c.p.mutex.RLock()
+		str, ok := c.p.streams[c.path]
+		c.p.mutex.RUnlock()
+
+		if ok && str.conf.Vod {
+			res, err := str.request(&gortsplib.Request{
+				Method: gortsplib.PAUSE,
+				Url: &url.URL{
+					Scheme:   "rtsp",
+					Host:     str.ur.Host,
+					Path:     str.ur.Path,
+					RawQuery: str.ur.RawQuery,
+				},
+			})
+			if err != nil {
+				c.writeResError(req, gortsplib.StatusBadRequest, err)
+				return false
+			}
+
+			if res.StatusCode != gortsplib.StatusOK {
+				c.writeResError(req, res.StatusCode, fmt.Errorf("source returned code %d", res.StatusCode))
+				return false
+			}
+		}
+
 		c.log("paused")
 
 		c.p.mutex.Lock()
 		c.state = _CLIENT_STATE_PRE_PLAY
+		c.unsubscribe()
+		c.stopTimeShift()
 		c.p.mutex.Unlock()
 
-		c.conn.WriteResponse(&gortsplib.Response{
+		c.writeResponse(&gortsplib.Response{
 			StatusCode: gortsplib.StatusOK,
 			Header: gortsplib.Header{
 				"CSeq":    []string{cseq[0]},
@@ -539,3 +1314,273 @@ func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
 		return false
 	}
 }
+
+// runTcpWriter writes interleaved frames to a TCP client. Frames are
+// coalesced into a buffer, that is written when it is full or when the flush
+// interval expires, in order to reduce the number of writes.
+func (c *serverClient) runTcpWriter() {
+	nconn := c.conn.NetConn()
+	bw := bufio.NewWriterSize(nconn, _TCP_WRITE_BUFFER_SIZE)
+	var header [4]byte
+	var err error
+
+	flushTimer := time.NewTimer(0)
+	<-flushTimer.C
+	flushPending := false
+
+	closing := false
+
+	for {
+		// the client is closed in a separate routine, since the mutex can
+		// be held by routines that are waiting for the queue
+		if err != nil && !closing {
+			closing = true
+			reason := connErrorReason(err, _TEARDOWN_WRITE_TIMEOUT)
+			c.log("ERR: %s", err)
+			go func() {
+				c.p.mutex.Lock()
+				defer c.p.mutex.Unlock()
+				c.close(reason)
+			}()
+		}
+
+		select {
+		case frame := <-c.chanWrite:
+			// after an error, frames are discarded until the client is closed
+			if err != nil {
+				continue
+			}
+
+			if c.pacer != nil {
+				if d := c.pacer.delay(frame, time.Now()); d > 0 {
+					// frames that precede the delay are sent before it
+					if flushPending {
+						flushTimer.Stop()
+						flushPending = false
+
+						start := time.Now()
+						nconn.SetWriteDeadline(start.Add(_WRITE_TIMEOUT))
+						err = bw.Flush()
+						c.addWriteDuration(time.Since(start))
+						if err != nil {
+							continue
+						}
+					}
+
+					t := time.NewTimer(d)
+					select {
+					case <-t.C:
+					case <-c.done:
+						t.Stop()
+						return
+					}
+				}
+			}
+
+			header[0] = '$'
+			header[1] = frame.Channel
+			binary.BigEndian.PutUint16(header[2:], uint16(len(frame.Content)))
+
+			start := time.Now()
+			nconn.SetWriteDeadline(start.Add(_WRITE_TIMEOUT))
+			_, err = bw.Write(header[:])
+			if err == nil {
+				_, err = bw.Write(frame.Content)
+			}
+			c.addWriteDuration(time.Since(start))
+			if err == nil {
+				c.sent.add(4 + len(frame.Content))
+			}
+
+			if !flushPending {
+				flushTimer.Reset(_TCP_FLUSH_INTERVAL)
+				flushPending = true
+			}
+
+		case <-flushTimer.C:
+			flushPending = false
+			if err != nil {
+				continue
+			}
+
+			start := time.Now()
+			nconn.SetWriteDeadline(start.Add(_WRITE_TIMEOUT))
+			err = bw.Flush()
+			c.addWriteDuration(time.Since(start))
+
+		case <-c.done:
+			flushTimer.Stop()
+			return
+		}
+	}
+}
+
+// addWriteDuration updates the average duration of writes, that is used to
+// find slow clients.
+func (c *serverClient) addWriteDuration(d time.Duration) {
+	// exponential moving average
+	avg := atomic.LoadInt64(&c.writeDuration)
+	atomic.StoreInt64(&c.writeDuration, avg+(int64(d)-avg)/16)
+}
+
+// setTrack sets up a track. The map is replaced instead of being modified,
+// since subscribers keep a reference to it.
+func (c *serverClient) setTrack(id int, t *track) {
+	tracks := make(map[int]*track, len(c.streamTracks)+1)
+	for k, v := range c.streamTracks {
+		tracks[k] = v
+	}
+	tracks[id] = t
+	c.streamTracks = tracks
+}
+
+// subscriber returns the subscriber that represents the client.
+func (c *serverClient) subscriber() streamSubscriber {
+	return streamSubscriber{
+		c:          c,
+		protocol:   c.streamProtocol,
+		tracks:     c.streamTracks,
+		dscp:       c.dscp,
+		dropFrames: c.latency.dropOnFullQueue,
+		videoFirst: c.videoFirst,
+	}
+}
+
+// subscribe starts sending the live frames of a stream to the client. It must
+// be called with the program mutex locked.
+func (c *serverClient) subscribe(str *stream) {
+	c.stream = str
+	str.subscribers[c] = c.subscriber()
+	str.updateOutputs()
+}
+
+// unsubscribe stops sending live frames to the client. It must be called with
+// the program mutex locked.
+func (c *serverClient) unsubscribe() {
+	if c.stream == nil {
+		return
+	}
+	delete(c.stream.subscribers, c)
+	c.stream.updateOutputs()
+	c.stream = nil
+}
+
+// stopTimeShift stops time-shifted playback. It must be called with the
+// program mutex locked.
+func (c *serverClient) stopTimeShift() {
+	if c.timeShiftStop != nil {
+		close(c.timeShiftStop)
+		c.timeShiftStop = nil
+	}
+}
+
+// runTimeShift sends buffered frames to the client, starting from the given
+// sequence number, with the given delay in respect to the live stream.
+func (c *serverClient) runTimeShift(dvr *streamDvr, seq int, delay time.Duration, stop chan struct{}) {
+	for {
+		e, eseq := dvr.get(seq)
+		if e == nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			continue
+		}
+
+		if wait := time.Until(e.time.Add(delay)); wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		ok := func() bool {
+			c.p.mutex.RLock()
+			defer c.p.mutex.RUnlock()
+
+			select {
+			case <-stop:
+				return false
+			default:
+			}
+
+			c.p.writeClientFrame(c.subscriber(), e.trackId, e.flow, e.frame)
+			return true
+		}()
+		if !ok {
+			return
+		}
+
+		seq = eseq + 1
+	}
+}
+
+// runReplay sends buffered frames to the client at an accelerated pace,
+// starting from the given sequence number, then switches the client to the
+// live stream.
+func (c *serverClient) runReplay(str *stream, seq int, stop chan struct{}) {
+	dvr := str.dvr
+	start := time.Now()
+	var base time.Time
+
+	for {
+		e, eseq := dvr.get(seq)
+		if e == nil {
+			// switch to live while frames can't be added to the buffer, in order
+			// not to lose any of them
+			done := func() bool {
+				c.p.mutex.Lock()
+				defer c.p.mutex.Unlock()
+
+				select {
+				case <-stop:
+					return true
+				default:
+				}
+
+				return dvr.ifCaughtUp(seq, func() {
+					c.stopTimeShift()
+					c.subscribe(str)
+				})
+			}()
+			if done {
+				return
+			}
+			continue
+		}
+
+		if base.IsZero() {
+			base = e.time
+		}
+
+		due := start.Add(e.time.Sub(base) / _REPLAY_SPEED)
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		ok := func() bool {
+			c.p.mutex.RLock()
+			defer c.p.mutex.RUnlock()
+
+			select {
+			case <-stop:
+				return false
+			default:
+			}
+
+			c.p.writeClientFrame(c.subscriber(), e.trackId, e.flow, e.frame)
+			return true
+		}()
+		if !ok {
+			return
+		}
+
+		seq = eseq + 1
+	}
+}
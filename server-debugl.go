@@ -0,0 +1,94 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serverDebugListener serves the metrics of the program through expvar,
+// for quick checks where no scraper is available.
+type serverDebugListener struct {
+	p    *program
+	netl net.Listener
+}
+
+func newServerDebugListener(p *program) (*serverDebugListener, error) {
+	netl, err := p.sockets.listenTcp(p.conf.DebugPort)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &serverDebugListener{
+		p:    p,
+		netl: netl,
+	}
+
+	expvar.Publish("rtsp_simple_proxy", expvar.Func(l.vars))
+
+	l.log("opened on :%d", p.conf.DebugPort)
+	return l, nil
+}
+
+func (l *serverDebugListener) log(format string, args ...interface{}) {
+	log.Printf("[debug listener] "+format, args...)
+}
+
+func (l *serverDebugListener) run() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", l.handleVars)
+
+	s := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  _READ_TIMEOUT,
+		WriteTimeout: _WRITE_TIMEOUT,
+	}
+	s.Serve(l.netl)
+}
+
+// handleVars serves the published variables like expvar.Handler(), except
+// the command line, that can contain credentials.
+func (l *serverDebugListener) handleVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// vars returns the metrics of the program, with the ones of streams grouped
+// by path.
+func (l *serverDebugListener) vars() interface{} {
+	ret := make(map[string]interface{})
+	streams := make(map[string]map[string]float64)
+
+	for _, m := range l.p.collectMetrics() {
+		path, ok := m.tags["path"]
+		if !ok {
+			ret[m.name] = m.value
+			continue
+		}
+
+		s, ok := streams[path]
+		if !ok {
+			s = make(map[string]float64)
+			streams[path] = s
+		}
+		s[strings.TrimPrefix(m.name, "stream_")] = m.value
+	}
+
+	ret["stream"] = streams
+	return ret
+}
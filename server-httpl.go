@@ -0,0 +1,674 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Url }}</title>
+<style>
+body { font-family: sans-serif; }
+td, th { text-align: left; padding: 2px 10px 2px 0; }
+</style>
+</head>
+<body>
+<h2>{{ .Url }}</h2>
+<table>
+<tr><th>State</th><td>{{ .State }} since {{ .StateTime }}</td></tr>
+{{ if .LastError }}<tr><th>Last error</th><td>{{ .LastError }} at {{ .LastErrorTime }}</td></tr>
+{{ end }}<tr><th>Protocol</th><td>{{ .Protocol }}</td></tr>
+<tr><th>Clients</th><td>{{ .Clients }}</td></tr>
+</table>
+<h3>Tracks</h3>
+<table>
+{{ range .Tracks }}<tr><td>{{ . }}</td></tr>
+{{ else }}<tr><td>no SDP received yet</td></tr>
+{{ end }}</table>
+<h3>Bitrate</h3>
+<p>current {{ .Bitrate }}, max {{ .MaxBitrate }} over the last {{ .Samples }} seconds</p>
+<svg width="600" height="120" style="border: 1px solid #ccc">
+<polyline fill="none" stroke="#06c" stroke-width="2" points="{{ .Graph }}"/>
+</svg>
+<h3>Recent events</h3>
+<table>
+{{ range .Events }}<tr><td>{{ .Time }}</td><td>{{ .Text }}</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`))
+
+// maximum size of the body of API requests
+const _API_MAX_BODY_SIZE = 64 * 1024
+
+type serverHttpListener struct {
+	p    *program
+	netl net.Listener
+	mux  *http.ServeMux
+}
+
+func newServerHttpListener(p *program) (*serverHttpListener, error) {
+	netl, err := p.sockets.listenTcp(p.conf.ApiPort)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &serverHttpListener{
+		p:    p,
+		netl: netl,
+		mux:  http.NewServeMux(),
+	}
+
+	l.mux.HandleFunc("/healthz", l.handleHealthz)
+	l.mux.HandleFunc("/ready", l.handleReady)
+	l.mux.HandleFunc("/metrics", l.handleMetrics)
+	l.mux.HandleFunc("/status/", l.handleStatus)
+	l.mux.HandleFunc("/v1/streams/", l.handleStreams)
+	l.mux.HandleFunc("/v1/config", l.handleConfig)
+	l.mux.HandleFunc("/v1/drain", l.handleDrain)
+	l.mux.HandleFunc("/v1/bans", l.handleBans)
+	l.mux.HandleFunc("/v1/bans/", l.handleBans)
+
+	l.log("opened on :%d", p.conf.ApiPort)
+	return l, nil
+}
+
+func (l *serverHttpListener) log(format string, args ...interface{}) {
+	log.Printf("[HTTP listener] "+format, args...)
+}
+
+func (l *serverHttpListener) run() {
+	s := &http.Server{
+		Handler:      l.p.audit.handler(l.cors(l.authenticate(l.mux))),
+		ReadTimeout:  _READ_TIMEOUT,
+		WriteTimeout: _WRITE_TIMEOUT,
+	}
+	s.Serve(l.netl)
+}
+
+// streamByPath returns the stream associated with a path requested by a
+// client. It must be called with the program mutex locked.
+func (l *serverHttpListener) streamByPath(path string) (*stream, bool) {
+	decoded, err := l.p.resolvePath(path)
+	if err != nil {
+		return nil, false
+	}
+
+	str, ok := l.p.streams[decoded]
+	return str, ok
+}
+
+func formatBitrate(v float64) string {
+	switch {
+	case v >= 1000000:
+		return fmt.Sprintf("%.2f Mbit/s", v/1000000)
+	case v >= 1000:
+		return fmt.Sprintf("%.1f kbit/s", v/1000)
+	}
+	return fmt.Sprintf("%.0f bit/s", v)
+}
+
+func (l *serverHttpListener) handleStatus(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/status/")
+
+	type event struct {
+		Time string
+		Text string
+	}
+
+	var data struct {
+		Url           string
+		State         string
+		StateTime     string
+		LastError     string
+		LastErrorTime string
+		Protocol      string
+		Clients       int
+		Tracks        []string
+		Bitrate       string
+		MaxBitrate    string
+		Samples       int
+		Graph         string
+		Events        []event
+	}
+
+	str, ok := func() (*stream, bool) {
+		l.p.mutex.RLock()
+		defer l.p.mutex.RUnlock()
+
+		str, ok := l.streamByPath(path)
+		if !ok {
+			return nil, false
+		}
+
+		data.Url = urlRedacted(str.ur)
+		data.State = str.state.String()
+		data.StateTime = str.stateTime.Format(time.RFC3339)
+		data.Protocol = str.proto.String()
+
+		for c := range l.p.clients {
+			if c.path == str.path {
+				data.Clients++
+			}
+		}
+
+		if str.clientSdpParsed != nil {
+			for i, m := range str.clientSdpParsed.Medias {
+				data.Tracks = append(data.Tracks, fmt.Sprintf("%d: %s (%s)", i, mediaDescription(m),
+					strings.Join(m.Attributes.Values("rtpmap"), ", ")))
+			}
+		}
+
+		return str, true
+	}()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	bitrates, events := str.stats.snapshot()
+
+	if lastError, errorTime := str.stats.lastErr(); lastError != "" {
+		data.LastError = lastError
+		data.LastErrorTime = errorTime.Format(time.RFC3339)
+	}
+
+	var max float64
+	for _, v := range bitrates {
+		if v > max {
+			max = v
+		}
+	}
+
+	var points []string
+	for i, v := range bitrates {
+		y := 118.0
+		if max > 0 {
+			y -= v / max * 110
+		}
+		points = append(points, fmt.Sprintf("%d,%.1f", i*600/_STATS_BITRATE_SAMPLES, y))
+	}
+
+	data.Samples = len(bitrates)
+	data.MaxBitrate = formatBitrate(max)
+	data.Graph = strings.Join(points, " ")
+	if len(bitrates) > 0 {
+		data.Bitrate = formatBitrate(bitrates[len(bitrates)-1])
+	} else {
+		data.Bitrate = formatBitrate(0)
+	}
+
+	// most recent first
+	for i := len(events) - 1; i >= 0; i-- {
+		data.Events = append(data.Events, event{
+			Time: events[i].time.Format("2006-01-02 15:04:05"),
+			Text: events[i].text,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, data)
+}
+
+func (l *serverHttpListener) handleStreams(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/streams/")
+
+	switch {
+	case rest == "":
+		l.handleStreamList(w, r)
+
+	case strings.HasSuffix(rest, "/sdp"):
+		l.handleStreamSdp(w, r, strings.TrimSuffix(rest, "/sdp"))
+
+	case strings.HasSuffix(rest, "/capture"):
+		l.handleStreamCapture(w, r, strings.TrimSuffix(rest, "/capture"))
+
+	case strings.HasSuffix(rest, "/remap"):
+		l.handleStreamRemap(w, r, strings.TrimSuffix(rest, "/remap"))
+
+	case strings.HasSuffix(rest, "/clients"):
+		l.handleStreamClients(w, r, strings.TrimSuffix(rest, "/clients"))
+
+	case strings.HasSuffix(rest, "/kick"):
+		l.handleStreamKick(w, r, strings.TrimSuffix(rest, "/kick"))
+
+	case !strings.Contains(rest, "/"):
+		l.handleStreamInfo(w, r, rest)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamInfo is the state of a stream, as returned by the API.
+type streamInfo struct {
+	Name          string     `json:"name"`
+	State         string     `json:"state"`
+	StateTime     time.Time  `json:"stateTime"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	Clients       int        `json:"clients"`
+	BytesReceived uint64     `json:"bytesReceived"`
+	Bitrate       float64    `json:"bitrate"`
+
+	// mapping between RTP timestamps and wall-clock time of each track
+	Clocks []trackClock `json:"clocks,omitempty"`
+
+	// sessions of clients, grouped by user agent and transport
+	UserAgents []userAgentStats `json:"userAgents,omitempty"`
+
+	// sessions of clients by reason of their end, and end of the last
+	// session with the source
+	ClientTeardowns map[teardownReason]uint64 `json:"clientTeardowns,omitempty"`
+	LastTeardown    *streamTeardown           `json:"lastTeardown,omitempty"`
+
+	// rolling bitrates received from the source, and sent to all clients
+	Bitrates        bitrateWindows `json:"bitrates"`
+	ClientsBitrates bitrateWindows `json:"clientsBitrates"`
+}
+
+// clientInfo is the state of a client of a stream, as returned by the API.
+type clientInfo struct {
+	Ip        string         `json:"ip"`
+	State     string         `json:"state"`
+	Transport string         `json:"transport,omitempty"`
+	UserAgent string         `json:"userAgent,omitempty"`
+	Bitrates  bitrateWindows `json:"bitrates"`
+}
+
+// info returns the state of a client. It must be called with the program
+// mutex locked.
+func (c *serverClient) info() clientInfo {
+	info := clientInfo{
+		Ip:        c.ipString(),
+		State:     c.state.String(),
+		UserAgent: c.userAgent,
+		Bitrates:  c.sent.windows(),
+	}
+	if c.state == _CLIENT_STATE_PRE_PLAY || c.state == _CLIENT_STATE_PLAY {
+		info.Transport = c.streamProtocol.String()
+	}
+	return info
+}
+
+// streamInfo returns the state of a stream. It must be called with the
+// program mutex locked.
+func (p *program) streamInfo(str *stream) streamInfo {
+	info := streamInfo{
+		Name:          str.displayName(),
+		State:         str.state.String(),
+		StateTime:     str.stateTime,
+		BytesReceived: str.stats.totalBytes(),
+		Bitrate:       str.stats.bitrate(),
+		Clocks:        str.stats.clocks(),
+		UserAgents:    str.stats.userAgents(),
+		Bitrates:      str.stats.bitrateWindows(),
+	}
+
+	if lastError, errorTime := str.stats.lastErr(); lastError != "" {
+		info.LastError = lastError
+		info.LastErrorTime = &errorTime
+	}
+
+	info.ClientTeardowns, info.LastTeardown = str.stats.teardownStats()
+
+	for c := range p.clients {
+		if c.path == str.path {
+			info.Clients++
+			info.ClientsBitrates.add(c.sent.windows())
+		}
+	}
+
+	return info
+}
+
+func (l *serverHttpListener) handleStreamList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l.p.mutex.RLock()
+	defer l.p.mutex.RUnlock()
+
+	infos := []streamInfo{}
+	for _, str := range l.p.streams {
+		infos = append(infos, l.p.streamInfo(str))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	l.writeJson(w, infos)
+}
+
+func (l *serverHttpListener) handleStreamInfo(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l.p.mutex.RLock()
+	defer l.p.mutex.RUnlock()
+
+	str, ok := l.streamByPath(path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	l.writeJson(w, l.p.streamInfo(str))
+}
+
+func (l *serverHttpListener) handleStreamClients(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l.p.mutex.RLock()
+	defer l.p.mutex.RUnlock()
+
+	str, ok := l.streamByPath(path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	infos := []clientInfo{}
+	for c := range l.p.clients {
+		if c.path != str.path {
+			continue
+		}
+
+		infos = append(infos, c.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Ip < infos[j].Ip
+	})
+
+	l.writeJson(w, infos)
+}
+
+func (l *serverHttpListener) handleStreamSdp(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sdp, err := func() ([]byte, error) {
+		l.p.mutex.RLock()
+		defer l.p.mutex.RUnlock()
+
+		str, ok := l.streamByPath(path)
+		if !ok {
+			return nil, fmt.Errorf("stream not found")
+		}
+
+		if str.state == _STREAM_STATE_READY {
+			return str.serverSdpText, nil
+		}
+
+		if e, ok := l.p.sdpCache[str.path]; ok {
+			return e.text, nil
+		}
+
+		return nil, nil
+	}()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if sdp == nil {
+		http.Error(w, "stream is not ready yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Write(sdp)
+}
+
+// handleStreamCapture starts writing the traffic of a stream into a pcap
+// file for the duration given in the query, that defaults to 10 seconds.
+func (l *serverHttpListener) handleStreamCapture(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if l.p.conf.CaptureDir == "" {
+		http.Error(w, "captures are disabled", http.StatusForbidden)
+		return
+	}
+
+	duration := 10 * time.Second
+	if v := r.URL.Query().Get("duration"); v != "" {
+		var err error
+		duration, err = time.ParseDuration(v)
+		if err != nil || duration <= 0 || duration > _CAPTURE_MAX_DURATION {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	l.p.mutex.Lock()
+	defer l.p.mutex.Unlock()
+
+	str, ok := l.streamByPath(path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if str.capture != nil {
+		http.Error(w, "a capture is already in progress", http.StatusConflict)
+		return
+	}
+
+	fpath := filepath.Join(l.p.conf.CaptureDir, logFileName(str.displayName())+
+		"-"+time.Now().Format("20060102-150405")+".pcap")
+
+	var capture *streamCapture
+	capture, err := newStreamCapture(fpath, duration, func() {
+		l.p.mutex.Lock()
+		defer l.p.mutex.Unlock()
+
+		if str.capture == capture {
+			str.capture = nil
+			str.updateOutputs()
+		}
+		str.log("capture written to %s", fpath)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	str.capture = capture
+	str.updateOutputs()
+	str.log("capturing traffic for %s", duration)
+
+	l.writeJson(w, struct {
+		File     string  `json:"file"`
+		Duration float64 `json:"duration"`
+	}{fpath, duration.Seconds()})
+}
+
+// handleStreamRemap replaces the source of a static stream with the URL
+// given in the body.
+// handleStreamKick disconnects the clients of a stream, or the ones with the
+// IP given in the query.
+func (l *serverHttpListener) handleStreamKick(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ip net.IP
+	if v := r.URL.Query().Get("ip"); v != "" {
+		ip = net.ParseIP(v)
+		if ip == nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+	}
+
+	l.p.mutex.Lock()
+	defer l.p.mutex.Unlock()
+
+	str, ok := l.streamByPath(path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	n := str.kickClients(ip)
+	l.log("%d clients of stream '%s' kicked", n, str.path)
+
+	l.writeJson(w, struct {
+		Clients int `json:"clients"`
+	}{n})
+}
+
+func (l *serverHttpListener) handleStreamRemap(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Url     string `json:"url"`
+		Migrate bool   `json:"migrate"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, _API_MAX_BODY_SIZE)).Decode(&req)
+	if err != nil || req.Url == "" {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	name, err := l.p.resolvePath(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	str, err := l.p.remapStream(name, req.Url, req.Migrate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.log("source of stream '%s' changed to %s", name, urlRedacted(str.ur))
+
+	l.p.mutex.RLock()
+	defer l.p.mutex.RUnlock()
+	l.writeJson(w, l.p.streamInfo(str))
+}
+
+func (l *serverHttpListener) writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleConfig returns the static streams and the ACL, in the format of the
+// configuration file and without credentials.
+func (l *serverHttpListener) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snap, err := l.p.conf.snapshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	byts, err := yaml.Marshal(snap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(byts)
+}
+
+// handleDrain enables drain mode with POST, disables it with DELETE and
+// returns its state with GET.
+func (l *serverHttpListener) handleDrain(w http.ResponseWriter, r *http.Request) {
+	l.p.mutex.Lock()
+	defer l.p.mutex.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		if !l.p.draining {
+			l.log("drain mode enabled")
+			go l.p.saveState()
+		}
+		l.p.draining = true
+
+	case http.MethodDelete:
+		if l.p.draining {
+			l.log("drain mode disabled")
+			go l.p.saveState()
+		}
+		l.p.draining = false
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l.writeJson(w, struct {
+		Draining bool `json:"draining"`
+		Clients  int  `json:"clients"`
+	}{l.p.draining, len(l.p.clients)})
+}
+
+// handleBans lists bans with GET and removes them with DELETE, either all
+// or the one of the IP in the path.
+func (l *serverHttpListener) handleBans(w http.ResponseWriter, r *http.Request) {
+	ip := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/bans"), "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		type ban struct {
+			Ip    string    `json:"ip"`
+			Until time.Time `json:"until"`
+		}
+
+		bans := []ban{}
+		for ip, until := range l.p.bans.list() {
+			bans = append(bans, ban{ip, until})
+		}
+		l.writeJson(w, bans)
+
+	case http.MethodDelete:
+		l.p.bans.clear(ip)
+		l.p.saveState()
+		if ip == "" {
+			l.log("all bans cleared")
+		} else {
+			l.log("ban of %s cleared", ip)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
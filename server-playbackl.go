@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverPlaybackListener serves streams to browsers and players over HTTP.
+type serverPlaybackListener struct {
+	p    *program
+	netl net.Listener
+}
+
+func newServerPlaybackListener(p *program) (*serverPlaybackListener, error) {
+	netl, err := p.sockets.listenTcp(p.conf.PlaybackPort)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &serverPlaybackListener{
+		p:    p,
+		netl: netl,
+	}
+
+	l.log("opened on :%d", p.conf.PlaybackPort)
+	return l, nil
+}
+
+func (l *serverPlaybackListener) log(format string, args ...interface{}) {
+	log.Printf("[playback listener] "+format, args...)
+}
+
+func (l *serverPlaybackListener) run() {
+	// no write timeout, since blocking playlist reloads can last several
+	// seconds
+	s := &http.Server{
+		Handler:     http.HandlerFunc(l.handle),
+		ReadTimeout: _READ_TIMEOUT,
+	}
+	s.Serve(l.netl)
+}
+
+// authenticate checks the credentials and the ACL of a request for a stream,
+// like the ones of RTSP clients. When they are not valid, it writes the
+// response and returns false.
+func (l *serverPlaybackListener) authenticate(w http.ResponseWriter, r *http.Request, name string) bool {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	if l.p.bans.isBanned(ip) {
+		http.Error(w, "IP is banned", http.StatusForbidden)
+		l.p.audit.write(auditEvent{
+			Event:  _AUDIT_ACCESS_DENIED,
+			Ip:     ip,
+			Method: r.Method,
+			Path:   l.p.auditPath(name),
+			Detail: "IP is banned",
+		})
+		return false
+	}
+
+	var id authIdentity
+
+	if l.p.authRequired() {
+		header, ok := r.Header["Authorization"]
+		valid := false
+		if ok {
+			id, valid = l.p.checkCredentials(header, r.Method, r.URL, name, "", l.log)
+		}
+
+		if !valid {
+			// requests without credentials are the first step of the
+			// authentication and are not failures
+			if ok {
+				l.log("ERR: authentication of %s failed", ip)
+				l.p.audit.write(auditEvent{
+					Event:  _AUDIT_AUTH_FAILURE,
+					User:   authHeaderUser(header),
+					Ip:     ip,
+					Method: r.Method,
+					Path:   l.p.auditPath(name),
+				})
+
+				if l.p.bans.addFailure(ip) {
+					l.log("%s banned for %s", ip, l.p.conf.AuthBanDuration)
+					go l.p.saveState()
+					l.p.audit.write(auditEvent{
+						Event:  _AUDIT_BAN,
+						Ip:     ip,
+						Detail: fmt.Sprintf("banned for %s", l.p.conf.AuthBanDuration),
+					})
+				}
+			}
+
+			w.Header()["WWW-Authenticate"] = l.p.authChallenge(name, "")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+	}
+
+	if !aclAllows(l.p.conf.Acl, id, name) {
+		http.Error(w, "access denied", http.StatusForbidden)
+		l.p.audit.write(auditEvent{
+			Event:  _AUDIT_ACCESS_DENIED,
+			User:   id.user,
+			Ip:     ip,
+			Method: r.Method,
+			Path:   l.p.auditPath(name),
+			Detail: "denied by ACL",
+		})
+		return false
+	}
+
+	return true
+}
+
+// outputs returns the muxer and the MJPEG broadcaster of a stream, together
+// with its configuration.
+func (l *serverPlaybackListener) outputs(name string) (*hlsMuxer, *mjpegBroadcaster, streamConf, bool) {
+	l.p.mutex.RLock()
+	defer l.p.mutex.RUnlock()
+
+	str, ok := l.p.streams[name]
+	if !ok || !str.conf.playback() {
+		return nil, nil, streamConf{}, false
+	}
+	return str.hls, str.mjpeg, str.conf, true
+}
+
+// queryInt returns the value of an integer query parameter, or -1 when it
+// is not present.
+func queryInt(r *http.Request, key string) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return -1, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s", key)
+	}
+	return n, nil
+}
+
+func (l *serverPlaybackListener) handle(w http.ResponseWriter, r *http.Request) {
+	// players can be served from other origins. Credentials are not sent to
+	// other origins, since the origin is not listed explicitly
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/rtsp" && l.p.conf.RtspWebsocket {
+		l.handleRtsp(w, r)
+		return
+	}
+
+	// paths are in the format /name/file
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	name, file := parts[0], parts[1]
+
+	if !l.authenticate(w, r, name) {
+		return
+	}
+
+	m, mjpeg, sc, ok := l.outputs(name)
+	if !ok {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+
+	if file == "mjpeg" {
+		if mjpeg == nil {
+			http.Error(w, "MJPEG is not available on this stream", http.StatusNotFound)
+			return
+		}
+		l.handleMjpeg(w, r, mjpeg, name)
+		return
+	}
+
+	if m == nil {
+		http.Error(w, "HLS, DASH and MSE are not available on this stream", http.StatusNotFound)
+		return
+	}
+
+	if file == "ws" {
+		if !sc.Mse {
+			http.Error(w, "MSE is not enabled on this stream", http.StatusNotFound)
+			return
+		}
+		l.handleMse(w, r, m, name)
+		return
+	}
+
+	if strings.HasPrefix(file, "dash-") || file == "manifest.mpd" {
+		if !sc.Dash {
+			http.Error(w, "DASH is not enabled on this stream", http.StatusNotFound)
+			return
+		}
+		l.handleDash(w, r, m, file)
+		return
+	}
+
+	if !sc.Hls {
+		http.Error(w, "HLS is not enabled on this stream", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case file == "index.m3u8":
+		msn, err := queryInt(r, "_HLS_msn")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		part, err := queryInt(r, "_HLS_part")
+		if err != nil || (part >= 0 && msn < 0) {
+			http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+			return
+		}
+
+		byts, err := m.playlist(msn, part)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(byts)
+
+	case file == "init.mp4":
+		byts, ok := m.initSegment()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(byts)
+
+	case strings.HasPrefix(file, "seg") && strings.HasSuffix(file, ".mp4"),
+		strings.HasPrefix(file, "part") && strings.HasSuffix(file, ".mp4"):
+		isPart := strings.HasPrefix(file, "part")
+
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(file, "seg"), "part"), ".mp4"))
+		if err != nil || id < 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		var byts []byte
+		if isPart {
+			byts, ok = m.part(id)
+		} else {
+			byts, ok = m.segment(id)
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(byts)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleDash serves the manifest and the segments of a DASH presentation.
+// Segments are named dash-<track>-init.mp4 and dash-<track>-<time>.m4s.
+func (l *serverPlaybackListener) handleDash(w http.ResponseWriter, r *http.Request, m *hlsMuxer, file string) {
+	if file == "manifest.mpd" {
+		byts, err := m.dashManifest(time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(byts)
+		return
+	}
+
+	parts := strings.Split(file, "-")
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	trackId, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var byts []byte
+	var ok bool
+
+	switch {
+	case parts[2] == "init.mp4":
+		byts, ok = m.dashInitSegment(trackId)
+
+	case strings.HasSuffix(parts[2], ".m4s"):
+		start, err := strconv.ParseUint(strings.TrimSuffix(parts[2], ".m4s"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		byts, ok = m.dashSegment(trackId, start)
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Write(byts)
+}
+
+// handleRtsp serves a RTSP session over a WebSocket. The messages carry the
+// same bytes that are exchanged over a TCP connection, that are requests,
+// responses and interleaved frames; their boundaries are not meaningful.
+// Authentication and ACLs are applied to the RTSP requests, as usual.
+func (l *serverPlaybackListener) handleRtsp(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrade(w, r, "rtsp")
+	if err != nil {
+		return
+	}
+
+	c := newServerClient(l.p, newWsNetConn(conn))
+	c.tunneled = true
+	c.run()
+}
+
+// handleMse sends a stream to a browser through a WebSocket, in a format that
+// can be fed to Media Source Extensions: a text message with the MIME type,
+// followed by binary messages with the initialization segment and with fMP4
+// fragments, starting from the last key frame.
+func (l *serverPlaybackListener) handleMse(w http.ResponseWriter, r *http.Request, m *hlsMuxer, name string) {
+	conn, err := wsUpgrade(w, r, "")
+	if err != nil {
+		return
+	}
+	defer conn.close()
+
+	l.log("%s opened '%s' via WebSocket", r.RemoteAddr, name)
+
+	// messages sent by the client are discarded. They are read in order to
+	// answer pings and to detect when the connection is closed
+	go func() {
+		for {
+			_, _, err := conn.readMessage()
+			if err != nil {
+				conn.close()
+				return
+			}
+		}
+	}()
+
+	err = func() error {
+		id, ok := m.livePart()
+		if !ok {
+			return fmt.Errorf("the stream is not ready")
+		}
+
+		init, _ := m.initSegment()
+
+		err := conn.writeMessage(_WS_OPCODE_TEXT, []byte(m.mimeType()))
+		if err != nil {
+			return err
+		}
+
+		err = conn.writeMessage(_WS_OPCODE_BINARY, init)
+		if err != nil {
+			return err
+		}
+
+		for ; ; id++ {
+			// parts are not available when the client is too slow or when
+			// the stream has stopped
+			byts, ok := m.part(id)
+			if !ok {
+				return fmt.Errorf("the stream is not available anymore")
+			}
+
+			err = conn.writeMessage(_WS_OPCODE_BINARY, byts)
+			if err != nil {
+				return err
+			}
+		}
+	}()
+
+	l.log("%s closed '%s' via WebSocket: %s", r.RemoteAddr, name, err)
+}
+
+// handleMjpeg sends the frames of a stream as a multipart/x-mixed-replace
+// response, that can be displayed by any browser. Clients that are slower
+// than the stream skip frames.
+func (l *serverPlaybackListener) handleMjpeg(w http.ResponseWriter, r *http.Request, b *mjpegBroadcaster, name string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+_MJPEG_BOUNDARY)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	l.log("%s opened '%s' via MJPEG", r.RemoteAddr, name)
+
+	err := func() error {
+		id := -1
+		for {
+			var frame []byte
+			var ok bool
+			frame, id, ok = b.next(id, _MJPEG_FRAME_TIMEOUT)
+			if !ok {
+				return fmt.Errorf("the stream is not available anymore")
+			}
+
+			_, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n",
+				_MJPEG_BOUNDARY, len(frame))
+			if err != nil {
+				return err
+			}
+
+			_, err = w.Write(frame)
+			if err != nil {
+				return err
+			}
+
+			_, err = w.Write([]byte("\r\n"))
+			if err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+	}()
+
+	l.log("%s closed '%s' via MJPEG: %s", r.RemoteAddr, name, err)
+}
@@ -1,29 +1,44 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net"
 )
 
 type serverTcpListener struct {
-	p    *program
-	netl *net.TCPListener
+	p       *program
+	netl    *net.TCPListener
+	tlsConf *tls.Config
 }
 
-func newServerTcpListener(p *program) (*serverTcpListener, error) {
-	netl, err := net.ListenTCP("tcp", &net.TCPAddr{
-		Port: p.conf.RtspPort,
-	})
+// newServerTcpListener allocates a serverTcpListener. If tlsConf is not nil,
+// connections are encrypted (RTSPS).
+func newServerTcpListener(p *program, port int, tlsConf *tls.Config) (*serverTcpListener, error) {
+	netl, err := p.sockets.listenTcp(port)
 	if err != nil {
 		return nil, err
 	}
 
+	if p.conf.ListenBacklog > 0 {
+		err := setListenBacklog(netl, p.conf.ListenBacklog)
+		if err != nil {
+			netl.Close()
+			return nil, err
+		}
+	}
+
 	s := &serverTcpListener{
-		p:    p,
-		netl: netl,
+		p:       p,
+		netl:    netl,
+		tlsConf: tlsConf,
 	}
 
-	s.log("opened on :%d", p.conf.RtspPort)
+	if tlsConf != nil {
+		s.log("opened on :%d (TLS)", port)
+	} else {
+		s.log("opened on :%d", port)
+	}
 	return s, nil
 }
 
@@ -31,6 +46,15 @@ func (l *serverTcpListener) log(format string, args ...interface{}) {
 	log.Printf("[TCP listener] "+format, args...)
 }
 
+// wrap wraps a connection with TLS, when enabled. The PROXY protocol header,
+// if any, precedes the TLS handshake.
+func (l *serverTcpListener) wrap(conn net.Conn) net.Conn {
+	if l.tlsConf == nil {
+		return conn
+	}
+	return tls.Server(conn, l.tlsConf)
+}
+
 func (l *serverTcpListener) run() {
 	for {
 		nconn, err := l.netl.AcceptTCP()
@@ -38,7 +62,26 @@ func (l *serverTcpListener) run() {
 			break
 		}
 
-		rsc := newServerClient(l.p, nconn)
+		err = l.p.conf.ClientSocket.applyTcp(nconn)
+		if err != nil {
+			l.log("ERR: %s", err)
+		}
+
+		if l.p.conf.ProxyProtocol {
+			go func() {
+				conn, err := readProxyProtocol(nconn)
+				if err != nil {
+					l.log("ERR: %s", err)
+					nconn.Close()
+					return
+				}
+
+				newServerClient(l.p, l.wrap(conn)).run()
+			}()
+			continue
+		}
+
+		rsc := newServerClient(l.p, l.wrap(nconn))
 		go rsc.run()
 	}
 }
@@ -6,31 +6,62 @@ import (
 	"time"
 )
 
+// packets that are sent to clients to open the reverse path through stateful
+// firewalls and NATs. Their RTP version is invalid, therefore they are
+// discarded by clients.
+var holePunchPacket = []byte{0xce, 0xfa, 0xed, 0xfe}
+
+const _HOLE_PUNCH_COUNT = 3
+
+// maximum number of datagrams that are written or read with a single system
+// call
+const _UDP_BATCH_SIZE = 64
+
 type udpWrite struct {
 	addr *net.UDPAddr
 	buf  []byte
+	dscp uint8 // 0 means the DSCP of the socket
 }
 
 type serverUdpListener struct {
 	p         *program
 	nconn     *net.UDPConn
+	bconn     *udpBatchConn
 	flow      trackFlow
-	chanWrite chan *udpWrite
+	chanWrite chan udpWrite
 }
 
 func newServerUdpListener(p *program, port int, flow trackFlow) (*serverUdpListener, error) {
-	nconn, err := net.ListenUDP("udp", &net.UDPAddr{
-		Port: port,
-	})
+	nconn, err := p.sockets.listenUdp(port)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.conf.ClientSocket.applyUdp(nconn)
+	if err != nil {
+		nconn.Close()
+		return nil, err
+	}
+
+	bconn, err := newUdpBatchConn(nconn)
 	if err != nil {
+		nconn.Close()
 		return nil, err
 	}
 
 	l := &serverUdpListener{
 		p:         p,
 		nconn:     nconn,
+		bconn:     bconn,
 		flow:      flow,
-		chanWrite: make(chan *udpWrite),
+		chanWrite: make(chan udpWrite, _UDP_BATCH_SIZE),
+	}
+
+	if p.conf.UdpOffload {
+		err := bconn.enableGso()
+		if err != nil {
+			l.log("ERR: unable to enable segmentation offload: %s", err)
+		}
 	}
 
 	l.log("opened on :%d", port)
@@ -50,18 +81,42 @@ func (l *serverUdpListener) log(format string, args ...interface{}) {
 func (l *serverUdpListener) run() {
 
 	go func() {
-		buf := make([]byte, 2048) // UDP MTU is 1400
+		// packets sent by clients are discarded
+		batch := newUdpReadBatch(_UDP_BATCH_SIZE, 2048) // UDP MTU is 1400
 
 		for {
-			l.nconn.ReadFromUDP(buf)
+			l.bconn.readBatch(batch)
 		}
 	}()
 
 	go func() {
+		batch := make([]udpWrite, 0, _UDP_BATCH_SIZE)
+
 		for {
-			w := <-l.chanWrite
+			batch = append(batch[:0], <-l.chanWrite)
+
+			// write together all the datagrams that are waiting
+		collect:
+			for len(batch) < _UDP_BATCH_SIZE {
+				select {
+				case w := <-l.chanWrite:
+					batch = append(batch, w)
+				default:
+					break collect
+				}
+			}
+
 			l.nconn.SetWriteDeadline(time.Now().Add(_WRITE_TIMEOUT))
-			l.nconn.WriteTo(w.buf, w.addr)
+			l.bconn.writeBatch(batch)
 		}
 	}()
 }
+
+func (l *serverUdpListener) punchHole(addr *net.UDPAddr) {
+	for i := 0; i < _HOLE_PUNCH_COUNT; i++ {
+		l.chanWrite <- udpWrite{
+			addr: addr,
+			buf:  holePunchPacket,
+		}
+	}
+}
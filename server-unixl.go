@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"net"
+)
+
+type serverUnixListener struct {
+	p    *program
+	netl *net.UnixListener
+}
+
+func newServerUnixListener(p *program, path string) (*serverUnixListener, error) {
+	netl, err := p.sockets.listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &serverUnixListener{
+		p:    p,
+		netl: netl,
+	}
+
+	l.log("opened on %s", path)
+	return l, nil
+}
+
+func (l *serverUnixListener) log(format string, args ...interface{}) {
+	log.Printf("[Unix listener] "+format, args...)
+}
+
+func (l *serverUnixListener) run() {
+	for {
+		nconn, err := l.netl.AcceptUnix()
+		if err != nil {
+			break
+		}
+
+		rsc := newServerClient(l.p, nconn)
+		go rsc.run()
+	}
+}
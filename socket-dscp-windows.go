@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func setDscp(nconn syscall.Conn, dscp int) error {
+	return fmt.Errorf("the DSCP can't be set on Windows")
+}
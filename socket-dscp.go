@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// setDscp sets the DSCP of the packets sent by a socket, by setting both the
+// IPv4 type of service and the IPv6 traffic class, since sockets that listen
+// on all interfaces send both kinds of packets.
+func setDscp(nconn syscall.Conn, dscp int) error {
+	rc, err := nconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var v4Err, v6Err error
+	err = rc.Control(func(fd uintptr) {
+		v4Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+		v6Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+
+	// one of the two options fails when the socket is not dual-stack
+	if v4Err != nil && v6Err != nil {
+		return v4Err
+	}
+	return nil
+}
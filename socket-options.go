@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// socketConf contains the options of the sockets on one side of the proxy,
+// either towards clients or towards sources.
+type socketConf struct {
+	NoDelay       bool
+	SendBuffer    int           // 0 means the system default
+	ReceiveBuffer int           // 0 means the system default
+	KeepAlive     time.Duration // 0 means the default, a negative value disables keepalives
+	Dscp          int           // 0 means the system default
+}
+
+func (sc socketConf) applyTcp(nconn *net.TCPConn) error {
+	err := nconn.SetNoDelay(sc.NoDelay)
+	if err != nil {
+		return err
+	}
+
+	if sc.KeepAlive < 0 {
+		err := nconn.SetKeepAlive(false)
+		if err != nil {
+			return err
+		}
+
+	} else if sc.KeepAlive > 0 {
+		err := nconn.SetKeepAlive(true)
+		if err != nil {
+			return err
+		}
+
+		err = nconn.SetKeepAlivePeriod(sc.KeepAlive)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = sc.applyDscp(nconn)
+	if err != nil {
+		return err
+	}
+
+	return sc.applyBuffers(nconn)
+}
+
+func (sc socketConf) applyUdp(nconn *net.UDPConn) error {
+	err := sc.applyDscp(nconn)
+	if err != nil {
+		return err
+	}
+
+	return sc.applyBuffers(nconn)
+}
+
+func (sc socketConf) applyDscp(nconn syscall.Conn) error {
+	if sc.Dscp == 0 {
+		return nil
+	}
+	return setDscp(nconn, sc.Dscp)
+}
+
+func (sc socketConf) applyBuffers(nconn interface {
+	SetWriteBuffer(int) error
+	SetReadBuffer(int) error
+}) error {
+	if sc.SendBuffer > 0 {
+		err := nconn.SetWriteBuffer(sc.SendBuffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sc.ReceiveBuffer > 0 {
+		err := nconn.SetReadBuffer(sc.ReceiveBuffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aler9/gortsplib"
+)
+
+// authChallenge is a challenge contained in a WWW-Authenticate header.
+type authChallenge struct {
+	scheme string
+	params map[string]string // with lowercase keys
+}
+
+// parseAuthChallenges parses the challenges of WWW-Authenticate headers.
+// Sources can send a header for each challenge, or several challenges in a
+// single comma-separated header.
+func parseAuthChallenges(headers []string) []authChallenge {
+	var ret []authChallenge
+
+	for _, in := range headers {
+		var params map[string]string
+
+		for {
+			in = strings.TrimLeft(in, " ,")
+			if in == "" {
+				break
+			}
+
+			// a token that is not followed by '=' is the scheme of a new
+			// challenge
+			i := strings.IndexAny(in, " ,=")
+			if i < 0 || in[i] != '=' {
+				if i < 0 {
+					i = len(in)
+				}
+				params = make(map[string]string)
+				ret = append(ret, authChallenge{
+					scheme: in[:i],
+					params: params,
+				})
+				in = in[i:]
+				continue
+			}
+
+			key := strings.ToLower(strings.TrimSpace(in[:i]))
+			in = in[i+1:]
+
+			var val string
+			if strings.HasPrefix(in, "\"") {
+				j := strings.IndexByte(in[1:], '"')
+				if j < 0 {
+					break
+				}
+				val = in[1 : j+1]
+				in = in[j+2:]
+			} else {
+				j := strings.IndexByte(in, ',')
+				if j < 0 {
+					j = len(in)
+				}
+				val = strings.TrimSpace(in[:j])
+				in = in[j:]
+			}
+
+			// parameters without a scheme are invalid
+			if params != nil {
+				params[key] = val
+			}
+		}
+	}
+
+	return ret
+}
+
+// sourceAuth generates the Authorization headers of the requests sent to a
+// source.
+type sourceAuth struct {
+	user   string
+	pass   string
+	digest bool
+	realm  string
+	nonce  string
+	opaque string
+	qop    string // "auth" or empty
+	stale  bool   // whether the previous nonce was rejected because expired
+	nc     int    // number of requests sent with the nonce
+}
+
+// newSourceAuth chooses a challenge among the ones offered by a source.
+// Digest is preferred over Basic, since it doesn't send the password.
+func newSourceAuth(challenges []authChallenge, user string, pass string) (*sourceAuth, error) {
+	var schemes []string
+	var basic bool
+
+	for _, c := range challenges {
+		schemes = append(schemes, c.scheme)
+
+		switch {
+		case strings.EqualFold(c.scheme, "Digest"):
+			if alg := c.params["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+				continue
+			}
+			if c.params["nonce"] == "" {
+				continue
+			}
+
+			a := &sourceAuth{
+				user:   user,
+				pass:   pass,
+				digest: true,
+				realm:  c.params["realm"],
+				nonce:  c.params["nonce"],
+				opaque: c.params["opaque"],
+				stale:  strings.EqualFold(c.params["stale"], "true"),
+			}
+			for _, q := range strings.Split(c.params["qop"], ",") {
+				if strings.EqualFold(strings.TrimSpace(q), "auth") {
+					a.qop = "auth"
+				}
+			}
+			return a, nil
+
+		case strings.EqualFold(c.scheme, "Basic"):
+			basic = true
+		}
+	}
+
+	if basic {
+		return &sourceAuth{
+			user: user,
+			pass: pass,
+		}, nil
+	}
+
+	if len(schemes) == 0 {
+		return nil, fmt.Errorf("401 without authentication challenges")
+	}
+	return nil, fmt.Errorf("unsupported authentication methods: %s", strings.Join(schemes, ", "))
+}
+
+// header returns the Authorization header of a request.
+func (a *sourceAuth) header(method gortsplib.Method, ur *url.URL) string {
+	if !a.digest {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.user+":"+a.pass))
+	}
+
+	// credentials are not part of the URI
+	u := *ur
+	u.User = nil
+	uri := u.String()
+
+	ha1 := md5Hex(a.user + ":" + a.realm + ":" + a.pass)
+	ha2 := md5Hex(string(method) + ":" + uri)
+
+	params := []string{
+		"username=\"" + a.user + "\"",
+		"realm=\"" + a.realm + "\"",
+		"nonce=\"" + a.nonce + "\"",
+		"uri=\"" + uri + "\"",
+	}
+
+	if a.qop != "" {
+		a.nc++
+		nc := fmt.Sprintf("%08x", a.nc)
+		cnonce := newAuthNonce()
+		params = append(params,
+			"response=\""+md5Hex(ha1+":"+a.nonce+":"+nc+":"+cnonce+":"+a.qop+":"+ha2)+"\"",
+			"qop="+a.qop,
+			"nc="+nc,
+			"cnonce=\""+cnonce+"\"")
+	} else {
+		params = append(params, "response=\""+md5Hex(ha1+":"+a.nonce+":"+ha2)+"\"")
+	}
+
+	if a.opaque != "" {
+		params = append(params, "opaque=\""+a.opaque+"\"")
+	}
+
+	return "Digest " + strings.Join(params, ", ")
+}
+
+// reauthenticate reads the challenges of a 401 response and returns whether
+// the request must be repeated with new credentials. Requests are repeated
+// when credentials were not sent yet, or when the source rejected an expired
+// nonce; otherwise credentials are wrong, and repeating the request would
+// cause an endless loop.
+func (s *stream) reauthenticate(res *gortsplib.Response) bool {
+	if s.ur.User == nil {
+		return false
+	}
+
+	pass, _ := s.ur.User.Password()
+	if pass == "" {
+		return false
+	}
+
+	auth, err := newSourceAuth(parseAuthChallenges(res.Header["WWW-Authenticate"]), s.ur.User.Username(), pass)
+	if err != nil {
+		s.log("ERR: %s", err)
+		return false
+	}
+
+	prev := s.auth
+	s.auth = auth
+
+	if prev == nil {
+		return true
+	}
+
+	// some sources replace nonces without flagging them as stale
+	if auth.stale || (auth.digest && prev.digest && auth.nonce != prev.nonce) {
+		s.log("nonce expired, authenticating again")
+		return true
+	}
+
+	return false
+}
+
+// authError returns the error of a request that has been refused with 401.
+func (s *stream) authError(method gortsplib.Method) error {
+	if s.ur.User == nil {
+		return fmt.Errorf("401 but user not provided")
+	}
+
+	if pass, _ := s.ur.User.Password(); pass == "" {
+		return fmt.Errorf("401 but password not provided")
+	}
+
+	return fmt.Errorf("%s returned code 401, credentials were refused", method)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+// sourceConn is the connection with a source. gortsplib refuses interleaved
+// frames bigger than 2048 bytes, therefore frames are read by the proxy
+// from the same buffer that gortsplib uses for responses. The buffer is
+// exposed to gortsplib one byte at a time, such that it never reads ahead
+// and frames that follow a response are not lost.
+type sourceConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func newSourceConn(nconn net.Conn) *sourceConn {
+	return &sourceConn{
+		Conn: nconn,
+		br:   bufio.NewReaderSize(nconn, 4096),
+	}
+}
+
+func (c *sourceConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return c.br.Read(b)
+}
+
+// readInterleavedFrame reads an interleaved frame. Its length is encoded
+// with 16 bits, therefore it is at most 64 KiB, like packets received with
+// UDP.
+func (c *sourceConn) readInterleavedFrame(timeout time.Duration) (*gortsplib.InterleavedFrame, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+
+	var header [4]byte
+	_, err := io.ReadFull(c.br, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0] != 0x24 {
+		return nil, fmt.Errorf("wrong magic byte (0x%.2x)", header[0])
+	}
+
+	f := &gortsplib.InterleavedFrame{
+		Channel: header[1],
+		Content: make([]byte, binary.BigEndian.Uint16(header[2:])),
+	}
+
+	_, err = io.ReadFull(c.br, f.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+// serveBigFrameSource serves a source that sends interleaved frames bigger
+// than the limit of gortsplib, right after the response to PLAY.
+func serveBigFrameSource(ln net.Listener, size int) {
+	nconn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer nconn.Close()
+
+	conn := gortsplib.NewConnServer(nconn, 10*time.Second, 5*time.Second)
+
+	sdpText := []byte("v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=Big\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"t=0 0\r\n" +
+		"m=application 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 vnd.onvif.metadata/90000\r\n")
+
+	for {
+		req, err := conn.ReadRequest()
+		if err != nil {
+			return
+		}
+
+		res := &gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq": req.Header["CSeq"],
+			},
+		}
+
+		switch req.Method {
+		case gortsplib.OPTIONS:
+			res.Header["Public"] = []string{"DESCRIBE, SETUP, PLAY"}
+
+		case gortsplib.DESCRIBE:
+			res.Header["Content-Type"] = []string{"application/sdp"}
+			res.Header["Content-Base"] = []string{req.Url.String() + "/"}
+			res.Content = sdpText
+
+		case gortsplib.SETUP:
+			res.Header["Transport"] = req.Header["Transport"]
+			res.Header["Session"] = []string{"12345678"}
+
+		case gortsplib.PLAY:
+			res.Header["Session"] = []string{"12345678"}
+		}
+
+		err = conn.WriteResponse(res)
+		if err != nil {
+			return
+		}
+
+		if req.Method == gortsplib.PLAY {
+			pkt := make([]byte, size)
+			pkt[0] = 0x80
+			pkt[1] = 96
+			for {
+				err := conn.WriteInterleavedFrame(&gortsplib.InterleavedFrame{
+					Channel: 0,
+					Content: pkt,
+				})
+				if err != nil {
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}
+}
+
+// TestSourceBigInterleavedFrames proxies a TCP source that sends frames
+// bigger than the MTU and checks that a client receives them.
+func TestSourceBigInterleavedFrames(t *testing.T) {
+	const size = 10000
+
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go serveBigFrameSource(sl, size)
+
+	port := freeTcpPort(t)
+
+	p, err := newProgramFromConf(&conf{
+		Protocols:          []string{"tcp"},
+		RtspPorts:          []int{port},
+		StreamReadyTimeout: 10 * time.Second,
+		StreamTTL:          10 * time.Second,
+		SourceTimeouts: sourceTimeoutsConf{
+			Describe:    5 * time.Second,
+			Setup:       5 * time.Second,
+			FirstPacket: 5 * time.Second,
+			FrameGap:    5 * time.Second,
+		},
+		SourceUdpPorts: defaultSourceUdpPorts,
+		Streams: map[string]streamConf{
+			"big": {
+				Url:    "rtsp://" + sl.Addr().String() + "/big",
+				UseTcp: true,
+			},
+		},
+	}, map[streamProtocol]struct{}{
+		_STREAM_PROTOCOL_TCP: {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.run()
+
+	nconn, err := dialRetry(fmt.Sprintf("127.0.0.1:%d", port), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nconn.Close()
+
+	// the client reads frames like the proxy reads the ones of sources
+	sconn := newSourceConn(nconn)
+	conn := gortsplib.NewConnClient(sconn, 10*time.Second, 5*time.Second)
+
+	ur, err := url.Parse(fmt.Sprintf("rtsp://127.0.0.1:%d/big", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*gortsplib.Request{
+		{
+			Method: gortsplib.DESCRIBE,
+			Url:    ur,
+		},
+		{
+			Method: gortsplib.SETUP,
+			Url:    &url.URL{Scheme: "rtsp", Host: ur.Host, Path: ur.Path + "/trackID=0"},
+			Header: gortsplib.Header{
+				"Transport": []string{"RTP/AVP/TCP;unicast;interleaved=0-1"},
+			},
+		},
+		{
+			Method: gortsplib.PLAY,
+			Url:    ur,
+		},
+	} {
+		res, err := conn.WriteRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != gortsplib.StatusOK {
+			t.Fatalf("%s: unexpected status %d", req.Method, res.StatusCode)
+		}
+	}
+
+	for {
+		frame, err := sconn.readInterleavedFrame(10 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame.Channel != 0 {
+			continue
+		}
+
+		if len(frame.Content) != size {
+			t.Fatalf("unexpected frame size: %d", len(frame.Content))
+		}
+		return
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runStateDump writes a snapshot of the runtime state each time SIGUSR1 is
+// received.
+func (p *program) runStateDump() {
+	chanSignal := make(chan os.Signal, 1)
+	signal.Notify(chanSignal, syscall.SIGUSR1)
+
+	for range chanSignal {
+		p.writeStateDump()
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+// +build windows
+
+package main
+
+// runStateDump does nothing, since SIGUSR1 is not available on Windows.
+func (p *program) runStateDump() {
+}
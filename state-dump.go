@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// stateDump is a snapshot of the runtime state of the program, written for
+// post-incident analysis when the API is not reachable.
+type stateDump struct {
+	Time       time.Time         `json:"time"`
+	Version    string            `json:"version"`
+	Streams    []streamInfo      `json:"streams"`
+	Clients    []clientDumpEntry `json:"clients"`
+	Goroutines int               `json:"goroutines"`
+	Stacks     string            `json:"stacks"`
+}
+
+// clientDumpEntry is the state of a client and of its queue.
+type clientDumpEntry struct {
+	clientInfo
+	Path string `json:"path,omitempty"`
+
+	// frames waiting to be written, and capacity of the queue
+	QueueLength int `json:"queueLength"`
+	QueueSize   int `json:"queueSize"`
+}
+
+// goroutineStacks returns the stacks of all goroutines.
+func goroutineStacks() string {
+	buf := make([]byte, 1024*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func (p *program) stateDump() stateDump {
+	dump := stateDump{
+		Time:    time.Now(),
+		Version: Version,
+	}
+
+	func() {
+		p.mutex.RLock()
+		defer p.mutex.RUnlock()
+
+		dump.Streams = []streamInfo{}
+		for _, str := range p.streams {
+			dump.Streams = append(dump.Streams, p.streamInfo(str))
+		}
+
+		dump.Clients = []clientDumpEntry{}
+		for c := range p.clients {
+			dump.Clients = append(dump.Clients, clientDumpEntry{
+				clientInfo:  c.info(),
+				Path:        p.pathDisplayName(c.path),
+				QueueLength: len(c.chanWrite),
+				QueueSize:   cap(c.chanWrite),
+			})
+		}
+	}()
+
+	sort.Slice(dump.Streams, func(i, j int) bool {
+		return dump.Streams[i].Name < dump.Streams[j].Name
+	})
+	sort.Slice(dump.Clients, func(i, j int) bool {
+		return dump.Clients[i].Ip < dump.Clients[j].Ip
+	})
+
+	dump.Goroutines = runtime.NumGoroutine()
+	dump.Stacks = goroutineStacks()
+	return dump
+}
+
+// writeStateDump writes a snapshot of the runtime state into the dump
+// directory, or to stderr.
+func (p *program) writeStateDump() {
+	byts, err := json.MarshalIndent(p.stateDump(), "", "  ")
+	if err != nil {
+		log.Printf("[dump] ERR: %s", err)
+		return
+	}
+
+	if p.conf.DumpDir == "" {
+		os.Stderr.Write(append(byts, '\n'))
+		return
+	}
+
+	path := filepath.Join(p.conf.DumpDir,
+		fmt.Sprintf("dump-%s.json", time.Now().Format("20060102-150405")))
+	err = ioutil.WriteFile(path, byts, 0644)
+	if err != nil {
+		log.Printf("[dump] ERR: %s", err)
+		return
+	}
+	log.Printf("[dump] state written to %s", path)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// programState is the state changed at runtime, that is kept across
+// restarts.
+type programState struct {
+	Draining bool                 `json:"draining"`
+	Bans     map[string]time.Time `json:"bans"`
+	Remaps   map[string]string    `json:"remaps"`
+}
+
+// stateFile stores the state of the program into a JSON file, that is
+// replaced atomically at each change.
+type stateFile struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func newStateFile(path string) *stateFile {
+	return &stateFile{path: path}
+}
+
+func (f *stateFile) log(format string, args ...interface{}) {
+	log.Printf("[state file] "+format, args...)
+}
+
+// load reads the state. A missing file is an empty state.
+func (f *stateFile) load() (*programState, error) {
+	st := &programState{}
+
+	byts, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(byts, st)
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// write replaces the state with the one returned by snapshot, that is
+// called with the file locked, such that concurrent writes never store an
+// outdated state. Nothing is written if snapshot returns nil.
+func (f *stateFile) write(snapshot func() *programState) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	st := snapshot()
+	if st == nil {
+		return
+	}
+
+	byts, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		f.log("ERR: %s", err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), ".state-*")
+	if err != nil {
+		f.log("ERR: %s", err)
+		return
+	}
+
+	_, err = tmp.Write(byts)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		f.log("ERR: %s", err)
+	}
+}
+
+// saveState writes the runtime state into the state file, if any. It must
+// be called without the program mutex. After a handover, the file is
+// written by the new instance only.
+func (p *program) saveState() {
+	if p.state == nil {
+		return
+	}
+
+	p.state.write(func() *programState {
+		p.mutex.RLock()
+		defer p.mutex.RUnlock()
+
+		if p.handedOver {
+			return nil
+		}
+
+		st := &programState{
+			Draining: p.draining,
+			Bans:     p.bans.list(),
+			Remaps:   make(map[string]string),
+		}
+		for name, u := range p.remaps {
+			st.Remaps[name] = u
+		}
+		return st
+	})
+}
+
+// restoreState applies the state read from the state file, before streams
+// are created.
+func (p *program) restoreState() error {
+	st, err := p.state.load()
+	if err != nil {
+		return err
+	}
+
+	p.draining = st.Draining
+	if p.draining {
+		p.state.log("drain mode restored")
+	}
+
+	for ip, until := range st.Bans {
+		if p.bans.restore(ip, until) {
+			p.state.log("ban of %s restored", ip)
+		}
+	}
+
+	for name, u := range st.Remaps {
+		if _, ok := p.conf.Streams[name]; ok {
+			p.remaps[name] = u
+			p.state.log("source of stream '%s' restored to %s", name, urlStringRedacted(u))
+		}
+	}
+
+	return nil
+}
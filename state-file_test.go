@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestStateHandedOver checks that an instance that has handed over its
+// sockets doesn't overwrite the state of the new instance.
+func TestStateHandedOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+
+	p, err := newProgramFromConf(&conf{
+		StateFile:      path,
+		SourceUdpPorts: defaultSourceUdpPorts,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.saveState()
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.mutex.Lock()
+	p.handedOver = true
+	p.draining = true
+	p.mutex.Unlock()
+
+	p.saveState()
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(after) != string(before) {
+		t.Errorf("state file overwritten after the handover: %s", after)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const _STATUS_TIMEOUT = 10 * time.Second
+
+// fetchStreams reads the state of the streams of a running instance through
+// its API.
+func fetchStreams(apiUrl string, auth apiAuthConf) ([]streamInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(apiUrl, "/")+"/v1/streams/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.setRequestAuth(req)
+
+	res, err := (&http.Client{Timeout: _STATUS_TIMEOUT}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	byts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []streamInfo
+	err = json.Unmarshal(byts, &infos)
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// runStatus prints a table with the state of the streams of a running
+// instance.
+func runStatus(apiUrl string, auth apiAuthConf) error {
+	infos, err := fetchStreams(apiUrl, auth)
+	if err != nil {
+		return fmt.Errorf("unable to read the streams of the running instance: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STREAM\tSTATE\tSINCE\tCLIENTS\tRECEIVED\tSENT\tLAST ERROR")
+	for _, info := range infos {
+		since := ""
+		if !info.StateTime.IsZero() {
+			since = time.Since(info.StateTime).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			info.Name,
+			info.State,
+			since,
+			info.Clients,
+			formatBitrate(info.Bitrates.Last10s),
+			formatBitrate(info.ClientsBitrates.Last10s),
+			info.LastError)
+	}
+	return w.Flush()
+}
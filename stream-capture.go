@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	_CAPTURE_MAX_DURATION = 5 * time.Minute
+	_CAPTURE_LINKTYPE_RAW = 101
+	_CAPTURE_BASE_PORT    = 5000
+)
+
+// streamCapture writes the RTP and RTCP packets of a stream into a pcap
+// file. Since packets are received without their network headers, every
+// packet is wrapped into a synthetic IPv4/UDP header, whose port is
+// 5000 + 2*trackId for RTP and 5001 + 2*trackId for RTCP.
+type streamCapture struct {
+	mutex  sync.Mutex
+	path   string
+	f      *os.File
+	bw     *bufio.Writer
+	closed bool
+	onDone func()
+}
+
+func newStreamCapture(path string, duration time.Duration, onDone func()) (*streamCapture, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &streamCapture{
+		path:   path,
+		f:      f,
+		bw:     bufio.NewWriter(f),
+		onDone: onDone,
+	}
+
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], _CAPTURE_LINKTYPE_RAW)
+	c.bw.Write(header[:])
+
+	time.AfterFunc(duration, c.close)
+
+	return c, nil
+}
+
+func (c *streamCapture) write(trackId int, flow trackFlow, frame []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	port := uint16(_CAPTURE_BASE_PORT + trackId*2)
+	if flow == _TRACK_FLOW_RTCP {
+		port++
+	}
+
+	now := time.Now()
+	size := 20 + 8 + len(frame)
+	if size > 65535 {
+		return
+	}
+
+	var header [16 + 20 + 8]byte
+
+	// pcap record
+	binary.LittleEndian.PutUint32(header[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(size))
+	binary.LittleEndian.PutUint32(header[12:], uint32(size))
+
+	// IPv4, from 127.0.0.1 to 127.0.0.1
+	ip := header[16:36]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(size))
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:], []byte{127, 0, 0, 1})
+	copy(ip[16:], []byte{127, 0, 0, 1})
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	binary.BigEndian.PutUint16(ip[10:], ^uint16(sum))
+
+	// UDP, without checksum
+	udp := header[36:44]
+	binary.BigEndian.PutUint16(udp[0:], port)
+	binary.BigEndian.PutUint16(udp[2:], port)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(frame)))
+
+	c.bw.Write(header[:])
+	c.bw.Write(frame)
+}
+
+func (c *streamCapture) close() {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	c.closed = true
+	c.bw.Flush()
+	c.f.Close()
+	c.mutex.Unlock()
+
+	c.onDone()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+
+	"gortc.io/sdp"
+)
+
+// time within which the other sources of a composed stream must provide
+// their SDP
+const _COMPOSE_SDP_TIMEOUT = 10 * time.Second
+
+// seconds between 1900 and 1970, the epochs of NTP and Unix
+const _NTP_EPOCH_OFFSET = 2208988800
+
+// streamComposeConf is an additional source of a composed stream, whose
+// tracks of a given media type replace the ones of the main source.
+type streamComposeConf struct {
+	Url    string `yaml:"url"`
+	UseTcp bool   `yaml:"useTcp"`
+	Media  string `yaml:"media"`
+}
+
+// newComposeSource allocates a stream that receives an additional source of
+// a composed stream, and forwards its tracks to it.
+// parseUrl validates the configuration of a composed source and returns
+// its URL.
+func (cc streamComposeConf) parseUrl() (*url.URL, error) {
+	switch cc.Media {
+	case "audio", "video", "application":
+	default:
+		return nil, fmt.Errorf("invalid compose media: '%s'", cc.Media)
+	}
+
+	ur, err := url.Parse(cc.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compose url: %s", err)
+	}
+
+	if ur.Scheme != "rtsp" {
+		return nil, fmt.Errorf("unsupported compose scheme: %s", ur.Scheme)
+	}
+	if ur.Port() == "" {
+		ur.Host = ur.Hostname() + ":554"
+	}
+
+	return ur, nil
+}
+
+func newComposeSource(parent *stream, cc streamComposeConf) (*stream, error) {
+	ur, err := cc.parseUrl()
+	if err != nil {
+		return nil, err
+	}
+
+	proto := _STREAM_PROTOCOL_UDP
+	if cc.UseTcp {
+		proto = _STREAM_PROTOCOL_TCP
+	}
+
+	s := &stream{
+		p:             parent.p,
+		state:         _STREAM_STATE_STARTING,
+		path:          parent.path,
+		conf:          streamConf{Url: cc.Url, UseTcp: cc.UseTcp},
+		ur:            ur,
+		initialUr:     ur,
+		proto:         proto,
+		stats:         newStreamStats(),
+		subscribers:   make(map[*serverClient]streamSubscriber),
+		stateTime:     time.Now(),
+		chanReady:     make(chan struct{}),
+		chanRequest:   make(chan *streamRequest),
+		stop:          make(chan struct{}),
+		composeParent: parent,
+		composeMedia:  cc.Media,
+		composeSdp:    make(chan struct{}),
+	}
+	s.updateOutputs()
+
+	return s, nil
+}
+
+// composeReplaced tells whether the tracks of the main source with the
+// given media type are replaced by the ones of another source.
+func (s *stream) composeReplaced(media string) bool {
+	for _, c := range s.composeSources {
+		if c.composeMedia == media {
+			return true
+		}
+	}
+	return false
+}
+
+// composeSdps waits for the SDPs of the other sources of a composed stream
+// and merges them with the SDP of the main source. Tracks are numbered in
+// the order of sources.
+func (s *stream) composeSdps(main *sdp.Message) (*sdp.Message, error) {
+	for _, c := range s.composeSources {
+		select {
+		case <-c.composeSdp:
+		case <-time.After(_COMPOSE_SDP_TIMEOUT):
+			return nil, fmt.Errorf("SDP of %s not received", urlRedacted(c.ur))
+		case <-s.stop:
+			return nil, fmt.Errorf("terminated")
+		}
+	}
+
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+
+	out := *main
+	out.Medias = nil
+
+	s.sourceTracks = make(map[int]int)
+	for i, m := range main.Medias {
+		if !s.composeReplaced(m.Description.Type) {
+			s.sourceTracks[i] = len(out.Medias)
+			out.Medias = append(out.Medias, m)
+		}
+	}
+
+	for _, c := range s.composeSources {
+		c.sourceTracks = make(map[int]int)
+		for i, m := range c.clientSdpParsed.Medias {
+			if m.Description.Type == c.composeMedia {
+				c.sourceTracks[i] = len(out.Medias)
+				out.Medias = append(out.Medias, m)
+			}
+		}
+		c.updateOutputs()
+	}
+
+	if len(out.Medias) == 0 {
+		return nil, fmt.Errorf("composed stream has no tracks")
+	}
+
+	return &out, nil
+}
+
+// setComposeSdp stores the SDP of an additional source of a composed
+// stream.
+func (s *stream) setComposeSdp(clientSdpParsed *sdp.Message) {
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+
+	first := s.clientSdpParsed == nil
+	s.clientSdpParsed = clientSdpParsed
+	if first {
+		close(s.composeSdp)
+	}
+}
+
+// rtcpSetSenderTime replaces the NTP timestamp of a RTCP sender report with
+// the time at which it has been received. Sources of a composed stream
+// don't share a clock, while clients use sender reports to synchronize
+// tracks; the time of the proxy is a common reference.
+func rtcpSetSenderTime(frame []byte, t time.Time) []byte {
+	// sender reports are always the first packet of compound packets
+	if len(frame) < 28 || frame[1] != 200 {
+		return frame
+	}
+
+	ret := append([]byte(nil), frame...)
+	secs := uint64(t.Unix()) + _NTP_EPOCH_OFFSET
+	frac := uint64(t.Nanosecond()) << 32 / 1000000000
+	binary.BigEndian.PutUint64(ret[8:], secs<<32|frac)
+	return ret
+}
+
+// forwardSourceTrack sends a frame received from a source, whose track
+// id can differ from the one seen by clients when the stream is composed or
+// derived.
+func (s *stream) forwardSourceTrack(id int, flow trackFlow, frame []byte) {
+	o := s.outputs.Load().(*streamOutputs)
+
+	if o.sourceTracks != nil {
+		out, ok := o.sourceTracks[id]
+		if !ok {
+			return
+		}
+		id = out
+
+		if flow == _TRACK_FLOW_RTCP && (s.composeParent != nil || len(s.composeSources) > 0) {
+			frame = rtcpSetSenderTime(frame, time.Now())
+		}
+	}
+
+	if s.composeParent != nil {
+		// frames received before the SDP of the composed stream is
+		// ready are discarded
+		if o.sourceTracks != nil {
+			s.composeParent.forwardTrack(id, flow, frame)
+		}
+		return
+	}
+
+	s.forwardTrack(id, flow, frame)
+}
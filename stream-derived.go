@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+
+	"gortc.io/sdp"
+)
+
+// linkDerivedStreams attaches the streams that are derived from another
+// stream to it. Derived streams don't have a source; they receive the
+// tracks of their parent that pass their filters.
+func (p *program) linkDerivedStreams() error {
+	for name, s := range p.streams {
+		if s.conf.From == "" || s.conf.Disabled {
+			continue
+		}
+
+		parent, ok := p.streams[s.conf.From]
+		if !ok {
+			return fmt.Errorf("stream '%s': stream '%s' not found", name, s.conf.From)
+		}
+		if parent.conf.From != "" {
+			return fmt.Errorf("stream '%s': stream '%s' is derived from another stream", name, s.conf.From)
+		}
+
+		parent.derived = append(parent.derived, s)
+		parent.updateOutputs()
+	}
+	return nil
+}
+
+func validateDerivedConf(conf streamConf) error {
+	if conf.Url != "" || conf.Source != "" || len(conf.Compose) > 0 {
+		return fmt.Errorf("derived streams can't have a source")
+	}
+	if conf.Vod {
+		return fmt.Errorf("derived streams can't be vod")
+	}
+
+	for _, media := range conf.FromMedia {
+		switch media {
+		case "audio", "video", "application":
+		default:
+			return fmt.Errorf("invalid media: '%s'", media)
+		}
+	}
+
+	for _, id := range conf.FromTracks {
+		if id < 0 {
+			return fmt.Errorf("invalid track: %d", id)
+		}
+	}
+
+	return nil
+}
+
+// derivedAccepts tells whether a track of the parent passes the filters of
+// a derived stream.
+func (sc streamConf) derivedAccepts(i int, m sdp.Media) bool {
+	if len(sc.FromTracks) > 0 {
+		found := false
+		for _, id := range sc.FromTracks {
+			if id == i {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(sc.FromMedia) > 0 {
+		found := false
+		for _, media := range sc.FromMedia {
+			if media == m.Description.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setParentSdp sets the SDP of a derived stream from the one of its
+// parent.
+func (s *stream) setParentSdp(parentSdp *sdp.Message) {
+	out := *parentSdp
+	out.Medias = nil
+
+	sourceTracks := make(map[int]int)
+	for i, m := range parentSdp.Medias {
+		if s.conf.derivedAccepts(i, m) {
+			sourceTracks[i] = len(out.Medias)
+			out.Medias = append(out.Medias, m)
+		}
+	}
+
+	if len(out.Medias) == 0 {
+		s.log("ERR: no tracks of stream '%s' pass the filters", s.conf.From)
+
+		s.p.mutex.Lock()
+		defer s.p.mutex.Unlock()
+		s.clientSdpParsed = nil
+		return
+	}
+
+	s.setSdp(&out, nil)
+
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+	s.sourceTracks = sourceTracks
+	s.updateOutputs()
+}
+
+// derivedStreams returns the streams derived from a stream.
+func (s *stream) derivedStreams() []*stream {
+	s.p.mutex.RLock()
+	defer s.p.mutex.RUnlock()
+	return append([]*stream(nil), s.derived...)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dvrEntry struct {
+	time    time.Time
+	trackId int
+	flow    trackFlow
+	frame   []byte
+}
+
+// streamDvr is a rolling in-memory buffer of the most recent frames of a
+// stream, used to serve time-shifted playback.
+type streamDvr struct {
+	duration time.Duration
+	maxBytes int // 0 means unlimited
+	mutex    sync.Mutex
+	entries  []dvrEntry // stored by value to avoid an allocation for each frame
+	bytes    int
+	firstSeq int // sequence number of entries[0]
+}
+
+func newStreamDvr(duration time.Duration, maxBytes int) *streamDvr {
+	return &streamDvr{
+		duration: duration,
+		maxBytes: maxBytes,
+	}
+}
+
+func (d *streamDvr) push(trackId int, flow trackFlow, frame []byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	d.entries = append(d.entries, dvrEntry{
+		time:    now,
+		trackId: trackId,
+		flow:    flow,
+		frame:   frame,
+	})
+	d.bytes += len(frame)
+
+	// remove expired entries and entries that exceed the size limit
+	n := 0
+	for n < len(d.entries) && (now.Sub(d.entries[n].time) > d.duration ||
+		(d.maxBytes > 0 && d.bytes > d.maxBytes)) {
+		d.bytes -= len(d.entries[n].frame)
+		n++
+	}
+	if n > 0 {
+		d.entries = d.entries[n:]
+		d.firstSeq += n
+	}
+}
+
+func (d *streamDvr) clear() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.firstSeq += len(d.entries)
+	d.entries = nil
+	d.bytes = 0
+}
+
+// size returns the amount of buffered bytes.
+func (d *streamDvr) size() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.bytes
+}
+
+// seek returns the sequence number of the first entry received at or after t.
+func (d *streamDvr) seek(t time.Time) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for i, e := range d.entries {
+		if !e.time.Before(t) {
+			return d.firstSeq + i
+		}
+	}
+	return d.firstSeq + len(d.entries)
+}
+
+// get returns the entry with the given sequence number, or the oldest
+// available one if it has already expired, together with its sequence number.
+func (d *streamDvr) get(seq int) (*dvrEntry, int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if seq < d.firstSeq {
+		seq = d.firstSeq
+	}
+
+	i := seq - d.firstSeq
+	if i >= len(d.entries) {
+		return nil, seq
+	}
+	// entries are never modified after being added, therefore a pointer
+	// into the slice remains valid
+	return &d.entries[i], seq
+}
+
+// ifCaughtUp calls fn if there are no entries starting from the given
+// sequence number, while entries can't be added. It returns whether fn has
+// been called.
+func (d *streamDvr) ifCaughtUp(seq int, fn func()) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if seq < d.firstSeq {
+		seq = d.firstSeq
+	}
+	if seq-d.firstSeq < len(d.entries) {
+		return false
+	}
+
+	fn()
+	return true
+}
+
+func (d *streamDvr) oldest() time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.entries) == 0 {
+		return time.Now()
+	}
+	return d.entries[0].time
+}
+
+// parseRangeStart returns the playback start requested by a Range header.
+// A zero time means live playback. Supported formats are
+// clock=YYYYMMDDThhmmss[.fff]Z- and npt=<seconds>- where npt is relative to
+// the oldest buffered frame.
+func (d *streamDvr) parseRangeStart(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+
+	// ignore the time parameter
+	if n := strings.Index(v, ";"); n >= 0 {
+		v = v[:n]
+	}
+
+	n := strings.Index(v, "=")
+	if n < 0 {
+		return time.Time{}, fmt.Errorf("invalid range (%s)", v)
+	}
+	unit, val := v[:n], v[n+1:]
+
+	if n := strings.Index(val, "-"); n >= 0 {
+		val = val[:n]
+	}
+
+	switch unit {
+	case "clock":
+		if val == "" {
+			return time.Time{}, nil
+		}
+		for _, layout := range []string{"20060102T150405Z", "20060102T150405.999999999Z"} {
+			t, err := time.Parse(layout, val)
+			if err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid clock range (%s)", val)
+
+	case "npt":
+		if val == "" || val == "now" {
+			return time.Time{}, nil
+		}
+		secs, err := parseNpt(val)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return d.oldest().Add(time.Duration(secs * float64(time.Second))), nil
+
+	default:
+		return time.Time{}, fmt.Errorf("unsupported range unit (%s)", unit)
+	}
+}
+
+// parseNpt parses a npt time in the npt-sec or npt-hhmmss format.
+func parseNpt(v string) (float64, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) != 1 && len(parts) != 3 {
+		return 0, fmt.Errorf("invalid npt time (%s)", v)
+	}
+
+	var ret float64
+	for _, part := range parts {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil || f < 0 {
+			return 0, fmt.Errorf("invalid npt time (%s)", v)
+		}
+		ret = ret*60 + f
+	}
+	return ret, nil
+}
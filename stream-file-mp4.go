@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// mp4Box is a box of a MP4 file.
+type mp4Box struct {
+	typ     string
+	content []byte
+}
+
+// mp4ReadBoxes splits a buffer into boxes.
+func mp4ReadBoxes(buf []byte) ([]mp4Box, error) {
+	var ret []mp4Box
+
+	for len(buf) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(buf[0:]))
+		typ := string(buf[4:8])
+		headerLen := uint64(8)
+
+		switch size {
+		case 0:
+			size = uint64(len(buf))
+		case 1:
+			if len(buf) < 16 {
+				return nil, fmt.Errorf("invalid MP4 box")
+			}
+			size = binary.BigEndian.Uint64(buf[8:])
+			headerLen = 16
+		}
+
+		if size < headerLen || size > uint64(len(buf)) {
+			return nil, fmt.Errorf("invalid MP4 box")
+		}
+
+		ret = append(ret, mp4Box{typ, buf[headerLen:size]})
+		buf = buf[size:]
+	}
+
+	return ret, nil
+}
+
+// mp4FindBox returns the content of the box at the given path.
+func mp4FindBox(buf []byte, path ...string) ([]byte, bool) {
+	for _, typ := range path {
+		boxes, err := mp4ReadBoxes(buf)
+		if err != nil {
+			return nil, false
+		}
+
+		found := false
+		for _, b := range boxes {
+			if b.typ == typ {
+				buf = b.content
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return buf, true
+}
+
+// mp4ReadEsds returns the DecoderSpecificInfo of an elementary stream
+// descriptor.
+func mp4ReadEsds(buf []byte) ([]byte, error) {
+	// version and flags
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("invalid esds")
+	}
+	buf = buf[4:]
+
+	readDescriptor := func() (byte, []byte, error) {
+		if len(buf) < 2 {
+			return 0, nil, fmt.Errorf("invalid esds")
+		}
+		tag := buf[0]
+		buf = buf[1:]
+
+		size := 0
+		for i := 0; i < 4; i++ {
+			if len(buf) == 0 {
+				return 0, nil, fmt.Errorf("invalid esds")
+			}
+			b := buf[0]
+			buf = buf[1:]
+			size = size<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+
+		if size > len(buf) {
+			return 0, nil, fmt.Errorf("invalid esds")
+		}
+		return tag, buf[:size], nil
+	}
+
+	// ES_Descriptor
+	tag, content, err := readDescriptor()
+	if err != nil || tag != 0x03 || len(content) < 3 {
+		return nil, fmt.Errorf("invalid esds")
+	}
+	flags := content[2]
+	buf = content[3:]
+	skip := 0
+	if flags&0x80 != 0 {
+		skip += 2
+	}
+	if flags&0x40 != 0 {
+		if len(buf) <= skip {
+			return nil, fmt.Errorf("invalid esds")
+		}
+		skip += 1 + int(buf[skip])
+	}
+	if flags&0x20 != 0 {
+		skip += 2
+	}
+	if skip > len(buf) {
+		return nil, fmt.Errorf("invalid esds")
+	}
+	buf = buf[skip:]
+
+	// DecoderConfigDescriptor
+	tag, content, err = readDescriptor()
+	if err != nil || tag != 0x04 || len(content) < 13 {
+		return nil, fmt.Errorf("invalid esds")
+	}
+	buf = content[13:]
+
+	// DecoderSpecificInfo
+	tag, content, err = readDescriptor()
+	if err != nil || tag != 0x05 {
+		return nil, fmt.Errorf("invalid esds")
+	}
+	return content, nil
+}
+
+// mp4Uint32s reads a table of a full box whose entries are made of
+// 32-bit integers.
+func mp4Uint32s(buf []byte, fields int) ([][]uint32, bool) {
+	if len(buf) < 8 {
+		return nil, false
+	}
+	count := int(binary.BigEndian.Uint32(buf[4:]))
+	buf = buf[8:]
+	if count*fields*4 > len(buf) {
+		return nil, false
+	}
+
+	ret := make([][]uint32, count)
+	for i := range ret {
+		ret[i] = make([]uint32, fields)
+		for j := range ret[i] {
+			ret[i][j] = binary.BigEndian.Uint32(buf[(i*fields+j)*4:])
+		}
+	}
+	return ret, true
+}
+
+// mp4ReadMoov returns the content of the moov box of a file, without
+// reading the other top-level boxes, that contain the samples.
+func mp4ReadMoov(r io.ReaderAt, size int64) ([]byte, error) {
+	header := make([]byte, 16)
+
+	for offset := int64(0); offset+8 <= size; {
+		_, err := r.ReadAt(header[:8], offset)
+		if err != nil {
+			return nil, err
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(header[0:]))
+		typ := string(header[4:8])
+		headerLen := int64(8)
+
+		switch boxSize {
+		case 0:
+			boxSize = size - offset
+		case 1:
+			_, err := r.ReadAt(header[8:16], offset+8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MP4 box")
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:]))
+			headerLen = 16
+		}
+
+		if boxSize < headerLen || boxSize > size-offset {
+			return nil, fmt.Errorf("invalid MP4 box")
+		}
+
+		if typ == "moov" {
+			moov := make([]byte, boxSize-headerLen)
+			_, err := r.ReadAt(moov, offset+headerLen)
+			if err != nil {
+				return nil, err
+			}
+			return moov, nil
+		}
+
+		offset += boxSize
+	}
+
+	return nil, fmt.Errorf("moov box not found")
+}
+
+// readMp4 reads the H.264, AAC and Opus tracks of a MP4 file that is not
+// fragmented. Only the moov box and the samples are read.
+func readMp4(r io.ReaderAt, size int64) ([]*fileTrack, []fileSample, error) {
+	moov, err := mp4ReadMoov(r, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	boxes, err := mp4ReadBoxes(moov)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tracks []*fileTrack
+	var samples []fileSample
+
+	for _, trak := range boxes {
+		if trak.typ != "trak" {
+			continue
+		}
+
+		mdhd, ok := mp4FindBox(trak.content, "mdia", "mdhd")
+		if !ok || len(mdhd) < 24 {
+			continue
+		}
+		var timeScale uint32
+		if mdhd[0] == 1 {
+			if len(mdhd) < 36 {
+				continue
+			}
+			timeScale = binary.BigEndian.Uint32(mdhd[20:])
+		} else {
+			timeScale = binary.BigEndian.Uint32(mdhd[12:])
+		}
+		if timeScale == 0 {
+			continue
+		}
+
+		stbl, ok := mp4FindBox(trak.content, "mdia", "minf", "stbl")
+		if !ok {
+			continue
+		}
+
+		stsd, ok := mp4FindBox(stbl, "stsd")
+		if !ok || len(stsd) < 8 {
+			continue
+		}
+		entries, err := mp4ReadBoxes(stsd[8:])
+		if err != nil || len(entries) == 0 {
+			continue
+		}
+
+		track := &fileTrack{id: len(tracks)}
+		nalLenSize := 0
+
+		switch entries[0].typ {
+		case "avc1":
+			// skip the visual sample entry
+			if len(entries[0].content) < 78 {
+				continue
+			}
+			avcc, ok := mp4FindBox(entries[0].content[78:], "avcC")
+			if !ok || len(avcc) < 8 {
+				continue
+			}
+			nalLenSize = int(avcc[4]&0x03) + 1
+
+			// first SPS and first PPS
+			if avcc[5]&0x1f == 0 {
+				continue
+			}
+			spsLen := int(binary.BigEndian.Uint16(avcc[6:]))
+			if 8+spsLen+3 > len(avcc) {
+				continue
+			}
+			track.sps = avcc[8 : 8+spsLen]
+			rest := avcc[8+spsLen:]
+			if rest[0] == 0 {
+				continue
+			}
+			ppsLen := int(binary.BigEndian.Uint16(rest[1:]))
+			if 3+ppsLen > len(rest) {
+				continue
+			}
+			track.pps = rest[3 : 3+ppsLen]
+			track.codec = _FILE_CODEC_H264
+
+		case "mp4a":
+			// skip the audio sample entry
+			if len(entries[0].content) < 28 {
+				continue
+			}
+			esds, ok := mp4FindBox(entries[0].content[28:], "esds")
+			if !ok {
+				continue
+			}
+			dsi, err := mp4ReadEsds(esds)
+			if err != nil {
+				return nil, nil, err
+			}
+			conf := &aacConfig{}
+			err = conf.decode(dsi)
+			if err != nil {
+				return nil, nil, err
+			}
+			track.aacConf = conf
+			track.codec = _FILE_CODEC_AAC
+
+		case "Opus":
+			// skip the audio sample entry
+			if len(entries[0].content) < 28 {
+				continue
+			}
+			dops, ok := mp4FindBox(entries[0].content[28:], "dOps")
+			if !ok || len(dops) < 2 {
+				continue
+			}
+			track.channels = int(dops[1])
+			track.codec = _FILE_CODEC_OPUS
+
+		default:
+			continue
+		}
+
+		// sample sizes
+		stsz, ok := mp4FindBox(stbl, "stsz")
+		if !ok || len(stsz) < 12 {
+			return nil, nil, fmt.Errorf("stsz box not found")
+		}
+		fixedSize := binary.BigEndian.Uint32(stsz[4:])
+		count := int(binary.BigEndian.Uint32(stsz[8:]))
+		sizes := make([]uint32, count)
+		for i := range sizes {
+			if fixedSize != 0 {
+				sizes[i] = fixedSize
+			} else {
+				if 12+i*4+4 > len(stsz) {
+					return nil, nil, fmt.Errorf("invalid stsz box")
+				}
+				sizes[i] = binary.BigEndian.Uint32(stsz[12+i*4:])
+			}
+		}
+
+		// chunk offsets
+		var chunkOffsets []uint64
+		if stco, ok := mp4FindBox(stbl, "stco"); ok {
+			table, ok := mp4Uint32s(stco, 1)
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid stco box")
+			}
+			for _, e := range table {
+				chunkOffsets = append(chunkOffsets, uint64(e[0]))
+			}
+		} else if co64, ok := mp4FindBox(stbl, "co64"); ok {
+			table, ok := mp4Uint32s(co64, 2)
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid co64 box")
+			}
+			for _, e := range table {
+				chunkOffsets = append(chunkOffsets, uint64(e[0])<<32|uint64(e[1]))
+			}
+		} else {
+			return nil, nil, fmt.Errorf("chunk offsets not found")
+		}
+
+		stscBox, _ := mp4FindBox(stbl, "stsc")
+		stsc, ok := mp4Uint32s(stscBox, 3)
+		if !ok || len(stsc) == 0 {
+			return nil, nil, fmt.Errorf("invalid stsc box")
+		}
+
+		sttsBox, _ := mp4FindBox(stbl, "stts")
+		stts, ok := mp4Uint32s(sttsBox, 2)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid stts box")
+		}
+
+		var ctts [][]uint32
+		if cttsBox, ok := mp4FindBox(stbl, "ctts"); ok {
+			ctts, _ = mp4Uint32s(cttsBox, 2)
+		}
+
+		// sync samples; if the box is missing, all samples are sync samples
+		var syncSamples map[int]struct{}
+		if stssBox, ok := mp4FindBox(stbl, "stss"); ok {
+			stss, _ := mp4Uint32s(stssBox, 1)
+			syncSamples = make(map[int]struct{})
+			for _, e := range stss {
+				syncSamples[int(e[0])-1] = struct{}{}
+			}
+		}
+
+		// sample offsets
+		offsets := make([]uint64, 0, count)
+		for i, e := range stsc {
+			firstChunk := int(e[0]) - 1
+			lastChunk := len(chunkOffsets)
+			if i+1 < len(stsc) {
+				lastChunk = int(stsc[i+1][0]) - 1
+			}
+
+			for chunk := firstChunk; chunk < lastChunk && chunk < len(chunkOffsets); chunk++ {
+				off := chunkOffsets[chunk]
+				for j := uint32(0); j < e[1] && len(offsets) < count; j++ {
+					offsets = append(offsets, off)
+					off += uint64(sizes[len(offsets)-1])
+				}
+			}
+		}
+		if len(offsets) < count {
+			return nil, nil, fmt.Errorf("invalid stsc box")
+		}
+
+		// sample times
+		dts := uint64(0)
+		sttsEntry, sttsLeft := 0, uint32(0)
+		cttsEntry, cttsLeft := 0, uint32(0)
+		if len(stts) > 0 {
+			sttsLeft = stts[0][0]
+		}
+		if len(ctts) > 0 {
+			cttsLeft = ctts[0][0]
+		}
+
+		toDuration := func(v int64) time.Duration {
+			if v < 0 {
+				v = 0
+			}
+			return time.Duration(v) * time.Second / time.Duration(timeScale)
+		}
+
+		for i := 0; i < count; i++ {
+			if offsets[i] > uint64(size) || offsets[i]+uint64(sizes[i]) > uint64(size) {
+				return nil, nil, fmt.Errorf("sample outside the file")
+			}
+			data := make([]byte, sizes[i])
+			_, err := r.ReadAt(data, int64(offsets[i]))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			pts := int64(dts)
+			if cttsEntry < len(ctts) {
+				// composition offsets are signed in version 1
+				pts += int64(int32(ctts[cttsEntry][1]))
+			}
+
+			sample := fileSample{
+				track: track,
+				dts:   toDuration(int64(dts)),
+				pts:   toDuration(pts),
+			}
+
+			if track.codec == _FILE_CODEC_H264 {
+				_, isSync := syncSamples[i]
+				if syncSamples == nil || isSync {
+					sample.nalus = [][]byte{track.sps, track.pps}
+				}
+
+				for len(data) >= nalLenSize {
+					l := 0
+					for _, b := range data[:nalLenSize] {
+						l = l<<8 | int(b)
+					}
+					data = data[nalLenSize:]
+					if l > len(data) {
+						return nil, nil, fmt.Errorf("invalid NAL unit length")
+					}
+					if l > 0 {
+						sample.nalus = append(sample.nalus, data[:l])
+					}
+					data = data[l:]
+				}
+			} else {
+				sample.au = data
+			}
+
+			samples = append(samples, sample)
+
+			if sttsEntry < len(stts) {
+				dts += uint64(stts[sttsEntry][1])
+				sttsLeft--
+				if sttsLeft == 0 {
+					sttsEntry++
+					if sttsEntry < len(stts) {
+						sttsLeft = stts[sttsEntry][0]
+					}
+				}
+			}
+			if cttsEntry < len(ctts) {
+				cttsLeft--
+				if cttsLeft == 0 {
+					cttsEntry++
+					if cttsEntry < len(ctts) {
+						cttsLeft = ctts[cttsEntry][0]
+					}
+				}
+			}
+		}
+
+		tracks = append(tracks, track)
+	}
+
+	return tracks, samples, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	_TS_PACKET_SIZE          = 188
+	_TS_STREAM_TYPE_H264     = 0x1b
+	_TS_STREAM_TYPE_AAC      = 0x0f
+	_TS_STREAM_TYPE_PRIVATE  = 0x06
+	_TS_STREAM_TYPE_METADATA = 0x15
+)
+
+// h264SplitAnnexB splits a byte stream into NAL units.
+func h264SplitAnnexB(buf []byte) [][]byte {
+	var ret [][]byte
+
+	for {
+		i := bytes.Index(buf, []byte{0, 0, 1})
+		if i < 0 {
+			break
+		}
+		buf = buf[i+3:]
+
+		end := bytes.Index(buf, []byte{0, 0, 1})
+		if end < 0 {
+			end = len(buf)
+		}
+
+		nalu := buf[:end]
+		// remove the zero byte of 4-byte start codes and trailing zeros
+		for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+			nalu = nalu[:len(nalu)-1]
+		}
+		if len(nalu) > 0 {
+			ret = append(ret, nalu)
+		}
+
+		buf = buf[end:]
+	}
+
+	return ret
+}
+
+// tsParsePts decodes a timestamp of a PES header.
+func tsParsePts(b []byte) time.Duration {
+	v := int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 | int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 | int64(b[4]>>1)
+	return time.Duration(v) * time.Second / 90000
+}
+
+// readTs reads the H.264, AAC and KLV tracks of a MPEG-TS file.
+func readTs(r io.Reader) ([]*fileTrack, []fileSample, error) {
+	pmtPid := -1
+	trackByPid := make(map[int]*fileTrack)
+	klvCells := make(map[*fileTrack]bool)
+	var tracks []*fileTrack
+	pesBufs := make(map[int][]byte)
+	var samples []fileSample
+
+	flushPes := func(pid int) error {
+		buf := pesBufs[pid]
+		delete(pesBufs, pid)
+		track := trackByPid[pid]
+
+		if len(buf) < 9 || buf[0] != 0 || buf[1] != 0 || buf[2] != 1 {
+			return nil
+		}
+
+		headerLen := int(buf[8])
+		if len(buf) < 9+headerLen {
+			return nil
+		}
+
+		var pts, dts time.Duration
+		switch {
+		case buf[7]&0x80 != 0 && headerLen >= 5:
+			pts = tsParsePts(buf[9:])
+			dts = pts
+			if buf[7]&0x40 != 0 && headerLen >= 10 {
+				dts = tsParsePts(buf[14:])
+			}
+
+		case track.codec == _FILE_CODEC_KLV && len(samples) > 0:
+			// asynchronous KLV doesn't have timestamps, and is aligned
+			// with the previous sample
+			pts = samples[len(samples)-1].pts
+			dts = samples[len(samples)-1].dts
+
+		default:
+			return nil
+		}
+		payload := buf[9+headerLen:]
+
+		switch track.codec {
+		case _FILE_CODEC_H264:
+			var nalus [][]byte
+			for _, nalu := range h264SplitAnnexB(payload) {
+				switch nalu[0] & 0x1f {
+				case _H264_NALU_SPS:
+					track.sps = nalu
+				case _H264_NALU_PPS:
+					track.pps = nalu
+				case 9: // access unit delimiter
+					continue
+				}
+				nalus = append(nalus, nalu)
+			}
+
+			if len(nalus) > 0 {
+				samples = append(samples, fileSample{
+					track: track,
+					dts:   dts,
+					pts:   pts,
+					nalus: nalus,
+				})
+			}
+
+		case _FILE_CODEC_AAC:
+			conf, aus, err := readAdts(payload)
+			if err != nil {
+				return err
+			}
+			if conf == nil {
+				return nil
+			}
+			track.aacConf = conf
+
+			for i, au := range aus {
+				t := pts + time.Duration(i*1024)*time.Second/time.Duration(conf.sampleRate)
+				samples = append(samples, fileSample{
+					track: track,
+					dts:   t,
+					pts:   t,
+					au:    au,
+				})
+			}
+
+		case _FILE_CODEC_KLV:
+			if klvCells[track] {
+				payload = tsKlvUnwrapCells(payload)
+			}
+
+			if len(payload) > 0 {
+				samples = append(samples, fileSample{
+					track: track,
+					dts:   dts,
+					pts:   pts,
+					au:    payload,
+				})
+			}
+		}
+
+		return nil
+	}
+
+	// payloads are copied into PES buffers, therefore the packet buffer
+	// is reused
+	pkt := make([]byte, _TS_PACKET_SIZE)
+
+	for {
+		_, err := io.ReadFull(r, pkt)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if pkt[0] != 0x47 {
+			return nil, nil, fmt.Errorf("invalid MPEG-TS packet")
+		}
+
+		pusi := pkt[1]&0x40 != 0
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		afc := pkt[3] >> 4 & 0x03
+
+		payload := pkt[4:]
+		if afc&0x02 != 0 {
+			if int(payload[0])+1 > len(payload) {
+				continue
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		if afc&0x01 == 0 {
+			continue
+		}
+
+		switch {
+		case pid == 0 || pid == pmtPid:
+			// tables are supposed to fit into a single packet
+			if !pusi || len(payload) < 1 || int(payload[0])+1 > len(payload) {
+				continue
+			}
+			table := payload[1+int(payload[0]):]
+			if len(table) < 3 {
+				continue
+			}
+			sectionLen := int(table[1]&0x0f)<<8 | int(table[2])
+			if 3+sectionLen > len(table) || sectionLen < 9 {
+				continue
+			}
+			// remove CRC
+			section := table[3 : 3+sectionLen-4]
+
+			if pid == 0 {
+				for entries := section[5:]; len(entries) >= 4; entries = entries[4:] {
+					program := int(entries[0])<<8 | int(entries[1])
+					if program != 0 {
+						pmtPid = int(entries[2]&0x1f)<<8 | int(entries[3])
+						break
+					}
+				}
+				continue
+			}
+
+			if len(tracks) > 0 || len(section) < 9 {
+				continue
+			}
+			infoLen := int(section[7]&0x0f)<<8 | int(section[8])
+			if 9+infoLen > len(section) {
+				continue
+			}
+			for entries := section[9+infoLen:]; len(entries) >= 5; {
+				streamType := entries[0]
+				esPid := int(entries[1]&0x1f)<<8 | int(entries[2])
+				esInfoLen := int(entries[3]&0x0f)<<8 | int(entries[4])
+				if 5+esInfoLen > len(entries) {
+					break
+				}
+				descriptors := entries[5 : 5+esInfoLen]
+
+				var codec fileCodec
+				switch streamType {
+				case _TS_STREAM_TYPE_H264:
+					codec = _FILE_CODEC_H264
+				case _TS_STREAM_TYPE_AAC:
+					codec = _FILE_CODEC_AAC
+				case _TS_STREAM_TYPE_PRIVATE, _TS_STREAM_TYPE_METADATA:
+					if tsIsKlv(descriptors) {
+						codec = _FILE_CODEC_KLV
+					}
+				}
+
+				if codec != _FILE_CODEC_NONE {
+					track := &fileTrack{
+						id:    len(tracks),
+						codec: codec,
+					}
+					tracks = append(tracks, track)
+					trackByPid[esPid] = track
+
+					// synchronous metadata is wrapped into cells
+					if streamType == _TS_STREAM_TYPE_METADATA {
+						klvCells[track] = true
+					}
+				}
+
+				entries = entries[5+esInfoLen:]
+			}
+
+		default:
+			if _, ok := trackByPid[pid]; !ok {
+				continue
+			}
+
+			if pusi {
+				err := flushPes(pid)
+				if err != nil {
+					return nil, nil, err
+				}
+				pesBufs[pid] = append([]byte(nil), payload...)
+			} else if _, ok := pesBufs[pid]; ok {
+				pesBufs[pid] = append(pesBufs[pid], payload...)
+			}
+		}
+	}
+
+	for pid := range pesBufs {
+		err := flushPes(pid)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return tracks, samples, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// tsTestPackets splits data into MPEG-TS packets, filling the last one with
+// an adaptation field.
+func tsTestPackets(pid int, data []byte) []byte {
+	var ret []byte
+
+	for first := true; first || len(data) > 0; first = false {
+		pkt := make([]byte, _TS_PACKET_SIZE)
+		pkt[0] = 0x47
+		pkt[1] = byte(pid>>8) & 0x1f
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+
+		n := len(data)
+		if n >= 184 {
+			n = 184
+			pkt[3] = 0x10
+			copy(pkt[4:], data[:n])
+		} else {
+			pkt[3] = 0x30
+			afLen := 183 - n
+			pkt[4] = byte(afLen)
+			for i := 5; i < 5+afLen; i++ {
+				pkt[i] = 0xff
+			}
+			if afLen > 0 {
+				pkt[5] = 0
+			}
+			copy(pkt[5+afLen:], data[:n])
+		}
+
+		ret = append(ret, pkt...)
+		data = data[n:]
+	}
+
+	return ret
+}
+
+// tsTestSection returns the packet of a table section, with an empty CRC.
+func tsTestSection(pid int, tableId byte, section []byte) []byte {
+	l := len(section) + 4
+	data := append([]byte{0, tableId, 0xb0 | byte(l>>8), byte(l)}, section...)
+	data = append(data, 0, 0, 0, 0)
+	return tsTestPackets(pid, data)
+}
+
+// tsTestPes returns the packets of a PES, with a PTS in 90kHz units if it is
+// not negative.
+func tsTestPes(pid int, streamId byte, pts int64, payload []byte) []byte {
+	pes := []byte{0, 0, 1, streamId, 0, 0, 0x84}
+	if pts >= 0 {
+		pes = append(pes, 0x80, 5,
+			0x21|byte(pts>>29)&0x0e, byte(pts>>22), byte(pts>>14)|1, byte(pts>>7), byte(pts<<1)|1)
+	} else {
+		pes = append(pes, 0, 0)
+	}
+	return tsTestPackets(pid, append(pes, payload...))
+}
+
+func TestReadTsKlv(t *testing.T) {
+	syncKlv := bytes.Repeat([]byte{0x06, 0x0e, 0x2b, 0x34}, 500)
+	asyncKlv := []byte{0x06, 0x0e, 0x2b, 0x34, 0x01, 0x00}
+
+	// the synchronous stream is wrapped into a metadata AU cell
+	cell := make([]byte, 5, 5+len(syncKlv))
+	cell[2] = 0xdf
+	binary.BigEndian.PutUint16(cell[3:], uint16(len(syncKlv)))
+	cell = append(cell, syncKlv...)
+
+	var buf []byte
+	buf = append(buf, tsTestSection(0, 0x00, []byte{
+		0x00, 0x01, 0xc1, 0x00, 0x00,
+		0x00, 0x01, 0xf0, 0x00, // program 1, PMT on PID 0x1000
+	})...)
+	buf = append(buf, tsTestSection(0x1000, 0x02, []byte{
+		0x00, 0x01, 0xc1, 0x00, 0x00,
+		0xe1, 0x01, 0xf0, 0x00,
+		// synchronous KLV, with a metadata descriptor
+		_TS_STREAM_TYPE_METADATA, 0xe1, 0x01, 0xf0, 0x0b,
+		_TS_DESCRIPTOR_METADATA, 0x09, 0x01, 0x00, 0xdf, 'K', 'L', 'V', 'A', 0x00, 0x0f,
+		// asynchronous KLV, with a registration descriptor
+		_TS_STREAM_TYPE_PRIVATE, 0xe1, 0x02, 0xf0, 0x06,
+		_TS_DESCRIPTOR_REGISTRATION, 0x04, 'K', 'L', 'V', 'A',
+	})...)
+	buf = append(buf, tsTestPes(0x101, 0xfc, 90000, cell)...)
+	buf = append(buf, tsTestPes(0x102, 0xbd, -1, asyncKlv)...)
+	buf = append(buf, tsTestPes(0x101, 0xfc, 180000, cell)...)
+	buf = append(buf, tsTestPes(0x102, 0xbd, -1, asyncKlv)...)
+
+	sdpText, pkts, err := readMediaFile(readTs(bytes.NewReader(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Count(string(sdpText), "smpte336m/90000") != 2 {
+		t.Fatalf("unexpected SDP: %s", sdpText)
+	}
+
+	var trackPkts [2][][]byte
+	for _, pkt := range pkts {
+		trackPkts[pkt.trackId] = append(trackPkts[pkt.trackId], pkt.buf)
+	}
+
+	// the synchronous unit is split into two packets, the marker is set on
+	// the last one
+	sync := trackPkts[0]
+	if len(sync) != 4 {
+		t.Fatalf("unexpected synchronous packet count: %d", len(sync))
+	}
+	if sync[0][1] != 96 || sync[1][1] != 0x80|96 {
+		t.Errorf("unexpected markers or payload types: %x %x", sync[0][1], sync[1][1])
+	}
+	if ts := binary.BigEndian.Uint32(sync[0][4:]); ts != 90000 {
+		t.Errorf("unexpected timestamp: %d", ts)
+	}
+	if !bytes.Equal(append(sync[0][12:], sync[1][12:]...), syncKlv) {
+		t.Errorf("unexpected synchronous KLV")
+	}
+
+	// the asynchronous unit takes the timestamp of the previous sample
+	async := trackPkts[1]
+	if len(async) != 2 {
+		t.Fatalf("unexpected asynchronous packet count: %d", len(async))
+	}
+	if async[0][1] != 0x80|97 || !bytes.Equal(async[0][12:], asyncKlv) {
+		t.Errorf("unexpected asynchronous packet: %x", async[0])
+	}
+	if ts := binary.BigEndian.Uint32(async[0][4:]); ts != 90000 {
+		t.Errorf("unexpected timestamp: %d", ts)
+	}
+}
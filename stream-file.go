@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// first line of rtpdump files
+	_RTPDUMP_MAGIC = "#!rtpplay1.0 "
+
+	// maximum length of pcap records, that is the maximum snapshot length
+	// of libpcap
+	_PCAP_MAX_RECORD_SIZE = 262144
+)
+
+// filePacket is a packet read from a capture file.
+type filePacket struct {
+	offset  time.Duration
+	trackId int
+	flow    trackFlow
+	buf     []byte
+}
+
+type fileCodec int
+
+const (
+	_FILE_CODEC_NONE fileCodec = iota
+	_FILE_CODEC_H264
+	_FILE_CODEC_AAC
+	_FILE_CODEC_OPUS
+	_FILE_CODEC_KLV
+)
+
+// fileTrack is a track of a media file.
+type fileTrack struct {
+	id      int
+	codec   fileCodec
+	sps     []byte
+	pps     []byte
+	aacConf *aacConfig
+
+	// Opus
+	channels int
+}
+
+// fileSample is an access unit of a media file.
+type fileSample struct {
+	track *fileTrack
+	dts   time.Duration
+	pts   time.Duration
+	nalus [][]byte
+	au    []byte
+}
+
+// readFile reads the SDP and the packets of a file. pcap and rtpdump
+// files contain RTP packets and require a SDP, while the tracks of MPEG-TS
+// and MP4 files are demuxed and packetized. Files are read progressively,
+// such that only the packets are kept in memory.
+func readFile(fpath string, sdpPath string) ([]byte, []filePacket, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(len(_RTPDUMP_MAGIC))
+
+	var sdpText []byte
+	var pkts []filePacket
+
+	switch {
+	case fi.Size() >= _TS_PACKET_SIZE && len(head) >= 1 && head[0] == 0x47:
+		sdpText, pkts, err = readMediaFile(readTs(br))
+
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		sdpText, pkts, err = readMediaFile(readMp4(f, fi.Size()))
+
+	default:
+		if sdpPath == "" {
+			return nil, nil, fmt.Errorf("pcap and rtpdump files require a SDP")
+		}
+
+		sdpText, err = ioutil.ReadFile(sdpPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read SDP: %s", err)
+		}
+
+		if bytes.HasPrefix(head, []byte(_RTPDUMP_MAGIC)) {
+			pkts, err = readRtpdump(br)
+		} else {
+			pkts, err = readPcap(br)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(pkts) == 0 {
+		return nil, nil, fmt.Errorf("file does not contain any RTP packet")
+	}
+	return sdpText, pkts, nil
+}
+
+// readMediaFile generates the SDP and the RTP packets of demuxed tracks.
+func readMediaFile(tracks []*fileTrack, samples []fileSample, err error) ([]byte, []filePacket, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(tracks) == 0 {
+		return nil, nil, fmt.Errorf("file does not contain any H.264, AAC or Opus track")
+	}
+
+	sdpText := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=File\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"t=0 0\r\n"
+
+	h264Packetizers := make(map[*fileTrack]*rtpH264Packetizer)
+	aacPacketizers := make(map[*fileTrack]*rtpAacPacketizer)
+	opusPacketizers := make(map[*fileTrack]*rtpOpusPacketizer)
+	klvPacketizers := make(map[*fileTrack]*rtpKlvPacketizer)
+
+	for _, track := range tracks {
+		payloadType := uint8(96 + track.id)
+
+		switch track.codec {
+		case _FILE_CODEC_H264:
+			if len(track.sps) < 4 || len(track.pps) == 0 {
+				return nil, nil, fmt.Errorf("SPS or PPS not found")
+			}
+
+			sdpText += fmt.Sprintf("m=video 0 RTP/AVP %d\r\n"+
+				"a=rtpmap:%d H264/90000\r\n"+
+				"a=fmtp:%d packetization-mode=1; profile-level-id=%X; sprop-parameter-sets=%s,%s\r\n",
+				payloadType, payloadType, payloadType, track.sps[1:4],
+				base64.StdEncoding.EncodeToString(track.sps),
+				base64.StdEncoding.EncodeToString(track.pps))
+
+			h264Packetizers[track] = &rtpH264Packetizer{
+				payloadType: payloadType,
+				ssrc:        rand.Uint32(),
+				seq:         uint16(rand.Uint32()),
+			}
+
+		case _FILE_CODEC_AAC:
+			if track.aacConf == nil {
+				return nil, nil, fmt.Errorf("AAC configuration not found")
+			}
+
+			sdpText += fmt.Sprintf("m=audio 0 RTP/AVP %d\r\n"+
+				"a=rtpmap:%d mpeg4-generic/%d/%d\r\n"+
+				"a=fmtp:%d streamtype=5; profile-level-id=1; mode=AAC-hbr; "+
+				"sizelength=13; indexlength=3; indexdeltalength=3; config=%x\r\n",
+				payloadType, payloadType, track.aacConf.sampleRate, track.aacConf.channels,
+				payloadType, track.aacConf.encode())
+
+			aacPacketizers[track] = &rtpAacPacketizer{
+				payloadType: payloadType,
+				ssrc:        rand.Uint32(),
+				seq:         uint16(rand.Uint32()),
+			}
+
+		case _FILE_CODEC_OPUS:
+			// the rtpmap of Opus always has 2 channels (RFC7587)
+			sdpText += fmt.Sprintf("m=audio 0 RTP/AVP %d\r\n"+
+				"a=rtpmap:%d opus/%d/2\r\n",
+				payloadType, payloadType, _OPUS_CLOCK_RATE)
+			if track.channels == 2 {
+				sdpText += fmt.Sprintf("a=fmtp:%d sprop-stereo=1\r\n", payloadType)
+			}
+
+			opusPacketizers[track] = &rtpOpusPacketizer{
+				payloadType: payloadType,
+				ssrc:        rand.Uint32(),
+				seq:         uint16(rand.Uint32()),
+			}
+
+		case _FILE_CODEC_KLV:
+			sdpText += fmt.Sprintf("m=application 0 RTP/AVP %d\r\n"+
+				"a=rtpmap:%d smpte336m/%d\r\n",
+				payloadType, payloadType, _KLV_CLOCK_RATE)
+
+			klvPacketizers[track] = &rtpKlvPacketizer{
+				payloadType: payloadType,
+				ssrc:        rand.Uint32(),
+				seq:         uint16(rand.Uint32()),
+			}
+		}
+	}
+
+	if len(samples) == 0 {
+		return nil, nil, fmt.Errorf("file does not contain any sample")
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].dts < samples[j].dts
+	})
+	start := samples[0].dts
+
+	var pkts []filePacket
+	for _, sample := range samples {
+		var bufs [][]byte
+
+		switch sample.track.codec {
+		case _FILE_CODEC_H264:
+			ts := uint32(int64(sample.pts) * 90000 / int64(time.Second))
+			bufs = h264Packetizers[sample.track].packetize(sample.nalus, ts)
+
+		case _FILE_CODEC_AAC:
+			if len(sample.au) >= 1<<13 {
+				continue
+			}
+			ts := uint32(int64(sample.pts) * int64(sample.track.aacConf.sampleRate) / int64(time.Second))
+			bufs = [][]byte{aacPacketizers[sample.track].packetize(sample.au, ts)}
+
+		case _FILE_CODEC_OPUS:
+			ts := uint32(int64(sample.pts) * _OPUS_CLOCK_RATE / int64(time.Second))
+			bufs = [][]byte{opusPacketizers[sample.track].packetize(sample.au, ts)}
+
+		case _FILE_CODEC_KLV:
+			ts := uint32(int64(sample.pts) * _KLV_CLOCK_RATE / int64(time.Second))
+			bufs = klvPacketizers[sample.track].packetize(sample.au, ts)
+		}
+
+		for _, buf := range bufs {
+			pkts = append(pkts, filePacket{
+				offset:  sample.dts - start,
+				trackId: sample.track.id,
+				flow:    _TRACK_FLOW_RTP,
+				buf:     buf,
+			})
+		}
+	}
+
+	return []byte(sdpText), pkts, nil
+}
+
+// isRtcp tells whether a packet is RTCP, by its payload type (RFC5761).
+func isRtcp(buf []byte) bool {
+	return len(buf) >= 2 && buf[1] >= 192 && buf[1] <= 223
+}
+
+// readRtpdump reads a file in the format of rtptools, that contains a
+// single track.
+func readRtpdump(br *bufio.Reader) ([]filePacket, error) {
+	_, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("invalid rtpdump header")
+	}
+
+	header := make([]byte, 16)
+	_, err = io.ReadFull(br, header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rtpdump header")
+	}
+
+	var pkts []filePacket
+	for {
+		_, err := io.ReadFull(br, header[:8])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rtpdump packet")
+		}
+
+		length := int(binary.BigEndian.Uint16(header[0:]))
+		offset := binary.BigEndian.Uint32(header[4:])
+		if length < 8 {
+			return nil, fmt.Errorf("invalid rtpdump packet")
+		}
+
+		buf := make([]byte, length-8)
+		_, err = io.ReadFull(br, buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rtpdump packet")
+		}
+
+		flow := _TRACK_FLOW_RTP
+		if isRtcp(buf) {
+			flow = _TRACK_FLOW_RTCP
+		}
+
+		pkts = append(pkts, filePacket{
+			offset: time.Duration(offset) * time.Millisecond,
+			flow:   flow,
+			buf:    buf,
+		})
+	}
+
+	return pkts, nil
+}
+
+// readPcap reads a pcap file. Tracks are told apart by the destination port
+// of packets: tracks are sorted by RTP port, while RTCP packets belong to
+// the track whose RTP port precedes their port.
+func readPcap(r io.Reader) ([]filePacket, error) {
+	header := make([]byte, 24)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported file format")
+	}
+
+	var bo binary.ByteOrder
+	var nano bool
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4:
+		bo = binary.LittleEndian
+	case 0xa1b23c4d:
+		bo, nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		bo = binary.BigEndian
+	case 0x4d3cb2a1:
+		bo, nano = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("unsupported file format")
+	}
+
+	linkType := bo.Uint32(header[20:])
+
+	type udpPacket struct {
+		time time.Duration
+		port int
+		buf  []byte
+	}
+
+	var udpPkts []udpPacket
+	for {
+		_, err := io.ReadFull(r, header[:16])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid pcap record")
+		}
+
+		sec := bo.Uint32(header[0:])
+		frac := bo.Uint32(header[4:])
+		inclLen := bo.Uint32(header[8:])
+
+		if inclLen > _PCAP_MAX_RECORD_SIZE {
+			return nil, fmt.Errorf("invalid pcap record")
+		}
+
+		frame := make([]byte, inclLen)
+		_, err = io.ReadFull(r, frame)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pcap record")
+		}
+
+		t := time.Duration(sec) * time.Second
+		if nano {
+			t += time.Duration(frac)
+		} else {
+			t += time.Duration(frac) * time.Microsecond
+		}
+
+		port, buf, ok := pcapUdpPayload(linkType, frame)
+		if !ok || len(buf) < 2 || buf[0]>>6 != 2 {
+			continue
+		}
+
+		udpPkts = append(udpPkts, udpPacket{t, port, buf})
+	}
+
+	var rtpPorts []int
+	for _, up := range udpPkts {
+		if isRtcp(up.buf) {
+			continue
+		}
+
+		found := false
+		for _, port := range rtpPorts {
+			if port == up.port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			rtpPorts = append(rtpPorts, up.port)
+		}
+	}
+	sort.Ints(rtpPorts)
+
+	trackByPort := make(map[int]int)
+	for i, port := range rtpPorts {
+		trackByPort[port] = i
+	}
+
+	var pkts []filePacket
+	for _, up := range udpPkts {
+		flow := _TRACK_FLOW_RTP
+		port := up.port
+		if isRtcp(up.buf) {
+			flow = _TRACK_FLOW_RTCP
+			port--
+		}
+
+		trackId, ok := trackByPort[port]
+		if !ok {
+			continue
+		}
+
+		pkts = append(pkts, filePacket{
+			offset:  up.time - udpPkts[0].time,
+			trackId: trackId,
+			flow:    flow,
+			buf:     up.buf,
+		})
+	}
+
+	return pkts, nil
+}
+
+// pcapUdpPayload returns the destination port and the payload of a frame
+// that contains an UDP packet.
+func pcapUdpPayload(linkType uint32, frame []byte) (int, []byte, bool) {
+	switch linkType {
+	case 0: // BSD loopback
+		if len(frame) < 4 {
+			return 0, nil, false
+		}
+		frame = frame[4:]
+
+	case 1: // ethernet
+		if len(frame) < 14 {
+			return 0, nil, false
+		}
+		// skip VLAN tag
+		if binary.BigEndian.Uint16(frame[12:]) == 0x8100 {
+			if len(frame) < 18 {
+				return 0, nil, false
+			}
+			frame = frame[4:]
+		}
+		frame = frame[14:]
+
+	case 101: // raw IP
+
+	case 113: // linux cooked capture
+		if len(frame) < 16 {
+			return 0, nil, false
+		}
+		frame = frame[16:]
+
+	default:
+		return 0, nil, false
+	}
+
+	if len(frame) < 1 {
+		return 0, nil, false
+	}
+
+	switch frame[0] >> 4 {
+	case 4:
+		ihl := int(frame[0]&0x0f) * 4
+		// the header contains at least 20 bytes
+		if ihl < 20 || len(frame) < ihl+8 || frame[9] != 17 {
+			return 0, nil, false
+		}
+		frame = frame[ihl:]
+
+	case 6:
+		if len(frame) < 40+8 || frame[6] != 17 {
+			return 0, nil, false
+		}
+		frame = frame[40:]
+
+	default:
+		return 0, nil, false
+	}
+
+	port := int(binary.BigEndian.Uint16(frame[2:]))
+	length := int(binary.BigEndian.Uint16(frame[4:]))
+	if length < 8 || length > len(frame) {
+		return 0, nil, false
+	}
+
+	return port, frame[8:length], true
+}
+
+// fileLoop rewrites sequence numbers and timestamps of RTP packets, such
+// that they keep increasing when a file is looped.
+type fileLoop struct {
+	iteration uint32
+	tracks    map[int]*fileLoopTrack
+	gap       time.Duration
+}
+
+type fileLoopTrack struct {
+	seqSpan uint16
+	tsSpan  uint32
+}
+
+func newFileLoop(pkts []filePacket) *fileLoop {
+	type trackInfo struct {
+		firstSeq uint16
+		lastSeq  uint16
+		firstTs  uint32
+		lastTs   uint32
+		tsCount  int
+	}
+
+	infos := make(map[int]*trackInfo)
+	for _, pkt := range pkts {
+		if pkt.flow != _TRACK_FLOW_RTP || len(pkt.buf) < 12 {
+			continue
+		}
+
+		seq := binary.BigEndian.Uint16(pkt.buf[2:])
+		ts := binary.BigEndian.Uint32(pkt.buf[4:])
+
+		info, ok := infos[pkt.trackId]
+		if !ok {
+			infos[pkt.trackId] = &trackInfo{seq, seq, ts, ts, 1}
+			continue
+		}
+
+		info.lastSeq = seq
+		if ts != info.lastTs {
+			info.lastTs = ts
+			info.tsCount++
+		}
+	}
+
+	l := &fileLoop{
+		tracks: make(map[int]*fileLoopTrack),
+	}
+
+	for trackId, info := range infos {
+		// the last frame lasts as much as the average frame
+		tsSpan := info.lastTs - info.firstTs
+		if info.tsCount > 1 {
+			tsSpan += tsSpan / uint32(info.tsCount-1)
+		}
+
+		l.tracks[trackId] = &fileLoopTrack{
+			seqSpan: info.lastSeq - info.firstSeq + 1,
+			tsSpan:  tsSpan,
+		}
+
+		if trackId == 0 && info.tsCount > 1 {
+			l.gap = pkts[len(pkts)-1].offset / time.Duration(info.tsCount-1)
+		}
+	}
+
+	return l
+}
+
+// rewrite returns a copy of a packet, adapted to the current iteration.
+func (l *fileLoop) rewrite(pkt filePacket) []byte {
+	buf := make([]byte, len(pkt.buf))
+	copy(buf, pkt.buf)
+
+	t, ok := l.tracks[pkt.trackId]
+	if !ok || pkt.flow != _TRACK_FLOW_RTP || len(buf) < 12 {
+		return buf
+	}
+
+	seq := binary.BigEndian.Uint16(buf[2:]) + uint16(l.iteration)*t.seqSpan
+	ts := binary.BigEndian.Uint32(buf[4:]) + l.iteration*t.tsSpan
+	binary.BigEndian.PutUint16(buf[2:], seq)
+	binary.BigEndian.PutUint32(buf[4:], ts)
+	return buf
+}
+
+// runFile reads a source from a file, in real time and in a loop.
+func (s *stream) runFile() {
+	sdpText, pkts, err := readFile(s.ur.Path, s.conf.Sdp)
+	if err != nil {
+		s.log("ERR: %s", err)
+		return
+	}
+
+	clientSdpParsed, err := sdpParse(sdpText)
+	if err != nil {
+		s.log("ERR: invalid SDP: %s", err)
+		return
+	}
+
+	s.setSdp(clientSdpParsed, sdpText)
+	s.setReady()
+	defer s.setNotReady()
+
+	s.logReady()
+
+	// captures can lack RTCP packets, and media files never contain them
+	receivers := make([]*rtcpReceiver, len(clientSdpParsed.Medias))
+	for i, m := range clientSdpParsed.Medias {
+		receivers[i] = newRtcpReceiver(mediaClockRate(m))
+	}
+	s.stats.setReceivers(receivers)
+	defer s.stats.setReceivers(nil)
+	var lastReport time.Time
+
+	loop := newFileLoop(pkts)
+	t := time.NewTimer(0)
+	<-t.C
+	defer t.Stop()
+
+	for {
+		start := time.Now()
+
+		for _, pkt := range pkts {
+			if pkt.trackId >= len(clientSdpParsed.Medias) {
+				continue
+			}
+
+			if d := time.Until(start.Add(pkt.offset)); d > 0 {
+				t.Reset(d)
+				select {
+				case <-t.C:
+				case <-s.stop:
+					return
+				}
+			} else {
+				select {
+				case <-s.stop:
+					return
+				default:
+				}
+			}
+
+			buf := loop.rewrite(pkt)
+
+			now := time.Now()
+			if pkt.flow == _TRACK_FLOW_RTP {
+				receivers[pkt.trackId].processRtp(buf)
+			} else {
+				receivers[pkt.trackId].processRtcp(buf, now)
+			}
+
+			s.forwardTrack(pkt.trackId, pkt.flow, buf)
+
+			if now.Sub(lastReport) >= _RTCP_RECEIVER_REPORT_INTERVAL {
+				lastReport = now
+				for i, r := range receivers {
+					if sr := r.senderReport(now); sr != nil {
+						s.forwardTrack(i, _TRACK_FLOW_RTCP, sr)
+					}
+				}
+			}
+		}
+
+		loop.iteration++
+
+		t.Reset(loop.gap)
+		select {
+		case <-t.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
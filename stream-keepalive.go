@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/aler9/gortsplib"
+)
+
+// methods that keep alive the session with the source, in order of
+// preference. Some cameras refuse OPTIONS inside a session, while they
+// accept empty SET_PARAMETER or GET_PARAMETER requests.
+var keepaliveMethods = []gortsplib.Method{
+	gortsplib.OPTIONS,
+	gortsplib.SET_PARAMETER,
+	gortsplib.GET_PARAMETER,
+}
+
+// sendKeepalive keeps alive the session with the source, with the method
+// that has been accepted the last time. When it is refused, the following
+// methods are tried, and the one that is accepted is used from then on, also
+// after reconnections.
+func (s *stream) sendKeepalive(conn *gortsplib.ConnClient) error {
+	for i := range keepaliveMethods {
+		index := (s.keepaliveMethod + i) % len(keepaliveMethods)
+		method := keepaliveMethods[index]
+
+		ur := &url.URL{
+			Scheme: "rtsp",
+			Host:   s.ur.Host,
+			Path:   "/",
+		}
+		if method != gortsplib.OPTIONS {
+			ur.Path = s.ur.Path
+			ur.RawQuery = s.ur.RawQuery
+		}
+
+		res, err := s.writeRequest(conn, &gortsplib.Request{
+			Method: method,
+			Url:    ur,
+		})
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode == gortsplib.StatusOK {
+			if index != s.keepaliveMethod {
+				s.log("source accepts %s as keepalive", method)
+				s.keepaliveMethod = index
+			}
+			return nil
+		}
+
+		s.log("ERR: %s keepalive returned code %d", method, res.StatusCode)
+	}
+
+	// the session can still be kept alive by the source, therefore it is
+	// not closed
+	return nil
+}
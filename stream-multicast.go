@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// streamMulticastConf contains the options of the pushes of a stream whose
+// destination is a multicast group.
+type streamMulticastConf struct {
+	Ttl       int    `yaml:"ttl"`
+	Interface string `yaml:"interface"`
+	Source    string `yaml:"source"`
+}
+
+func (mc streamMulticastConf) validate() error {
+	if mc.Ttl < 0 || mc.Ttl > 255 {
+		return fmt.Errorf("invalid multicast ttl: %d", mc.Ttl)
+	}
+
+	if mc.Interface != "" {
+		_, err := net.InterfaceByName(mc.Interface)
+		if err != nil {
+			return fmt.Errorf("invalid multicast interface: %s", err)
+		}
+	}
+
+	if mc.Source != "" && net.ParseIP(mc.Source) == nil {
+		return fmt.Errorf("invalid multicast source: %s", mc.Source)
+	}
+
+	return nil
+}
+
+// isSsmGroup checks whether an address belongs to the range reserved to
+// source-specific multicast, in which receivers join a group together with
+// the address of its source.
+func isSsmGroup(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 232
+	}
+	return len(ip) == net.IPv6len && ip[0] == 0xff && (ip[1]&0xf0) == 0x30
+}
+
+// streamMulticastSender sends the pushes of a stream whose destination is a
+// multicast group. It uses dedicated sockets, since the TTL, the interface
+// and the source address are specific to each stream.
+type streamMulticastSender struct {
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+}
+
+func newStreamMulticastSender(conf streamMulticastConf) (*streamMulticastSender, error) {
+	var ifi *net.Interface
+	if conf.Interface != "" {
+		var err error
+		ifi, err = net.InterfaceByName(conf.Interface)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listen := func() (*net.UDPConn, error) {
+		nconn, err := net.ListenUDP("udp", &net.UDPAddr{
+			IP: net.ParseIP(conf.Source),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if conf.Ttl > 0 {
+			err := setMulticastTtl(nconn, conf.Ttl)
+			if err != nil {
+				nconn.Close()
+				return nil, fmt.Errorf("unable to set multicast ttl: %s", err)
+			}
+		}
+
+		if ifi != nil {
+			err := setMulticastInterface(nconn, ifi)
+			if err != nil {
+				nconn.Close()
+				return nil, fmt.Errorf("unable to set multicast interface: %s", err)
+			}
+		}
+
+		return nconn, nil
+	}
+
+	rtpConn, err := listen()
+	if err != nil {
+		return nil, err
+	}
+
+	rtcpConn, err := listen()
+	if err != nil {
+		rtpConn.Close()
+		return nil, err
+	}
+
+	return &streamMulticastSender{
+		rtpConn:  rtpConn,
+		rtcpConn: rtcpConn,
+	}, nil
+}
+
+func (ms *streamMulticastSender) close() {
+	ms.rtpConn.Close()
+	ms.rtcpConn.Close()
+}
+
+func (ms *streamMulticastSender) write(flow trackFlow, addr *net.UDPAddr, buf []byte) {
+	if flow == _TRACK_FLOW_RTP {
+		ms.rtpConn.WriteTo(buf, addr)
+	} else {
+		ms.rtcpConn.WriteTo(buf, addr)
+	}
+}
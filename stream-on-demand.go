@@ -0,0 +1,33 @@
+package main
+
+// onDemandStreams returns the static streams that are pulled when clients
+// request them, that is, the ones without preload when --on-demand is set.
+// Streams whose frames are used without clients, that is, the ones with
+// pushes, with playback and the parents of derived streams, are always
+// preloaded.
+func onDemandStreams(c *conf) map[string]struct{} {
+	ret := make(map[string]struct{})
+	if !c.OnDemand {
+		return ret
+	}
+
+	parents := make(map[string]struct{})
+	for _, sc := range c.Streams {
+		if sc.From != "" {
+			parents[sc.From] = struct{}{}
+		}
+	}
+
+	for name, sc := range c.Streams {
+		if sc.Preload || sc.Vod || len(sc.QueryPassthrough) > 0 || sc.Disabled ||
+			sc.From != "" || len(sc.Push) > 0 || sc.playback() {
+			continue
+		}
+		if _, ok := parents[name]; ok {
+			continue
+		}
+		ret[name] = struct{}{}
+	}
+
+	return ret
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// streamQuota limits the bandwidth of a stream with a token bucket, that
+// allows bursts of one second.
+type streamQuota struct {
+	mutex          sync.Mutex
+	rate           float64 // bytes per second
+	tokens         float64
+	lastTime       time.Time
+	dropping       bool
+	droppedBytes   uint64
+	droppedPackets uint64
+}
+
+func newStreamQuota(maxBitrate uint64) *streamQuota {
+	rate := float64(maxBitrate) / 8
+	return &streamQuota{
+		rate:     rate,
+		tokens:   rate,
+		lastTime: time.Now(),
+	}
+}
+
+// allow tells whether a packet can be forwarded, and whether it's the first
+// packet that is dropped since the quota was exceeded.
+func (q *streamQuota) allow(n int) (bool, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	q.tokens += now.Sub(q.lastTime).Seconds() * q.rate
+	if q.tokens > q.rate {
+		q.tokens = q.rate
+	}
+	q.lastTime = now
+
+	if float64(n) > q.tokens {
+		q.droppedBytes += uint64(n)
+		q.droppedPackets++
+		started := !q.dropping
+		q.dropping = true
+		return false, started
+	}
+
+	q.tokens -= float64(n)
+	q.dropping = false
+	return true, false
+}
+
+// dropped returns the amount of bytes and of packets dropped.
+func (q *streamQuota) dropped() (uint64, uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.droppedBytes, q.droppedPackets
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// remapStream replaces the source of a static stream. The new stream serves
+// new clients, while the previous one keeps serving the clients that are
+// playing it, until they disconnect or, when migrate is set, until they are
+// moved to the new stream on its first key frame.
+func (p *program) remapStream(name string, rawUrl string, migrate bool) (*stream, error) {
+	ur, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+
+	// local files and generated sources can be used only by the
+	// configuration file
+	if ur.Scheme != "rtsp" {
+		return nil, fmt.Errorf("unsupported scheme: %s", ur.Scheme)
+	}
+
+	p.mutex.RLock()
+	old, ok := p.streams[name]
+	_, static := p.conf.Streams[name]
+	p.mutex.RUnlock()
+
+	if !ok || !static || old.conf.Vod {
+		return nil, fmt.Errorf("there is no static stream on path '%s'", name)
+	}
+
+	if old.conf.From != "" {
+		return nil, fmt.Errorf("derived streams can't be remapped")
+	}
+
+	sc := old.conf
+	sc.Url = ur.String()
+	sc.Source = ""
+
+	str, err := newStream(p, name, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// the stream may have been replaced or removed in the meanwhile
+	old = p.streams[name]
+	if old == nil {
+		str.stopWithReason(_TEARDOWN_SOURCE_REPLACED)
+		return nil, fmt.Errorf("there is no static stream on path '%s'", name)
+	}
+
+	p.streams[name] = str
+	delete(p.sdpCache, name)
+
+	if migrate {
+		str.migrateFrom = old
+	}
+
+	// derived streams follow the new stream, and are ready again when it
+	// is
+	for _, d := range old.derived {
+		if d.state == _STREAM_STATE_READY {
+			d.unready()
+		}
+	}
+	str.derived = old.derived
+	old.derived = nil
+	old.updateOutputs()
+	str.updateOutputs()
+
+	old.retire()
+
+	if sc.Url == p.conf.Streams[name].Url {
+		delete(p.remaps, name)
+	} else {
+		p.remaps[name] = sc.Url
+	}
+	go p.saveState()
+
+	str.log("source changed from %s to %s", urlRedacted(old.ur), urlRedacted(str.ur))
+
+	return str, nil
+}
+
+// retire stops the pushes of a stream that has been replaced, and stops it
+// once it has no more clients. It must be called with the program mutex
+// locked.
+func (s *stream) retire() {
+	s.retired = true
+	s.pushes = nil
+	s.updateOutputs()
+	s.p.retiredStreams[s] = struct{}{}
+	s.stopIfUnused()
+}
+
+// stopIfUnused stops a retired stream without clients. It must be called
+// with the program mutex locked.
+func (s *stream) stopIfUnused() {
+	if _, ok := s.p.retiredStreams[s]; !ok || len(s.subscribers) > 0 {
+		return
+	}
+
+	s.log("replaced and without clients, stopping, reason: %s", _TEARDOWN_SOURCE_REPLACED)
+	s.stopWithReason(_TEARDOWN_SOURCE_REPLACED)
+	delete(s.p.retiredStreams, s)
+}
+
+// ownsClient tells whether a client receives, or will receive, the frames
+// of the stream. It must be called with the program mutex locked.
+func (s *stream) ownsClient(c *serverClient) bool {
+	if c.path != s.path || s.composeParent != nil {
+		return false
+	}
+	if c.stream != nil {
+		return c.stream == s
+	}
+	return s.p.streams[s.path] == s
+}
+
+// migrationCompatible tells whether clients of a stream can be moved to
+// another one, that is, whether both streams have the same tracks. It must
+// be called with the program mutex locked.
+func migrationCompatible(from *stream, to *stream) bool {
+	if from.clientSdpParsed == nil || to.clientSdpParsed == nil ||
+		len(from.clientSdpParsed.Medias) != len(to.clientSdpParsed.Medias) {
+		return false
+	}
+
+	for i, m := range from.clientSdpParsed.Medias {
+		if !strings.EqualFold(mediaEncoding(m), mediaEncoding(to.clientSdpParsed.Medias[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// migrate moves the clients of the stream that has been replaced by this
+// one.
+func (s *stream) migrate() {
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+
+	from := s.migrateFrom
+	if from == nil {
+		return
+	}
+	s.migrateFrom = nil
+	s.updateOutputs()
+
+	if !migrationCompatible(from, s) {
+		s.log("ERR: clients can't be migrated, since the tracks of the sources are different")
+		return
+	}
+
+	for c, sub := range from.subscribers {
+		delete(from.subscribers, c)
+		c.stream = s
+		s.subscribers[c] = sub
+	}
+	from.updateOutputs()
+	s.updateOutputs()
+	s.log("clients migrated from %s", urlRedacted(from.ur))
+
+	from.stopIfUnused()
+}
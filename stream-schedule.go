@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduleWindow is a weekly time window, in the format "Mon-Fri 18:00-08:00".
+// Windows whose end precedes their start end the following day.
+type scheduleWindow struct {
+	days  [7]bool
+	start int // minutes since midnight
+	end   int
+}
+
+func parseScheduleTime(v string) (int, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time: %s", v)
+	}
+
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time: %s", v)
+	}
+	return h*60 + m, nil
+}
+
+func parseScheduleDays(v string) ([7]bool, error) {
+	var ret [7]bool
+
+	if v == "*" {
+		for i := range ret {
+			ret[i] = true
+		}
+		return ret, nil
+	}
+
+	for _, part := range strings.Split(v, ",") {
+		bounds := strings.Split(strings.ToLower(strings.TrimSpace(part)), "-")
+		if len(bounds) > 2 {
+			return ret, fmt.Errorf("invalid days: %s", v)
+		}
+
+		first, ok := scheduleDays[bounds[0]]
+		if !ok {
+			return ret, fmt.Errorf("invalid day: %s", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, ok = scheduleDays[bounds[1]]
+			if !ok {
+				return ret, fmt.Errorf("invalid day: %s", bounds[1])
+			}
+		}
+
+		// ranges can wrap around the end of the week, like Sat-Mon
+		for d := first; ; d = (d + 1) % 7 {
+			ret[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func parseSchedule(vals []string) ([]scheduleWindow, error) {
+	var ret []scheduleWindow
+
+	for _, v := range vals {
+		fields := strings.Fields(v)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid schedule window: '%s'", v)
+		}
+
+		days, err := parseScheduleDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		times := strings.Split(fields[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid schedule window: '%s'", v)
+		}
+		start, err := parseScheduleTime(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseScheduleTime(times[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == end || start == 24*60 {
+			return nil, fmt.Errorf("invalid schedule window: '%s'", v)
+		}
+
+		ret = append(ret, scheduleWindow{days, start, end})
+	}
+
+	return ret, nil
+}
+
+// active tells whether the window contains the given time.
+func (w scheduleWindow) active(t time.Time) bool {
+	day := t.Weekday()
+	m := t.Hour()*60 + t.Minute()
+
+	if w.start < w.end {
+		return w.days[day] && m >= w.start && m < w.end
+	}
+
+	return (w.days[day] && m >= w.start) || (w.days[(day+6)%7] && m < w.end)
+}
+
+// scheduleActive tells whether the stream must be pulled at the given time,
+// that is, whether it has no schedule or a window of its schedule contains
+// the time.
+func (sc streamConf) scheduleActive(t time.Time) bool {
+	if len(sc.Schedule) == 0 {
+		return true
+	}
+
+	// the schedule has been validated
+	windows, _ := parseSchedule(sc.Schedule)
+	for _, w := range windows {
+		if w.active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// applySchedules enables the streams whose schedule has begun, and disables
+// the ones whose schedule has ended, by replacing them. It must be called
+// with the program mutex locked.
+func (p *program) applySchedules(now time.Time) {
+	for name, sc := range p.conf.Streams {
+		if len(sc.Schedule) == 0 {
+			continue
+		}
+
+		old, ok := p.streams[name]
+		if !ok {
+			continue
+		}
+
+		disabled := sc.Disabled || !sc.scheduleActive(now)
+		if old.conf.Disabled == disabled {
+			continue
+		}
+
+		if u, ok := p.remaps[name]; ok {
+			sc.Url = u
+		}
+		sc.Disabled = disabled
+
+		str, err := newStream(p, name, sc)
+		if err != nil {
+			old.log("ERR: %s", err)
+			continue
+		}
+
+		p.streams[name] = str
+		delete(p.sdpCache, name)
+
+		// derived streams follow the new stream
+		for _, d := range old.derived {
+			if d.state == _STREAM_STATE_READY {
+				d.unready()
+			}
+		}
+		str.derived = old.derived
+		old.derived = nil
+		old.updateOutputs()
+		str.updateOutputs()
+
+		if disabled {
+			old.log("schedule ended, stopping, reason: %s", _TEARDOWN_SCHEDULE)
+		} else {
+			old.log("schedule began, starting")
+		}
+		old.stopWithReason(_TEARDOWN_SCHEDULE)
+	}
+}
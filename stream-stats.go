@@ -0,0 +1,257 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	_STATS_BITRATE_SAMPLES = 60
+	_STATS_EVENTS          = 20
+	_STATS_USER_AGENTS     = 100
+)
+
+// user agent of clients whose user agent is not recorded, since the limit
+// has been reached
+const _STATS_OTHER_USER_AGENTS = "(other)"
+
+type streamEvent struct {
+	time time.Time
+	text string
+}
+
+// userAgentStats counts the sessions started by clients with a user agent
+// and a transport.
+type userAgentStats struct {
+	UserAgent string    `json:"userAgent"`
+	Transport string    `json:"transport"`
+	Sessions  uint64    `json:"sessions"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// streamStats collects statistics about a stream.
+type streamStats struct {
+	mutex     sync.Mutex
+	bytes     uint64
+	lastBytes uint64
+	lastTime  time.Time
+	bitrates  []float64 // bits per second, most recent last
+	events    []streamEvent
+	lastError string
+	errorTime time.Time
+	receivers []*rtcpReceiver
+	agents    map[[2]string]*userAgentStats // by user agent and transport
+	teardowns map[teardownReason]uint64     // sessions of clients by reason of their end
+	teardown  *streamTeardown               // end of the last session with the source
+}
+
+func newStreamStats() *streamStats {
+	return &streamStats{
+		lastTime: time.Now(),
+	}
+}
+
+func (st *streamStats) addBytes(n int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.bytes += uint64(n)
+}
+
+// sample computes the bitrate since the previous sample.
+func (st *streamStats) sample() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(st.lastTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	st.bitrates = append(st.bitrates, float64(st.bytes-st.lastBytes)*8/elapsed)
+	if len(st.bitrates) > _STATS_BITRATE_SAMPLES {
+		st.bitrates = st.bitrates[len(st.bitrates)-_STATS_BITRATE_SAMPLES:]
+	}
+
+	st.lastBytes = st.bytes
+	st.lastTime = now
+}
+
+func (st *streamStats) totalBytes() uint64 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.bytes
+}
+
+// bitrate returns the most recent bitrate sample.
+func (st *streamStats) bitrate() float64 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if len(st.bitrates) == 0 {
+		return 0
+	}
+	return st.bitrates[len(st.bitrates)-1]
+}
+
+// bitrateWindows returns the average bitrates over the last 1, 10 and 60
+// seconds.
+func (st *streamStats) bitrateWindows() bitrateWindows {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return newBitrateWindows(st.bitrates)
+}
+
+func (st *streamStats) addEvent(text string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.events = append(st.events, streamEvent{
+		time: time.Now(),
+		text: text,
+	})
+	if len(st.events) > _STATS_EVENTS {
+		st.events = st.events[len(st.events)-_STATS_EVENTS:]
+	}
+}
+
+// snapshot returns a copy of the bitrate samples and of the events.
+func (st *streamStats) snapshot() ([]float64, []streamEvent) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	bitrates := append([]float64(nil), st.bitrates...)
+	events := append([]streamEvent(nil), st.events...)
+	return bitrates, events
+}
+
+func (st *streamStats) setError(text string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.lastError = text
+	st.errorTime = time.Now()
+}
+
+// lastErr returns the last error of the stream and its time.
+func (st *streamStats) lastErr() (string, time.Time) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.lastError, st.errorTime
+}
+
+// setReceivers sets the RTCP state of the tracks of the running source.
+func (st *streamStats) setReceivers(receivers []*rtcpReceiver) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.receivers = receivers
+}
+
+// clocks returns the mapping between RTP timestamps and wall-clock time of
+// the tracks of the source.
+func (st *streamStats) clocks() []trackClock {
+	st.mutex.Lock()
+	receivers := st.receivers
+	st.mutex.Unlock()
+
+	var ret []trackClock
+	for i, r := range receivers {
+		if c, ok := r.clock(); ok {
+			c.Track = i
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// addSession records a session started by a client.
+func (st *streamStats) addSession(userAgent string, transport string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.agents == nil {
+		st.agents = make(map[[2]string]*userAgentStats)
+	}
+
+	key := [2]string{userAgent, transport}
+	a, ok := st.agents[key]
+	if !ok {
+		// user agents are chosen by clients, therefore their number is
+		// limited
+		if len(st.agents) >= _STATS_USER_AGENTS {
+			key[0] = _STATS_OTHER_USER_AGENTS
+			a, ok = st.agents[key]
+		}
+		if !ok {
+			a = &userAgentStats{
+				UserAgent: key[0],
+				Transport: transport,
+			}
+			st.agents[key] = a
+		}
+	}
+
+	a.Sessions++
+	a.LastSeen = time.Now()
+}
+
+// userAgents returns the sessions of clients, grouped by user agent and
+// transport, the most recent first.
+func (st *streamStats) userAgents() []userAgentStats {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var ret []userAgentStats
+	for _, a := range st.agents {
+		ret = append(ret, *a)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].LastSeen.After(ret[j].LastSeen)
+	})
+	return ret
+}
+
+// addClientTeardown records the end of the session of a client.
+func (st *streamStats) addClientTeardown(reason teardownReason) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.teardowns == nil {
+		st.teardowns = make(map[teardownReason]uint64)
+	}
+	st.teardowns[reason]++
+}
+
+// setTeardown records the end of the session with the source.
+func (st *streamStats) setTeardown(reason teardownReason) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.teardown = &streamTeardown{
+		Reason: reason,
+		Time:   time.Now(),
+	}
+}
+
+// teardownStats returns the sessions of clients by reason of their end, and
+// the end of the last session with the source.
+func (st *streamStats) teardownStats() (map[teardownReason]uint64, *streamTeardown) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var teardowns map[teardownReason]uint64
+	if len(st.teardowns) > 0 {
+		teardowns = make(map[teardownReason]uint64)
+		for k, v := range st.teardowns {
+			teardowns[k] = v
+		}
+	}
+
+	var teardown *streamTeardown
+	if st.teardown != nil {
+		t := *st.teardown
+		teardown = &t
+	}
+
+	return teardowns, teardown
+}
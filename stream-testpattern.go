@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	_TESTPATTERN_WIDTH_MBS  = 10
+	_TESTPATTERN_HEIGHT_MBS = 7
+	_TESTPATTERN_FPS        = 10
+)
+
+const testPatternMbs = _TESTPATTERN_WIDTH_MBS * _TESTPATTERN_HEIGHT_MBS
+
+// color bars, in YCbCr
+var testPatternBars = [][3]byte{
+	{180, 128, 128},
+	{162, 44, 142},
+	{131, 156, 44},
+	{112, 72, 58},
+	{84, 184, 198},
+	{65, 100, 212},
+	{35, 212, 114},
+	{16, 128, 128},
+}
+
+// 5x7 glyphs of the characters of the clock
+var testPatternFont = map[rune][7]byte{
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+}
+
+// testPatternSps returns a baseline SPS.
+func testPatternSps() []byte {
+	w := &h264BitWriter{}
+	w.writeBits(0x67, 8)                   // nal_unit_type = SPS
+	w.writeBits(66, 8)                     // profile_idc = baseline
+	w.writeBits(0xc0, 8)                   // constraint_set0_flag, constraint_set1_flag
+	w.writeBits(20, 8)                     // level_idc = 2.0
+	w.writeUe(0)                           // seq_parameter_set_id
+	w.writeUe(0)                           // log2_max_frame_num_minus4
+	w.writeUe(2)                           // pic_order_cnt_type
+	w.writeUe(1)                           // max_num_ref_frames
+	w.writeFlag(false)                     // gaps_in_frame_num_value_allowed_flag
+	w.writeUe(_TESTPATTERN_WIDTH_MBS - 1)  // pic_width_in_mbs_minus1
+	w.writeUe(_TESTPATTERN_HEIGHT_MBS - 1) // pic_height_in_map_units_minus1
+	w.writeFlag(true)                      // frame_mbs_only_flag
+	w.writeFlag(true)                      // direct_8x8_inference_flag
+	w.writeFlag(false)                     // frame_cropping_flag
+	w.writeFlag(false)                     // vui_parameters_present_flag
+	return w.rbspTrailingBits()
+}
+
+// testPatternPps returns a PPS that uses CAVLC and disables deblocking.
+func testPatternPps() []byte {
+	w := &h264BitWriter{}
+	w.writeBits(0x68, 8) // nal_unit_type = PPS
+	w.writeUe(0)         // pic_parameter_set_id
+	w.writeUe(0)         // seq_parameter_set_id
+	w.writeFlag(false)   // entropy_coding_mode_flag
+	w.writeFlag(false)   // bottom_field_pic_order_in_frame_present_flag
+	w.writeUe(0)         // num_slice_groups_minus1
+	w.writeUe(0)         // num_ref_idx_l0_default_active_minus1
+	w.writeUe(0)         // num_ref_idx_l1_default_active_minus1
+	w.writeFlag(false)   // weighted_pred_flag
+	w.writeBits(0, 2)    // weighted_bipred_idc
+	w.writeSe(0)         // pic_init_qp_minus26
+	w.writeSe(0)         // pic_init_qs_minus26
+	w.writeSe(0)         // chroma_qp_index_offset
+	w.writeFlag(true)    // deblocking_filter_control_present_flag
+	w.writeFlag(false)   // constrained_intra_pred_flag
+	w.writeFlag(false)   // redundant_pic_cnt_present_flag
+	return w.rbspTrailingBits()
+}
+
+// testPatternIdr returns an IDR picture that contains color bars and a
+// clock. Since there's no encoder, macroblocks are written uncompressed
+// (I_PCM).
+func testPatternIdr(idrPicId uint32, now time.Time) []byte {
+	width := _TESTPATTERN_WIDTH_MBS * 16
+	height := _TESTPATTERN_HEIGHT_MBS * 16
+
+	y := make([]byte, width*height)
+	cb := make([]byte, width*height/4)
+	cr := make([]byte, width*height/4)
+
+	set := func(px int, py int, c [3]byte) {
+		y[py*width+px] = c[0]
+		if px%2 == 0 && py%2 == 0 {
+			cb[(py/2)*(width/2)+px/2] = c[1]
+			cr[(py/2)*(width/2)+px/2] = c[2]
+		}
+	}
+
+	textTop := height - 32
+	for py := 0; py < height; py++ {
+		for px := 0; px < width; px++ {
+			if py < textTop {
+				set(px, py, testPatternBars[px*len(testPatternBars)/width])
+			} else {
+				set(px, py, testPatternBars[len(testPatternBars)-1])
+			}
+		}
+	}
+
+	// draw the clock with a 2x scale
+	text := now.Format("15:04:05")
+	left := (width - len(text)*12) / 2
+	for i, r := range text {
+		glyph := testPatternFont[r]
+		for gy := 0; gy < 7; gy++ {
+			for gx := 0; gx < 5; gx++ {
+				if glyph[gy]&(0x10>>uint(gx)) == 0 {
+					continue
+				}
+				for d := 0; d < 4; d++ {
+					set(left+i*12+gx*2+d%2, textTop+9+gy*2+d/2, testPatternBars[0])
+				}
+			}
+		}
+	}
+
+	w := &h264BitWriter{}
+	w.writeBits(0x65, 8) // nal_unit_type = IDR
+	w.writeUe(0)         // first_mb_in_slice
+	w.writeUe(7)         // slice_type = I
+	w.writeUe(0)         // pic_parameter_set_id
+	w.writeBits(0, 4)    // frame_num
+	w.writeUe(idrPicId)  // idr_pic_id
+	w.writeFlag(false)   // no_output_of_prior_pics_flag
+	w.writeFlag(false)   // long_term_reference_flag
+	w.writeSe(0)         // slice_qp_delta
+	w.writeUe(1)         // disable_deblocking_filter_idc
+
+	mb := make([]byte, 0, 384)
+	for mby := 0; mby < _TESTPATTERN_HEIGHT_MBS; mby++ {
+		for mbx := 0; mbx < _TESTPATTERN_WIDTH_MBS; mbx++ {
+			mb = mb[:0]
+			for py := 0; py < 16; py++ {
+				start := (mby*16+py)*width + mbx*16
+				mb = append(mb, y[start:start+16]...)
+			}
+			for _, plane := range [][]byte{cb, cr} {
+				for py := 0; py < 8; py++ {
+					start := (mby*8+py)*(width/2) + mbx*8
+					mb = append(mb, plane[start:start+8]...)
+				}
+			}
+
+			w.writeUe(25) // mb_type = I_PCM
+			w.writeBytes(mb)
+		}
+	}
+
+	return w.rbspTrailingBits()
+}
+
+// testPatternP returns a P picture in which all macroblocks are skipped.
+func testPatternP(frameNum uint32) []byte {
+	w := &h264BitWriter{}
+	w.writeBits(0x41, 8)             // nal_unit_type = non-IDR
+	w.writeUe(0)                     // first_mb_in_slice
+	w.writeUe(5)                     // slice_type = P
+	w.writeUe(0)                     // pic_parameter_set_id
+	w.writeBits(uint64(frameNum), 4) // frame_num
+	w.writeFlag(false)               // num_ref_idx_active_override_flag
+	w.writeFlag(false)               // ref_pic_list_modification_flag_l0
+	w.writeFlag(false)               // adaptive_ref_pic_marking_mode_flag
+	w.writeSe(0)                     // slice_qp_delta
+	w.writeUe(1)                     // disable_deblocking_filter_idc
+	w.writeUe(testPatternMbs)        // mb_skip_run
+	return w.rbspTrailingBits()
+}
+
+// runTestPattern generates a H.264 stream with color bars and a clock, with
+// a GOP that lasts one second.
+func (s *stream) runTestPattern() {
+	sps := testPatternSps()
+	pps := testPatternPps()
+
+	sdpText := []byte(fmt.Sprintf("v=0\r\n"+
+		"o=- 0 0 IN IP4 127.0.0.1\r\n"+
+		"s=Test pattern\r\n"+
+		"c=IN IP4 0.0.0.0\r\n"+
+		"t=0 0\r\n"+
+		"m=video 0 RTP/AVP 96\r\n"+
+		"a=rtpmap:96 H264/90000\r\n"+
+		"a=fmtp:96 packetization-mode=1; profile-level-id=42C014; sprop-parameter-sets=%s,%s\r\n",
+		base64.StdEncoding.EncodeToString(sps),
+		base64.StdEncoding.EncodeToString(pps)))
+
+	clientSdpParsed, err := sdpParse(sdpText)
+	if err != nil {
+		s.log("ERR: invalid SDP: %s", err)
+		return
+	}
+
+	s.setSdp(clientSdpParsed, sdpText)
+	s.setReady()
+	defer s.setNotReady()
+
+	s.logReady()
+
+	packetizer := &rtpH264Packetizer{
+		payloadType: 96,
+		ssrc:        rand.Uint32(),
+		seq:         uint16(rand.Uint32()),
+	}
+	ts := rand.Uint32()
+	receiver := newRtcpReceiver(90000)
+	s.stats.setReceivers([]*rtcpReceiver{receiver})
+	defer s.stats.setReceivers(nil)
+	var lastReport time.Time
+
+	ticker := time.NewTicker(time.Second / _TESTPATTERN_FPS)
+	defer ticker.Stop()
+
+	for i := uint32(0); ; i++ {
+		var nalus [][]byte
+		if frameNum := i % _TESTPATTERN_FPS; frameNum == 0 {
+			nalus = [][]byte{sps, pps, testPatternIdr((i/_TESTPATTERN_FPS)%2, time.Now())}
+		} else {
+			nalus = [][]byte{testPatternP(frameNum)}
+		}
+
+		pkts := packetizer.packetize(nalus, ts)
+		ts += 90000 / _TESTPATTERN_FPS
+
+		for _, pkt := range pkts {
+			receiver.processRtp(pkt)
+			s.forwardTrack(0, _TRACK_FLOW_RTP, pkt)
+		}
+
+		if now := time.Now(); now.Sub(lastReport) >= _RTCP_RECEIVER_REPORT_INTERVAL {
+			lastReport = now
+			if sr := receiver.senderReport(now); sr != nil {
+				s.forwardTrack(0, _TRACK_FLOW_RTCP, sr)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// sourceTimeoutsConf contains the timeouts of each phase of the session with
+// a source. In the configuration of a stream, 0 means the global value.
+type sourceTimeoutsConf struct {
+	// from the connection to the response to DESCRIBE
+	Describe time.Duration `yaml:"describe"`
+
+	// from the first SETUP to the response to PLAY
+	Setup time.Duration `yaml:"setup"`
+
+	// from the response to PLAY to the first packet
+	FirstPacket time.Duration `yaml:"firstPacket"`
+
+	// maximum time between two packets, after the first one
+	FrameGap time.Duration `yaml:"frameGap"`
+}
+
+// timeouts returns the timeouts of the stream, that are the global ones
+// overridden by the ones of the stream.
+func (s *stream) timeouts() sourceTimeoutsConf {
+	ret := s.p.conf.SourceTimeouts
+	if v := s.conf.Timeouts.Describe; v != 0 {
+		ret.Describe = v
+	}
+	if v := s.conf.Timeouts.Setup; v != 0 {
+		ret.Setup = v
+	}
+	if v := s.conf.Timeouts.FirstPacket; v != 0 {
+		ret.FirstPacket = v
+	}
+	if v := s.conf.Timeouts.FrameGap; v != 0 {
+		ret.FrameGap = v
+	}
+	return ret
+}
+
+// readTimeout returns the timeout of each read of the connection, that must
+// not expire before the timeout of the current phase.
+func (t sourceTimeoutsConf) readTimeout() time.Duration {
+	ret := _READ_TIMEOUT
+	for _, v := range []time.Duration{t.Describe, t.Setup, t.FirstPacket, t.FrameGap} {
+		if v > ret {
+			ret = v
+		}
+	}
+	return ret
+}
+
+// sourcePhaseTimer closes the connection with a source when a phase of the
+// session lasts longer than its timeout.
+type sourcePhaseTimer struct {
+	mutex   sync.Mutex
+	timer   *time.Timer
+	phase   string
+	timeout time.Duration
+	expired bool
+}
+
+func (s *stream) startPhaseTimer(nconn net.Conn, phase string, d time.Duration) *sourcePhaseTimer {
+	pt := &sourcePhaseTimer{
+		phase:   phase,
+		timeout: d,
+	}
+
+	pt.timer = time.AfterFunc(d, func() {
+		pt.mutex.Lock()
+		pt.expired = true
+		phase, timeout := pt.phase, pt.timeout
+		pt.mutex.Unlock()
+
+		s.log("ERR: %s timed out after %s", phase, timeout)
+		nconn.Close()
+	})
+
+	return pt
+}
+
+// reset restarts the timer with another phase, unless it has expired.
+func (pt *sourcePhaseTimer) reset(phase string, d time.Duration) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	if pt.expired {
+		return
+	}
+	pt.phase = phase
+	pt.timeout = d
+	pt.timer.Reset(d)
+}
+
+func (pt *sourcePhaseTimer) stop() {
+	pt.timer.Stop()
+}
@@ -6,6 +6,13 @@ import (
 	"time"
 )
 
+// maximum number of packets that are read with a single system call. Buffers
+// are large, therefore it is lower than the write batch size.
+const _UDP_READ_BATCH_SIZE = 8
+
+// time spent discarding the packets queued in a socket before it is reused
+const _UDPL_DRAIN_DURATION = 10 * time.Millisecond
+
 type streamUdpListenerState int
 
 const (
@@ -16,15 +23,25 @@ const (
 type streamUdpListener struct {
 	p             *program
 	nconn         *net.UDPConn
+	bconn         *udpBatchConn
 	state         streamUdpListenerState
 	chanDone      chan struct{}
 	publisherIp   net.IP
 	publisherPort int
 	trackId       int
 	flow          trackFlow
-	path          string
+	stream        *stream
+	receiver      *rtcpReceiver
+	reorder       *rtpReorderBuffer
 	mutex         sync.Mutex
 	lastFrameTime time.Time
+
+	// whether reading failed for a reason different from stop()
+	failed bool
+
+	// whether stop() has been called. It is guarded by the mutex, like the
+	// read deadline set by run()
+	stopping bool
 }
 
 func newStreamUdpListener(p *program, port int) (*streamUdpListener, error) {
@@ -35,9 +52,28 @@ func newStreamUdpListener(p *program, port int) (*streamUdpListener, error) {
 		return nil, err
 	}
 
+	err = p.conf.SourceSocket.applyUdp(nconn)
+	if err != nil {
+		nconn.Close()
+		return nil, err
+	}
+
+	bconn, err := newUdpBatchConn(nconn)
+	if err != nil {
+		nconn.Close()
+		return nil, err
+	}
+
+	// receive offload is an optimization, that is skipped when it is not
+	// supported by the kernel
+	if p.conf.UdpOffload {
+		bconn.enableGro()
+	}
+
 	l := &streamUdpListener{
 		p:        p,
 		nconn:    nconn,
+		bconn:    bconn,
 		state:    _UDPL_STATE_STARTING,
 		chanDone: make(chan struct{}),
 	}
@@ -58,34 +94,192 @@ func (l *streamUdpListener) start() {
 	go l.run()
 }
 
+// stop stops reading packets without closing the socket, such that it can
+// be reused by the next session with the source.
+func (l *streamUdpListener) stop() {
+	if l.state != _UDPL_STATE_RUNNING {
+		return
+	}
+
+	func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.stopping = true
+		l.nconn.SetReadDeadline(time.Now())
+	}()
+
+	<-l.chanDone
+	l.nconn.SetReadDeadline(time.Time{})
+	l.stopping = false
+	l.state = _UDPL_STATE_STARTING
+}
+
+// reuse prepares a stopped listener for a new session, by discarding the
+// packets received after the previous one. It returns false when the socket
+// is not usable anymore.
+func (l *streamUdpListener) reuse() bool {
+	if l.failed {
+		return false
+	}
+
+	buf := make([]byte, 65536)
+	l.nconn.SetReadDeadline(time.Now().Add(_UDPL_DRAIN_DURATION))
+	for {
+		_, _, err := l.nconn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				return false
+			}
+			break
+		}
+	}
+	l.nconn.SetReadDeadline(time.Time{})
+
+	l.lastFrameTime = time.Time{}
+	return true
+}
+
 func (l *streamUdpListener) run() {
 	defer func() { l.chanDone <- struct{}{} }()
 
+	// packets can be bigger than the MTU, for instance ONVIF metadata
+	// packets that are fragmented at the IP level
+	batch := newUdpReadBatch(_UDP_READ_BATCH_SIZE, 65536)
+	var slab frameSlab
+
+	// packets held by the reorder buffer are released when their hold
+	// time expires, even if no other packets are received. The read
+	// deadline is not changed once stop() has been called.
+	var deadline time.Time
+	setDeadline := func(t time.Time) bool {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.stopping {
+			return false
+		}
+		if !t.Equal(deadline) {
+			deadline = t
+			l.nconn.SetReadDeadline(t)
+		}
+		return true
+	}
+
 	for {
-		// create a buffer for each read.
-		// this is necessary since the buffer is propagated with channels
-		// so it must be unique.
-		buf := make([]byte, 2048) // UDP MTU is 1400
-		n, addr, err := l.nconn.ReadFromUDP(buf)
-		if err != nil {
-			return
+		if l.reorder != nil {
+			t, _ := l.reorder.deadline()
+			if !setDeadline(t) {
+				return
+			}
 		}
 
-		if !l.publisherIp.Equal(addr.IP) || addr.Port != l.publisherPort {
+		count, err := l.bconn.readBatch(batch)
+		if err != nil {
+			ne, ok := err.(net.Error)
+			if !ok || !ne.Timeout() {
+				l.failed = true
+				return
+			}
+
+			// the timeout has been caused by stop()
+			if deadline.IsZero() || !setDeadline(deadline) {
+				return
+			}
+
+			for _, pkt := range l.reorder.expire(nil, time.Now()) {
+				l.stream.forwardSourceTrack(l.trackId, l.flow, pkt)
+			}
 			continue
 		}
 
-		func() {
-			l.p.mutex.RLock()
-			defer l.p.mutex.RUnlock()
+		received := false
 
-			l.p.forwardTrack(l.path, l.trackId, l.flow, buf[:n])
-		}()
+		for i := 0; i < count; i++ {
+			// some sources send RTCP packets from a port that differs from
+			// the one advertised
+			addr := &batch.addrs[i]
+			if !l.publisherIp.Equal(addr.IP) ||
+				(l.flow == _TRACK_FLOW_RTP && addr.Port != l.publisherPort) {
+				continue
+			}
+			received = true
+
+			batch.datagrams(i, func(datagram []byte) {
+				if l.flow == _TRACK_FLOW_RTP {
+					l.receiver.processRtp(datagram)
+				} else {
+					l.receiver.processRtcp(datagram, time.Now())
+				}
+
+				// copy into a dedicated buffer, since the buffer is propagated
+				// with channels and can be retained by the DVR
+				buf := slab.copy(datagram)
+
+				if l.reorder != nil {
+					for _, pkt := range l.reorder.push(buf, time.Now()) {
+						l.stream.forwardSourceTrack(l.trackId, l.flow, pkt)
+					}
+					return
+				}
+
+				l.stream.forwardSourceTrack(l.trackId, l.flow, buf)
+			})
+		}
+
+		if received {
+			func() {
+				l.mutex.Lock()
+				defer l.mutex.Unlock()
+				l.lastFrameTime = time.Now()
+			}()
+		}
+	}
+}
+
+// sendReport sends a RTCP receiver report to the source.
+func (l *streamUdpListener) sendReport() {
+	l.nconn.WriteTo(l.receiver.report(time.Now()), &net.UDPAddr{
+		IP:   l.publisherIp,
+		Port: l.publisherPort,
+	})
+}
+
+// udpListenerPair returns two listeners for a track, on an even port for RTP
+// and on the following odd port for RTCP. Listeners of the previous sessions
+// are reused when possible, in order to avoid bind failures and changes of
+// the state of firewalls while a source is flapping.
+func (s *stream) udpListenerPair() (*streamUdpListener, *streamUdpListener, error) {
+	for len(s.udpListenerPool) > 0 {
+		pair := s.udpListenerPool[len(s.udpListenerPool)-1]
+		s.udpListenerPool = s.udpListenerPool[:len(s.udpListenerPool)-1]
+
+		if pair.rtpl.reuse() && pair.rtcpl.reuse() {
+			return pair.rtpl, pair.rtcpl, nil
+		}
+		pair.rtpl.close()
+		pair.rtcpl.close()
+	}
+
+	return s.p.conf.SourceUdpPorts.newUdpListenerPair(s.p)
+}
+
+// releaseUdpListenerPair stops two listeners and puts them into the pool of
+// the stream.
+func (s *stream) releaseUdpListenerPair(rtpl *streamUdpListener, rtcpl *streamUdpListener) {
+	rtpl.stop()
+	rtcpl.stop()
+	s.udpListenerPool = append(s.udpListenerPool, streamUdpListenerPair{
+		rtpl:  rtpl,
+		rtcpl: rtcpl,
+	})
+}
 
-		func() {
-			l.mutex.Lock()
-			defer l.mutex.Unlock()
-			l.lastFrameTime = time.Now()
-		}()
+// trimUdpListenerPool closes the listeners that exceed the ones needed by a
+// session.
+func (s *stream) trimUdpListenerPool(pairs int) {
+	for len(s.udpListenerPool) > pairs {
+		pair := s.udpListenerPool[len(s.udpListenerPool)-1]
+		pair.rtpl.close()
+		pair.rtcpl.close()
+		s.udpListenerPool = s.udpListenerPool[:len(s.udpListenerPool)-1]
 	}
 }
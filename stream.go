@@ -3,11 +3,13 @@ package main
 import (
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
@@ -15,11 +17,15 @@ import (
 )
 
 const (
-	_DIAL_TIMEOUT          = 10 * time.Second
 	_RETRY_INTERVAL        = 5 * time.Second
-	_CHECK_STREAM_INTERVAL = 6 * time.Second
-	_STREAM_DEAD_AFTER     = 5 * time.Second
+	_MAX_RETRY_INTERVAL    = 5 * time.Minute
+	_CHECK_STREAM_INTERVAL = 1 * time.Second
 	_KEEPALIVE_INTERVAL    = 60 * time.Second
+	_MAX_REDIRECTS         = 5
+
+	// number of consecutive failed attempts after which a stream is
+	// considered failed, although attempts continue
+	_STREAM_FAILED_AFTER = 3
 )
 
 func sdpParse(in []byte) (*sdp.Message, error) {
@@ -43,7 +49,7 @@ func sdpParse(in []byte) (*sdp.Message, error) {
 }
 
 // remove everything from SDP except the bare minimum
-func sdpFilter(msgIn *sdp.Message, byteIn []byte) (*sdp.Message, []byte) {
+func sdpFilter(msgIn *sdp.Message, byteIn []byte, externalIp net.IP, sc streamConf) (*sdp.Message, []byte) {
 	msgOut := &sdp.Message{}
 
 	msgOut.Name = "Stream"
@@ -54,14 +60,44 @@ func sdpFilter(msgIn *sdp.Message, byteIn []byte) (*sdp.Message, []byte) {
 		Address:     "127.0.0.1",
 	}
 
+	if externalIp != nil {
+		addressType := "IP4"
+		if externalIp.To4() == nil {
+			addressType = "IP6"
+		}
+
+		msgOut.Origin.AddressType = addressType
+		msgOut.Origin.Address = externalIp.String()
+		msgOut.Connection = sdp.ConnectionData{
+			NetworkType: "IN",
+			AddressType: addressType,
+			IP:          externalIp,
+		}
+	}
+
 	for i, m := range msgIn.Medias {
+		// H264 tracks that are repacketized declare the new packetization mode
+		repacketized := sc.H264PacketizationMode != "" && strings.ToUpper(mediaEncoding(m)) == "H264"
+		hasFmtp := false
+
 		var attributes []sdp.Attribute
 		for _, attr := range m.Attributes {
 			if attr.Key == "rtpmap" || attr.Key == "fmtp" {
+				if attr.Key == "fmtp" && repacketized {
+					attr.Value = fmtpSetParam(attr.Value, "packetization-mode", sc.H264PacketizationMode)
+					hasFmtp = true
+				}
 				attributes = append(attributes, attr)
 			}
 		}
 
+		if repacketized && !hasFmtp && len(m.Description.Formats) > 0 {
+			attributes = append(attributes, sdp.Attribute{
+				Key:   "fmtp",
+				Value: m.Description.Formats[0] + " packetization-mode=" + sc.H264PacketizationMode,
+			})
+		}
+
 		// control attribute is mandatory, and is the path that is appended
 		// to the stream path in SETUP
 		attributes = append(attributes, sdp.Attribute{
@@ -80,76 +116,1239 @@ func sdpFilter(msgIn *sdp.Message, byteIn []byte) (*sdp.Message, []byte) {
 		})
 	}
 
-	sdps := sdp.Session{}
-	sdps = msgOut.Append(sdps)
-	byteOut := sdps.AppendTo(nil)
+	sc.SdpOverrides.apply(msgOut)
+
+	sdps := sdp.Session{}
+	sdps = msgOut.Append(sdps)
+	byteOut := sdps.AppendTo(nil)
+
+	return msgOut, byteOut
+}
+
+// metadataEncodings are the encodings of metadata tracks, that are
+// forwarded like audio and video tracks, preserving their RTP timestamps
+// and RTCP sender reports, that keep them aligned with video.
+var metadataEncodings = map[string]string{
+	"vnd.onvif.metadata": "ONVIF metadata",
+	"smpte336m":          "KLV metadata",
+}
+
+// staticPayloadTypes are the encodings and the clock rates of the static
+// payload types of RFC3551, that can be used without rtpmap. The clock rate
+// of G.722 is 8000, even if its sample rate is 16000.
+var staticPayloadTypes = map[string]string{
+	"0":  "PCMU/8000",
+	"3":  "GSM/8000",
+	"4":  "G723/8000",
+	"8":  "PCMA/8000",
+	"9":  "G722/8000",
+	"10": "L16/44100/2",
+	"11": "L16/44100",
+	"14": "MPA/90000",
+	"18": "G729/8000",
+	"26": "JPEG/90000",
+	"32": "MPV/90000",
+	"33": "MP2T/90000",
+}
+
+// mediaRtpmap returns the rtpmap of a media, or the one of its static payload
+// type when it is missing.
+func mediaRtpmap(m sdp.Media) string {
+	rtpmap := m.Attributes.Value("rtpmap")
+	if rtpmap == "" && len(m.Description.Formats) > 0 {
+		if v, ok := staticPayloadTypes[m.Description.Formats[0]]; ok {
+			return m.Description.Formats[0] + " " + v
+		}
+	}
+	return rtpmap
+}
+
+// mediaEncoding returns the encoding of a media, as written in its rtpmap.
+func mediaEncoding(m sdp.Media) string {
+	rtpmap := mediaRtpmap(m)
+
+	// rtpmap is in the format "payloadType encoding/clockRate"
+	encoding := rtpmap
+	if n := strings.Index(encoding, " "); n >= 0 {
+		encoding = encoding[n+1:]
+	}
+	if n := strings.Index(encoding, "/"); n >= 0 {
+		encoding = encoding[:n]
+	}
+	return encoding
+}
+
+// mediaClockRate returns the clock rate of a media, as written in its rtpmap.
+func mediaClockRate(m sdp.Media) int {
+	parts := strings.Split(mediaRtpmap(m), "/")
+	if len(parts) < 2 {
+		return 0
+	}
+	v, _ := strconv.Atoi(strings.TrimSpace(parts[1]))
+	return v
+}
+
+// mediaFmtp returns the parameters of the fmtp attribute of a media, with
+// lowercase keys.
+func mediaFmtp(m sdp.Media) map[string]string {
+	ret := make(map[string]string)
+
+	// fmtp is in the format "payloadType key=value; key=value"
+	fmtp := m.Attributes.Value("fmtp")
+	if n := strings.Index(fmtp, " "); n >= 0 {
+		fmtp = fmtp[n+1:]
+	}
+	for _, kv := range strings.Split(fmtp, ";") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) == 2 {
+			ret[strings.ToLower(parts[0])] = parts[1]
+		}
+	}
+	return ret
+}
+
+// fmtpSetParam sets a parameter of the value of a fmtp attribute, replacing
+// the existing one, if any.
+func fmtpSetParam(fmtp string, key string, value string) string {
+	payloadType := fmtp
+	params := ""
+	if n := strings.Index(fmtp, " "); n >= 0 {
+		payloadType = fmtp[:n]
+		params = fmtp[n+1:]
+	}
+
+	var out []string
+	for _, kv := range strings.Split(params, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if strings.EqualFold(parts[0], key) {
+			continue
+		}
+		out = append(out, kv)
+	}
+	out = append(out, key+"="+value)
+
+	return payloadType + " " + strings.Join(out, "; ")
+}
+
+// mediaDescription returns a description of a track, that recognizes
+// metadata tracks.
+func mediaDescription(m sdp.Media) string {
+	encoding := mediaEncoding(m)
+
+	if d, ok := metadataEncodings[strings.ToLower(encoding)]; ok {
+		return d
+	}
+
+	if encoding == "" {
+		return m.Description.Type
+	}
+	return m.Description.Type + " " + encoding
+}
+
+type sdpCacheEntry struct {
+	text []byte
+	time time.Time
+}
+
+// streamPush is a fixed destination to which a track is sent.
+type streamPush struct {
+	trackId   int
+	rtpAddr   *net.UDPAddr
+	rtcpAddr  *net.UDPAddr
+	multicast bool
+}
+
+// streamSubscriber is a client that receives the frames of a stream, together
+// with the tracks it has set up before PLAY.
+type streamSubscriber struct {
+	c        *serverClient
+	protocol streamProtocol
+	tracks   map[int]*track
+	dscp     uint8
+
+	// frames are dropped when the queue of the client is full
+	dropFrames bool
+
+	// audio and metadata are dropped before video when the queue of the
+	// client fills up
+	videoFirst bool
+}
+
+// streamOutputs is a snapshot of the destinations of the frames of a stream.
+// It is replaced as a whole each time destinations change, such that frames
+// are forwarded without locking the program mutex and a client that connects
+// or disconnects never stalls other streams.
+type streamOutputs struct {
+	subscribers []streamSubscriber
+	pushes      []streamPush
+	multicast   *streamMulticastSender
+	capture     *streamCapture
+	h264Tracks  map[int]bool
+	videoTracks map[int]bool
+	hls         *hlsMuxer
+	mjpeg       *mjpegBroadcaster
+
+	// repacketizers of H264 tracks, that are used by a single goroutine
+	// for each track
+	repacketizers map[int]*rtpH264Repacketizer
+
+	// stream whose clients are waiting to be migrated
+	migrateFrom *stream
+
+	// ids of tracks of composed and derived streams, by id of the track of
+	// the source
+	sourceTracks map[int]int
+
+	// streams that receive a part of the tracks
+	derived []*stream
+}
+
+type streamUdpListenerPair struct {
+	rtpl  *streamUdpListener
+	rtcpl *streamUdpListener
+}
+
+type streamState int
+
+const (
+	_STREAM_STATE_STARTING streamState = iota
+	_STREAM_STATE_READY
+	_STREAM_STATE_RECONNECTING
+	_STREAM_STATE_FAILED
+	_STREAM_STATE_DISABLED
+	_STREAM_STATE_EXHAUSTED
+)
+
+func (s streamState) String() string {
+	switch s {
+	case _STREAM_STATE_READY:
+		return "running"
+	case _STREAM_STATE_RECONNECTING:
+		return "reconnecting"
+	case _STREAM_STATE_FAILED:
+		return "failed"
+	case _STREAM_STATE_DISABLED:
+		return "disabled"
+	case _STREAM_STATE_EXHAUSTED:
+		return "exhausted"
+	}
+	return "starting"
+}
+
+type stream struct {
+	p               *program
+	state           streamState
+	path            string
+	conf            streamConf
+	ur              *url.URL
+	initialUr       *url.URL
+	proto           streamProtocol
+	clientSdpParsed *sdp.Message
+	serverSdpText   []byte
+	serverSdpParsed *sdp.Message
+	dvr             *streamDvr
+	capture         *streamCapture
+	quota           *streamQuota
+	latency         latencyProfile
+	h264Tracks      map[int]bool
+	videoTracks     map[int]bool
+	pushes          []streamPush
+	multicast       *streamMulticastSender
+	hls             *hlsMuxer
+	mjpeg           *mjpegBroadcaster
+	repacketizers   map[int]*rtpH264Repacketizer
+	retired         bool
+	migrateFrom     *stream
+	composeSources  []*stream
+	composeParent   *stream
+	composeMedia    string
+	composeSdp      chan struct{}
+	sourceTracks    map[int]int
+	derived         []*stream
+	subscribers     map[*serverClient]streamSubscriber
+	outputs         atomic.Value // *streamOutputs
+	stats           *streamStats
+	logger          *log.Logger
+	logFile         *os.File
+	stateTime       time.Time
+	attempts        int
+	reconnects      int
+	stopReason      teardownReason
+	keepaliveMethod int // index of the method that keeps alive the session
+
+	// UDP sockets of the previous sessions with the source, that are reused
+	// by the next ones
+	udpListenerPool []streamUdpListenerPair
+
+	// credentials of the session with the source, set after the first 401
+	auth *sourceAuth
+
+	// closed when the stream becomes ready
+	chanReady   chan struct{}
+	chanRequest chan *streamRequest
+	stop        chan struct{}
+}
+
+// streamRequest is a request sent to the source on behalf of a client.
+type streamRequest struct {
+	req  *gortsplib.Request
+	res  *gortsplib.Response
+	err  error
+	done chan struct{}
+}
+
+// parseStreamConf validates the configuration of a stream and returns the
+// URL of its source.
+func parseStreamConf(gconf *conf, conf streamConf) (*url.URL, error) {
+	var ur *url.URL
+	switch {
+	case conf.From != "":
+		err := validateDerivedConf(conf)
+		if err != nil {
+			return nil, err
+		}
+		ur = &url.URL{Scheme: "stream", Opaque: conf.From}
+
+	case conf.Source == "":
+		var err error
+		ur, err = url.Parse(conf.Url)
+		if err != nil {
+			return nil, err
+		}
+
+	case conf.Source == "testpattern":
+		ur = &url.URL{Scheme: conf.Source}
+
+	default:
+		return nil, fmt.Errorf("unsupported source: %s", conf.Source)
+	}
+
+	switch ur.Scheme {
+	case "rtsp":
+		if ur.Port() == "" {
+			ur.Host = ur.Hostname() + ":554"
+		}
+
+	case "file", "testpattern", "stream":
+
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", ur.Scheme)
+	}
+
+	if conf.Dscp < 0 || conf.Dscp > 63 {
+		return nil, fmt.Errorf("invalid DSCP: %d", conf.Dscp)
+	}
+
+	err := conf.Multicast.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = conf.SdpOverrides.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch conf.H264PacketizationMode {
+	case "", "0", "1":
+	default:
+		return nil, fmt.Errorf("unsupported H264 packetization mode: %s", conf.H264PacketizationMode)
+	}
+
+	_, err = parseLatencyProfile(conf.LatencyProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = parseCongestionPolicy(conf.CongestionPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.Timeouts.Describe < 0 || conf.Timeouts.Setup < 0 ||
+		conf.Timeouts.FirstPacket < 0 || conf.Timeouts.FrameGap < 0 {
+		return nil, fmt.Errorf("timeouts can't be negative")
+	}
+
+	_, err = parseSchedule(conf.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.ReconnectInterval < 0 {
+		return nil, fmt.Errorf("reconnect interval can't be negative")
+	}
+
+	if conf.MaxReconnectAttempts < 0 {
+		return nil, fmt.Errorf("max reconnect attempts can't be negative")
+	}
+
+	if conf.ReplayOnConnect < 0 {
+		return nil, fmt.Errorf("replay on connect duration must be positive")
+	}
+
+	if conf.BackoffFactor != 0 && conf.BackoffFactor < 1 {
+		return nil, fmt.Errorf("backoff factor must be at least 1")
+	}
+
+	if conf.H264MaxPacketSize != 0 {
+		if conf.H264PacketizationMode == "" {
+			return nil, fmt.Errorf("H264 max packet size requires a H264 packetization mode")
+		}
+		// in mode 0, NAL units can't be fragmented
+		if conf.H264PacketizationMode == "0" {
+			return nil, fmt.Errorf("H264 max packet size can't be used with packetization mode 0")
+		}
+		if conf.H264MaxPacketSize < _H264_MIN_PACKET_SIZE || conf.H264MaxPacketSize > _H264_MAX_PACKET_SIZE {
+			return nil, fmt.Errorf("invalid H264 max packet size: %d", conf.H264MaxPacketSize)
+		}
+	}
+
+	if len(conf.AuthMethods) > 0 {
+		methods, err := parseAuthMethods(conf.AuthMethods)
+		if err != nil {
+			return nil, err
+		}
+
+		if (gconf.AuthLdap.Url != "" || gconf.AuthHtpasswd != "") && !methods.basic {
+			return nil, fmt.Errorf("LDAP and htpasswd authentication require the basic auth method")
+		}
+	}
+
+	if len(conf.AuthGroups) > 0 && gconf.AuthLdap.Url == "" {
+		return nil, fmt.Errorf("auth groups require LDAP authentication")
+	}
+
+	if len(conf.AuthScopes) > 0 && gconf.AuthOauth.IntrospectionUrl == "" {
+		return nil, fmt.Errorf("auth scopes require OAuth authentication")
+	}
+
+	for _, pc := range conf.Push {
+		if pc.Track < 0 {
+			return nil, fmt.Errorf("invalid push track: %d", pc.Track)
+		}
+
+		// addresses are resolved by the stream, such that unresolvable
+		// destinations do not prevent startup
+		_, _, err := net.SplitHostPort(pc.Rtp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid push rtp address: %s", err)
+		}
+
+		if pc.Rtcp != "" {
+			_, _, err := net.SplitHostPort(pc.Rtcp)
+			if err != nil {
+				return nil, fmt.Errorf("invalid push rtcp address: %s", err)
+			}
+		}
+	}
+
+	if len(conf.Compose) > 0 {
+		if ur.Scheme != "rtsp" {
+			return nil, fmt.Errorf("only rtsp sources can be composed")
+		}
+		if conf.Vod {
+			return nil, fmt.Errorf("vod streams can't be composed")
+		}
+
+		for _, cc := range conf.Compose {
+			_, err := cc.parseUrl()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ur, nil
+}
+
+func newStream(p *program, path string, conf streamConf) (*stream, error) {
+	ur, err := parseStreamConf(&p.conf, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	proto := _STREAM_PROTOCOL_UDP
+	if conf.UseTcp {
+		proto = _STREAM_PROTOCOL_TCP
+	}
+
+	s := &stream{
+		p:           p,
+		state:       _STREAM_STATE_STARTING,
+		path:        path,
+		conf:        conf,
+		ur:          ur,
+		initialUr:   ur,
+		proto:       proto,
+		stats:       newStreamStats(),
+		latency:     latencyProfiles[conf.LatencyProfile],
+		subscribers: make(map[*serverClient]streamSubscriber),
+		stateTime:   time.Now(),
+		chanReady:   make(chan struct{}),
+		chanRequest: make(chan *streamRequest),
+		stop:        make(chan struct{}),
+	}
+
+	logPath := conf.LogFile
+	if logPath == "" && p.conf.StreamLogDir != "" {
+		logPath = filepath.Join(p.conf.StreamLogDir, logFileName(s.displayName())+".log")
+	}
+	if logPath != "" {
+		f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.logFile = f
+		s.logger = log.New(f, "", log.LstdFlags)
+	}
+
+	// the buffer is shared by time-shifted playback and replay on connect
+	dvrDuration := p.conf.DvrDuration
+	if conf.ReplayOnConnect > dvrDuration {
+		dvrDuration = conf.ReplayOnConnect
+	}
+	maxBufferSize := conf.MaxBufferSize
+	if maxBufferSize == 0 {
+		maxBufferSize = p.conf.StreamMaxBufferSize
+	}
+	if dvrDuration > 0 {
+		s.dvr = newStreamDvr(dvrDuration, maxBufferSize)
+	}
+
+	maxBitrate := conf.MaxBitrate
+	if maxBitrate == 0 {
+		maxBitrate = p.conf.StreamMaxBitrate
+	}
+	if maxBitrate > 0 {
+		s.quota = newStreamQuota(maxBitrate)
+	}
+
+	for _, cc := range conf.Compose {
+		c, err := newComposeSource(s, cc)
+		if err != nil {
+			return nil, err
+		}
+		s.composeSources = append(s.composeSources, c)
+	}
+
+	s.updateOutputs()
+
+	if conf.Disabled {
+		s.state = _STREAM_STATE_DISABLED
+		return s, nil
+	}
+
+	// derived streams are driven by their parent
+	if conf.From != "" {
+		s.resolvePushes()
+		return s, nil
+	}
+
+	go s.run()
+	for _, c := range s.composeSources {
+		go c.run()
+	}
+
+	return s, nil
+}
+
+// urlRedacted returns the URL without the password.
+func urlRedacted(ur *url.URL) string {
+	if ur.User == nil {
+		return ur.String()
+	}
+
+	u := *ur
+	u.User = url.User(ur.User.Username())
+	return u.String()
+}
+
+// urlStringRedacted returns the URL without the password.
+func urlStringRedacted(v string) string {
+	ur, err := url.Parse(v)
+	if err != nil {
+		return v
+	}
+	return urlRedacted(ur)
+}
+
+// displayName returns the name of a static stream, or the URL without
+// password of a dynamic one.
+func (s *stream) displayName() string {
+	if _, ok := s.p.conf.Streams[s.path]; ok {
+		return s.path
+	}
+	return urlRedacted(s.ur)
+}
+
+// pathDisplayName returns the name of a static stream, or the URL without
+// password of a dynamic one, given its path.
+func (p *program) pathDisplayName(path string) string {
+	if _, ok := p.conf.Streams[path]; ok {
+		return path
+	}
+	return urlStringRedacted(path)
+}
+
+// logFileName returns a file name that contains only safe characters.
+func logFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+			r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (s *stream) log(format string, args ...interface{}) {
+	// additional sources of composed streams log into their stream
+	if s.composeParent != nil {
+		args = append([]interface{}{urlRedacted(s.ur)}, args...)
+		if strings.HasPrefix(format, "ERR: ") {
+			s.composeParent.log("ERR: source %s: "+strings.TrimPrefix(format, "ERR: "), args...)
+		} else {
+			s.composeParent.log("source %s: "+format, args...)
+		}
+		return
+	}
+
+	s.stats.addEvent(fmt.Sprintf(format, args...))
+	if strings.HasPrefix(format, "ERR: ") {
+		s.stats.setError(fmt.Sprintf(strings.TrimPrefix(format, "ERR: "), args...))
+	}
+
+	// the name is passed as argument since URLs can contain percent signs
+	format = "[STREAM %s] " + format
+	args = append([]interface{}{s.displayName()}, args...)
+	log.Printf(format, args...)
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
+}
+
+// writeRequest sends a request to the source, adding the configured headers.
+func (s *stream) writeRequest(conn *gortsplib.ConnClient, req *gortsplib.Request) (*gortsplib.Response, error) {
+	if req.Header == nil {
+		req.Header = gortsplib.Header{}
+	}
+
+	for k, v := range s.conf.Headers {
+		req.Header[k] = []string{v}
+	}
+
+	userAgent := s.conf.UserAgent
+	if userAgent == "" {
+		userAgent = s.p.conf.UserAgent
+	}
+	if userAgent != "" {
+		req.Header["User-Agent"] = []string{userAgent}
+	}
+
+	debug := s.p.conf.DebugRtsp || s.conf.DebugRtsp
+
+	// sources can require credentials with any method, and can expire
+	// nonces during the session; the request is repeated once with new
+	// credentials
+	for retry := false; ; retry = true {
+		if s.auth != nil {
+			req.Header["Authorization"] = []string{s.auth.header(req.Method, req.Url)}
+		}
+
+		if debug {
+			s.log("request: %s", dumpRequest(req))
+		}
+
+		res, err := conn.WriteRequest(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if debug {
+			s.log("response: %s", dumpResponse(res))
+		}
+
+		if res.StatusCode != 401 || retry || !s.reauthenticate(res) {
+			return res, nil
+		}
+	}
+}
+
+// request sends a request to the source on behalf of a client, through the
+// session of the stream. It must be called with the program mutex unlocked.
+func (s *stream) request(req *gortsplib.Request) (*gortsplib.Response, error) {
+	if s.ur.Scheme != "rtsp" {
+		return nil, fmt.Errorf("requests can't be forwarded to %s sources", s.ur.Scheme)
+	}
+
+	// when the source is read with TCP, responses can't be told apart from
+	// interleaved frames
+	if s.proto != _STREAM_PROTOCOL_UDP {
+		return nil, fmt.Errorf("requests can't be forwarded to sources received via TCP")
+	}
+
+	sr := &streamRequest{
+		req:  req,
+		done: make(chan struct{}),
+	}
+
+	t := time.NewTimer(_READ_TIMEOUT + _WRITE_TIMEOUT)
+	defer t.Stop()
+
+	select {
+	case s.chanRequest <- sr:
+	case <-t.C:
+		return nil, fmt.Errorf("stream is not ready")
+	}
+
+	select {
+	case <-sr.done:
+		return sr.res, sr.err
+	case <-t.C:
+		return nil, fmt.Errorf("request timed out")
+	}
+}
+
+// setupUrl returns the URL used to setup a track, that is built from the
+// control attribute of the track, that can be absolute or relative.
+func (s *stream) setupUrl(i int, media sdp.Media) *url.URL {
+	control := media.Attributes.Value("control")
+
+	if strings.HasPrefix(control, "rtsp://") {
+		ur, err := url.Parse(control)
+		if err == nil {
+			// credentials are not included in SDPs
+			ur.User = nil
+			return ur
+		}
+	}
+
+	ret := s.ur.Path
+	if len(ret) == 0 || ret[len(ret)-1] != '/' {
+		ret += "/"
+	}
+
+	if control != "" {
+		ret += control
+	} else {
+		ret += "trackID=" + strconv.FormatInt(int64(i+1), 10)
+	}
+
+	return &url.URL{
+		Scheme:   "rtsp",
+		Host:     s.ur.Host,
+		Path:     ret,
+		RawQuery: s.ur.RawQuery,
+	}
+}
+
+func (s *stream) setState(state streamState) {
+	s.state = state
+	s.stateTime = time.Now()
+}
+
+// setSdp stores the SDP received from the source.
+func (s *stream) setSdp(clientSdpParsed *sdp.Message, clientSdpText []byte) {
+	// create a filtered SDP that is used by the server (not by the client)
+	serverSdpParsed, serverSdpText := sdpFilter(clientSdpParsed, clientSdpText, s.p.conf.ExternalIp, s.conf)
+
+	// segments of the previous session are discarded
+	var hls *hlsMuxer
+	if s.conf.Hls || s.conf.Dash || s.conf.Mse {
+		var err error
+		hls, err = newHlsMuxer(clientSdpParsed, s.p.conf.HlsSegmentDuration, s.p.conf.HlsPartDuration)
+		if err != nil {
+			s.log("ERR: HLS: %s", err)
+		}
+	}
+
+	var mjpeg *mjpegBroadcaster
+	if s.conf.Mjpeg {
+		var err error
+		mjpeg, err = newMjpegBroadcaster(clientSdpParsed)
+		if err != nil {
+			s.log("ERR: MJPEG: %s", err)
+		}
+	}
+
+	func() {
+		s.p.mutex.Lock()
+		defer s.p.mutex.Unlock()
+
+		s.clientSdpParsed = clientSdpParsed
+		s.serverSdpText = serverSdpText
+		s.serverSdpParsed = serverSdpParsed
+
+		s.h264Tracks = make(map[int]bool)
+		s.videoTracks = make(map[int]bool)
+		s.repacketizers = nil
+		for i, m := range clientSdpParsed.Medias {
+			if m.Description.Type == "video" {
+				s.videoTracks[i] = true
+			}
+
+			if strings.ToUpper(mediaEncoding(m)) == "H264" {
+				s.h264Tracks[i] = true
+
+				if s.conf.H264PacketizationMode != "" {
+					if s.repacketizers == nil {
+						s.repacketizers = make(map[int]*rtpH264Repacketizer)
+					}
+					s.repacketizers[i] = newRtpH264Repacketizer(s.conf.h264PacketizationMode(),
+						s.conf.h264MaxPacketSize())
+				}
+			}
+		}
+		s.hls = hls
+		s.mjpeg = mjpeg
+		s.updateOutputs()
+
+		if s.p.conf.SdpCacheTTL > 0 {
+			s.p.sdpCache[s.path] = &sdpCacheEntry{
+				text: serverSdpText,
+				time: time.Now(),
+			}
+		}
+	}()
+
+	// buffered frames belong to the previous session
+	if s.dvr != nil {
+		s.dvr.clear()
+	}
+
+	for _, d := range s.derivedStreams() {
+		d.setParentSdp(clientSdpParsed)
+	}
+}
+
+// resolvePushes resolves the addresses of the push destinations. Destinations
+// that can't be resolved are skipped until the next attempt.
+func (s *stream) resolvePushes() {
+	var pushes []streamPush
+
+	for _, pc := range s.conf.Push {
+		rtpAddr, err := net.ResolveUDPAddr("udp", pc.Rtp)
+		if err != nil {
+			s.log("ERR: unable to resolve push rtp address: %s", err)
+			continue
+		}
+
+		var rtcpAddr *net.UDPAddr
+		if pc.Rtcp != "" {
+			rtcpAddr, err = net.ResolveUDPAddr("udp", pc.Rtcp)
+			if err != nil {
+				s.log("ERR: unable to resolve push rtcp address: %s", err)
+				continue
+			}
+		}
+
+		multicast := rtpAddr.IP.IsMulticast()
+		if multicast && s.conf.Multicast.Source != "" && !isSsmGroup(rtpAddr.IP) {
+			s.log("ERR: push group %s is not a source-specific multicast group", rtpAddr.IP)
+			continue
+		}
+
+		if multicast && s.multicast == nil {
+			ms, err := newStreamMulticastSender(s.conf.Multicast)
+			if err != nil {
+				s.log("ERR: unable to create multicast sender: %s", err)
+				continue
+			}
+
+			s.p.mutex.Lock()
+			s.multicast = ms
+			s.p.mutex.Unlock()
+		}
+
+		pushes = append(pushes, streamPush{
+			trackId:   pc.Track,
+			rtpAddr:   rtpAddr,
+			rtcpAddr:  rtcpAddr,
+			multicast: multicast,
+		})
+	}
+
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+
+	// retired streams leave destinations to the stream that replaced them
+	if s.retired {
+		pushes = nil
+	}
+
+	s.pushes = pushes
+	s.updateOutputs()
+}
+
+// updateOutputs publishes a new snapshot of the destinations of frames. It
+// must be called with the program mutex locked.
+func (s *stream) updateOutputs() {
+	o := &streamOutputs{
+		pushes:     s.pushes,
+		multicast:  s.multicast,
+		capture:    s.capture,
+		h264Tracks: s.h264Tracks,
+		hls:        s.hls,
+		mjpeg:      s.mjpeg,
+
+		videoTracks:   s.videoTracks,
+		repacketizers: s.repacketizers,
+		migrateFrom:   s.migrateFrom,
+		sourceTracks:  s.sourceTracks,
+		derived:       s.derived,
+	}
+	for _, sub := range s.subscribers {
+		o.subscribers = append(o.subscribers, sub)
+	}
+	s.outputs.Store(o)
+}
+
+// forwardTrack sends a frame received from the source to clients and to the
+// other destinations. It doesn't need the program mutex.
+func (s *stream) forwardTrack(id int, flow trackFlow, frame []byte) {
+	s.stats.addBytes(len(frame))
+
+	if s.quota != nil {
+		allowed, started := s.quota.allow(len(frame))
+		if started {
+			s.log("bitrate quota exceeded, dropping packets")
+		}
+		if !allowed {
+			return
+		}
+	}
+
+	o := s.outputs.Load().(*streamOutputs)
+
+	// under memory pressure, keep only what is needed to decode video
+	if s.p.getMemoryPressure() >= _MEMORY_PRESSURE_DROP && flow == _TRACK_FLOW_RTP &&
+		o.h264Tracks[id] && !rtpH264IsKeyFrame(frame) {
+		return
+	}
+
+	// clients of the previous source are moved at the start of a key frame,
+	// such that they can decode the new source immediately
+	if o.migrateFrom != nil && flow == _TRACK_FLOW_RTP &&
+		(len(o.h264Tracks) == 0 || (o.h264Tracks[id] && rtpH264IsKeyFrameStart(frame))) {
+		s.migrate()
+		o = s.outputs.Load().(*streamOutputs)
+	}
+
+	if r, ok := o.repacketizers[id]; ok && flow == _TRACK_FLOW_RTP {
+		for _, pkt := range r.repacketize(frame) {
+			s.forwardFrame(o, id, flow, pkt)
+		}
+		return
+	}
+
+	s.forwardFrame(o, id, flow, frame)
+}
+
+// forwardFrame sends a frame to clients and to the other destinations.
+func (s *stream) forwardFrame(o *streamOutputs, id int, flow trackFlow, frame []byte) {
+	if s.dvr != nil {
+		s.dvr.push(id, flow, frame)
+
+		// load outputs again, since clients that were replaying the buffer
+		// may have switched to live before the frame was added to it
+		o = s.outputs.Load().(*streamOutputs)
+	}
+	if o.capture != nil {
+		o.capture.write(id, flow, frame)
+	}
+	if o.hls != nil && flow == _TRACK_FLOW_RTP {
+		o.hls.writeRtp(id, frame, time.Now())
+	}
+	if o.mjpeg != nil && flow == _TRACK_FLOW_RTP {
+		o.mjpeg.writeRtp(id, frame)
+	}
+
+	for _, sub := range o.subscribers {
+		// clients that wait for a key frame receive video starting from its
+		// first packet
+		if flow == _TRACK_FLOW_RTP && o.h264Tracks[id] && atomic.LoadInt32(&sub.c.keyFrameWait) != 0 {
+			if !rtpH264IsKeyFrameStart(frame) {
+				continue
+			}
+			atomic.StoreInt32(&sub.c.keyFrameWait, 0)
+		}
+
+		if sub.videoFirst && o.congestionDrop(sub, id, flow, frame) {
+			continue
+		}
+
+		s.p.writeClientFrame(sub, id, flow, frame)
+	}
+
+	for _, push := range o.pushes {
+		if push.trackId != id {
+			continue
+		}
+
+		if push.multicast {
+			if flow == _TRACK_FLOW_RTP {
+				o.multicast.write(flow, push.rtpAddr, frame)
+			} else if push.rtcpAddr != nil {
+				o.multicast.write(flow, push.rtcpAddr, frame)
+			}
+
+		} else if flow == _TRACK_FLOW_RTP {
+			s.p.rtpl.chanWrite <- udpWrite{
+				addr: push.rtpAddr,
+				buf:  frame,
+				dscp: uint8(s.conf.Dscp),
+			}
+		} else if push.rtcpAddr != nil {
+			s.p.rtcpl.chanWrite <- udpWrite{
+				addr: push.rtcpAddr,
+				buf:  frame,
+				dscp: uint8(s.conf.Dscp),
+			}
+		}
+	}
+
+	for _, d := range o.derived {
+		d.forwardSourceTrack(id, flow, frame)
+	}
+}
+
+// setRetryState sets the state of a stream whose previous attempt has failed.
+func (s *stream) setRetryState() {
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+
+	state := _STREAM_STATE_RECONNECTING
+	if s.attempts >= _STREAM_FAILED_AFTER {
+		state = _STREAM_STATE_FAILED
+	}
+
+	if s.state != state {
+		s.setState(state)
+	}
+}
+
+// retryInterval returns the time to wait before the next attempt, that grows
+// with the number of consecutive failed attempts.
+func (s *stream) retryInterval() time.Duration {
+	interval := s.conf.ReconnectInterval
+	if interval == 0 {
+		interval = _RETRY_INTERVAL
+	}
+
+	maxInterval := _MAX_RETRY_INTERVAL
+	if interval > maxInterval {
+		maxInterval = interval
+	}
+
+	if s.conf.BackoffFactor > 1 {
+		for i := 1; i < s.attempts && interval < maxInterval; i++ {
+			interval = time.Duration(float64(interval) * s.conf.BackoffFactor)
+		}
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
 
-	return msgOut, byteOut
+	return interval
 }
 
-type streamUdpListenerPair struct {
-	rtpl  *streamUdpListener
-	rtcpl *streamUdpListener
+// setExhausted sets the terminal state of a stream whose reconnect attempts
+// are exhausted. The stream stays exhausted until it is stopped.
+func (s *stream) setExhausted() {
+	s.log("ERR: %d consecutive reconnect attempts failed, giving up", s.reconnects)
+
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+	s.setState(_STREAM_STATE_EXHAUSTED)
 }
 
-type streamState int
+func (s *stream) setReady() {
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+	s.setState(_STREAM_STATE_READY)
+	close(s.chanReady)
+	s.attempts = 0
+	s.reconnects = 0
+
+	for _, d := range s.derived {
+		if d.clientSdpParsed != nil && d.state != _STREAM_STATE_READY {
+			d.setState(_STREAM_STATE_READY)
+			close(d.chanReady)
+			d.logReady()
+		}
+	}
+}
 
-const (
-	_STREAM_STATE_STARTING streamState = iota
-	_STREAM_STATE_READY
-)
+func (s *stream) logReady() {
+	var tracks []string
+	for i, m := range s.clientSdpParsed.Medias {
+		tracks = append(tracks, fmt.Sprintf("%d: %s", i, mediaDescription(m)))
+	}
+	s.log("ready, tracks: %s", strings.Join(tracks, ", "))
+}
 
-type stream struct {
-	p               *program
-	state           streamState
-	path            string
-	conf            streamConf
-	ur              *url.URL
-	proto           streamProtocol
-	clientSdpParsed *sdp.Message
-	serverSdpText   []byte
-	serverSdpParsed *sdp.Message
+func (s *stream) setNotReady() {
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+	s.unready()
+}
 
-	stop chan struct{}
+// unready sets the stream as not ready and disconnects its clients. It must
+// be called with the program mutex locked.
+func (s *stream) unready() {
+	s.setState(_STREAM_STATE_RECONNECTING)
+	s.chanReady = make(chan struct{})
+
+	// the session with the source ends because the stream has been stopped,
+	// or because the source has been lost
+	reason := s.stopReason
+	if reason == "" {
+		reason = _TEARDOWN_SOURCE_LOST
+		s.stats.setTeardown(reason)
+		s.log("session with the source ended, reason: %s", reason)
+	}
+
+	// disconnect all clients
+	for c := range s.p.clients {
+		if s.ownsClient(c) {
+			c.close(reason)
+		}
+	}
+
+	for _, d := range s.derived {
+		if d.state == _STREAM_STATE_READY {
+			d.unready()
+		}
+	}
 }
 
-func newStream(p *program, path string, conf streamConf) (*stream, error) {
-	ur, err := url.Parse(conf.Url)
+func isRedirect(code gortsplib.StatusCode) bool {
+	switch code {
+	case 301, 302, 303, 307:
+		return true
+	}
+	return false
+}
+
+// redirectUrl returns the URL contained in the Location header of a
+// redirect. Credentials are kept when the new URL does not provide them.
+func (s *stream) redirectUrl(res *gortsplib.Response) (*url.URL, error) {
+	loc, ok := res.Header["Location"]
+	if !ok || len(loc) != 1 {
+		return nil, fmt.Errorf("DESCRIBE returned code %d without location", res.StatusCode)
+	}
+
+	ur, err := s.ur.Parse(loc[0])
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid location (%s)", loc[0])
 	}
 
 	if ur.Scheme != "rtsp" {
-		return nil, fmt.Errorf("unsupported scheme: %s", ur.Scheme)
+		return nil, fmt.Errorf("unsupported location (%s)", loc[0])
 	}
 
 	if ur.Port() == "" {
 		ur.Host = ur.Hostname() + ":554"
 	}
 
-	proto := _STREAM_PROTOCOL_UDP
-	if conf.UseTcp {
-		proto = _STREAM_PROTOCOL_TCP
+	if ur.User == nil {
+		ur.User = s.ur.User
 	}
 
-	s := &stream{
-		p:     p,
-		state: _STREAM_STATE_STARTING,
-		path:  path,
-		conf:  conf,
-		ur:    ur,
-		proto: proto,
-		stop:  make(chan struct{}),
+	return ur, nil
+}
+
+func (s *stream) setUrl(ur *url.URL) {
+	s.p.mutex.Lock()
+	defer s.p.mutex.Unlock()
+	s.ur = ur
+}
+
+// describe connects to the source and sends OPTIONS and DESCRIBE.
+func (s *stream) describe() (net.Conn, *gortsplib.ConnClient, *gortsplib.Response, error) {
+	timeouts := s.timeouts()
+	start := time.Now()
+
+	nconn, err := net.DialTimeout("tcp", s.ur.Host, timeouts.Describe)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	go s.run()
+	describeTimer := s.startPhaseTimer(nconn, "DESCRIBE", timeouts.Describe-time.Since(start))
+	defer describeTimer.stop()
 
-	return s, nil
-}
+	err = s.p.conf.SourceSocket.applyTcp(nconn.(*net.TCPConn))
+	if err != nil {
+		nconn.Close()
+		return nil, nil, nil, err
+	}
 
-func (s *stream) log(format string, args ...interface{}) {
-	format = "[STREAM " + s.path + "] " + format
-	log.Printf(format, args...)
+	nconn = newSourceConn(nconn)
+
+	// nonces are bound to connections
+	s.auth = nil
+
+	res, conn, err := func() (*gortsplib.Response, *gortsplib.ConnClient, error) {
+		conn := gortsplib.NewConnClient(nconn, timeouts.readTimeout(), _WRITE_TIMEOUT)
+
+		res, err := s.writeRequest(conn, &gortsplib.Request{
+			Method: gortsplib.OPTIONS,
+			Url: &url.URL{
+				Scheme: "rtsp",
+				Host:   s.ur.Host,
+				Path:   "/",
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if res.StatusCode == 401 {
+			return nil, nil, s.authError(gortsplib.OPTIONS)
+		}
+
+		if res.StatusCode != 200 {
+			return nil, nil, fmt.Errorf("OPTIONS returned code %d", res.StatusCode)
+		}
+
+		if sxRaw, ok := res.Header["Session"]; ok && len(sxRaw) == 1 {
+			sx, err := gortsplib.ReadHeaderSession(sxRaw[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to parse session: %s", err)
+			}
+			conn.SetSession(sx.Session)
+		}
+
+		res, err = s.writeRequest(conn, &gortsplib.Request{
+			Method: gortsplib.DESCRIBE,
+			Url: &url.URL{
+				Scheme:   "rtsp",
+				Host:     s.ur.Host,
+				Path:     s.ur.Path,
+				RawQuery: s.ur.RawQuery,
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if res.StatusCode == 401 {
+			return nil, nil, s.authError(gortsplib.DESCRIBE)
+		}
+
+		return res, conn, nil
+	}()
+	if err != nil {
+		nconn.Close()
+		return nil, nil, nil, err
+	}
+
+	return nconn, conn, res, nil
 }
 
 func (s *stream) run() {
@@ -159,6 +1358,19 @@ func (s *stream) run() {
 		select {
 		case <-s.stop:
 			s.log("stopped")
+			if s.logFile != nil {
+				s.logFile.Close()
+			}
+			if s.multicast != nil {
+				s.multicast.close()
+			}
+			for _, c := range s.composeSources {
+				close(c.stop)
+			}
+			for _, pair := range s.udpListenerPool {
+				pair.rtpl.close()
+				pair.rtcpl.close()
+			}
 			return
 		default:
 		}
@@ -166,95 +1378,85 @@ func (s *stream) run() {
 		if firstTime {
 			firstTime = false
 		} else {
-			time.Sleep(_RETRY_INTERVAL)
+			// the first connection is not a reconnect attempt, such that
+			// streams that fail at startup and streams that are lost have
+			// the same number of attempts
+			if maxAttempts := s.conf.MaxReconnectAttempts; maxAttempts > 0 && s.reconnects >= maxAttempts {
+				s.setExhausted()
+				<-s.stop
+				continue
+			}
+			s.reconnects++
+
+			t := time.NewTimer(s.retryInterval())
+			select {
+			case <-t.C:
+			case <-s.stop:
+				t.Stop()
+				continue
+			}
 		}
 
-		s.log("initializing with protocol %s", s.proto)
+		if s.attempts > 0 {
+			s.setRetryState()
+		}
+		s.attempts++
 
-		func() {
-			nconn, err := net.DialTimeout("tcp", s.ur.Host, _DIAL_TIMEOUT)
-			if err != nil {
-				s.log("ERR: %s", err)
-				return
-			}
-			defer nconn.Close()
+		s.resolvePushes()
 
-			conn := gortsplib.NewConnClient(nconn, _READ_TIMEOUT, _WRITE_TIMEOUT)
+		switch s.ur.Scheme {
+		case "file":
+			s.log("initializing from %s", s.ur.Path)
+			s.runFile()
+			continue
 
-			res, err := conn.WriteRequest(&gortsplib.Request{
-				Method: gortsplib.OPTIONS,
-				Url: &url.URL{
-					Scheme: "rtsp",
-					Host:   s.ur.Host,
-					Path:   "/",
-				},
-			})
-			if err != nil {
-				s.log("ERR: %s", err)
-				return
-			}
+		case "testpattern":
+			s.log("initializing test pattern")
+			s.runTestPattern()
+			continue
+		}
 
-			if res.StatusCode != 200 {
-				s.log("ERR: OPTIONS returned code %d", res.StatusCode)
-				return
-			}
+		s.log("initializing with protocol %s", s.proto)
 
-			if sxRaw, ok := res.Header["Session"]; ok && len(sxRaw) == 1 {
-				sx, err := gortsplib.ReadHeaderSession(sxRaw[0])
-				if err != nil {
-					s.log("ERR: unable to parse session: %s", err)
-					return
-				}
-				conn.SetSession(sx.Session)
+		func() {
+			// redirects are valid for a single attempt
+			if s.ur != s.initialUr {
+				s.setUrl(s.initialUr)
 			}
 
-			res, err = conn.WriteRequest(&gortsplib.Request{
-				Method: gortsplib.DESCRIBE,
-				Url: &url.URL{
-					Scheme:   "rtsp",
-					Host:     s.ur.Host,
-					Path:     s.ur.Path,
-					RawQuery: s.ur.RawQuery,
-				},
-			})
-			if err != nil {
-				s.log("ERR: %s", err)
-				return
-			}
+			var nconn net.Conn
+			var conn *gortsplib.ConnClient
+			var res *gortsplib.Response
 
-			if res.StatusCode == 401 {
-				if s.ur.User == nil {
-					s.log("ERR: 401 but user not provided")
+			for redirects := 0; ; redirects++ {
+				var err error
+				nconn, conn, res, err = s.describe()
+				if err != nil {
+					s.log("ERR: %s", err)
 					return
 				}
 
-				user := s.ur.User.Username()
-				pass, _ := s.ur.User.Password()
-				if pass == "" {
-					s.log("ERR: 401 but password not provided")
-					return
+				if !isRedirect(res.StatusCode) {
+					break
 				}
 
-				err = conn.SetCredentials(res.Header["WWW-Authenticate"], user, pass)
-				if err != nil {
-					s.log("ERR: unable to set credentials: %s", err)
+				nconn.Close()
+
+				if redirects >= _MAX_REDIRECTS {
+					s.log("ERR: too many redirects")
 					return
 				}
 
-				res, err = conn.WriteRequest(&gortsplib.Request{
-					Method: gortsplib.DESCRIBE,
-					Url: &url.URL{
-						Scheme:   "rtsp",
-						Host:     s.ur.Host,
-						Path:     s.ur.Path,
-						RawQuery: s.ur.RawQuery,
-					},
-				})
+				ur, err := s.redirectUrl(res)
 				if err != nil {
 					s.log("ERR: %s", err)
 					return
 				}
+
+				s.log("redirected to %s", urlRedacted(ur))
+				s.setUrl(ur)
 			}
+			defer nconn.Close()
 
 			if res.StatusCode != 200 {
 				s.log("ERR: DESCRIBE returned code %d", res.StatusCode)
@@ -278,28 +1480,34 @@ func (s *stream) run() {
 				return
 			}
 
-			// create a filtered SDP that is used by the server (not by the client)
-			serverSdpParsed, serverSdpText := sdpFilter(clientSdpParsed, res.Content)
+			switch {
+			case s.composeParent != nil:
+				s.setComposeSdp(clientSdpParsed)
 
-			func() {
-				s.p.mutex.Lock()
-				defer s.p.mutex.Unlock()
+			case len(s.composeSources) > 0:
+				composed, err := s.composeSdps(clientSdpParsed)
+				if err != nil {
+					s.log("ERR: %s", err)
+					return
+				}
+				s.setSdp(composed, nil)
 
-				s.clientSdpParsed = clientSdpParsed
-				s.serverSdpText = serverSdpText
-				s.serverSdpParsed = serverSdpParsed
-			}()
+			default:
+				s.setSdp(clientSdpParsed, res.Content)
+			}
 
 			if s.proto == _STREAM_PROTOCOL_UDP {
-				s.runUdp(conn)
+				s.runUdp(nconn, conn, clientSdpParsed.Medias)
 			} else {
-				s.runTcp(conn)
+				s.runTcp(nconn, conn, clientSdpParsed.Medias)
 			}
 		}()
 	}
 }
 
-func (s *stream) runUdp(conn *gortsplib.ConnClient) {
+func (s *stream) runUdp(nconn net.Conn, conn *gortsplib.ConnClient, medias []sdp.Media) {
+	timeouts := s.timeouts()
+
 	publisherAddr, err := net.ResolveUDPAddr("udp", s.ur.Hostname()+":0")
 	if err != nil {
 		s.log("ERR: %s", err)
@@ -310,65 +1518,26 @@ func (s *stream) runUdp(conn *gortsplib.ConnClient) {
 
 	defer func() {
 		for _, pair := range streamUdpListenerPairs {
-			pair.rtpl.close()
-			pair.rtcpl.close()
+			s.releaseUdpListenerPair(pair.rtpl, pair.rtcpl)
 		}
+		s.trimUdpListenerPool(len(medias))
 	}()
 
-	for i, media := range s.clientSdpParsed.Medias {
-		var rtpPort int
-		var rtcpPort int
-		var rtpl *streamUdpListener
-		var rtcpl *streamUdpListener
-		err := func() error {
-			for {
-				// choose two consecutive ports in range 65536-10000
-				// rtp must be pair and rtcp odd
-				rtpPort = (rand.Intn((65535-10000)/2) * 2) + 10000
-				rtcpPort = rtpPort + 1
-
-				rtpl, err = newStreamUdpListener(s.p, rtpPort)
-				if err != nil {
-					continue
-				}
-
-				rtcpl, err = newStreamUdpListener(s.p, rtcpPort)
-				if err != nil {
-					rtpl.close()
-					continue
-				}
+	setupTimer := s.startPhaseTimer(nconn, "SETUP", timeouts.Setup)
+	defer setupTimer.stop()
 
-				return nil
-			}
-		}()
+	for i, media := range medias {
+		rtpl, rtcpl, err := s.udpListenerPair()
 		if err != nil {
 			s.log("ERR: %s", err)
 			return
 		}
+		rtpPort := rtpl.nconn.LocalAddr().(*net.UDPAddr).Port
+		rtcpPort := rtpPort + 1
 
-		res, err := conn.WriteRequest(&gortsplib.Request{
+		res, err := s.writeRequest(conn, &gortsplib.Request{
 			Method: gortsplib.SETUP,
-			Url: &url.URL{
-				Scheme: "rtsp",
-				Host:   s.ur.Host,
-				Path: func() string {
-					ret := s.ur.Path
-
-					if len(ret) == 0 || ret[len(ret)-1] != '/' {
-						ret += "/"
-					}
-
-					control := media.Attributes.Value("control")
-					if control != "" {
-						ret += control
-					} else {
-						ret += "trackID=" + strconv.FormatInt(int64(i+1), 10)
-					}
-
-					return ret
-				}(),
-				RawQuery: s.ur.RawQuery,
-			},
+			Url:    s.setupUrl(i, media),
 			Header: gortsplib.Header{
 				"Transport": []string{strings.Join([]string{
 					"RTP/AVP/UDP",
@@ -379,11 +1548,11 @@ func (s *stream) runUdp(conn *gortsplib.ConnClient) {
 		})
 		if err != nil {
 			s.log("ERR: %s", err)
-			rtpl.close()
-			rtcpl.close()
+			s.releaseUdpListenerPair(rtpl, rtcpl)
 			return
 		}
 
+		// the source may have refused the ports, that are replaced
 		if res.StatusCode != 200 {
 			s.log("ERR: SETUP returned code %d", res.StatusCode)
 			rtpl.close()
@@ -395,6 +1564,7 @@ func (s *stream) runUdp(conn *gortsplib.ConnClient) {
 			sx, err := gortsplib.ReadHeaderSession(sxRaw[0])
 			if err != nil {
 				s.log("ERR: unable to parse session: %s", err)
+				s.releaseUdpListenerPair(rtpl, rtcpl)
 				return
 			}
 			conn.SetSession(sx.Session)
@@ -403,8 +1573,7 @@ func (s *stream) runUdp(conn *gortsplib.ConnClient) {
 		tsRaw, ok := res.Header["Transport"]
 		if !ok || len(tsRaw) != 1 {
 			s.log("ERR: transport header not provided")
-			rtpl.close()
-			rtcpl.close()
+			s.releaseUdpListenerPair(rtpl, rtcpl)
 			return
 		}
 
@@ -412,22 +1581,29 @@ func (s *stream) runUdp(conn *gortsplib.ConnClient) {
 		rtpServerPort, rtcpServerPort := th.GetPorts("server_port")
 		if rtpServerPort == 0 {
 			s.log("ERR: server ports not provided")
-			rtpl.close()
-			rtcpl.close()
+			s.releaseUdpListenerPair(rtpl, rtcpl)
 			return
 		}
 
+		receiver := newRtcpReceiver(mediaClockRate(media))
+
 		rtpl.publisherIp = publisherAddr.IP
 		rtpl.publisherPort = rtpServerPort
 		rtpl.trackId = i
 		rtpl.flow = _TRACK_FLOW_RTP
-		rtpl.path = s.path
+		rtpl.stream = s
+		rtpl.receiver = receiver
+		rtpl.reorder = nil
+		if s.latency.reorderDepth > 0 {
+			rtpl.reorder = newRtpReorderBuffer(s.latency.reorderDepth, s.latency.reorderHold)
+		}
 
 		rtcpl.publisherIp = publisherAddr.IP
 		rtcpl.publisherPort = rtcpServerPort
 		rtcpl.trackId = i
 		rtcpl.flow = _TRACK_FLOW_RTCP
-		rtcpl.path = s.path
+		rtcpl.stream = s
+		rtcpl.receiver = receiver
 
 		streamUdpListenerPairs = append(streamUdpListenerPairs, streamUdpListenerPair{
 			rtpl:  rtpl,
@@ -435,7 +1611,7 @@ func (s *stream) runUdp(conn *gortsplib.ConnClient) {
 		})
 	}
 
-	res, err := conn.WriteRequest(&gortsplib.Request{
+	res, err := s.writeRequest(conn, &gortsplib.Request{
 		Method: gortsplib.PLAY,
 		Url: &url.URL{
 			Scheme:   "rtsp",
@@ -454,55 +1630,81 @@ func (s *stream) runUdp(conn *gortsplib.ConnClient) {
 		return
 	}
 
+	setupTimer.stop()
+	playTime := time.Now()
+
+	var receivers []*rtcpReceiver
 	for _, pair := range streamUdpListenerPairs {
 		pair.rtpl.start()
 		pair.rtcpl.start()
+
+		// the first report opens the path of sender reports through NATs
+		pair.rtcpl.sendReport()
+
+		receivers = append(receivers, pair.rtcpl.receiver)
 	}
 
+	s.stats.setReceivers(receivers)
+	defer s.stats.setReceivers(nil)
+
 	tickerSendKeepalive := time.NewTicker(_KEEPALIVE_INTERVAL)
 	tickerCheckStream := time.NewTicker(_CHECK_STREAM_INTERVAL)
+	tickerSendReport := time.NewTicker(_RTCP_RECEIVER_REPORT_INTERVAL)
 
-	func() {
-		s.p.mutex.Lock()
-		defer s.p.mutex.Unlock()
-		s.state = _STREAM_STATE_READY
-	}()
-
-	defer func() {
-		s.p.mutex.Lock()
-		defer s.p.mutex.Unlock()
-		s.state = _STREAM_STATE_STARTING
+	s.setReady()
+	defer s.setNotReady()
 
-		// disconnect all clients
-		for c := range s.p.clients {
-			if c.path == s.path {
-				c.close()
-			}
-		}
-	}()
+	s.logReady()
 
-	s.log("ready")
+	paused := false
+	var pausedEnd time.Time
 
 	for {
 		select {
 		case <-s.stop:
 			return
 		case <-tickerSendKeepalive.C:
-			_, err = conn.WriteRequest(&gortsplib.Request{
-				Method: gortsplib.OPTIONS,
-				Url: &url.URL{
-					Scheme: "rtsp",
-					Host:   s.ur.Host,
-					Path:   "/",
-				},
-			})
+			err := s.sendKeepalive(conn)
 			if err != nil {
 				s.log("ERR: %s", err)
 				return
 			}
 
+		case <-tickerSendReport.C:
+			now := time.Now()
+			for i, pair := range streamUdpListenerPairs {
+				pair.rtcpl.sendReport()
+
+				if sr := pair.rtcpl.receiver.senderReport(now); sr != nil {
+					s.forwardSourceTrack(i, _TRACK_FLOW_RTCP, sr)
+				}
+			}
+
+		case sr := <-s.chanRequest:
+			sr.res, sr.err = s.writeRequest(conn, sr.req)
+			close(sr.done)
+			if sr.err != nil {
+				s.log("ERR: %s", sr.err)
+				return
+			}
+
+			// do not consider a paused stream dead
+			if sr.res.StatusCode == 200 {
+				switch sr.req.Method {
+				case gortsplib.PAUSE:
+					paused = true
+				case gortsplib.PLAY:
+					paused = false
+					pausedEnd = time.Now()
+				}
+			}
+
 		case <-tickerCheckStream.C:
-			lastFrameTime := time.Time{}
+			if paused {
+				continue
+			}
+
+			lastFrameTime := pausedEnd
 
 			getLastFrameTime := func(l *streamUdpListener) {
 				l.mutex.Lock()
@@ -517,7 +1719,16 @@ func (s *stream) runUdp(conn *gortsplib.ConnClient) {
 				getLastFrameTime(pair.rtcpl)
 			}
 
-			if time.Since(lastFrameTime) >= _STREAM_DEAD_AFTER {
+			// sources can take a while to send the first packet
+			if lastFrameTime.IsZero() {
+				if time.Since(playTime) >= timeouts.FirstPacket {
+					s.log("ERR: no packets received within %s", timeouts.FirstPacket)
+					return
+				}
+				continue
+			}
+
+			if time.Since(lastFrameTime) >= timeouts.FrameGap {
 				s.log("ERR: stream is dead")
 				return
 			}
@@ -525,33 +1736,31 @@ func (s *stream) runUdp(conn *gortsplib.ConnClient) {
 	}
 }
 
-func (s *stream) runTcp(conn *gortsplib.ConnClient) {
-	for i, media := range s.clientSdpParsed.Medias {
-		interleaved := fmt.Sprintf("interleaved=%d-%d", (i * 2), (i*2)+1)
+// streamTcpChannel is the track associated with an interleaved channel.
+type streamTcpChannel struct {
+	trackId int
+	flow    trackFlow
+}
 
-		res, err := conn.WriteRequest(&gortsplib.Request{
-			Method: gortsplib.SETUP,
-			Url: &url.URL{
-				Scheme: "rtsp",
-				Host:   s.ur.Host,
-				Path: func() string {
-					ret := s.ur.Path
+func (s *stream) runTcp(nconn net.Conn, conn *gortsplib.ConnClient, medias []sdp.Media) {
+	timeouts := s.timeouts()
+	sconn := nconn.(*sourceConn)
 
-					if len(ret) == 0 || ret[len(ret)-1] != '/' {
-						ret += "/"
-					}
+	setupTimer := s.startPhaseTimer(nconn, "SETUP", timeouts.Setup)
+	defer setupTimer.stop()
 
-					control := media.Attributes.Value("control")
-					if control != "" {
-						ret += control
-					} else {
-						ret += "trackID=" + strconv.FormatInt(int64(i+1), 10)
-					}
+	// channels are mapped to tracks with the SETUP responses, since some
+	// sources do not use the requested channels
+	channels := make(map[uint8]streamTcpChannel)
+	rtcpChannels := make([]uint8, len(medias))
+	receivers := make([]*rtcpReceiver, len(medias))
 
-					return ret
-				}(),
-				RawQuery: s.ur.RawQuery,
-			},
+	for i, media := range medias {
+		interleaved := fmt.Sprintf("interleaved=%d-%d", (i * 2), (i*2)+1)
+
+		res, err := s.writeRequest(conn, &gortsplib.Request{
+			Method: gortsplib.SETUP,
+			Url:    s.setupUrl(i, media),
 			Header: gortsplib.Header{
 				"Transport": []string{strings.Join([]string{
 					"RTP/AVP/TCP",
@@ -587,14 +1796,32 @@ func (s *stream) runTcp(conn *gortsplib.ConnClient) {
 
 		th := gortsplib.ReadHeaderTransport(tsRaw[0])
 
-		_, ok = th[interleaved]
-		if !ok {
-			s.log("ERR: transport header does not have %s (%s)", interleaved, tsRaw[0])
+		rtpChannel, rtcpChannel, hasChannels, err := readInterleaved(th)
+		if err != nil {
+			s.log("ERR: %s", err)
 			return
 		}
+
+		if !hasChannels {
+			rtpChannel, rtcpChannel = i*2, (i*2)+1
+		} else if rtpChannel != i*2 || rtcpChannel != (i*2)+1 {
+			s.log("track %d uses interleaved channels %d-%d", i, rtpChannel, rtcpChannel)
+		}
+
+		for _, ch := range []int{rtpChannel, rtcpChannel} {
+			if _, ok := channels[uint8(ch)]; ok {
+				s.log("ERR: interleaved channel %d is used by multiple tracks (%s)", ch, tsRaw[0])
+				return
+			}
+		}
+
+		channels[uint8(rtpChannel)] = streamTcpChannel{i, _TRACK_FLOW_RTP}
+		channels[uint8(rtcpChannel)] = streamTcpChannel{i, _TRACK_FLOW_RTCP}
+		rtcpChannels[i] = uint8(rtcpChannel)
+		receivers[i] = newRtcpReceiver(mediaClockRate(media))
 	}
 
-	res, err := conn.WriteRequest(&gortsplib.Request{
+	res, err := s.writeRequest(conn, &gortsplib.Request{
 		Method: gortsplib.PLAY,
 		Url: &url.URL{
 			Scheme:   "rtsp",
@@ -613,26 +1840,24 @@ func (s *stream) runTcp(conn *gortsplib.ConnClient) {
 		return
 	}
 
-	func() {
-		s.p.mutex.Lock()
-		defer s.p.mutex.Unlock()
-		s.state = _STREAM_STATE_READY
-	}()
+	setupTimer.stop()
 
-	defer func() {
-		s.p.mutex.Lock()
-		defer s.p.mutex.Unlock()
-		s.state = _STREAM_STATE_STARTING
+	// the connection is closed when the source stops sending packets
+	packetTimer := s.startPhaseTimer(nconn, "first packet", timeouts.FirstPacket)
+	defer packetTimer.stop()
 
-		// disconnect all clients
-		for c := range s.p.clients {
-			if c.path == s.path {
-				c.close()
-			}
-		}
-	}()
+	s.stats.setReceivers(receivers)
+	defer s.stats.setReceivers(nil)
+
+	s.setReady()
+	defer s.setNotReady()
 
-	s.log("ready")
+	s.logReady()
+
+	// reports are sent by the reading routine, in order not to write
+	// concurrently to the connection, therefore the first one is sent
+	// after the first frame
+	var lastReport time.Time
 
 	for {
 		select {
@@ -641,19 +1866,44 @@ func (s *stream) runTcp(conn *gortsplib.ConnClient) {
 		default:
 		}
 
-		frame, err := conn.ReadInterleavedFrame()
+		frame, err := sconn.readInterleavedFrame(timeouts.readTimeout())
 		if err != nil {
 			s.log("ERR: %s", err)
 			return
 		}
 
-		trackId, trackFlow := interleavedChannelToTrack(frame.Channel)
+		packetTimer.reset("frame gap", timeouts.FrameGap)
 
-		func() {
-			s.p.mutex.RLock()
-			defer s.p.mutex.RUnlock()
+		ch, ok := channels[frame.Channel]
+		if !ok {
+			continue
+		}
 
-			s.p.forwardTrack(s.path, trackId, trackFlow, frame.Content)
-		}()
+		now := time.Now()
+		if ch.flow == _TRACK_FLOW_RTP {
+			receivers[ch.trackId].processRtp(frame.Content)
+		} else {
+			receivers[ch.trackId].processRtcp(frame.Content, now)
+		}
+
+		s.forwardSourceTrack(ch.trackId, ch.flow, frame.Content)
+
+		if now.Sub(lastReport) >= _RTCP_RECEIVER_REPORT_INTERVAL {
+			lastReport = now
+			for i, r := range receivers {
+				err := conn.WriteInterleavedFrame(&gortsplib.InterleavedFrame{
+					Channel: rtcpChannels[i],
+					Content: r.report(now),
+				})
+				if err != nil {
+					s.log("ERR: %s", err)
+					return
+				}
+
+				if sr := r.senderReport(now); sr != nil {
+					s.forwardSourceTrack(i, _TRACK_FLOW_RTCP, sr)
+				}
+			}
+		}
 	}
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+// freeUdpPortPair returns an even port, such that it and the following one
+// can be used as the RTP and RTCP ports of the proxy.
+func freeUdpPortPair(tb testing.TB) int {
+	for i := 0; i < 100; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		port := pc.LocalAddr().(*net.UDPAddr).Port
+		pc.Close()
+
+		if port%2 == 0 && port < 65535 {
+			return port
+		}
+	}
+
+	tb.Fatal("unable to find a free port pair")
+	return 0
+}
+
+// newForwardingProgram returns a program with its UDP listeners running and
+// a disabled stream, whose frames are forwarded by calling forwardTrack.
+func newForwardingProgram(tb testing.TB) (*program, *stream) {
+	port := freeUdpPortPair(tb)
+
+	p, err := newProgramFromConf(&conf{
+		Protocols:      []string{"udp", "tcp"},
+		RtpPort:        port,
+		RtcpPort:       port + 1,
+		SourceUdpPorts: defaultSourceUdpPorts,
+	}, map[streamProtocol]struct{}{
+		_STREAM_PROTOCOL_UDP: {},
+		_STREAM_PROTOCOL_TCP: {},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go p.rtpl.run()
+	go p.rtcpl.run()
+
+	s, err := newStream(p, "bench", streamConf{
+		Url:      "rtsp://127.0.0.1:554/bench",
+		Disabled: true,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return p, s
+}
+
+// benchmarkRtpPacket returns a RTP packet of the size of a video packet.
+func benchmarkRtpPacket() []byte {
+	pkt := make([]byte, 1200)
+	pkt[0] = 0x80
+	pkt[1] = 96
+	return pkt
+}
+
+// benchmarkForwardTrack checks that frames are forwarded without
+// allocations, then measures forwardTrack.
+func benchmarkForwardTrack(b *testing.B, s *stream) {
+	pkt := benchmarkRtpPacket()
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		s.forwardTrack(0, _TRACK_FLOW_RTP, pkt)
+	})
+	if allocs != 0 {
+		b.Fatalf("forwardTrack allocates %v times per frame", allocs)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(pkt)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s.forwardTrack(0, _TRACK_FLOW_RTP, pkt)
+	}
+}
+
+// BenchmarkForwardTrackUdp forwards frames to a UDP client, through the
+// batched writes of the RTP listener.
+func BenchmarkForwardTrackUdp(b *testing.B) {
+	p, s := newForwardingProgram(b)
+
+	// datagrams are not read, since reading allocates the source address
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	sinkPort := sink.LocalAddr().(*net.UDPAddr).Port
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+
+	c := newServerClient(p, sconn)
+	c.ip = net.ParseIP("127.0.0.1")
+	c.streamProtocol = _STREAM_PROTOCOL_UDP
+	c.streamTracks[0] = &track{
+		rtpPort:  sinkPort,
+		rtcpPort: sinkPort + 1,
+		rtpAddr:  &net.UDPAddr{IP: c.ip, Port: sinkPort},
+		rtcpAddr: &net.UDPAddr{IP: c.ip, Port: sinkPort + 1},
+	}
+
+	p.mutex.Lock()
+	c.subscribe(s)
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		c.close(_TEARDOWN_CLIENT_TEARDOWN)
+	}()
+
+	benchmarkForwardTrack(b, s)
+}
+
+// BenchmarkForwardTrackTcp forwards frames to a TCP client, through the
+// writing routine of the client.
+func BenchmarkForwardTrackTcp(b *testing.B) {
+	p, s := newForwardingProgram(b)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	cconn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cconn.Close()
+	go io.Copy(ioutil.Discard, cconn)
+
+	sconn, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	c := newServerClient(p, sconn)
+	c.streamProtocol = _STREAM_PROTOCOL_TCP
+	c.streamTracks[0] = &track{
+		rtpChannel:  0,
+		rtcpChannel: 1,
+	}
+	c.chanWrite = make(chan gortsplib.InterleavedFrame, 256)
+	go c.runTcpWriter()
+
+	p.mutex.Lock()
+	c.subscribe(s)
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		c.close(_TEARDOWN_CLIENT_TEARDOWN)
+	}()
+
+	benchmarkForwardTrack(b, s)
+}
+
+// BenchmarkUdpWriteBatch writes batches of datagrams to a client.
+func BenchmarkUdpWriteBatch(b *testing.B) {
+	nconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer nconn.Close()
+
+	bconn, err := newUdpBatchConn(nconn)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+
+	pkt := benchmarkRtpPacket()
+	batch := make([]udpWrite, _UDP_BATCH_SIZE)
+	for i := range batch {
+		batch[i] = udpWrite{
+			addr: sink.LocalAddr().(*net.UDPAddr),
+			buf:  pkt,
+		}
+	}
+
+	writeBatch := func() {
+		nconn.SetWriteDeadline(time.Now().Add(_WRITE_TIMEOUT))
+		bconn.writeBatch(batch)
+	}
+
+	allocs := testing.AllocsPerRun(100, writeBatch)
+	if allocs != 0 {
+		b.Fatalf("writeBatch allocates %v times per batch", allocs)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(pkt) * len(batch)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		writeBatch()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+const (
+	// size of the queue of TCP clients whose frames are paced, when the
+	// latency profile does not set one, in order not to stall the source
+	_TCP_PACING_QUEUE = 1024
+
+	// frames that are late by more than this are sent immediately, and
+	// the following ones are paced from them
+	_TCP_PACING_MAX_LAG = 500 * time.Millisecond
+
+	// frames that are early by more than this are considered a discontinuity
+	// of the timestamps of the source
+	_TCP_PACING_MAX_DELAY = time.Second
+)
+
+// tcpPacerTrack is the association between a RTP timestamp of a track and
+// the time at which it has been sent.
+type tcpPacerTrack struct {
+	clockRate  int
+	anchorTs   uint32
+	anchorTime time.Time
+}
+
+// tcpPacer spreads the frames sent to a TCP client according to their RTP
+// timestamps, instead of sending bursts of the source as they are.
+type tcpPacer struct {
+	tracks map[uint8]*tcpPacerTrack // by RTP channel
+}
+
+// newTcpPacer allocates a pacer for the given RTP channels and clock rates.
+// Tracks with an unknown clock rate are not paced.
+func newTcpPacer(clockRates map[uint8]int) *tcpPacer {
+	p := &tcpPacer{
+		tracks: make(map[uint8]*tcpPacerTrack),
+	}
+	for channel, rate := range clockRates {
+		if rate > 0 {
+			p.tracks[channel] = &tcpPacerTrack{clockRate: rate}
+		}
+	}
+	return p
+}
+
+// delay returns how long a frame must be delayed before being sent.
+func (p *tcpPacer) delay(frame gortsplib.InterleavedFrame, now time.Time) time.Duration {
+	t, ok := p.tracks[frame.Channel]
+	if !ok || len(frame.Content) < 12 {
+		return 0
+	}
+
+	ts := binary.BigEndian.Uint32(frame.Content[4:])
+
+	if t.anchorTime.IsZero() {
+		t.anchorTs = ts
+		t.anchorTime = now
+		return 0
+	}
+
+	elapsed := time.Duration(int64(int32(ts-t.anchorTs)) * int64(time.Second) / int64(t.clockRate))
+	d := t.anchorTime.Add(elapsed).Sub(now)
+
+	if d < -_TCP_PACING_MAX_LAG || d > _TCP_PACING_MAX_DELAY {
+		t.anchorTs = ts
+		t.anchorTime = now
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// teardownReason is a machine-readable reason of the end of the session of a
+// client, or of the session with the source of a stream.
+type teardownReason string
+
+const (
+	_TEARDOWN_CLIENT_TEARDOWN     teardownReason = "client-teardown"
+	_TEARDOWN_CLIENT_DISCONNECTED teardownReason = "client-disconnected"
+	_TEARDOWN_REQUEST_REJECTED    teardownReason = "request-rejected"
+	_TEARDOWN_READ_TIMEOUT        teardownReason = "read-timeout"
+	_TEARDOWN_WRITE_TIMEOUT       teardownReason = "write-timeout"
+	_TEARDOWN_TTL_EXPIRED         teardownReason = "ttl-expired"
+	_TEARDOWN_AUTH_REVOKED        teardownReason = "auth-revoked"
+	_TEARDOWN_SOURCE_LOST         teardownReason = "source-lost"
+	_TEARDOWN_SOURCE_REPLACED     teardownReason = "source-replaced"
+	_TEARDOWN_ADMIN_KICK          teardownReason = "admin-kick"
+	_TEARDOWN_MEMORY_LIMIT        teardownReason = "memory-limit"
+	_TEARDOWN_SCHEDULE            teardownReason = "schedule"
+	_TEARDOWN_PROTOCOL_VIOLATION  teardownReason = "protocol-violation"
+)
+
+// interval between checks of the credentials of playing clients
+const _AUTH_REVALIDATE_INTERVAL = 1 * time.Minute
+
+// connErrorReason returns the reason of the end of a session caused by an
+// error of the connection of a client.
+func connErrorReason(err error, timeout teardownReason) teardownReason {
+	var lerr rtspLimitError
+	if errors.As(err, &lerr) {
+		return _TEARDOWN_PROTOCOL_VIOLATION
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return timeout
+	}
+	return _TEARDOWN_CLIENT_DISCONNECTED
+}
+
+// initiatedByProxy tells whether the session has been closed by the proxy
+// instead of the client or of the source.
+func (r teardownReason) initiatedByProxy() bool {
+	switch r {
+	case _TEARDOWN_READ_TIMEOUT, _TEARDOWN_WRITE_TIMEOUT, _TEARDOWN_AUTH_REVOKED,
+		_TEARDOWN_ADMIN_KICK, _TEARDOWN_MEMORY_LIMIT, _TEARDOWN_PROTOCOL_VIOLATION:
+		return true
+	}
+	return false
+}
+
+// streamTeardown is the end of the last session with the source of a stream.
+type streamTeardown struct {
+	Reason teardownReason `json:"reason"`
+	Time   time.Time      `json:"time"`
+}
+
+// stopWithReason stops a stream. It must be called with the program mutex
+// locked.
+func (s *stream) stopWithReason(reason teardownReason) {
+	s.stopReason = reason
+	s.stats.setTeardown(reason)
+	close(s.stop)
+}
+
+// kickClients disconnects the clients of a stream, or the ones with the given
+// IP, if not nil. It must be called with the program mutex locked.
+func (s *stream) kickClients(ip net.IP) int {
+	n := 0
+	for c := range s.p.clients {
+		if s.ownsClient(c) && (ip == nil || ip.Equal(c.ip)) {
+			c.log("kicked by the API")
+			c.close(_TEARDOWN_ADMIN_KICK)
+			n++
+		}
+	}
+	return n
+}
+
+// runAuthRevalidation periodically checks the credentials of playing
+// clients, that are disconnected when their credentials are revoked.
+func (p *program) runAuthRevalidation() {
+	t := time.NewTicker(_AUTH_REVALIDATE_INTERVAL)
+	defer t.Stop()
+
+	for range t.C {
+		type entry struct {
+			c      *serverClient
+			header []string
+			id     authIdentity
+		}
+
+		var entries []entry
+		p.mutex.RLock()
+		for c := range p.clients {
+			if c.state == _CLIENT_STATE_PLAY && c.authHeader != nil {
+				entries = append(entries, entry{c, c.authHeader, c.identity})
+			}
+		}
+		p.mutex.RUnlock()
+
+		// backends are queried without the mutex, since they can be slow
+		var revoked []*serverClient
+		for _, e := range entries {
+			if p.credentialsRevoked(e.header, e.id) {
+				revoked = append(revoked, e.c)
+			}
+		}
+
+		if len(revoked) == 0 {
+			continue
+		}
+
+		p.mutex.Lock()
+		for _, c := range revoked {
+			if _, ok := p.clients[c]; ok {
+				c.log("ERR: credentials of '%s' have been revoked", c.identity.user)
+				c.close(_TEARDOWN_AUTH_REVOKED)
+			}
+		}
+		p.mutex.Unlock()
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	_CERT_CHECK_INTERVAL = 5 * time.Second
+)
+
+// certStore provides the certificate of TLS listeners. The certificate is
+// reloaded from disk when its files change or when SIGHUP is received, such
+// that renewed certificates are served without restarting.
+type certStore struct {
+	certPath string
+	keyPath  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertStore(certPath string, keyPath string) (*certStore, error) {
+	s := &certStore{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+
+	err := s.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *certStore) log(format string, args ...interface{}) {
+	log.Printf("[TLS] "+format, args...)
+}
+
+// filesModTime returns the most recent modification time of the files.
+func (s *certStore) filesModTime() (time.Time, error) {
+	var ret time.Time
+	for _, p := range []string{s.certPath, s.keyPath} {
+		info, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(ret) {
+			ret = info.ModTime()
+		}
+	}
+	return ret, nil
+}
+
+func (s *certStore) reload() error {
+	modTime, err := s.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certPath, s.keyPath)
+	if err != nil {
+		return err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cert = &cert
+	s.modTime = modTime
+	return nil
+}
+
+// expiration returns the expiration of the certificate.
+func (s *certStore) expiration() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert.Leaf.NotAfter
+}
+
+func (s *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert, nil
+}
+
+func (s *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.getCertificate,
+	}
+}
+
+func (s *certStore) run() {
+	chanSignal := make(chan os.Signal, 1)
+	signal.Notify(chanSignal, syscall.SIGHUP)
+
+	ticker := time.NewTicker(_CERT_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-chanSignal:
+			err := s.reload()
+			if err != nil {
+				s.log("ERR: unable to reload certificate: %s", err)
+				continue
+			}
+			s.log("certificate reloaded, expires on %s", s.expiration().Format(time.RFC3339))
+
+		case <-ticker.C:
+			modTime, err := s.filesModTime()
+			if err != nil {
+				continue
+			}
+
+			s.mutex.RLock()
+			changed := !modTime.Equal(s.modTime)
+			s.mutex.RUnlock()
+			if !changed {
+				continue
+			}
+
+			// in case of errors, the previous certificate is kept and the
+			// files are read again at the next check
+			err = s.reload()
+			if err != nil {
+				s.log("ERR: unable to reload certificate: %s", err)
+				continue
+			}
+			s.log("certificate reloaded, expires on %s", s.expiration().Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,308 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// limits of UDP segmentation offload. Segments must fit into the MTU.
+	_UDP_GSO_MAX_SEGMENTS     = 64
+	_UDP_GSO_MAX_SIZE         = 65000
+	_UDP_GSO_MAX_SEGMENT_SIZE = 1400
+	_UDP_GSO_BUF_SIZE         = 256 * 1024
+)
+
+// udpBatchConn sends and receives multiple datagrams with a single system
+// call, by using the batches of ipv4.PacketConn, that work with IPv6 sockets
+// too. Optionally, datagrams sent to the same destination are merged and
+// split by the kernel or by the network card (GSO), and datagrams received
+// from the same source are merged (GRO).
+type udpBatchConn struct {
+	nconn    *net.UDPConn
+	pconn    *ipv4.PacketConn
+	msgs     []ipv4.Message
+	bufs     [][]byte
+	readMsgs []ipv4.Message
+	readBufs [][]byte
+
+	oobs     []byte
+	gso      bool
+	gsoBuf   []byte
+	gsoOrder []int
+	gsoUsed  []bool
+	gro      bool
+	groOobs  []byte
+}
+
+// size of the control messages of each datagram that is written
+var udpOobSize = unix.CmsgSpace(2) + unix.CmsgSpace(4)
+
+func newUdpBatchConn(nconn *net.UDPConn) (*udpBatchConn, error) {
+	c := &udpBatchConn{
+		nconn:    nconn,
+		pconn:    ipv4.NewPacketConn(nconn),
+		msgs:     make([]ipv4.Message, _UDP_BATCH_SIZE),
+		bufs:     make([][]byte, _UDP_BATCH_SIZE),
+		readMsgs: make([]ipv4.Message, _UDP_BATCH_SIZE),
+		readBufs: make([][]byte, _UDP_BATCH_SIZE),
+		oobs:     make([]byte, _UDP_BATCH_SIZE*udpOobSize),
+	}
+
+	// each message contains a single buffer
+	for i := range c.msgs {
+		c.msgs[i].Buffers = c.bufs[i : i+1 : i+1]
+		c.readMsgs[i].Buffers = c.readBufs[i : i+1 : i+1]
+	}
+
+	return c, nil
+}
+
+func (c *udpBatchConn) setsockopt(opt int, value int) error {
+	rc, err := c.nconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var optErr error
+	err = rc.Control(func(fd uintptr) {
+		optErr = unix.SetsockoptInt(int(fd), unix.SOL_UDP, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return optErr
+}
+
+// enableGso enables UDP segmentation offload, if supported by the kernel.
+func (c *udpBatchConn) enableGso() error {
+	err := c.setsockopt(unix.UDP_SEGMENT, 0)
+	if err != nil {
+		return err
+	}
+
+	c.gso = true
+	c.gsoBuf = make([]byte, _UDP_GSO_BUF_SIZE)
+	c.gsoOrder = make([]int, 0, _UDP_BATCH_SIZE)
+	c.gsoUsed = make([]bool, _UDP_BATCH_SIZE)
+	return nil
+}
+
+// enableGro enables UDP receive offload, if supported by the kernel. Read
+// buffers must be big enough to contain merged datagrams.
+func (c *udpBatchConn) enableGro() error {
+	err := c.setsockopt(unix.UDP_GRO, 1)
+	if err != nil {
+		return err
+	}
+
+	c.gro = true
+	c.groOobs = make([]byte, _UDP_BATCH_SIZE*unix.CmsgSpace(4))
+	return nil
+}
+
+func udpAddrEqual(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a == b || (a.Port == b.Port && a.IP.Equal(b.IP))
+}
+
+// putCmsg writes a control message into a buffer and returns its size.
+func putCmsg(oob []byte, level int32, typ int32, data []byte) int {
+	cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	cmsg.Level = level
+	cmsg.Type = typ
+	cmsg.SetLen(unix.CmsgLen(len(data)))
+	copy(oob[unix.CmsgLen(0):], data)
+	return unix.CmsgSpace(len(data))
+}
+
+// setMsg fills the message with the given index with a datagram. The control
+// messages contain the size of segments when segmentation offload is used,
+// and the DSCP when it differs from the one of the socket.
+func (c *udpBatchConn) setMsg(i int, buf []byte, segSize int, addr *net.UDPAddr, dscp uint8) {
+	c.bufs[i] = buf
+
+	msg := &c.msgs[i]
+	msg.Addr = addr
+
+	oob := c.oobs[i*udpOobSize : (i+1)*udpOobSize]
+	n := 0
+
+	if segSize > 0 {
+		var data [2]byte
+		*(*uint16)(unsafe.Pointer(&data[0])) = uint16(segSize)
+		n += putCmsg(oob[n:], unix.SOL_UDP, unix.UDP_SEGMENT, data[:])
+	}
+
+	if dscp != 0 {
+		var data [4]byte
+		*(*int32)(unsafe.Pointer(&data[0])) = int32(dscp) << 2
+		if addr.IP.To4() != nil {
+			n += putCmsg(oob[n:], unix.IPPROTO_IP, unix.IP_TOS, data[:])
+		} else {
+			n += putCmsg(oob[n:], unix.IPPROTO_IPV6, unix.IPV6_TCLASS, data[:])
+		}
+	}
+
+	msg.OOB = oob[:n]
+}
+
+// writeBatch writes datagrams. Datagrams that can't be sent are skipped.
+func (c *udpBatchConn) writeBatch(ws []udpWrite) error {
+	count := len(ws)
+	if c.gso {
+		count = c.fillGso(ws)
+	} else {
+		for i, w := range ws {
+			c.setMsg(i, w.buf, 0, w.addr, w.dscp)
+		}
+	}
+
+	for done := 0; done < count; {
+		n, err := c.pconn.WriteBatch(c.msgs[done:count], 0)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return err
+			}
+
+			// the network card doesn't support segmentation offload
+			if errors.Is(err, syscall.EIO) && c.gso {
+				c.gso = false
+			}
+
+			// the first datagram has failed, for instance because the
+			// destination is unreachable
+			n = 1
+		}
+		done += n
+	}
+
+	// do not retain buffers
+	for i := 0; i < count; i++ {
+		c.bufs[i] = nil
+		c.msgs[i].Addr = nil
+	}
+
+	return nil
+}
+
+// fillGso fills the messages with datagrams, merging consecutive datagrams
+// sent to the same destination, and returns the number of messages. Order of
+// datagrams is preserved for each destination.
+func (c *udpBatchConn) fillGso(ws []udpWrite) int {
+	// group datagrams by destination
+	order := c.gsoOrder[:0]
+	for i := range ws {
+		c.gsoUsed[i] = false
+	}
+	for i := range ws {
+		if c.gsoUsed[i] {
+			continue
+		}
+		for j := i; j < len(ws); j++ {
+			if !c.gsoUsed[j] && udpAddrEqual(ws[i].addr, ws[j].addr) {
+				c.gsoUsed[j] = true
+				order = append(order, j)
+			}
+		}
+	}
+
+	count := 0
+	gsoBuf := c.gsoBuf[:0]
+
+	for k := 0; k < len(order); {
+		w := ws[order[k]]
+		size := len(w.buf)
+
+		// datagrams can be merged when they have the same size, except the
+		// last one, that can be smaller
+		end := k + 1
+		total := size
+		if size > 0 && size <= _UDP_GSO_MAX_SEGMENT_SIZE {
+			for end < len(order) && end-k < _UDP_GSO_MAX_SEGMENTS {
+				next := ws[order[end]]
+				if !udpAddrEqual(w.addr, next.addr) || next.dscp != w.dscp || len(next.buf) > size ||
+					total+len(next.buf) > _UDP_GSO_MAX_SIZE ||
+					len(gsoBuf)+total+len(next.buf) > cap(gsoBuf) {
+					break
+				}
+				total += len(next.buf)
+				end++
+				if len(next.buf) < size {
+					break
+				}
+			}
+		}
+
+		if end-k == 1 {
+			c.setMsg(count, w.buf, 0, w.addr, w.dscp)
+
+		} else {
+			start := len(gsoBuf)
+			for _, i := range order[k:end] {
+				gsoBuf = append(gsoBuf, ws[i].buf...)
+			}
+			c.setMsg(count, gsoBuf[start:], size, w.addr, w.dscp)
+		}
+
+		count++
+		k = end
+	}
+
+	return count
+}
+
+// readBatch reads datagrams into a batch, and returns how many have been read.
+func (c *udpBatchConn) readBatch(b *udpReadBatch) (int, error) {
+	msgs := c.readMsgs[:len(b.bufs)]
+	for i, buf := range b.bufs {
+		c.readBufs[i] = buf
+		if c.gro {
+			msgs[i].OOB = c.groOobs[i*unix.CmsgSpace(4) : (i+1)*unix.CmsgSpace(4)]
+		}
+	}
+
+	n, err := c.pconn.ReadBatch(msgs, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		b.ns[i] = msgs[i].N
+		b.segSizes[i] = 0
+		if c.gro {
+			b.segSizes[i] = groSegSize(msgs[i].OOB[:msgs[i].NN])
+		}
+
+		if addr, ok := msgs[i].Addr.(*net.UDPAddr); ok {
+			copy(b.addrs[i].IP, addr.IP.To16())
+			b.addrs[i].Port = addr.Port
+		}
+	}
+
+	return n, nil
+}
+
+// groSegSize returns the size of the datagrams that have been merged into a
+// message, or zero.
+func groSegSize(oob []byte) int {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level == unix.SOL_UDP && cmsg.Header.Type == unix.UDP_GRO && len(cmsg.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&cmsg.Data[0])))
+		}
+	}
+
+	return 0
+}
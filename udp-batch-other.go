@@ -0,0 +1,56 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// udpBatchConn writes and reads datagrams one by one, since sendmmsg and
+// recvmmsg are available on Linux only.
+type udpBatchConn struct {
+	nconn *net.UDPConn
+}
+
+func newUdpBatchConn(nconn *net.UDPConn) (*udpBatchConn, error) {
+	return &udpBatchConn{
+		nconn: nconn,
+	}, nil
+}
+
+// writeBatch writes datagrams. Datagrams that can't be sent are skipped.
+func (c *udpBatchConn) writeBatch(ws []udpWrite) error {
+	for _, w := range ws {
+		_, err := c.nconn.WriteTo(w.buf, w.addr)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *udpBatchConn) enableGso() error {
+	return fmt.Errorf("UDP segmentation offload is available on Linux only")
+}
+
+func (c *udpBatchConn) enableGro() error {
+	return fmt.Errorf("UDP receive offload is available on Linux only")
+}
+
+// readBatch reads a datagram into a batch.
+func (c *udpBatchConn) readBatch(b *udpReadBatch) (int, error) {
+	n, addr, err := c.nconn.ReadFromUDP(b.bufs[0])
+	if err != nil {
+		return 0, err
+	}
+
+	b.ns[0] = n
+	b.segSizes[0] = 0
+	copy(b.addrs[0].IP, addr.IP.To16())
+	b.addrs[0].Port = addr.Port
+	return 1, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+)
+
+// udpReadBatch contains the buffers into which datagrams are read in batches.
+type udpReadBatch struct {
+	bufs     [][]byte
+	ns       []int         // size of each message
+	segSizes []int         // size of the datagrams merged into each message, or zero
+	addrs    []net.UDPAddr // source of each message, in the IPv6 format
+}
+
+func newUdpReadBatch(count int, size int) *udpReadBatch {
+	b := &udpReadBatch{
+		bufs:     make([][]byte, count),
+		ns:       make([]int, count),
+		segSizes: make([]int, count),
+		addrs:    make([]net.UDPAddr, count),
+	}
+	for i := 0; i < count; i++ {
+		b.bufs[i] = make([]byte, size)
+		b.addrs[i].IP = make(net.IP, net.IPv6len)
+	}
+	return b
+}
+
+// datagrams calls fn for each datagram contained in a message, that can
+// contain several datagrams when receive offload is enabled.
+func (b *udpReadBatch) datagrams(i int, fn func([]byte)) {
+	buf := b.bufs[i][:b.ns[i]]
+
+	segSize := b.segSizes[i]
+	if segSize <= 0 {
+		segSize = len(buf)
+	}
+
+	for len(buf) > 0 {
+		n := segSize
+		if n > len(buf) {
+			n = len(buf)
+		}
+		fn(buf[:n])
+		buf = buf[n:]
+	}
+}
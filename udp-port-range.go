@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// range of local ports used to receive RTP and RTCP from sources when no
+// range is configured
+var defaultSourceUdpPorts = udpPortRange{Min: 10000, Max: 65535}
+
+// udpPortRange is a range of UDP ports, with both ends included.
+type udpPortRange struct {
+	Min int
+	Max int
+}
+
+// parseUdpPortRange parses a range in the format "min-max".
+func parseUdpPortRange(v string) (udpPortRange, error) {
+	parts := strings.SplitN(v, "-", 2)
+	if len(parts) != 2 {
+		return udpPortRange{}, fmt.Errorf("invalid port range: %s", v)
+	}
+
+	min, err1 := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	max, err2 := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+	if err1 != nil || err2 != nil || min == 0 {
+		return udpPortRange{}, fmt.Errorf("invalid port range: %s", v)
+	}
+
+	r := udpPortRange{Min: int(min), Max: int(max)}
+	if r.pairs() == 0 {
+		return udpPortRange{}, fmt.Errorf("port range %s doesn't contain an even port followed by an odd one", v)
+	}
+	return r, nil
+}
+
+func (r udpPortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// firstEven returns the first even port of the range.
+func (r udpPortRange) firstEven() int {
+	return (r.Min + 1) &^ 1
+}
+
+// pairs returns the number of pairs of consecutive ports of the range, in
+// which the first port is even.
+func (r udpPortRange) pairs() int {
+	n := (r.Max - r.firstEven() + 1) / 2
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// newUdpListenerPair listens on two consecutive ports of the range, the
+// first even for RTP and the second odd for RTCP. Pairs are tried starting
+// from a random one, until a free one is found.
+func (r udpPortRange) newUdpListenerPair(p *program) (*streamUdpListener, *streamUdpListener, error) {
+	n := r.pairs()
+	if n == 0 {
+		return nil, nil, fmt.Errorf("port range %s is empty", r)
+	}
+
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		rtpPort := r.firstEven() + ((start+i)%n)*2
+
+		rtpl, err := newStreamUdpListener(p, rtpPort)
+		if err != nil {
+			continue
+		}
+
+		rtcpl, err := newStreamUdpListener(p, rtpPort+1)
+		if err != nil {
+			rtpl.close()
+			continue
+		}
+
+		return rtpl, rtcpl, nil
+	}
+
+	return nil, nil, fmt.Errorf("no free ports in range %s", r)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_WS_OPCODE_CONTINUATION = 0x0
+	_WS_OPCODE_TEXT         = 0x1
+	_WS_OPCODE_BINARY       = 0x2
+	_WS_OPCODE_CLOSE        = 0x8
+	_WS_OPCODE_PING         = 0x9
+	_WS_OPCODE_PONG         = 0xa
+
+	_WS_GUID             = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	_WS_MAX_MESSAGE_SIZE = 1024 * 1024
+)
+
+func headerContainsToken(h http.Header, key string, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is the server side of a WebSocket connection, as described in
+// RFC6455.
+type wsConn struct {
+	conn       net.Conn
+	br         *bufio.Reader
+	writeMutex sync.Mutex
+}
+
+// wsUpgrade performs the WebSocket handshake. The subprotocol, if not empty,
+// is accepted when it is offered by the client. In case of errors, it writes
+// the response.
+func wsUpgrade(w http.ResponseWriter, r *http.Request, protocol string) (*wsConn, error) {
+	if !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("not a WebSocket request")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("unsupported WebSocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("missing Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("connection can't be hijacked")
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// remove the deadlines set by the HTTP server
+	conn.SetDeadline(time.Time{})
+
+	h := sha1.Sum([]byte(key + _WS_GUID))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n")
+	if protocol != "" && headerContainsToken(r.Header, "Sec-WebSocket-Protocol", protocol) {
+		brw.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	brw.WriteString("\r\n")
+
+	conn.SetWriteDeadline(time.Now().Add(_WRITE_TIMEOUT))
+	err = brw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{
+		conn: conn,
+		br:   brw.Reader,
+	}, nil
+}
+
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
+
+// writeMessage writes an unfragmented message or control frame.
+func (c *wsConn) writeMessage(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode // FIN
+
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(_WRITE_TIMEOUT))
+	_, err := (&net.Buffers{header, payload}).WriteTo(c.conn)
+	return err
+}
+
+// readMessage reads a text or binary message. Pings are answered and
+// close frames are echoed, as required by the protocol.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var msg []byte
+
+	for {
+		var header [2]byte
+		_, err := io.ReadFull(c.br, header[:])
+		if err != nil {
+			return 0, nil, err
+		}
+
+		fin := (header[0] & 0x80) != 0
+		op := header[0] & 0x0f
+
+		// frames sent by clients are always masked
+		if (header[1] & 0x80) == 0 {
+			return 0, nil, fmt.Errorf("unmasked frame")
+		}
+
+		size := uint64(header[1] & 0x7f)
+		switch size {
+		case 126:
+			var buf [2]byte
+			_, err = io.ReadFull(c.br, buf[:])
+			if err != nil {
+				return 0, nil, err
+			}
+			size = uint64(binary.BigEndian.Uint16(buf[:]))
+
+		case 127:
+			var buf [8]byte
+			_, err = io.ReadFull(c.br, buf[:])
+			if err != nil {
+				return 0, nil, err
+			}
+			size = binary.BigEndian.Uint64(buf[:])
+
+			// the most significant bit must be zero (RFC6455, section 5.2)
+			if size&(1<<63) != 0 {
+				return 0, nil, fmt.Errorf("invalid frame length")
+			}
+		}
+
+		// control frames can't be fragmented and their payload is limited
+		if (op&0x08) != 0 && (!fin || size > 125) {
+			return 0, nil, fmt.Errorf("invalid control frame")
+		}
+
+		if size > _WS_MAX_MESSAGE_SIZE-uint64(len(msg)) {
+			return 0, nil, fmt.Errorf("message too big")
+		}
+
+		var mask [4]byte
+		_, err = io.ReadFull(c.br, mask[:])
+		if err != nil {
+			return 0, nil, err
+		}
+
+		payload := make([]byte, size)
+		_, err = io.ReadFull(c.br, payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch op {
+		case _WS_OPCODE_PING:
+			err := c.writeMessage(_WS_OPCODE_PONG, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+
+		case _WS_OPCODE_PONG:
+			continue
+
+		case _WS_OPCODE_CLOSE:
+			c.writeMessage(_WS_OPCODE_CLOSE, payload)
+			return 0, nil, io.EOF
+
+		case _WS_OPCODE_CONTINUATION:
+			if msg == nil {
+				return 0, nil, fmt.Errorf("unexpected continuation frame")
+			}
+
+		case _WS_OPCODE_TEXT, _WS_OPCODE_BINARY:
+			if msg != nil {
+				return 0, nil, fmt.Errorf("unterminated message")
+			}
+			opcode = op
+
+		default:
+			return 0, nil, fmt.Errorf("unsupported opcode %d", op)
+		}
+
+		msg = append(msg, payload...)
+		if msg == nil {
+			msg = []byte{}
+		}
+
+		if fin {
+			return opcode, msg, nil
+		}
+	}
+}
+
+// wsNetConn exposes a WebSocket connection as a stream of bytes, such that it
+// can be used in place of a TCP connection. Each write is sent as a binary
+// message, while received messages are concatenated, regardless of their
+// boundaries.
+type wsNetConn struct {
+	ws  *wsConn
+	buf []byte
+}
+
+func newWsNetConn(ws *wsConn) *wsNetConn {
+	return &wsNetConn{
+		ws: ws,
+	}
+}
+
+func (c *wsNetConn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		_, msg, err := c.ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.buf = msg
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *wsNetConn) Write(b []byte) (int, error) {
+	err := c.ws.writeMessage(_WS_OPCODE_BINARY, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsNetConn) Close() error {
+	return c.ws.close()
+}
+
+func (c *wsNetConn) LocalAddr() net.Addr {
+	return c.ws.conn.LocalAddr()
+}
+
+func (c *wsNetConn) RemoteAddr() net.Addr {
+	return c.ws.conn.RemoteAddr()
+}
+
+func (c *wsNetConn) SetDeadline(t time.Time) error {
+	return c.ws.conn.SetDeadline(t)
+}
+
+func (c *wsNetConn) SetReadDeadline(t time.Time) error {
+	return c.ws.conn.SetReadDeadline(t)
+}
+
+func (c *wsNetConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// wsTestFrame returns a masked frame, whose length is encoded with the
+// given number of extended bytes, with a zero mask.
+func wsTestFrame(b0 byte, extLen int, size uint64, payload []byte) []byte {
+	var frame []byte
+	switch extLen {
+	case 0:
+		frame = []byte{b0, 0x80 | byte(size)}
+	case 2:
+		frame = []byte{b0, 0x80 | 126, 0, 0}
+		binary.BigEndian.PutUint16(frame[2:], uint16(size))
+	default:
+		frame = []byte{b0, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(frame[2:], size)
+	}
+	frame = append(frame, 0, 0, 0, 0)
+	return append(frame, payload...)
+}
+
+func wsTestRead(t *testing.T, data []byte) (byte, []byte, error) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	c := &wsConn{
+		conn: sconn,
+		br:   bufio.NewReader(bytes.NewReader(data)),
+	}
+	return c.readMessage()
+}
+
+func TestWsReadMessage(t *testing.T) {
+	data := append(wsTestFrame(_WS_OPCODE_TEXT, 0, 1, []byte("a")),
+		wsTestFrame(0x80|_WS_OPCODE_CONTINUATION, 0, 1, []byte("b"))...)
+
+	opcode, msg, err := wsTestRead(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != _WS_OPCODE_TEXT || string(msg) != "ab" {
+		t.Errorf("unexpected message: %d '%s'", opcode, msg)
+	}
+}
+
+func TestWsReadMalformed(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		data []byte
+	}{
+		{
+			"continuation with a length that overflows",
+			append(wsTestFrame(_WS_OPCODE_TEXT, 0, 1, []byte("a")),
+				wsTestFrame(0x80|_WS_OPCODE_CONTINUATION, 8, 1<<64-1, nil)...),
+		},
+		{
+			"length with the most significant bit set",
+			wsTestFrame(0x80|_WS_OPCODE_BINARY, 8, 1<<63, nil),
+		},
+		{
+			"message too big",
+			wsTestFrame(0x80|_WS_OPCODE_BINARY, 8, _WS_MAX_MESSAGE_SIZE+1, nil),
+		},
+		{
+			"fragmented ping",
+			wsTestFrame(_WS_OPCODE_PING, 0, 0, nil),
+		},
+		{
+			"long ping",
+			wsTestFrame(0x80|_WS_OPCODE_PING, 2, 126, make([]byte, 126)),
+		},
+		{
+			"long close",
+			wsTestFrame(0x80|_WS_OPCODE_CLOSE, 2, 200, make([]byte, 200)),
+		},
+	} {
+		_, _, err := wsTestRead(t, ca.data)
+		if err == nil {
+			t.Errorf("%s: expected an error", ca.name)
+		}
+	}
+}